@@ -23,6 +23,7 @@ import (
 // ExecutionConsumer allows callbacks from asycnhronous execution and statetransfer
 type ExecutionConsumer interface {
 	Executed(tag interface{})                                // Called whenever Execute completes
+	ExecutionFailed(tag interface{}, err error)              // Called instead of Executed when Execute fails, the failed batch is rolled back
 	Committed(tag interface{}, target *pb.BlockchainInfo)    // Called whenever Commit completes
 	RolledBack(tag interface{})                              // Called whenever a Rollback completes
 	StateUpdated(tag interface{}, target *pb.BlockchainInfo) // Called when state transfer completes, if target is nil, this indicates a failure and a new target should be supplied
@@ -35,6 +36,16 @@ type Consenter interface {
 	ExecutionConsumer
 }
 
+// ConnectionListener is implemented by the consenters which act on new connections to other peers
+type ConnectionListener interface {
+	Connected(handle *pb.PeerID) // Called once a connection to a peer is established, again on each reconnection
+}
+
+// Reconfigurer is implemented by the consenters whose settings can be changed at runtime
+type Reconfigurer interface {
+	SubmitReconfiguration(settings map[string]string, credential []byte) error // Orders a change of consensus settings, which the credential authorizes
+}
+
 // Inquirer is used to retrieve info about the validating network
 type Inquirer interface {
 	GetNetworkInfo() (self *pb.PeerEndpoint, network []*pb.PeerEndpoint, err error)
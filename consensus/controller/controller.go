@@ -34,15 +34,24 @@ func init() {
 	logger = logging.MustGetLogger("consensus/controller")
 }
 
+// engines constructs the Consenter selected by peer.validator.consensus.plugin
+var engines = map[string]func(stack consensus.Stack) (consensus.Consenter, error){
+	"pbft":   pbft.GetPlugin,
+	"memory": pbft.GetMemoryPlugin,
+	"noops": func(stack consensus.Stack) (consensus.Consenter, error) {
+		return noops.GetNoops(stack), nil
+	},
+}
+
 // NewConsenter constructs a Consenter object if not already present
-func NewConsenter(stack consensus.Stack) consensus.Consenter {
+func NewConsenter(stack consensus.Stack) (consensus.Consenter, error) {
 
 	plugin := strings.ToLower(viper.GetString("peer.validator.consensus.plugin"))
-	if plugin == "pbft" {
+	if newConsenter, ok := engines[plugin]; ok {
 		logger.Infof("Creating consensus plugin %s", plugin)
-		return pbft.GetPlugin(stack)
+		return newConsenter(stack)
 	}
 	logger.Info("Creating default consensus plugin (noops)")
-	return noops.GetNoops(stack)
+	return noops.GetNoops(stack), nil
 
 }
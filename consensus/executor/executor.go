@@ -71,11 +71,23 @@ func (co *coordinatorImpl) ProcessEvent(event events.Event) events.Event {
 		if !co.batchInProgress {
 			logger.Debug("Starting new transaction batch")
 			co.batchInProgress = true
-			err := co.rawExecutor.BeginTxBatch(co)
-			_ = err // TODO This should probably panic, see issue 752
+			if err := co.rawExecutor.BeginTxBatch(co); err != nil {
+				logger.Warningf("Could not start a transaction batch: %s", err)
+				co.batchInProgress = false
+				co.consumer.ExecutionFailed(et.tag, err)
+				return nil
+			}
 		}
 
-		co.rawExecutor.ExecTxs(co, et.txs)
+		if _, err := co.rawExecutor.ExecTxs(co, et.txs); err != nil {
+			logger.Warningf("Transaction batch failed to execute, rolling it back: %s", err)
+			co.batchInProgress = false
+			if err := co.rawExecutor.RollbackTxBatch(co); err != nil {
+				logger.Errorf("Could not roll back the failed transaction batch: %s", err)
+			}
+			co.consumer.ExecutionFailed(et.tag, err)
+			return nil
+		}
 
 		co.consumer.Executed(et.tag)
 	case commitEvent:
@@ -90,8 +102,9 @@ func (co *coordinatorImpl) ProcessEvent(event events.Event) events.Event {
 			return nil
 		}
 
-		_, err := co.rawExecutor.CommitTxBatch(co, et.metadata)
-		_ = err // TODO This should probably panic, see issue 752
+		if _, err := co.rawExecutor.CommitTxBatch(co, et.metadata); err != nil {
+			logger.Errorf("Could not commit the transaction batch: %s", err)
+		}
 
 		co.batchInProgress = false
 
@@ -112,8 +125,9 @@ func (co *coordinatorImpl) ProcessEvent(event events.Event) events.Event {
 			return nil
 		}
 
-		err := co.rawExecutor.RollbackTxBatch(co)
-		_ = err // TODO This should probably panic, see issue 752
+		if err := co.rawExecutor.RollbackTxBatch(co); err != nil {
+			logger.Errorf("Could not roll back the transaction batch: %s", err)
+		}
 
 		co.batchInProgress = false
 
@@ -121,8 +135,9 @@ func (co *coordinatorImpl) ProcessEvent(event events.Event) events.Event {
 	case stateUpdateEvent:
 		logger.Debug("Executor is processing a stateUpdateEvent")
 		if co.batchInProgress {
-			err := co.rawExecutor.RollbackTxBatch(co)
-			_ = err // TODO This should probably panic, see issue 752
+			if err := co.rawExecutor.RollbackTxBatch(co); err != nil {
+				logger.Errorf("Could not roll back the transaction batch before state transfer: %s", err)
+			}
 		}
 
 		co.skipInProgress = true
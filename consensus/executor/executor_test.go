@@ -39,10 +39,11 @@ func init() {
 // -------------------------
 
 type mockConsumer struct {
-	ExecutedImpl     func(tag interface{})                            // Called whenever Execute completes
-	CommittedImpl    func(tag interface{}, target *pb.BlockchainInfo) // Called whenever Commit completes
-	RolledBackImpl   func(tag interface{})                            // Called whenever a Rollback completes
-	StateUpdatedImpl func(tag interface{}, target *pb.BlockchainInfo) // Called when state transfer completes, if target is nil, this indicates a failure and a new target should be supplied
+	ExecutedImpl        func(tag interface{})                            // Called whenever Execute completes
+	ExecutionFailedImpl func(tag interface{}, err error)                 // Called instead of Executed when Execute fails
+	CommittedImpl       func(tag interface{}, target *pb.BlockchainInfo) // Called whenever Commit completes
+	RolledBackImpl      func(tag interface{})                            // Called whenever a Rollback completes
+	StateUpdatedImpl    func(tag interface{}, target *pb.BlockchainInfo) // Called when state transfer completes, if target is nil, this indicates a failure and a new target should be supplied
 }
 
 func (mock *mockConsumer) Executed(tag interface{}) {
@@ -51,6 +52,12 @@ func (mock *mockConsumer) Executed(tag interface{}) {
 	}
 }
 
+func (mock *mockConsumer) ExecutionFailed(tag interface{}, err error) {
+	if mock.ExecutionFailedImpl != nil {
+		mock.ExecutionFailedImpl(tag, err)
+	}
+}
+
 func (mock *mockConsumer) Committed(tag interface{}, target *pb.BlockchainInfo) {
 	if mock.CommittedImpl != nil {
 		mock.CommittedImpl(tag, target)
@@ -80,6 +87,7 @@ type mockRawExecutor struct {
 	curBatch    interface{}
 	curTxs      []*pb.Transaction
 	commitCount uint64
+	execErr     error // returned by ExecTxs when set
 }
 
 func (mock *mockRawExecutor) BeginTxBatch(id interface{}) error {
@@ -98,6 +106,9 @@ func (mock *mockRawExecutor) ExecTxs(id interface{}, txs []*pb.Transaction) ([]b
 		mock.t.Fatal(e)
 		return nil, e
 	}
+	if mock.execErr != nil {
+		return nil, mock.execErr
+	}
 	mock.curTxs = append(mock.curTxs, txs...)
 	return nil, nil
 }
@@ -358,6 +369,46 @@ func TestEmptyRollback(t *testing.T) {
 	mev.process()
 }
 
+// TestFailedExecutes fails an execution, ensuring that the failure is reported instead of the execution and that the batch is rolled back
+func TestFailedExecutes(t *testing.T) {
+	co, mc, mre, _, mev := newMocks(t)
+
+	id := struct{}{}
+	testTxs := []*pb.Transaction{&pb.Transaction{}, &pb.Transaction{}, &pb.Transaction{}}
+
+	mc.ExecutedImpl = func(tag interface{}) {
+		t.Fatalf("Executed should not be called for a failed execution")
+	}
+	failed := false
+	mc.ExecutionFailedImpl = func(tag interface{}, err error) {
+		if tag != id {
+			t.Fatalf("ExecutionFailed got wrong ID")
+		}
+		failed = true
+	}
+
+	mre.execErr = fmt.Errorf("transient failure")
+	co.Execute(id, testTxs)
+	mev.process()
+
+	if !failed {
+		t.Fatalf("Should have reported the failed execution")
+	}
+	if mre.curBatch != nil || co.batchInProgress {
+		t.Fatalf("Should have rolled back the failed batch")
+	}
+
+	mre.execErr = nil
+	mc.ExecutedImpl = nil
+	co.Execute(id, testTxs)
+	co.Commit(id, nil)
+	mev.process()
+
+	if mre.commitCount != 1 || len(mre.curTxs) != len(testTxs) {
+		t.Fatalf("Should have committed the retried execution of %d transactions, committed %d batches of %d", len(testTxs), mre.commitCount, len(mre.curTxs))
+	}
+}
+
 // TestNormalStateTransfer attempts a simple state transfer request with 10 recoverable failures
 func TestNormalStateTransfer(t *testing.T) {
 	co, mc, _, mst, mev := newMocks(t)
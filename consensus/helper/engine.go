@@ -114,7 +114,10 @@ func GetEngine(coord peer.MessageHandlerCoordinator) (peer.Engine, error) {
 	engineOnce.Do(func() {
 		engine = new(EngineImpl)
 		engine.helper = NewHelper(coord)
-		engine.consenter = controller.NewConsenter(engine.helper)
+		if engine.consenter, err = controller.NewConsenter(engine.helper); err != nil {
+			engine = nil
+			return
+		}
 		engine.helper.setConsenter(engine.consenter)
 		engine.peerEndpoint, err = coord.GetPeerEndpoint()
 		engine.consensusFan = util.NewMessageFan()
@@ -22,6 +22,7 @@ import (
 	"github.com/op/go-logging"
 	"github.com/spf13/viper"
 
+	"github.com/hyperledger/fabric/consensus"
 	"github.com/hyperledger/fabric/consensus/util"
 	"github.com/hyperledger/fabric/core/peer"
 
@@ -95,6 +96,19 @@ func (handler *ConsensusHandler) HandleMessage(msg *pb.Message) error {
 		}
 	}
 
+	if msg.Type == pb.Message_DISC_HELLO {
+		// The connection is established once the peer handler accepts the hello
+		if err := handler.MessageHandler.HandleMessage(msg); err != nil {
+			return err
+		}
+		if listener, ok := getEngineImpl().consenter.(consensus.ConnectionListener); ok {
+			if pe, err := handler.To(); err == nil {
+				listener.Connected(pe.ID)
+			}
+		}
+		return nil
+	}
+
 	if logger.IsEnabledFor(logging.DEBUG) {
 		logger.Debugf("Did not handle message of type %s, passing on to next MessageHandler", msg.Type)
 	}
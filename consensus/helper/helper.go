@@ -360,6 +360,13 @@ func (h *Helper) Executed(tag interface{}) {
 	}
 }
 
+// ExecutionFailed is called instead of Executed when Execute fails
+func (h *Helper) ExecutionFailed(tag interface{}, err error) {
+	if h.consenter != nil {
+		h.consenter.ExecutionFailed(tag, err)
+	}
+}
+
 // Committed is called whenever Commit completes
 func (h *Helper) Committed(tag interface{}, target *pb.BlockchainInfo) {
 	if h.consenter != nil {
@@ -299,6 +299,11 @@ func (i *Noops) Executed(tag interface{}) {
 	// Never called
 }
 
+// ExecutionFailed is called instead of Executed when Execute fails, no-op for noops as it uses the legacy synchronous api
+func (i *Noops) ExecutionFailed(tag interface{}, err error) {
+	// Never called
+}
+
 // Committed is called whenever Commit completes, no-op for noops as it uses the legacy synchronous api
 func (i *Noops) Committed(tag interface{}, target *pb.BlockchainInfo) {
 	// Never called
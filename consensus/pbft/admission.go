@@ -0,0 +1,61 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// RequestTransformer rewrites a client request before it is hashed and
+// ordered, such as to normalize its payload.  Every replica runs the
+// admission pipeline over the requests it takes in, so a transformer must be
+// deterministic, a function of the request alone, for the copies of the
+// replicas to agree with what the primary orders.
+type RequestTransformer func(req *Request) *Request
+
+var requestTransformers = map[string]RequestTransformer{}
+
+// RegisterRequestTransformer makes a transformer selectable through
+// general.admission, it must be called before the plugin is created
+func RegisterRequestTransformer(name string, transform RequestTransformer) {
+	requestTransformers[name] = transform
+}
+
+// newAdmissionPipeline returns the transformers general.admission names, in
+// the order they are applied
+func newAdmissionPipeline(config *viper.Viper) []RequestTransformer {
+	var pipeline []RequestTransformer
+	for _, name := range config.GetStringSlice("general.admission") {
+		transform, ok := requestTransformers[name]
+		if !ok {
+			panic(fmt.Errorf("Unknown request transformer: %s", name))
+		}
+		pipeline = append(pipeline, transform)
+	}
+	return pipeline
+}
+
+// admitRequest runs a request through the admission pipeline, returning the
+// form which is stored and ordered
+func (op *obcBatch) admitRequest(req *Request) *Request {
+	for _, transform := range op.admission {
+		req = transform(req)
+	}
+	return req
+}
@@ -0,0 +1,65 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+// auditTimerEvent is sent when the next integrity audit is due
+type auditTimerEvent struct{}
+
+// auditFinding reports an executed sequence number which the certificate
+// store does not justify
+type auditFinding struct {
+	replica uint64
+	seqNo   uint64
+}
+
+// logAuditFinding is the default audit sink, a finding indicates a bug
+func logAuditFinding(f auditFinding) {
+	logger.Criticalf("Replica %d integrity audit found no commit certificate for executed seqNo=%d", f.replica, f.seqNo)
+}
+
+// audit checks that every sequence number executed since the low watermark,
+// other than those reached through state transfer, holds a commit
+// certificate, and reports those which do not
+func (instance *pbftCore) audit() {
+	if !instance.activeView || instance.skipInProgress {
+		// Certificates are being re-formed in the new view, or replaced by transferred state
+		return
+	}
+
+	justified := make(map[uint64]bool)
+	for idx, cert := range instance.certStore {
+		if cert.prePrepare != nil && instance.committed(cert.digest, idx.v, idx.n) {
+			justified[idx.n] = true
+		}
+	}
+
+	from := instance.h
+	if instance.transferredTo > from {
+		from = instance.transferredTo
+	}
+	for n := from + 1; n <= instance.lastExec; n++ {
+		if justified[n] {
+			continue
+		}
+		if _, ok := instance.pset[n]; ok {
+			// Prepared in an earlier view, the new view commits it again
+			continue
+		}
+		instance.auditSink(auditFinding{replica: instance.id, seqNo: n})
+	}
+	logger.Debugf("Replica %d audited seqNo %d to %d", instance.id, from+1, instance.lastExec)
+}
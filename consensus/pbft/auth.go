@@ -0,0 +1,95 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// RequestAuthenticator verifies the authentication token a client request
+// payload carries, such as a signature by the key the membership service
+// registered for the client.  It is called concurrently, from RecvMsg and
+// from the event thread.
+type RequestAuthenticator interface {
+	Authenticate(payload []byte) error
+}
+
+var requestAuthenticators = map[string]RequestAuthenticator{}
+
+// RegisterRequestAuthenticator makes an authenticator selectable through
+// general.requestauth, it must be called before the plugin is created
+func RegisterRequestAuthenticator(name string, auth RequestAuthenticator) {
+	requestAuthenticators[name] = auth
+}
+
+// newRequestAuthenticator returns the authenticator selected by
+// general.requestauth, or nil if requests are not authenticated
+func newRequestAuthenticator(config *viper.Viper) RequestAuthenticator {
+	name := config.GetString("general.requestauth")
+	if name == "" {
+		return nil
+	}
+	auth, ok := requestAuthenticators[name]
+	if !ok {
+		panic(fmt.Errorf("Unknown request authenticator: %s", name))
+	}
+	return auth
+}
+
+// ReconfigurationAuthorizer decides whether an administrator issued a
+// reconfiguration, typically by verifying its credential as a signature
+// over the settings.  It is also consulted when the reconfiguration
+// executes, so it must decide alike on every replica.
+type ReconfigurationAuthorizer interface {
+	Authorize(settings []*ConfigSetting, credential []byte) error
+}
+
+var reconfigurationAuthorizers = map[string]ReconfigurationAuthorizer{}
+
+// RegisterReconfigurationAuthorizer makes an authorizer selectable through
+// general.reconfigauth, it must be called before the plugin is created
+func RegisterReconfigurationAuthorizer(name string, auth ReconfigurationAuthorizer) {
+	reconfigurationAuthorizers[name] = auth
+}
+
+// newReconfigurationAuthorizer returns the authorizer selected by
+// general.reconfigauth, or nil if reconfigurations are refused
+func newReconfigurationAuthorizer(config *viper.Viper) ReconfigurationAuthorizer {
+	name := config.GetString("general.reconfigauth")
+	if name == "" {
+		return nil
+	}
+	auth, ok := reconfigurationAuthorizers[name]
+	if !ok {
+		panic(fmt.Errorf("Unknown reconfiguration authorizer: %s", name))
+	}
+	return auth
+}
+
+// authenticate checks the token of a client request payload, if requests
+// are authenticated
+func (op *obcBatch) authenticate(payload []byte) error {
+	if op.authenticator == nil {
+		return nil
+	}
+	if err := op.authenticator.Authenticate(payload); err != nil {
+		return fmt.Errorf("PBFT refuses to order an unauthenticated transaction: %s", err)
+	}
+	return nil
+}
@@ -19,6 +19,8 @@ package pbft
 import (
 	"fmt"
 	"google/protobuf"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/hyperledger/fabric/consensus"
@@ -37,11 +39,19 @@ type obcBatch struct {
 	broadcaster *broadcaster
 
 	batchSize        int
+	maxBatchBytes    int // total payload of a batch, which the primary cuts before a request would overflow it, 0 disables
+	maxRequestBytes  int // payload of a single request at most, 0 disables
 	batchStore       []*Request
+	persistBatch     bool // whether batchStore is persisted, for a restarted primary to forward the requests again
 	batchTimer       events.Timer
 	batchTimerActive bool
 	batchTimeout     time.Duration
 
+	reconfigs          []pendingReconfiguration // committed reconfigurations awaiting their checkpoint, in order
+	reconfigured       map[string]string        // settings changed by reconfigurations
+	reconfiguredAt     uint64                   // checkpoint the last reconfiguration took effect at
+	executingReconfigs []*Reconfiguration       // reconfigurations of the batch in execution, scheduled once it commits
+
 	manager events.Manager // TODO, remove eventually, the event manager
 
 	incomingChan chan *batchMessage // Queues messages for processing by main thread
@@ -51,9 +61,94 @@ type obcBatch struct {
 
 	deduplicator *deduplicator
 
+	ackedReqs         map[string]uint64 // requests the primary acknowledged but has not yet pre-prepared, mapped to the number of batches omitting them
+	censorshipTimer   events.Timer
+	censorshipTimeout time.Duration
+
+	requestLifetime  time.Duration // how long a request may wait for a batch before it is dropped, 0 disables
+	lifetimeTimer    events.Timer
+	lifetimeDeadline time.Time // when the lifetime timer fires, zero when it is stopped
+
+	slowPrimaryFactor  float64              // pre-prepare delay, as a multiple of the commit latency, beyond which the primary is slow, 0 disables
+	slowPrimaryBatches int                  // slow pre-prepares in a row which trigger a performance view change
+	slowPrimaryCount   int                  // slow pre-prepares in a row of the current primary
+	arrivals           map[string]time.Time // when we took in each outstanding request, while watching the primary's performance
+
+	highWater        int        // outstanding requests above which the primary asks clients to back off, 0 disables
+	lowWater         int        // outstanding requests below which clients may resume
+	backpressure     bool       // whether we are currently asking clients to back off
+	maxQueuedBytes   int        // total payload of outstanding requests the primary buffers at most, 0 disables
+	queuedBytes      int        // total payload of the primary's outstanding requests, as RecvMsg sees it
+	softQueuedBytes  int        // total payload of outstanding requests above which the primary cuts batches early, 0 disables
+	backpressureLock sync.Mutex // guards backpressure and queuedBytes, which RecvMsg reads from outside the event thread
+
+	monotonicTimestamps bool          // reject requests whose timestamp does not exceed the submitting replica's previous one
+	timestampSkew       time.Duration // how far ahead of our clock a request timestamp may be
+
+	verifier *verifier // verifies consensus message signatures off the event thread, nil when verifying serially
+
+	replyCache *replyCache // replies to recently executed requests, nil when disabled
+
+	codec           PayloadCodec              // decodes request payloads into transactions
+	blockMetadata   BlockMetadataSource       // supplies the metadata of the batches we cut, nil when none is configured
+	authenticator   RequestAuthenticator      // verifies the authentication token of client requests, nil when they are not authenticated
+	reconfigAuth    ReconfigurationAuthorizer // authorizes reconfigurations, nil when they are refused
+	chaincodeLookup ChaincodeLookup           // tells whether invoked chaincode is deployed, nil when invocations are not checked
+	quotas          *quotas                   // what each organization had ordered against its quota, nil when quotas are not enforced
+	admission       []RequestTransformer      // rewrite the client requests we take in before they are stored and ordered
+	shuffleBatches  bool                      // execute a batch's requests in a deterministic shuffle rather than the primary's order
+
+	digestChain bool                            // link the metadata of each committed batch to the digest of the previous one
+	chainHead   string                          // digest of the batch we last committed, empty before the first of the chain
+	chainSink   func(replica uint64, err error) // receives the breaks in the digest chain found on commit
+
+	commitSubs  map[*commitSubscriber]bool // the commit streams, woken on each commit
+	readWaiters []*readWaiter              // reads waiting for the batch of their consistency token to commit
+	readTimer   events.Timer               // timeout giving up on the earliest held read
+
+	executeThenReply bool                             // withhold replies until the request's result is committed, otherwise reply once it is ordered
+	awaitingReply    *RequestBatch                    // the executing batch, answered once its result is committed
+	awaitingSeqNo    uint64                           // the sequence number of awaitingReply
+	awaitingView     uint64                           // the view in which awaitingReply committed
+	signReplies      bool                             // sign replies over the request digest, result, sequence number and view, for light clients
+	onReply          func(req *Request, reply *Reply) // delivers a reply to the client which submitted the request through us
+
+	sideEffect  SideEffect        // performs the external side effects of committed batches, nil when they have none
+	effectFence uint64            // sequence number of the last batch handed to sideEffect, persisted
+	effectHeld  bool              // set while the executing batch waits on its commit for its side effects
+	effectSeqNo uint64            // sequence number of the executing batch
+	effectTxs   []*pb.Transaction // transactions of the executing batch
+
+	speculator   Speculator    // pre-executes pre-prepared batches on a speculative state, nil when none is configured
+	speculations []speculation // the batches speculated and not yet pinned to the committed order, in speculation order
+
+	rejectDuringViewChange bool       // turn client transactions away during a view change, otherwise buffer them
+	maxViewChangeBuffered  int        // client transactions buffered during a view change at most
+	viewChangeBuffer       []*Request // client transactions received during the view change, submitted once the new view is installed
+	viewChangeRefusing     bool       // whether client transactions are currently turned away for the view change, guarded by backpressureLock
+
+	pessimisticForwarding bool // only forward client requests which are not already known, otherwise forward them right away
+	dedupCopies           bool // identify requests by their client digest, so the copies stamped by different replicas are ordered once
+
+	degradedReadOnly bool // turn client transactions away while the replica hears from too few replicas for a quorum
+	degradedRefusing bool // whether client transactions are currently turned away for lack of quorum, guarded by backpressureLock
+
+	priority         *requestPriority // priority queues of the outstanding requests, nil when disabled
+	systemChaincodes map[string]bool  // system chaincodes whose transactions are tagged for priority
+
 	persistForward
 }
 
+var errBackpressure = fmt.Errorf("PBFT primary has too many outstanding requests, back off and retry")
+
+var errViewChange = fmt.Errorf("PBFT view change in progress, retry later")
+
+var errNoQuorum = fmt.Errorf("PBFT network has lost its quorum, only queries are served")
+
+var errEmptyRequest = fmt.Errorf("PBFT refuses to order a transaction with an empty payload")
+
+var errOversizedRequest = fmt.Errorf("PBFT refuses to order a transaction with a payload above the maximum request size")
+
 type batchMessage struct {
 	msg    *pb.Message
 	sender *pb.PeerID
@@ -67,6 +162,26 @@ type batchMessageEvent batchMessage
 // batchTimerEvent is sent when the batch timer expires
 type batchTimerEvent struct{}
 
+// censorshipTimerEvent is sent when the primary has not included an acknowledged request in time
+type censorshipTimerEvent struct{}
+
+// signatureFailedEvent is sent when the verifier workers find a replica's signature invalid
+type signatureFailedEvent struct {
+	replica uint64
+	reason  string
+}
+
+// connectedEvent is sent when a connection to a replica is established
+type connectedEvent struct {
+	replica uint64
+}
+
+// tracedTransactionEvent is sent when a client transaction is submitted with a trace id
+type tracedTransactionEvent struct {
+	tx      []byte
+	traceID string
+}
+
 func newObcBatch(id uint64, config *viper.Viper, stack consensus.Stack) *obcBatch {
 	var err error
 
@@ -82,23 +197,117 @@ func newObcBatch(id uint64, config *viper.Viper, stack consensus.Stack) *obcBatc
 	op.manager.SetReceiver(op)
 	etf := events.NewTimerFactoryImpl(op.manager)
 	op.pbft = newPbftCore(id, config, op, etf)
+	if op.pbft.startErr != nil {
+		// New reports why the replica refuses to start, nothing may run meanwhile
+		op.pbft.close()
+		return op
+	}
 	op.manager.Start()
 	op.externalEventReceiver.manager = op.manager
-	op.broadcaster = newBroadcaster(id, op.pbft.N, op.pbft.f, stack)
+	coalesce, err := time.ParseDuration(config.GetString("general.coalescewindow"))
+	if err != nil {
+		coalesce = 0
+	}
+	logger.Infof("PBFT message coalescing window = %v", coalesce)
+	op.broadcaster = newBroadcaster(id, op.pbft.N, op.pbft.f, coalesce, stack)
+
+	if workers := config.GetInt("general.verifyworkers"); workers > 0 {
+		op.pbft.verifyOffloaded = true
+		// the workers only hold the stack's key material, never the state of the event thread
+		keys := func(senderID uint64, signature []byte, message []byte) error {
+			senderHandle, err := getValidatorHandle(senderID)
+			if err != nil {
+				return err
+			}
+			return stack.Verify(senderHandle, signature, message)
+		}
+		op.verifier = newVerifier(workers, func(ocMsg *pb.Message) error {
+			return verifyConsensusMsg(ocMsg, keys)
+		}, func(msg *batchMessage) {
+			op.externalEventReceiver.RecvMsg(msg.msg, msg.sender)
+		}, func(msg *batchMessage, err error) {
+			if sigErr, ok := err.(*signatureError); ok {
+				op.manager.Queue() <- signatureFailedEvent{replica: sigErr.replica, reason: sigErr.reason}
+			}
+		})
+		logger.Infof("PBFT signature verification workers = %d", workers)
+	}
 
 	op.batchSize = config.GetInt("general.batchsize")
+	op.maxBatchBytes = config.GetInt("general.maxbatchbytes")
+	op.maxRequestBytes = config.GetInt("general.maxrequestbytes")
 	op.batchStore = nil
+	op.persistBatch = config.GetBool("general.persistbatch")
+	op.reconfigured = make(map[string]string)
 	op.batchTimeout, err = time.ParseDuration(config.GetString("general.timeout.batch"))
 	if err != nil {
 		panic(fmt.Errorf("Cannot parse batch timeout: %s", err))
 	}
+	op.censorshipTimeout, err = time.ParseDuration(config.GetString("general.timeout.censorship"))
+	if err != nil {
+		panic(fmt.Errorf("Cannot parse censorship timeout: %s", err))
+	}
+	op.requestLifetime, err = time.ParseDuration(config.GetString("general.timeout.requestlifetime"))
+	if err != nil {
+		panic(fmt.Errorf("Cannot parse request lifetime: %s", err))
+	}
 	logger.Infof("PBFT Batch size = %d", op.batchSize)
 	logger.Infof("PBFT Batch timeout = %v", op.batchTimeout)
+	if op.pbft.inclusionProof {
+		logger.Infof("PBFT censorship timeout = %v", op.censorshipTimeout)
+	}
+
+	op.monotonicTimestamps = config.GetBool("general.monotonictimestamps")
+	if op.monotonicTimestamps {
+		op.timestampSkew, err = time.ParseDuration(config.GetString("general.timestampskew"))
+		if err != nil {
+			panic(fmt.Errorf("Cannot parse timestamp skew: %s", err))
+		}
+		logger.Infof("PBFT monotonic request timestamps enforced, skew = %v", op.timestampSkew)
+	}
+
+	op.slowPrimaryFactor = config.GetFloat64("general.slowprimary.factor")
+	op.slowPrimaryBatches = config.GetInt("general.slowprimary.batches")
+	op.arrivals = make(map[string]time.Time)
+	if op.slowPrimaryFactor > 0 {
+		logger.Infof("PBFT performance view change after %d batches pre-prepared %v x commit latency late", op.slowPrimaryBatches, op.slowPrimaryFactor)
+	}
+
+	op.highWater = config.GetInt("general.flowcontrol.highwater")
+	op.lowWater = config.GetInt("general.flowcontrol.lowwater")
+	if op.highWater > 0 {
+		if op.lowWater >= op.highWater {
+			op.lowWater = op.highWater / 2
+			logger.Warningf("Configured flow control low-water mark must be less than the high-water mark, setting to %d", op.lowWater)
+		}
+		logger.Infof("PBFT flow control high-water = %d, low-water = %d", op.highWater, op.lowWater)
+	} else {
+		logger.Infof("PBFT flow control disabled")
+	}
+	op.maxQueuedBytes = config.GetInt("general.flowcontrol.maxbytes")
+	if op.maxQueuedBytes > 0 {
+		logger.Infof("PBFT flow control outstanding request bytes limit = %d", op.maxQueuedBytes)
+	}
+	op.softQueuedBytes = config.GetInt("general.flowcontrol.softbytes")
+	if op.softQueuedBytes > 0 {
+		if op.maxQueuedBytes > 0 && op.softQueuedBytes >= op.maxQueuedBytes {
+			op.softQueuedBytes = op.maxQueuedBytes / 2
+			logger.Warningf("Configured flow control soft bytes limit must be less than the bytes limit, setting to %d", op.softQueuedBytes)
+		}
+		logger.Infof("PBFT flow control early batch cut above %d outstanding request bytes", op.softQueuedBytes)
+	}
 
 	if op.batchTimeout >= op.pbft.requestTimeout {
 		op.pbft.requestTimeout = 3 * op.batchTimeout / 2
 		logger.Warningf("Configured request timeout must be greater than batch timeout, setting to %v", op.pbft.requestTimeout)
 	}
+	if op.pbft.adaptiveFactor > 0 && op.batchTimeout >= op.pbft.adaptiveMin {
+		op.pbft.adaptiveMin = 3 * op.batchTimeout / 2
+		if op.pbft.adaptiveMax < op.pbft.adaptiveMin {
+			op.pbft.adaptiveMax = op.pbft.adaptiveMin
+		}
+		logger.Warningf("Configured adaptive request timeout minimum must be greater than batch timeout, setting to %v", op.pbft.adaptiveMin)
+	}
 
 	if op.pbft.requestTimeout >= op.pbft.nullRequestTimeout && op.pbft.nullRequestTimeout != 0 {
 		op.pbft.nullRequestTimeout = 3 * op.pbft.requestTimeout / 2
@@ -108,28 +317,354 @@ func newObcBatch(id uint64, config *viper.Viper, stack consensus.Stack) *obcBatc
 	op.incomingChan = make(chan *batchMessage)
 
 	op.batchTimer = etf.CreateTimer()
-
-	op.reqStore = newRequestStore()
+	op.censorshipTimer = etf.CreateTimer()
+	op.lifetimeTimer = etf.CreateTimer()
+	op.readTimer = etf.CreateTimer()
+	op.ackedReqs = make(map[string]uint64)
+	op.commitSubs = make(map[*commitSubscriber]bool)
+
+	op.dedupCopies = config.GetBool("general.dedupcopies")
+	logger.Infof("PBFT client copy deduplication = %v", op.dedupCopies)
+
+	op.priority = newRequestPriority(config)
+	if op.priority != nil {
+		if _, ok := op.priority.levels[systemTag]; ok {
+			op.systemChaincodes = enabledSystemChaincodes(config)
+		}
+		op.priority.tag = op.requestTag
+		logger.Infof("PBFT request priority tags = %v, weights = %v", config.GetStringSlice("general.priority.tags"), op.priority.weights)
+	} else {
+		logger.Infof("PBFT request priority disabled")
+	}
+	op.reqStore = op.newRequestStore()
 
 	op.deduplicator = newDeduplicator()
 
+	op.codec = newPayloadCodec(config)
+	op.blockMetadata = newBlockMetadataSource(config)
+	op.authenticator = newRequestAuthenticator(config)
+	op.reconfigAuth = newReconfigurationAuthorizer(config)
+	op.chaincodeLookup = newChaincodeLookup(config)
+	op.quotas = newQuotas(config, op.pbft.K)
+	if op.quotas != nil {
+		op.quotas.restore(op.headMetadata())
+	}
+	op.sideEffect = newSideEffect(config)
+	if op.sideEffect != nil {
+		op.restoreSideEffectFence()
+	}
+	op.admission = newAdmissionPipeline(config)
+	op.speculator = newSpeculator(config)
+
+	switch mode := config.GetString("general.viewchangerequests.mode"); mode {
+	case "", "buffer":
+		op.maxViewChangeBuffered = config.GetInt("general.viewchangerequests.maxbuffered")
+		logger.Infof("PBFT buffering up to %d client transactions during view changes", op.maxViewChangeBuffered)
+	case "reject":
+		op.rejectDuringViewChange = true
+		logger.Infof("PBFT rejecting client transactions during view changes")
+	default:
+		panic(fmt.Errorf("Unknown view change request mode: %s", mode))
+	}
+
+	switch mode := config.GetString("general.forwarding"); mode {
+	case "", "optimistic":
+	case "pessimistic":
+		op.pessimisticForwarding = true
+	default:
+		panic(fmt.Errorf("Unknown request forwarding mode: %s", mode))
+	}
+	logger.Infof("PBFT pessimistic request forwarding = %v", op.pessimisticForwarding)
+
+	op.degradedReadOnly = config.GetBool("general.degraded.readonly")
+	logger.Infof("PBFT read-only degraded mode = %v", op.degradedReadOnly)
+
+	op.shuffleBatches = config.GetBool("general.shufflebatches")
+	logger.Infof("PBFT intra-batch shuffle = %v", op.shuffleBatches)
+
+	op.digestChain = config.GetBool("general.digestchain")
+	op.chainSink = logChainBreak
+	if op.digestChain {
+		op.chainHead = op.headMetadata().BatchDigest
+	}
+	logger.Infof("PBFT batch digest chain = %v", op.digestChain)
+
+	if size := config.GetInt("general.replycache.size"); size > 0 {
+		persistInterval := config.GetInt("general.replycache.persistinterval")
+		op.replyCache = newReplyCache(size, persistInterval, op)
+		logger.Infof("PBFT reply cache size = %d, persisted every %d batches", size, persistInterval)
+	}
+
+	switch mode := config.GetString("general.replymode"); mode {
+	case "", "commit":
+	case "execute":
+		op.executeThenReply = true
+	default:
+		panic(fmt.Errorf("Unknown reply mode: %s", mode))
+	}
+	logger.Infof("PBFT replies after execution = %v", op.executeThenReply)
+	op.signReplies = config.GetBool("general.signreplies")
+	logger.Infof("PBFT signed replies = %v", op.signReplies)
+	op.onReply = func(req *Request, reply *Reply) {
+		logger.Debugf("Replica %d replying to request %s: %v", op.pbft.id, hash(req), reply)
+	}
+
 	op.idleChan = make(chan struct{})
 	close(op.idleChan) // TODO remove eventually
 
+	if op.pbft.protocolVersion > 0 {
+		op.pbft.sendHello()
+	}
+	if op.pbft.replicaSetCheck {
+		op.pbft.sendReplicaSet()
+	}
+	op.restoreReconfigurations()
+	if op.persistBatch {
+		op.manager.Queue() <- workEvent(op.restoreBatchStore)
+	}
+
 	return op
 }
 
 // Close tells us to release resources we are holding
 func (op *obcBatch) Close() {
 	op.batchTimer.Halt()
+	op.censorshipTimer.Halt()
+	op.lifetimeTimer.Halt()
+	op.readTimer.Halt()
+	if op.verifier != nil {
+		op.verifier.stop()
+	}
 	op.pbft.close()
 }
 
+// RecvMsg turns away client transactions while the primary signals backpressure, hands consensus
+// messages to the verifier when signatures are verified in parallel, and otherwise queues the message
+func (op *obcBatch) RecvMsg(ocMsg *pb.Message, senderHandle *pb.PeerID) error {
+	if ocMsg.Type == pb.Message_CHAIN_TRANSACTION {
+		if err := op.admit(ocMsg.Payload); err != nil {
+			return err
+		}
+	} else if ocMsg.Type == pb.Message_CONSENSUS && op.verifier != nil {
+		op.verifier.submit(ocMsg, senderHandle)
+		return nil
+	}
+	return op.externalEventReceiver.RecvMsg(ocMsg, senderHandle)
+}
+
+// Connected announces our protocol versions to a replica on each new
+// connection, so that a replica which reconnects, possibly upgraded, renegotiates
+func (op *obcBatch) Connected(handle *pb.PeerID) {
+	replica, err := getValidatorID(handle)
+	if err != nil {
+		return
+	}
+	op.manager.Queue() <- connectedEvent{replica: replica}
+}
+
+// SubmitTraced submits a client transaction like RecvMsg, tagging its request
+// with an opaque trace id which every replica reports, through structured log
+// lines, at each stage of consensus the request reaches
+func (op *obcBatch) SubmitTraced(tx []byte, traceID string) error {
+	if err := op.admit(tx); err != nil {
+		return err
+	}
+	op.manager.Queue() <- tracedTransactionEvent{tx: tx, traceID: traceID}
+	return nil
+}
+
+// Metrics runs pbftCore.Metrics on the event thread
+func (op *obcBatch) Metrics() Metrics {
+	result := make(chan Metrics)
+	op.manager.Queue() <- workEvent(func() {
+		result <- op.pbft.Metrics()
+	})
+	return <-result
+}
+
+// DumpCertStore takes the dump of pbftCore.DumpCertStore on the event thread,
+// so that debugging tools may call it from any goroutine
+func (op *obcBatch) DumpCertStore() []CertSnapshot {
+	result := make(chan []CertSnapshot)
+	op.manager.Queue() <- workEvent(func() {
+		result <- op.pbft.DumpCertStore()
+	})
+	return <-result
+}
+
+// admit turns away empty, oversized and unauthenticated client transactions, invocations of chaincode which is not deployed,
+// those exceeding the quota of their organization, and any while the primary signals backpressure
+func (op *obcBatch) admit(tx []byte) error {
+	if len(tx) == 0 {
+		return errEmptyRequest
+	}
+	if op.maxRequestBytes > 0 && len(tx) > op.maxRequestBytes {
+		return errOversizedRequest
+	}
+	if err := op.authenticate(tx); err != nil {
+		return err
+	}
+	if err := op.checkChaincode(tx); err != nil {
+		return err
+	}
+	if op.quotas != nil {
+		if err := op.quotas.admit(tx, op.pbft.now()); err != nil {
+			return err
+		}
+	}
+	op.backpressureLock.Lock()
+	defer op.backpressureLock.Unlock()
+	if op.degradedRefusing {
+		return errNoQuorum
+	}
+	if op.viewChangeRefusing {
+		return errViewChange
+	}
+	if op.backpressure || (op.maxQueuedBytes > 0 && op.queuedBytes+len(tx) > op.maxQueuedBytes) {
+		return errBackpressure
+	}
+	return nil
+}
+
+// updateViewChangeAdmission publishes, for RecvMsg, whether client
+// transactions are turned away because a view change is in progress
+func (op *obcBatch) updateViewChangeAdmission() {
+	refusing := !op.pbft.activeView && (op.rejectDuringViewChange || len(op.viewChangeBuffer) >= op.maxViewChangeBuffered)
+
+	op.backpressureLock.Lock()
+	defer op.backpressureLock.Unlock()
+	if refusing != op.viewChangeRefusing {
+		logger.Debugf("Replica %d turning away client transactions during view change = %v", op.pbft.id, refusing)
+		op.viewChangeRefusing = refusing
+	}
+}
+
+// updateDegradedAdmission publishes, for RecvMsg, whether client transactions
+// are turned away because the network lost its quorum.  Queries bypass
+// consensus, and keep being served from our committed state.
+func (op *obcBatch) updateDegradedAdmission() {
+	refusing := op.degradedReadOnly && op.pbft.quorumLost
+
+	op.backpressureLock.Lock()
+	defer op.backpressureLock.Unlock()
+	if refusing != op.degradedRefusing {
+		logger.Infof("Replica %d turning away client transactions for lack of quorum = %v", op.pbft.id, refusing)
+		op.degradedRefusing = refusing
+	}
+}
+
+// submitClientReq submits a client transaction, or holds it back while a view
+// change is in progress, when configured to buffer
+func (op *obcBatch) submitClientReq(req *Request) events.Event {
+	if op.pbft.activeView || op.rejectDuringViewChange {
+		return op.submitToLeader(req)
+	}
+	if len(op.viewChangeBuffer) >= op.maxViewChangeBuffered {
+		logger.Warningf("Replica %d already buffers %d client transactions during view change, dropping request", op.pbft.id, len(op.viewChangeBuffer))
+		return nil
+	}
+	logger.Debugf("Replica %d buffering client transaction until the view change completes", op.pbft.id)
+	op.viewChangeBuffer = append(op.viewChangeBuffer, req)
+	op.watchLifetime(req)
+	return nil
+}
+
+// signatureError is returned for a message whose signer's signature does not verify
+type signatureError struct {
+	replica uint64
+	reason  string
+	err     error
+}
+
+func (e *signatureError) Error() string {
+	return fmt.Sprintf("%s of replica %d: %s", e.reason, e.replica, e.err)
+}
+
+// verifyConsensusMsg checks the signatures carried by a consensus message
+// with the given key material, it is invoked by the verifier workers,
+// concurrently with the event thread
+func verifyConsensusMsg(ocMsg *pb.Message, verify func(senderID uint64, signature []byte, message []byte) error) error {
+	batchMsg := &BatchMessage{}
+	if err := proto.Unmarshal(ocMsg.Payload, batchMsg); err != nil {
+		return err
+	}
+	if bundle := batchMsg.GetBundle(); bundle != nil {
+		for _, payload := range bundle.Payloads {
+			if err := verifyConsensusMsg(&pb.Message{Type: pb.Message_CONSENSUS, Payload: payload}, verify); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	pbftMsg := batchMsg.GetPbftMessage()
+	if pbftMsg == nil {
+		return nil
+	}
+	msg := &Message{}
+	if err := proto.Unmarshal(pbftMsg, msg); err != nil {
+		return err
+	}
+	if vc := msg.GetViewChange(); vc != nil {
+		if err := verifySignable(vc, verify); err != nil {
+			return &signatureError{replica: vc.ReplicaId, reason: "bad view-change signature", err: err}
+		}
+	}
+	return nil
+}
+
+// updateBackpressure starts signalling backpressure once the primary's outstanding requests exceed
+// the high-water mark, and stops once they fall below the low-water mark or we are no longer primary.
+// It also publishes the primary's outstanding payload size, which RecvMsg checks against the byte limit
+func (op *obcBatch) updateBackpressure() {
+	if op.highWater <= 0 && op.maxQueuedBytes <= 0 {
+		return
+	}
+
+	queued := op.reqStore.outstandingRequests.Len()
+	isPrimary := op.pbft.primary(op.pbft.view) == op.pbft.id && op.pbft.activeView
+
+	op.backpressureLock.Lock()
+	defer op.backpressureLock.Unlock()
+	if isPrimary {
+		op.queuedBytes = op.reqStore.outstandingRequests.Bytes()
+	} else {
+		op.queuedBytes = 0
+	}
+	if op.highWater <= 0 {
+		return
+	}
+	if !op.backpressure && isPrimary && queued > op.highWater {
+		logger.Warningf("Replica %d has %d outstanding requests, above the high-water mark of %d, signalling clients to back off", op.pbft.id, queued, op.highWater)
+		op.backpressure = true
+	} else if op.backpressure && (!isPrimary || queued < op.lowWater) {
+		logger.Infof("Replica %d has %d outstanding requests, no longer signalling clients to back off", op.pbft.id, queued)
+		op.backpressure = false
+	}
+}
+
 func (op *obcBatch) submitToLeader(req *Request) events.Event {
+	// Forward the request as the client sent it, the other replicas admit it themselves
+	forward := req
+	req = op.admitRequest(req)
+	if op.alreadyExecuted(req) {
+		return nil
+	}
+	if op.pessimisticForwarding && op.duplicateRequest(req) {
+		logger.Debugf("Replica %d not forwarding request %s, which it already holds", op.pbft.id, hash(req))
+		return nil
+	}
+	op.pbft.traceRequest(req, traceSubmitted, op.pbft.view, 0)
 	// Broadcast the request to the network, in case we're in the wrong view
-	op.broadcastMsg(&BatchMessage{Payload: &BatchMessage_Request{Request: req}})
+	op.broadcastMsg(&BatchMessage{Payload: &BatchMessage_Request{Request: forward}})
+	if op.duplicateRequest(req) {
+		logger.Debugf("Replica %d forwarded request %s again, which it already holds", op.pbft.id, hash(req))
+		return nil
+	}
 	op.logAddTxFromRequest(req)
 	op.reqStore.storeOutstanding(req)
+	op.watchLifetime(req)
+	op.noteArrival(req)
+	op.updateBackpressure()
 	op.startTimerIfOutstandingRequests()
 	if op.pbft.primary(op.pbft.view) == op.pbft.id && op.pbft.activeView {
 		return op.leaderProcReq(req)
@@ -146,6 +681,14 @@ func (op *obcBatch) broadcastMsg(msg *BatchMessage) {
 	op.broadcaster.Broadcast(ocMsg)
 }
 
+func (op *obcBatch) broadcastRequest(req *Request) {
+	op.broadcastMsg(&BatchMessage{Payload: &BatchMessage_Request{Request: req}})
+}
+
+func (op *obcBatch) unicastRequest(req *Request, receiverID uint64) {
+	op.unicastMsg(&BatchMessage{Payload: &BatchMessage_Request{Request: req}}, receiverID)
+}
+
 // send a message to a specific replica
 func (op *obcBatch) unicastMsg(msg *BatchMessage, receiverID uint64) {
 	msgPayload, _ := proto.Marshal(msg)
@@ -186,10 +729,39 @@ func (op *obcBatch) verify(senderID uint64, signature []byte, message []byte) er
 // execute an opaque request which corresponds to an OBC Transaction
 func (op *obcBatch) execute(seqNo uint64, reqBatch *RequestBatch) {
 	var txs []*pb.Transaction
-	for _, req := range reqBatch.GetBatch() {
-		tx := &pb.Transaction{}
-		if err := proto.Unmarshal(req.Payload, tx); err != nil {
-			logger.Warningf("Batch replica %d could not unmarshal transaction %s", op.pbft.id, err)
+	reqs := reqBatch.GetBatch()
+	if op.shuffleBatches {
+		reqs = shuffleRequests(reqs)
+	}
+	var refused map[*Request]error
+	if op.quotas != nil {
+		refused = op.quotas.charge(seqNo, reqs)
+	}
+	var reconfigs []*Reconfiguration
+	for _, req := range reqs {
+		if err, ok := refused[req]; ok {
+			// every replica refuses it alike, its reply reports it failed
+			op.reqStore.remove(req)
+			op.deduplicator.Execute(req)
+			delete(op.arrivals, op.reqStore.outstandingRequests.keyOf(req))
+			logger.Warningf("Replica %d skipping request %s ordered at seqNo=%d: %s", op.pbft.id, hash(req), seqNo, err)
+			continue
+		}
+		if req.Reconfiguration {
+			op.reqStore.remove(req)
+			op.deduplicator.Execute(req)
+			delete(op.arrivals, op.reqStore.outstandingRequests.keyOf(req))
+			// a faulty primary may order a reconfiguration the replicas would not take in
+			if reconfig, err := op.authorizeReconfiguration(req.Payload); err != nil {
+				logger.Warningf("Replica %d skipping reconfiguration ordered at seqNo=%d: %s", op.pbft.id, seqNo, err)
+			} else {
+				reconfigs = append(reconfigs, reconfig)
+			}
+			continue
+		}
+		tx, err := op.codec.Decode(req.Payload)
+		if err != nil {
+			logger.Errorf("Batch replica %d could not decode transaction, skipping it: %s", op.pbft.id, err)
 			continue
 		}
 		logger.Debugf("Batch replica %d executing request with transaction %s from outstandingReqs, seqNo=%d", op.pbft.id, tx.Uuid, seqNo)
@@ -198,12 +770,41 @@ func (op *obcBatch) execute(seqNo uint64, reqBatch *RequestBatch) {
 		}
 		txs = append(txs, tx)
 		op.deduplicator.Execute(req)
+		delete(op.arrivals, op.reqStore.outstandingRequests.keyOf(req))
+	}
+	op.executingReconfigs = reconfigs
+	metadata := &Metadata{SeqNo: seqNo, BlockMetadata: reqBatch.Metadata}
+	if op.digestChain {
+		op.chainLink(metadata, reqBatch)
+	}
+	op.recordReconfigurations(metadata, seqNo, reconfigs)
+	if op.quotas != nil {
+		op.quotas.record(metadata)
 	}
-	meta, _ := proto.Marshal(&Metadata{seqNo})
+	meta, _ := proto.Marshal(metadata)
+	op.pinSpeculation(seqNo, reqBatch)
+	op.holdSideEffect(seqNo, txs)
+	if op.executeThenReply {
+		op.awaitingReply, op.awaitingSeqNo, op.awaitingView = reqBatch, seqNo, op.pbft.execView
+	} else {
+		op.reply(seqNo, op.pbft.execView, reqBatch.GetBatch(), nil)
+	}
+	op.updateBackpressure()
 	logger.Debugf("Batch replica %d received exec for seqNo %d containing %d transactions", op.pbft.id, seqNo, len(txs))
 	op.stack.Execute(meta, txs) // This executes in the background, we will receive an executedEvent once it completes
 }
 
+// abandonExecution rolls back the execution of seqNo, which pbft-core gave up
+// on while it was still running.  The stack executes in order, so the
+// rollback takes effect once the execution returns, before the next starts
+func (op *obcBatch) abandonExecution(seqNo uint64) {
+	logger.Warningf("Replica %d rolling back abandoned execution of seqNo=%d", op.pbft.id, seqNo)
+	op.awaitingReply = nil
+	op.effectHeld = false
+	op.executingReconfigs = nil
+	op.stack.Rollback(nil)
+}
+
 // =============================================================================
 // functions specific to batch mode
 // =============================================================================
@@ -212,20 +813,114 @@ func (op *obcBatch) leaderProcReq(req *Request) events.Event {
 	// XXX check req sig
 	digest := hash(req)
 	logger.Debugf("Batch primary %d queueing new request %s", op.pbft.id, digest)
+	if op.maxBatchBytes > 0 && len(op.batchStore) > 0 && op.batchBytes()+len(req.Payload) > op.maxBatchBytes {
+		// Cut the batch the request would overflow, a request larger than a batch is then ordered alone
+		op.manager.Inject(op.sendBatch())
+	}
 	op.batchStore = append(op.batchStore, req)
+	if op.priority != nil {
+		// Order the batch by priority, behind the queued requests of the same priority
+		level := op.priority.level(req)
+		for i := len(op.batchStore) - 1; i > 0 && op.priority.level(op.batchStore[i-1]) > level; i-- {
+			op.batchStore[i], op.batchStore[i-1] = op.batchStore[i-1], op.batchStore[i]
+		}
+	}
 	op.reqStore.storePending(req)
+	op.persistBatchedRequest(req)
 
 	if !op.batchTimerActive {
 		op.startBatchTimer()
 	}
 
-	if len(op.batchStore) >= op.batchSize {
+	if len(op.batchStore) >= op.batchSize || (op.maxBatchBytes > 0 && op.batchBytes() >= op.maxBatchBytes) {
+		return op.sendBatch()
+	}
+
+	if op.softQueuedBytes > 0 && op.reqStore.outstandingRequests.Bytes() >= op.softQueuedBytes {
+		// Ordering the queued requests is what frees their memory, do not wait for the timer
+		logger.Infof("Batch primary %d holds %d bytes of outstanding requests, above the soft limit of %d, cutting batch early",
+			op.pbft.id, op.reqStore.outstandingRequests.Bytes(), op.softQueuedBytes)
 		return op.sendBatch()
 	}
 
 	return nil
 }
 
+// batchBytes is the total payload of the requests queued for the next batch
+func (op *obcBatch) batchBytes() int {
+	bytes := 0
+	for _, req := range op.batchStore {
+		bytes += len(req.Payload)
+	}
+	return bytes
+}
+
+const batchStorePrefix = "batchStore."
+
+// persistBatchedRequest mirrors a request queued for the next batch to the persisted state
+func (op *obcBatch) persistBatchedRequest(req *Request) {
+	if !op.persistBatch {
+		return
+	}
+	raw, err := proto.Marshal(req)
+	if err != nil {
+		logger.Errorf("Replica %d could not marshal request %s of the batch it is assembling: %v", op.pbft.id, hash(req), err)
+		return
+	}
+	if err = op.StoreState(batchStorePrefix+hash(req), raw); err != nil {
+		logger.Warningf("Replica %d could not persist request %s of the batch it is assembling: %v", op.pbft.id, hash(req), err)
+	}
+}
+
+// persistDelBatchedRequests removes requests no longer queued for the next batch from the persisted state
+func (op *obcBatch) persistDelBatchedRequests(reqs []*Request) {
+	if !op.persistBatch {
+		return
+	}
+	for _, req := range reqs {
+		op.DelState(batchStorePrefix + hash(req))
+	}
+}
+
+// restoreBatchStore forwards the requests of the batch we were assembling
+// before we restarted again, as the other replicas may never have received
+// them, and orders them ourselves if we are still the primary
+func (op *obcBatch) restoreBatchStore() {
+	persisted, err := op.ReadStateSet(batchStorePrefix)
+	if err != nil || len(persisted) == 0 {
+		return
+	}
+	var keys []string
+	for key := range persisted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	reqBatch := &RequestBatch{}
+	for _, key := range keys {
+		op.DelState(key)
+		req := &Request{}
+		if err = proto.Unmarshal(persisted[key], req); err != nil {
+			logger.Warningf("Replica %d could not unmarshal request %s of the batch it was assembling: %v", op.pbft.id, key, err)
+			continue
+		}
+		reqBatch.Batch = append(reqBatch.Batch, req)
+	}
+
+	logger.Infof("Replica %d forwarding the %d requests of the batch it was assembling before it restarted", op.pbft.id, len(reqBatch.Batch))
+	for _, req := range reqBatch.Batch {
+		if op.alreadyExecuted(req) || op.duplicateRequest(req) {
+			continue
+		}
+		op.broadcastMsg(&BatchMessage{Payload: &BatchMessage_Request{Request: req}})
+		op.reqStore.storeOutstanding(req)
+		op.watchLifetime(req)
+		if op.pbft.primary(op.pbft.view) == op.pbft.id && op.pbft.activeView {
+			op.manager.Inject(op.leaderProcReq(req))
+		}
+	}
+	op.startTimerIfOutstandingRequests()
+}
+
 func (op *obcBatch) sendBatch() events.Event {
 	op.stopBatchTimer()
 	if len(op.batchStore) == 0 {
@@ -235,12 +930,14 @@ func (op *obcBatch) sendBatch() events.Event {
 
 	reqBatch := &RequestBatch{Batch: op.batchStore}
 	op.batchStore = nil
+	op.persistDelBatchedRequests(reqBatch.Batch)
+	op.attachBlockMetadata(reqBatch)
 	logger.Infof("Creating batch with %d requests", len(reqBatch.Batch))
 	return reqBatch
 }
 
 func (op *obcBatch) txToReq(tx []byte) *Request {
-	now := time.Now()
+	now := op.pbft.now()
 	req := &Request{
 		Timestamp: &google_protobuf.Timestamp{
 			Seconds: now.Unix(),
@@ -248,6 +945,7 @@ func (op *obcBatch) txToReq(tx []byte) *Request {
 		},
 		Payload:   tx,
 		ReplicaId: op.pbft.id,
+		Tag:       op.requestTag(tx),
 	}
 	// XXX sign req
 	return req
@@ -256,7 +954,7 @@ func (op *obcBatch) txToReq(tx []byte) *Request {
 func (op *obcBatch) processMessage(ocMsg *pb.Message, senderHandle *pb.PeerID) events.Event {
 	if ocMsg.Type == pb.Message_CHAIN_TRANSACTION {
 		req := op.txToReq(ocMsg.Payload)
-		return op.submitToLeader(req)
+		return op.submitClientReq(req)
 	}
 
 	if ocMsg.Type != pb.Message_CONSENSUS {
@@ -272,18 +970,84 @@ func (op *obcBatch) processMessage(ocMsg *pb.Message, senderHandle *pb.PeerID) e
 	}
 
 	if req := batchMsg.GetRequest(); req != nil {
+		if senderID, err := getValidatorID(senderHandle); err == nil && op.pbft.quarantined(senderID) {
+			logger.Debugf("Replica %d ignoring request forwarded by quarantined replica %d", op.pbft.id, senderID)
+			return nil
+		}
+		if senderID, err := getValidatorID(senderHandle); err == nil && op.pbft.incompatible(senderID) {
+			logger.Debugf("Replica %d refusing request forwarded by replica %d, which speaks an incompatible protocol version", op.pbft.id, senderID)
+			return nil
+		}
+
+		if len(req.Payload) == 0 {
+			logger.Warningf("Replica %d ignoring request with an empty payload from replica %d", op.pbft.id, req.ReplicaId)
+			return nil
+		}
+
+		if op.maxRequestBytes > 0 && len(req.Payload) > op.maxRequestBytes {
+			logger.Warningf("Replica %d ignoring request with a payload of %d bytes from replica %d, above the maximum request size", op.pbft.id, len(req.Payload), req.ReplicaId)
+			return nil
+		}
+
+		if req.Reconfiguration {
+			if _, err := op.authorizeReconfiguration(req.Payload); err != nil {
+				logger.Warningf("Replica %d ignoring reconfiguration from replica %d: %s", op.pbft.id, req.ReplicaId, err)
+				return nil
+			}
+		} else if err := op.authenticate(req.Payload); err != nil {
+			logger.Warningf("Replica %d ignoring request from replica %d: %s", op.pbft.id, req.ReplicaId, err)
+			return nil
+		}
+		req = op.admitRequest(req)
+
 		if !op.deduplicator.IsNew(req) {
 			logger.Warningf("Replica %d ignoring request as it is too old", op.pbft.id)
 			return nil
 		}
 
+		if op.monotonicTimestamps && !op.timestampValid(req) {
+			return nil
+		}
+
+		if op.alreadyExecuted(req) {
+			return nil
+		}
+
+		if op.duplicateRequest(req) {
+			logger.Debugf("Replica %d ignoring request %s from replica %d, which it already holds", op.pbft.id, hash(req), req.ReplicaId)
+			return nil
+		}
+
+		if op.monotonicTimestamps {
+			// only an admitted request raises the timestamp its replica's next must exceed
+			op.deduplicator.Request(req)
+		}
 		op.logAddTxFromRequest(req)
 		op.reqStore.storeOutstanding(req)
+		op.watchLifetime(req)
+		op.noteArrival(req)
+		op.updateBackpressure()
 		if (op.pbft.primary(op.pbft.view) == op.pbft.id) && op.pbft.activeView {
+			op.ackRequest(req)
 			return op.leaderProcReq(req)
 		}
 		op.startTimerIfOutstandingRequests()
 		return nil
+	} else if bundle := batchMsg.GetBundle(); bundle != nil {
+		// Coalesced by the sender's broadcaster, process each message on its own
+		for _, payload := range bundle.Payloads {
+			if e := op.processMessage(&pb.Message{Type: pb.Message_CONSENSUS, Payload: payload}, senderHandle); e != nil {
+				op.manager.Inject(e)
+			}
+		}
+		return nil
+	} else if ack := batchMsg.GetRequestAck(); ack != nil {
+		senderID, err := getValidatorID(senderHandle)
+		if err != nil {
+			panic("Cannot map sender's PeerID to a valid replica ID")
+		}
+		op.recvRequestAck(ack, senderID)
+		return nil
 	} else if pbftMsg := batchMsg.GetPbftMessage(); pbftMsg != nil {
 		senderID, err := getValidatorID(senderHandle) // who sent this?
 		if err != nil {
@@ -306,13 +1070,176 @@ func (op *obcBatch) processMessage(ocMsg *pb.Message, senderHandle *pb.PeerID) e
 	return nil
 }
 
+// duplicateRequest reports whether a request is already outstanding, or older
+// than an executed request of its replica
+func (op *obcBatch) duplicateRequest(req *Request) bool {
+	return op.reqStore.has(req) || !op.deduplicator.IsNew(req)
+}
+
+// alreadyExecuted reports whether the reply cache holds a reply to this
+// request, in which case it is a retransmission which must not be ordered again
+func (op *obcBatch) alreadyExecuted(req *Request) bool {
+	if op.replyCache == nil {
+		return false
+	}
+	raw, ok := op.replyCache.get(req)
+	if !ok {
+		return false
+	}
+	reply := &Reply{}
+	proto.Unmarshal(raw, reply)
+	logger.Infof("Replica %d ignoring retransmitted request %s, which executed at seqNo=%d", op.pbft.id, replyDigest(req), reply.SeqNo)
+	if req.ReplicaId == op.pbft.id {
+		op.onReply(req, reply)
+	}
+	return true
+}
+
+// reply answers the requests of the batch ordered at seqNo in view, and caches
+// the replies.  Once the batch is committed to the ledger, block holds the
+// results, otherwise the replies only acknowledge ordering
+func (op *obcBatch) reply(seqNo uint64, view uint64, reqs []*Request, block *pb.Block) {
+	for _, req := range reqs {
+		reply := &Reply{SeqNo: seqNo}
+		if block != nil {
+			reply.Executed = true
+			reply.Result = op.transactionResult(block, req)
+		}
+		if op.signReplies {
+			reply.RequestDigest = hash(req)
+			reply.View = view
+			reply.ReplicaId = op.pbft.id
+			if err := op.pbft.sign(reply); err != nil {
+				logger.Warningf("Replica %d could not sign its reply to request %s: %s", op.pbft.id, reply.RequestDigest, err)
+			}
+		}
+		if op.replyCache != nil {
+			raw, _ := proto.Marshal(reply)
+			op.replyCache.add(req, raw)
+		}
+		if req.ReplicaId == op.pbft.id {
+			op.onReply(req, reply)
+		}
+	}
+	if op.replyCache != nil {
+		op.replyCache.executed()
+	}
+}
+
+// transactionResult returns the marshaled result of the request's transaction,
+// which the ledger only commits to the block if it executed successfully
+func (op *obcBatch) transactionResult(block *pb.Block, req *Request) []byte {
+	tx, err := op.codec.Decode(req.Payload)
+	if err != nil {
+		return nil
+	}
+	result := &pb.TransactionResult{Uuid: tx.Uuid, ErrorCode: 1, Error: "transaction failed to execute"}
+	for _, committed := range block.Transactions {
+		if committed.Uuid == tx.Uuid {
+			result.ErrorCode, result.Error = 0, ""
+			break
+		}
+	}
+	raw, _ := proto.Marshal(result)
+	return raw
+}
+
+// timestampValid enforces that the requests of each replica carry strictly increasing
+// timestamps which are not too far in our future, rejecting replayed requests.  It
+// records nothing, the timestamp only counts once the request is admitted
+func (op *obcBatch) timestampValid(req *Request) bool {
+	if req.Timestamp == nil {
+		logger.Warningf("Replica %d rejecting request from replica %d without timestamp", op.pbft.id, req.ReplicaId)
+		return false
+	}
+	reqTime := time.Unix(req.Timestamp.Seconds, int64(req.Timestamp.Nanos))
+	if limit := op.pbft.now().Add(op.timestampSkew); reqTime.After(limit) {
+		logger.Warningf("Replica %d rejecting request from replica %d with timestamp %v, more than %v in the future", op.pbft.id, req.ReplicaId, reqTime, op.timestampSkew)
+		return false
+	}
+	if !op.deduplicator.IsLatest(req) {
+		logger.Warningf("Replica %d rejecting request from replica %d with timestamp %v, not later than its previous request", op.pbft.id, req.ReplicaId, reqTime)
+		return false
+	}
+	return true
+}
+
+// ackRequest promises the replica which forwarded a request that we, the primary, will include it
+func (op *obcBatch) ackRequest(req *Request) {
+	if !op.pbft.inclusionProof || req.ReplicaId == op.pbft.id {
+		return
+	}
+	op.unicastMsg(&BatchMessage{Payload: &BatchMessage_RequestAck{RequestAck: &RequestAck{
+		View:          op.pbft.view,
+		RequestDigest: hash(req),
+		ReplicaId:     op.pbft.id,
+	}}}, req.ReplicaId)
+}
+
+func (op *obcBatch) recvRequestAck(ack *RequestAck, senderID uint64) {
+	if !op.pbft.inclusionProof {
+		return
+	}
+	if !op.pbft.activeView || ack.View != op.pbft.view || senderID != ack.ReplicaId || senderID != op.pbft.primary(op.pbft.view) {
+		logger.Warningf("Replica %d ignoring request ack from replica %d for view %d", op.pbft.id, senderID, ack.View)
+		return
+	}
+	if !op.reqStore.outstandingRequests.has(ack.RequestDigest) || op.prePrepared(ack.RequestDigest) {
+		// Already executed, or the pre-prepare overtook the ack
+		return
+	}
+
+	logger.Debugf("Replica %d received ack from primary %d for request %s", op.pbft.id, senderID, ack.RequestDigest)
+	op.ackedReqs[ack.RequestDigest] = 0
+	op.censorshipTimer.SoftReset(op.censorshipTimeout, censorshipTimerEvent{})
+}
+
+// prePrepared reports whether a pre-prepare of the current view lists the request digest
+func (op *obcBatch) prePrepared(digest string) bool {
+	for idx, cert := range op.pbft.certStore {
+		if idx.v != op.pbft.view || cert.prePrepare == nil {
+			continue
+		}
+		for _, d := range cert.prePrepare.RequestDigests {
+			if d == digest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkInclusion clears the acknowledged requests an accepted pre-prepare includes, and counts
+// the batch against those it omits
+func (op *obcBatch) checkInclusion(preprep *PrePrepare) {
+	if len(op.ackedReqs) == 0 || preprep.BatchDigest == "" {
+		return
+	}
+	if cert, ok := op.pbft.certStore[msgID{v: preprep.View, n: preprep.SequenceNumber}]; !ok || cert.prePrepare != preprep {
+		// pbft-core rejected this pre-prepare
+		return
+	}
+
+	for _, digest := range preprep.RequestDigests {
+		delete(op.ackedReqs, digest)
+	}
+	for digest := range op.ackedReqs {
+		op.ackedReqs[digest]++
+		logger.Debugf("Replica %d found acknowledged request %s omitted from %d batches", op.pbft.id, digest, op.ackedReqs[digest])
+	}
+	if len(op.ackedReqs) == 0 {
+		op.censorshipTimer.Stop()
+	}
+}
+
 func (op *obcBatch) logAddTxFromRequest(req *Request) {
-	if logger.IsEnabledFor(logging.DEBUG) {
+	if req.Reconfiguration {
+		logger.Debugf("Replica %d adding reconfiguration from %d into outstandingReqs", op.pbft.id, req.ReplicaId)
+	} else if logger.IsEnabledFor(logging.DEBUG) {
 		// This is potentially a very large expensive debug statement, guard
-		tx := &pb.Transaction{}
-		err := proto.Unmarshal(req.Payload, tx)
+		tx, err := op.codec.Decode(req.Payload)
 		if err != nil {
-			logger.Errorf("Replica %d was sent a transaction which did not unmarshal: %s", op.pbft.id, err)
+			logger.Errorf("Replica %d was sent a transaction which did not decode: %s", op.pbft.id, err)
 		} else {
 			logger.Debugf("Replica %d adding request from %d with transaction %s into outstandingReqs", op.pbft.id, req.ReplicaId, tx.Uuid)
 		}
@@ -342,35 +1269,180 @@ func (op *obcBatch) resubmitOutstandingReqs() events.Event {
 	return nil
 }
 
+// queued returns the client requests we hold which are not yet handed to
+// consensus: those buffered for the view change, those of the batch we are
+// assembling and the outstanding ones no batch holds
+func (op *obcBatch) queued() []*Request {
+	reqs := append([]*Request(nil), op.viewChangeBuffer...)
+	reqs = append(reqs, op.batchStore...)
+	return append(reqs, op.reqStore.getNextNonPending(op.reqStore.outstandingRequests.Len())...)
+}
+
+// forget drops queued client requests, they are no longer waited on
+func (op *obcBatch) forget(reqs []*Request) {
+	forgotten := make(map[*Request]bool)
+	for _, req := range reqs {
+		forgotten[req] = true
+		op.reqStore.remove(req)
+		key := op.reqStore.outstandingRequests.keyOf(req)
+		delete(op.arrivals, key)
+		delete(op.ackedReqs, key)
+	}
+	var buffered []*Request
+	for _, req := range op.viewChangeBuffer {
+		if !forgotten[req] {
+			buffered = append(buffered, req)
+		}
+	}
+	op.viewChangeBuffer = buffered
+	var batched, unbatched []*Request
+	for _, req := range op.batchStore {
+		if forgotten[req] {
+			unbatched = append(unbatched, req)
+		} else {
+			batched = append(batched, req)
+		}
+	}
+	if len(unbatched) > 0 {
+		op.batchStore = batched
+		op.persistDelBatchedRequests(unbatched)
+		if len(op.batchStore) == 0 && op.batchTimerActive {
+			op.stopBatchTimer()
+		}
+	}
+
+	op.updateBackpressure()
+	if op.pbft.activeView && !op.reqStore.hasNonPending() && len(op.pbft.outstandingReqBatches) == 0 {
+		// Nothing is left for the timer to wait on
+		op.pbft.stopTimer()
+	}
+	op.armLifetimeTimer()
+}
+
+// DrainRequests runs pbftCore.DrainRequests on the event thread, and returns
+// once the held requests are handed on
+func (op *obcBatch) DrainRequests() {
+	done := make(chan struct{})
+	op.manager.Queue() <- workEvent(func() {
+		op.pbft.DrainRequests()
+		close(done)
+	})
+	<-done
+}
+
 // allow the primary to send a batch when the timer expires
 func (op *obcBatch) ProcessEvent(event events.Event) events.Event {
 	logger.Debugf("Replica %d batch main thread looping", op.pbft.id)
+	defer op.updateViewChangeAdmission()
+	defer op.updateDegradedAdmission()
 	switch et := event.(type) {
 	case batchMessageEvent:
 		ocMsg := et
 		return op.processMessage(ocMsg.msg, ocMsg.sender)
+	case tracedTransactionEvent:
+		req := op.txToReq(et.tx)
+		req.TraceId = et.traceID
+		return op.submitClientReq(req)
+	case signatureFailedEvent:
+		op.pbft.reportFault(et.replica, et.reason)
+	case connectedEvent:
+		if op.pbft.protocolVersion > 0 && et.replica != op.pbft.id {
+			op.pbft.sendHelloTo(et.replica)
+		}
+	case reconfigurationEvent:
+		req := op.txToReq(et.payload)
+		req.Reconfiguration = true
+		return op.submitClientReq(req)
 	case executedEvent:
+		meta := &Metadata{}
+		proto.Unmarshal(et.tag.([]byte), meta)
+		if op.pbft.currentExec == nil || *op.pbft.currentExec != meta.SeqNo {
+			// pbft-core abandoned this execution when it missed its deadline, the rollback is already queued
+			logger.Warningf("Replica %d ignoring late execution of abandoned seqNo=%d", op.pbft.id, meta.SeqNo)
+			return nil
+		}
 		op.stack.Commit(nil, et.tag.([]byte))
+		op.scheduleReconfigurations(meta.SeqNo, op.executingReconfigs)
+		op.executingReconfigs = nil
+		if op.quotas != nil {
+			op.quotas.commit()
+		}
+		if op.digestChain {
+			op.chainHead = meta.BatchDigest
+		}
+	case executionFailedEvent:
+		meta := &Metadata{}
+		proto.Unmarshal(et.tag.([]byte), meta)
+		logger.Warningf("Replica %d execution of seqNo=%d failed: %s", op.pbft.id, meta.SeqNo, et.err)
+		if op.pbft.currentExec == nil || *op.pbft.currentExec != meta.SeqNo {
+			// pbft-core already abandoned this execution
+			return nil
+		}
+		// the stack rolled the batch back, pbft-core retries or abandons it
+		op.awaitingReply = nil
+		op.effectHeld = false
+		op.executingReconfigs = nil
+		return op.pbft.ProcessEvent(execFailedEvent{seqNo: meta.SeqNo, err: et.err})
 	case committedEvent:
 		logger.Debugf("Replica %d received committedEvent", op.pbft.id)
+		op.releaseSideEffect()
+		op.notifyCommitSubs()
+		op.releaseReads()
+		if op.awaitingReply != nil {
+			block, err := op.stack.GetBlock(op.stack.GetBlockchainSize() - 1)
+			if err != nil {
+				logger.Warningf("Replica %d could not retrieve the results of seqNo=%d: %s", op.pbft.id, op.awaitingSeqNo, err)
+				block = &pb.Block{}
+			}
+			op.reply(op.awaitingSeqNo, op.awaitingView, op.awaitingReply.GetBatch(), block)
+			op.awaitingReply = nil
+		}
 		return execDoneEvent{}
 	case execDoneEvent:
-		if res := op.pbft.ProcessEvent(event); res != nil {
+		res := op.pbft.ProcessEvent(event)
+		op.applyReconfigurations()
+		if res != nil {
 			// This may trigger a view change, if so, process it, we will resubmit on new view
 			return res
 		}
 		return op.resubmitOutstandingReqs()
+	case lifetimeTimerEvent:
+		op.dropExpiredRequests()
+	case readTimerEvent:
+		op.expireReads()
 	case batchTimerEvent:
 		logger.Infof("Replica %d batch timer expired", op.pbft.id)
 		if op.pbft.activeView && (len(op.batchStore) > 0) {
 			return op.sendBatch()
 		}
+	case *PrePrepare:
+		res := op.pbft.ProcessEvent(event)
+		op.checkInclusion(et)
+		op.speculate(et)
+		if res == nil {
+			res = op.checkOrderingDelay(et)
+		}
+		return res
+	case censorshipTimerEvent:
+		if len(op.ackedReqs) == 0 || !op.pbft.activeView {
+			return nil
+		}
+		var omitted uint64
+		for _, count := range op.ackedReqs {
+			if count > omitted {
+				omitted = count
+			}
+		}
+		logger.Warningf("Replica %d censorship timer expired: primary %d omitted %d acknowledged requests from up to %d batches, sending view change",
+			op.pbft.id, op.pbft.primary(op.pbft.view), len(op.ackedReqs), omitted)
+		return op.pbft.sendViewChange(ViewChange_CENSORSHIP)
 	case *Commit:
 		// TODO, this is extremely hacky, but should go away when batch and core are merged
 		res := op.pbft.ProcessEvent(event)
 		op.startTimerIfOutstandingRequests()
 		return res
 	case viewChangedEvent:
+		op.persistDelBatchedRequests(op.batchStore)
 		op.batchStore = nil
 		// Outstanding reqs doesn't make sense for batch, as all the requests in a batch may be processed
 		// in a different batch, but PBFT core can't see through the opaque structure to see this
@@ -382,6 +1454,13 @@ func (op *obcBatch) ProcessEvent(event events.Event) events.Event {
 			op.stopBatchTimer()
 		}
 
+		// Acks were promises of the previous primary
+		op.ackedReqs = make(map[string]uint64)
+		op.slowPrimaryCount = 0
+		op.arrivals = make(map[string]time.Time)
+		op.censorshipTimer.Stop()
+		op.updateBackpressure()
+
 		if op.pbft.skipInProgress {
 			// If we're the new primary, but we're in state transfer, we can't trust ourself not to duplicate things
 			op.reqStore.outstandingRequests.empty()
@@ -411,11 +1490,49 @@ func (op *obcBatch) ProcessEvent(event events.Event) events.Event {
 			op.reqStore.storePendings(cert.prePrepare.RequestBatch.GetBatch())
 		}
 
+		// Committed, but deferred until the next checkpoint, these must not be resubmitted either
+		for _, reqBatch := range op.pbft.deferredReqBatches {
+			op.reqStore.storePendings(reqBatch.GetBatch())
+		}
+
+		buffered := op.viewChangeBuffer
+		op.viewChangeBuffer = nil
+		if len(buffered) > 0 {
+			logger.Infof("Replica %d submitting %d client transactions buffered during the view change", op.pbft.id, len(buffered))
+		}
+		for _, req := range buffered {
+			if e := op.submitToLeader(req); e != nil {
+				op.manager.Inject(e)
+			}
+		}
+
 		return op.resubmitOutstandingReqs()
+	case replicaSetConfirmedEvent:
+		// Replay what pbft-core withheld through the batch thread, which intercepts some of its messages
+		for _, withheld := range et.withheld {
+			events.SendEvent(op, withheld)
+		}
 	case stateUpdatedEvent:
 		// When the state is updated, clear any outstanding requests, they may have been processed while we were gone
-		op.reqStore = newRequestStore()
-		return op.pbft.ProcessEvent(event)
+		op.reqStore = op.newRequestStore()
+		op.ackedReqs = make(map[string]uint64)
+		op.arrivals = make(map[string]time.Time)
+		op.censorshipTimer.Stop()
+		op.updateBackpressure()
+		head := op.headMetadata()
+		if op.digestChain {
+			// The transferred blocks carry the chain on from the batches we missed
+			op.chainHead = head.BatchDigest
+		}
+		op.adoptReconfigurations(head)
+		if op.quotas != nil {
+			op.quotas.restore(head)
+		}
+		op.notifyCommitSubs()
+		op.releaseReads()
+		res := op.pbft.ProcessEvent(event)
+		op.applyReconfigurations()
+		return res
 	default:
 		return op.pbft.ProcessEvent(event)
 	}
@@ -469,5 +1586,5 @@ func (op *obcBatch) startTimerIfOutstandingRequests() {
 		logger.Debugf("Replica %d not starting timer because all outstanding requests are pending", op.pbft.id)
 		return
 	}
-	op.pbft.softStartTimer(op.pbft.requestTimeout, "Batch outstanding requests")
+	op.pbft.softStartTimer(op.pbft.effectiveRequestTimeout(), "Batch outstanding requests")
 }
@@ -17,6 +17,14 @@ limitations under the License.
 package pbft
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -24,6 +32,7 @@ import (
 	"github.com/hyperledger/fabric/consensus/util/events"
 	pb "github.com/hyperledger/fabric/protos"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/spf13/viper"
 )
 
@@ -76,6 +85,49 @@ func TestNetworkBatch(t *testing.T) {
 	}
 }
 
+func TestBlockMetadata(t *testing.T) {
+	cut := 0
+	RegisterBlockMetadataSource("test", func(txs []*pb.Transaction) []byte {
+		cut++
+		return []byte(fmt.Sprintf("header %d of %d transactions", cut, len(txs)))
+	})
+	defer delete(blockMetadataSources, "test")
+
+	validatorCount := 4
+	net := makeConsumerNetwork(validatorCount, func(id uint64, config *viper.Viper, stack consensus.Stack) pbftConsumer {
+		config.Set("general.blockmetadata", "test")
+		return newObcBatch(id, config, stack)
+	}, func(ce *consumerEndpoint) {
+		ce.consumer.(*obcBatch).batchSize = 2
+	})
+	defer net.stop()
+
+	broadcaster := net.endpoints[generateBroadcaster(validatorCount)].getHandle()
+	net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(1), broadcaster)
+	net.endpoints[2].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(2), broadcaster)
+	net.process()
+
+	for _, ep := range net.endpoints {
+		ce := ep.(*consumerEndpoint)
+		block, err := ce.consumer.(*obcBatch).stack.GetBlock(1)
+		if err != nil {
+			t.Fatalf("Replica %d could not retrieve the committed block: %s", ce.id, err)
+		}
+		meta := &Metadata{}
+		proto.Unmarshal(block.ConsensusMetadata, meta)
+		if string(meta.BlockMetadata) != "header 1 of 2 transactions" {
+			t.Errorf("Replica %d committed block metadata %q, expected the primary's", ce.id, meta.BlockMetadata)
+		}
+	}
+
+	reqBatch := &RequestBatch{Batch: []*Request{createPbftReq(1, 0)}}
+	digest := hash(reqBatch)
+	reqBatch.Metadata = []byte("header")
+	if hash(reqBatch) == digest {
+		t.Errorf("Expected the block metadata to be covered by the batch digest")
+	}
+}
+
 func TestClearOustandingReqsOnStateRecovery(t *testing.T) {
 	b := newObcBatch(0, loadConfig(), &omniProto{})
 	defer b.Close()
@@ -360,3 +412,2188 @@ func TestClearBatchStoreOnViewChange(t *testing.T) {
 		t.Fatalf("Should have cleared the batch store on view change")
 	}
 }
+
+func TestEmptyRequest(t *testing.T) {
+	b := newObcBatch(0, loadConfig(), &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+	})
+	defer b.Close()
+
+	if err := b.RecvMsg(&pb.Message{Type: pb.Message_CHAIN_TRANSACTION}, &pb.PeerID{Name: "vp0"}); err != errEmptyRequest {
+		t.Errorf("Expected a transaction with an empty payload to be rejected, got %v", err)
+	}
+
+	// Nor does the primary order an empty request another replica forwards
+	req := createPbftReq(1, 1)
+	req.Payload = nil
+	payload, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_Request{Request: req}})
+	b.manager.Queue() <- batchMessageEvent{&pb.Message{Type: pb.Message_CONSENSUS, Payload: payload}, &pb.PeerID{Name: "vp1"}}
+	b.manager.Queue() <- workEvent(func() {
+		if b.reqStore.outstandingRequests.Len() != 0 || len(b.batchStore) != 0 {
+			t.Errorf("Forwarded empty request should have been ignored")
+		}
+	})
+	b.manager.Queue() <- nil
+}
+
+// tokenAuthenticator accepts the transactions signed with the token
+type tokenAuthenticator []byte
+
+func (token tokenAuthenticator) Authenticate(payload []byte) error {
+	tx := &pb.Transaction{}
+	if err := proto.Unmarshal(payload, tx); err != nil {
+		return err
+	}
+	if !bytes.Equal(tx.Signature, token) {
+		return fmt.Errorf("invalid token")
+	}
+	return nil
+}
+
+func TestRequestAuthentication(t *testing.T) {
+	RegisterRequestAuthenticator("test", tokenAuthenticator("token"))
+	defer delete(requestAuthenticators, "test")
+
+	config := loadConfig()
+	config.Set("general.requestauth", "test")
+	b := newObcBatch(0, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+	})
+	defer b.Close()
+
+	signedTx := func(tag int64, token string) []byte {
+		tx := createTx(tag)
+		tx.Signature = []byte(token)
+		return marshalTx(tx)
+	}
+
+	if err := b.RecvMsg(&pb.Message{Type: pb.Message_CHAIN_TRANSACTION, Payload: signedTx(1, "forged")}, &pb.PeerID{Name: "vp0"}); err == nil {
+		t.Errorf("Expected a transaction with an invalid token to be rejected")
+	}
+
+	// Nor does the primary order an unauthenticated request another replica forwards
+	req := createPbftReq(2, 1)
+	req.Payload = signedTx(2, "forged")
+	payload, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_Request{Request: req}})
+	b.manager.Queue() <- batchMessageEvent{&pb.Message{Type: pb.Message_CONSENSUS, Payload: payload}, &pb.PeerID{Name: "vp1"}}
+	b.manager.Queue() <- workEvent(func() {
+		if b.reqStore.outstandingRequests.Len() != 0 || len(b.batchStore) != 0 {
+			t.Errorf("Forwarded unauthenticated request should have been ignored")
+		}
+	})
+	b.manager.Queue() <- nil
+
+	if err := b.RecvMsg(&pb.Message{Type: pb.Message_CHAIN_TRANSACTION, Payload: signedTx(3, "token")}, &pb.PeerID{Name: "vp0"}); err != nil {
+		t.Errorf("Expected a transaction with a valid token to be admitted, got %v", err)
+	}
+	b.manager.Queue() <- workEvent(func() {
+		if len(b.batchStore) != 1 {
+			t.Errorf("Expected the authenticated request to be queued for ordering, batch store holds %d", len(b.batchStore))
+		}
+	})
+	b.manager.Queue() <- nil
+}
+
+func TestAdmissionPipeline(t *testing.T) {
+	// Strip the client signature, once the request is admitted it is no longer needed
+	RegisterRequestTransformer("strip", func(req *Request) *Request {
+		tx := &pb.Transaction{}
+		proto.Unmarshal(req.Payload, tx)
+		tx.Signature = nil
+		stripped := *req
+		stripped.Payload, _ = proto.Marshal(tx)
+		return &stripped
+	})
+	defer delete(requestTransformers, "strip")
+
+	validatorCount := 4
+	net := makeConsumerNetwork(validatorCount, func(id uint64, config *viper.Viper, stack consensus.Stack) pbftConsumer {
+		config.Set("general.batchsize", 1)
+		config.Set("general.admission", "strip")
+		return newObcBatch(id, config, stack)
+	})
+	defer net.stop()
+
+	tx := createTx(1)
+	tx.Signature = []byte("client")
+	broadcaster := net.endpoints[generateBroadcaster(validatorCount)].getHandle()
+	net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(&pb.Message{Type: pb.Message_CHAIN_TRANSACTION, Payload: marshalTx(tx)}, broadcaster)
+	net.process()
+
+	for i, ep := range net.endpoints {
+		obc := ep.(*consumerEndpoint).consumer.(*obcBatch)
+		block, err := obc.stack.GetBlock(1)
+		if err != nil {
+			t.Fatalf("Replica %d could not retrieve block 1: %s", i, err)
+		}
+		if len(block.Transactions) != 1 || len(block.Transactions[0].Signature) != 0 {
+			t.Errorf("Expected replica %d to commit the transformed transaction, got %v", i, block.Transactions)
+		}
+		if n := obc.reqStore.outstandingRequests.Len(); n != 0 {
+			t.Errorf("Expected replica %d to hold no outstanding requests once the transformed request executed, has %d", i, n)
+		}
+	}
+}
+
+func TestDedupClientCopies(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		config := loadConfig()
+		config.Set("general.batchsize", 1)
+		config.Set("general.dedupcopies", dedup)
+		b := newObcBatch(0, config, &omniProto{
+			UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		})
+
+		// The client submits to the primary directly, and to replicas 1 and 2 which forward it
+		b.RecvMsg(createTxMsg(1), &pb.PeerID{Name: "vp0"})
+		for _, replica := range []uint64{1, 2} {
+			req := createPbftReq(1, replica)
+			req.Timestamp.Nanos = int32(replica)
+			payload, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_Request{Request: req}})
+			b.manager.Queue() <- batchMessageEvent{&pb.Message{Type: pb.Message_CONSENSUS, Payload: payload}, &pb.PeerID{Name: fmt.Sprintf("vp%d", replica)}}
+		}
+		b.manager.Queue() <- nil
+
+		expected := uint64(3)
+		if dedup {
+			expected = 1
+		}
+		if b.pbft.seqNo != expected {
+			t.Errorf("Expected %d orderings of the client transaction with deduplication %v, got %d", expected, dedup, b.pbft.seqNo)
+		}
+		b.Close()
+	}
+}
+
+func TestBatchTimerSkipsEmptyBatch(t *testing.T) {
+	b := newObcBatch(0, loadConfig(), &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error {
+			t.Errorf("Expected nothing to be sent for an empty batch")
+			return nil
+		},
+	})
+	defer b.Close()
+
+	b.manager.Queue() <- batchTimerEvent{}
+	// An empty batch arriving from the network does not take a sequence number either
+	b.manager.Queue() <- &RequestBatch{}
+	b.manager.Queue() <- workEvent(func() {
+		if b.pbft.seqNo != 0 || len(b.pbft.reqBatchStore) != 0 {
+			t.Errorf("Empty batch was assigned sequence number %d", b.pbft.seqNo)
+		}
+	})
+	b.manager.Queue() <- nil
+}
+
+func TestCensorshipTimer(t *testing.T) {
+	for _, include := range []bool{false, true} {
+		config := loadConfig()
+		config.Set("general.inclusionproof", true)
+		config.Set("general.timeout.censorship", "100ms")
+		b := newObcBatch(1, config, &omniProto{
+			UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+			SignImpl:    func(msg []byte) ([]byte, error) { return msg, nil },
+			VerifyImpl:  func(peerID *pb.PeerID, signature []byte, message []byte) error { return nil },
+		})
+		b.pbft.requestTimeout = 10 * time.Second
+		defer b.Close()
+		timer := &activeTimer{}
+		b.manager.Queue() <- workEvent(func() {
+			b.censorshipTimer.Halt()
+			b.censorshipTimer = timer
+		})
+
+		// Forward a request to the primary, which acknowledges it
+		b.manager.Queue() <- batchMessageEvent{createTxMsg(1), &pb.PeerID{Name: "vp0"}}
+		b.manager.Queue() <- nil
+		req := b.reqStore.getNextNonPending(1)[0]
+		digest := hash(req)
+		ackPayload, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_RequestAck{RequestAck: &RequestAck{
+			View:          0,
+			RequestDigest: digest,
+			ReplicaId:     0,
+		}}})
+		b.manager.Queue() <- batchMessageEvent{&pb.Message{Type: pb.Message_CONSENSUS, Payload: ackPayload}, &pb.PeerID{Name: "vp0"}}
+
+		// The primary orders batches of other requests, and the acknowledged one only if told to
+		for n := uint64(1); n <= 2; n++ {
+			batch := &RequestBatch{Batch: []*Request{createPbftReq(int64(n+1), 0)}}
+			if include && n == 2 {
+				batch.Batch = append(batch.Batch, req)
+			}
+			preprep := &PrePrepare{
+				View:           0,
+				SequenceNumber: n,
+				BatchDigest:    hash(batch),
+				RequestBatch:   batch,
+				ReplicaId:      0,
+			}
+			for _, r := range batch.Batch {
+				preprep.RequestDigests = append(preprep.RequestDigests, hash(r))
+			}
+			b.manager.Queue() <- pbftMessageEvent{msg: &Message{Payload: &Message_PrePrepare{PrePrepare: preprep}}, sender: 0}
+		}
+		b.manager.Queue() <- nil
+
+		if include {
+			if len(b.ackedReqs) != 0 {
+				t.Errorf("Expected included request to no longer be tracked, found %v", b.ackedReqs)
+			}
+		} else if count := b.ackedReqs[digest]; count != 2 {
+			t.Errorf("Expected acknowledged request to be omitted from 2 batches, got %d", count)
+		}
+
+		if timer.active == include || (!include && timer.duration != 100*time.Millisecond) {
+			t.Errorf("Expected the censorship timer to run only while the acknowledged request is omitted, active %v for %v", timer.active, timer.duration)
+		}
+
+		// Expire the timer, which only acts while a request is still omitted
+		b.manager.Queue() <- censorshipTimerEvent{}
+		b.manager.Queue() <- nil
+
+		if include && !b.pbft.activeView {
+			t.Errorf("Censorship timer fired although the acknowledged request was included")
+		}
+		if !include && b.pbft.activeView {
+			t.Errorf("Censorship timer should have fired and caused a view change")
+		}
+	}
+}
+
+func TestSlowPrimaryViewChange(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		config := loadConfig()
+		config.Set("general.slowprimary.batches", 2)
+		if enabled {
+			config.Set("general.slowprimary.factor", 4)
+		}
+		b := newObcBatch(1, config, &omniProto{
+			UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+			SignImpl:    func(msg []byte) ([]byte, error) { return msg, nil },
+			VerifyImpl:  func(peerID *pb.PeerID, signature []byte, message []byte) error { return nil },
+		})
+		b.pbft.requestTimeout = 10 * time.Second
+		b.pbft.commitLatency = 10 * time.Millisecond
+		clock := time.Unix(1000, 0)
+		b.pbft.now = func() time.Time { return clock }
+
+		// The primary pre-prepares each forwarded request a second after the batch timeout
+		for n := uint64(1); n <= 2; n++ {
+			req := createPbftReq(int64(n), 2)
+			payload, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_Request{Request: req}})
+			b.manager.Queue() <- batchMessageEvent{&pb.Message{Type: pb.Message_CONSENSUS, Payload: payload}, &pb.PeerID{Name: "vp2"}}
+			b.manager.Queue() <- workEvent(func() { clock = clock.Add(b.batchTimeout + time.Second) })
+
+			batch := &RequestBatch{Batch: []*Request{req}}
+			preprep := &PrePrepare{
+				View:           0,
+				SequenceNumber: n,
+				BatchDigest:    hash(batch),
+				RequestBatch:   batch,
+				ReplicaId:      0,
+			}
+			b.manager.Queue() <- pbftMessageEvent{msg: &Message{Payload: &Message_PrePrepare{PrePrepare: preprep}}, sender: 0}
+		}
+		b.manager.Queue() <- nil
+
+		if enabled && (b.pbft.activeView || b.pbft.viewChangeReasons[ViewChange_SLOW_PRIMARY] != 1) {
+			t.Errorf("Expected the slow primary to cause a performance view change")
+		}
+		if !enabled && !b.pbft.activeView {
+			t.Errorf("Slow primary caused a view change with performance view changes disabled")
+		}
+		b.Close()
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.flowcontrol.highwater", 3)
+	config.Set("general.flowcontrol.lowwater", 1)
+	b := newObcBatch(0, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		ExecuteImpl: func(tag interface{}, txs []*pb.Transaction) {},
+	})
+	defer b.Close()
+
+	// Fill the primary's queue past the high-water mark
+	for i := int64(1); i <= 4; i++ {
+		if err := b.RecvMsg(createTxMsg(i), &pb.PeerID{Name: "vp0"}); err != nil {
+			t.Fatalf("Transaction %d was rejected below the high-water mark: %v", i, err)
+		}
+	}
+	b.manager.Queue() <- nil
+
+	if err := b.RecvMsg(createTxMsg(5), &pb.PeerID{Name: "vp0"}); err != errBackpressure {
+		t.Fatalf("Expected backpressure signal above the high-water mark, got %v", err)
+	}
+
+	// Drain the queue by executing everything outstanding
+	b.manager.Queue() <- workEvent(func() {
+		var reqs []*Request
+		for e := b.reqStore.outstandingRequests.order.Front(); e != nil; e = e.Next() {
+			reqs = append(reqs, e.Value.(requestContainer).req)
+		}
+		b.execute(1, &RequestBatch{Batch: reqs})
+	})
+	b.manager.Queue() <- nil
+
+	if err := b.RecvMsg(createTxMsg(6), &pb.PeerID{Name: "vp0"}); err != nil {
+		t.Fatalf("Expected backpressure to clear after draining, got %v", err)
+	}
+}
+
+func TestBackpressureBytes(t *testing.T) {
+	size := len(createTxMsg(1).Payload)
+	config := loadConfig()
+	config.Set("general.flowcontrol.maxbytes", 8*size)
+	b := newObcBatch(0, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		ExecuteImpl: func(tag interface{}, txs []*pb.Transaction) {},
+	})
+	defer b.Close()
+
+	// Fill the global limit with small transactions, as if from many clients
+	for i := int64(1); i <= 8; i++ {
+		if err := b.RecvMsg(createTxMsg(i), &pb.PeerID{Name: "vp0"}); err != nil {
+			t.Fatalf("Transaction %d was rejected below the byte limit: %v", i, err)
+		}
+		b.manager.Queue() <- nil
+	}
+
+	for i := int64(9); i <= 10; i++ {
+		if err := b.RecvMsg(createTxMsg(i), &pb.PeerID{Name: "vp0"}); err != errBackpressure {
+			t.Fatalf("Expected backpressure signal at the byte limit, got %v", err)
+		}
+	}
+
+	// Drain the queue by executing everything outstanding
+	b.manager.Queue() <- workEvent(func() {
+		var reqs []*Request
+		for e := b.reqStore.outstandingRequests.order.Front(); e != nil; e = e.Next() {
+			reqs = append(reqs, e.Value.(requestContainer).req)
+		}
+		b.execute(1, &RequestBatch{Batch: reqs})
+		if bytes := b.reqStore.outstandingRequests.Bytes(); bytes != 0 {
+			t.Errorf("Expected no outstanding request bytes after draining, %d remain", bytes)
+		}
+	})
+	b.manager.Queue() <- nil
+
+	if err := b.RecvMsg(createTxMsg(9), &pb.PeerID{Name: "vp0"}); err != nil {
+		t.Fatalf("Expected backpressure to clear after draining, got %v", err)
+	}
+}
+
+func TestViewChangeRequests(t *testing.T) {
+	for _, mode := range []string{"buffer", "reject"} {
+		config := loadConfig()
+		config.Set("general.viewchangerequests.mode", mode)
+		config.Set("general.viewchangerequests.maxbuffered", 2)
+		var lock sync.Mutex
+		forwarded := make(map[string]bool)
+		b := newObcBatch(1, config, &omniProto{
+			UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error {
+				batchMsg := &BatchMessage{}
+				proto.Unmarshal(ocMsg.Payload, batchMsg)
+				if req := batchMsg.GetRequest(); req != nil {
+					lock.Lock()
+					forwarded[string(req.Payload)] = true
+					lock.Unlock()
+				}
+				return nil
+			},
+			SignImpl:   func(msg []byte) ([]byte, error) { return msg, nil },
+			VerifyImpl: func(peerID *pb.PeerID, signature []byte, message []byte) error { return nil },
+		})
+		b.pbft.requestTimeout = 10 * time.Second
+		defer b.Close()
+
+		b.manager.Queue() <- workEvent(func() { b.pbft.sendViewChange(ViewChange_MANUAL) })
+		b.manager.Queue() <- nil
+
+		var admitted []int64
+		for i := int64(1); i <= 3; i++ {
+			err := b.RecvMsg(createTxMsg(i), &pb.PeerID{Name: "vp1"})
+			b.manager.Queue() <- nil
+			if mode == "reject" || i == 3 {
+				if err != errViewChange {
+					t.Errorf("Mode %s: expected transaction %d to be turned away during the view change, got %v", mode, i, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("Mode %s: expected transaction %d to be buffered during the view change, got %v", mode, i, err)
+			}
+			admitted = append(admitted, i)
+		}
+		b.manager.Queue() <- workEvent(func() {
+			if len(forwarded) != 0 || b.reqStore.outstandingRequests.Len() != 0 {
+				t.Errorf("Mode %s: requests should not be submitted during the view change", mode)
+			}
+		})
+
+		// Install the new view
+		b.manager.Queue() <- workEvent(func() {
+			b.pbft.view = 1
+			b.pbft.activeView = true
+		})
+		b.manager.Queue() <- viewChangedEvent{}
+		b.manager.Queue() <- nil
+
+		b.manager.Queue() <- workEvent(func() {
+			if len(forwarded) != len(admitted) || b.reqStore.outstandingRequests.Len() != len(admitted) {
+				t.Errorf("Mode %s: expected transactions %v submitted after the new view, %d were", mode, admitted, len(forwarded))
+			}
+			for _, i := range admitted {
+				if !forwarded[string(createTxMsg(i).Payload)] {
+					t.Errorf("Mode %s: buffered transaction %d was not submitted after the new view", mode, i)
+				}
+			}
+		})
+		b.manager.Queue() <- nil
+		if err := b.RecvMsg(createTxMsg(4), &pb.PeerID{Name: "vp1"}); err != nil {
+			t.Errorf("Mode %s: expected transactions to be admitted in the new view, got %v", mode, err)
+		}
+	}
+}
+
+func TestRequestForwarding(t *testing.T) {
+	for _, mode := range []string{"optimistic", "pessimistic"} {
+		config := loadConfig()
+		config.Set("general.forwarding", mode)
+		config.Set("general.batchsize", 10)
+		forwarded := make(chan *Request, 10)
+		newReplica := func(id uint64) *obcBatch {
+			return newObcBatch(id, config, &omniProto{
+				UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error {
+					batchMsg := &BatchMessage{}
+					proto.Unmarshal(ocMsg.Payload, batchMsg)
+					if req := batchMsg.GetRequest(); req != nil && peer.Name == "vp0" {
+						forwarded <- req
+					}
+					return nil
+				},
+			})
+		}
+		backup := newReplica(1)
+		defer backup.Close()
+		primary := newReplica(0)
+		defer primary.Close()
+
+		// The client retransmits its request to the backup
+		req := createPbftReq(1, 1)
+		for i := 0; i < 2; i++ {
+			backup.manager.Queue() <- workEvent(func() { backup.submitToLeader(req) })
+		}
+		backup.manager.Queue() <- nil
+
+		expected := 1
+		if mode == "optimistic" {
+			expected = 2
+		}
+		for i := 0; i < expected; i++ {
+			select {
+			case fwd := <-forwarded:
+				payload, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_Request{Request: fwd}})
+				primary.manager.Queue() <- workEvent(func() {
+					primary.processMessage(&pb.Message{Type: pb.Message_CONSENSUS, Payload: payload}, &pb.PeerID{Name: "vp1"})
+				})
+			case <-time.After(time.Second):
+				t.Fatalf("Mode %s: expected the request to be forwarded %d times, only was %d", mode, expected, i)
+			}
+		}
+		select {
+		case <-forwarded:
+			t.Errorf("Mode %s: request forwarded more than %d times", mode, expected)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		primary.manager.Queue() <- nil
+		primary.manager.Queue() <- workEvent(func() {
+			if len(primary.batchStore) != 1 {
+				t.Errorf("Mode %s: expected the primary to queue the request once, queued %d", mode, len(primary.batchStore))
+			}
+		})
+		primary.manager.Queue() <- nil
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.batchsize", 2)
+	config.Set("general.priority.tags", systemTag)
+	config.Set("chaincode.system", map[string]string{"lscc": "enable"})
+	b := newObcBatch(0, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+	})
+	defer b.Close()
+
+	// The requests queue up during a view change, the system request last,
+	// behind one which claims the system tag without invoking a system chaincode
+	b.manager.Queue() <- workEvent(func() {
+		for i := 0; i < 5; i++ {
+			b.reqStore.storeOutstanding(createPbftReq(int64(i), 1))
+		}
+		forged := createPbftReq(5, 1)
+		forged.Tag = systemTag
+		b.reqStore.storeOutstanding(forged)
+		tx := createTx(6)
+		tx.ChaincodeID, _ = proto.Marshal(&pb.ChaincodeID{Name: "lscc"})
+		system := createPbftReq(6, 1)
+		system.Payload = marshalTx(tx)
+		b.reqStore.storeOutstanding(system)
+		b.resubmitOutstandingReqs()
+	})
+	b.manager.Queue() <- nil
+
+	b.manager.Queue() <- workEvent(func() {
+		cert := b.pbft.certStore[msgID{v: 0, n: 1}]
+		if cert == nil || cert.prePrepare == nil {
+			t.Fatalf("Expected the primary to pre-prepare the first batch")
+		}
+		if batch := cert.prePrepare.RequestBatch.GetBatch(); b.requestTag(batch[0].Payload) != systemTag || batch[1].Tag == systemTag {
+			t.Errorf("Expected only the system request to be batched ahead of the others, got %v", batch)
+		}
+	})
+	b.manager.Queue() <- nil
+}
+
+func TestMonotonicTimestamps(t *testing.T) {
+	for _, enforce := range []bool{false, true} {
+		config := loadConfig()
+		config.Set("general.monotonictimestamps", enforce)
+		b := newObcBatch(0, config, &omniProto{
+			UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		})
+		defer b.Close()
+
+		for _, req := range []*Request{
+			createPbftReq(2, 1),
+			createPbftReq(1, 1), // out of order
+			createPbftReq(time.Now().Add(time.Hour).Unix(), 1), // too far in the future
+		} {
+			payload, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_Request{Request: req}})
+			b.manager.Queue() <- batchMessageEvent{&pb.Message{Type: pb.Message_CONSENSUS, Payload: payload}, &pb.PeerID{Name: "vp1"}}
+		}
+		b.manager.Queue() <- nil
+
+		expected := 3
+		if enforce {
+			expected = 1
+		}
+		if l := b.reqStore.outstandingRequests.Len(); l != expected {
+			t.Errorf("With timestamp enforcement %v, expected %d outstanding requests, got %d", enforce, expected, l)
+		}
+		if !enforce {
+			continue
+		}
+
+		// Checking a request leaves no trace, only admitting it raises the bar
+		retry := createPbftReq(3, 1)
+		b.manager.Queue() <- workEvent(func() {
+			if !b.timestampValid(retry) || !b.timestampValid(retry) {
+				t.Errorf("Expected a request to stay valid until admitted")
+			}
+		})
+		payload, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_Request{Request: retry}})
+		b.manager.Queue() <- batchMessageEvent{&pb.Message{Type: pb.Message_CONSENSUS, Payload: payload}, &pb.PeerID{Name: "vp1"}}
+		b.manager.Queue() <- workEvent(func() {
+			if b.timestampValid(createPbftReq(3, 1)) {
+				t.Errorf("Expected the timestamp of the admitted request to be recorded")
+			}
+		})
+		b.manager.Queue() <- nil
+	}
+}
+
+func TestTimestampSkewTolerance(t *testing.T) {
+	for _, tc := range []struct {
+		skew   time.Duration
+		accept bool
+	}{
+		{900 * time.Millisecond, true},
+		{1100 * time.Millisecond, false},
+	} {
+		validatorCount := 4
+		// The clock of replica 1, which stamps the client transaction, runs ahead
+		net := makeConsumerNetwork(validatorCount, func(id uint64, config *viper.Viper, stack consensus.Stack) pbftConsumer {
+			config.Set("general.batchsize", 1)
+			config.Set("general.monotonictimestamps", true)
+			config.Set("general.timestampskew", "1s")
+			return newObcBatch(id, config, stack)
+		}, skewClocks(0, tc.skew))
+
+		broadcaster := net.endpoints[generateBroadcaster(validatorCount)].getHandle()
+		net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(1), broadcaster)
+		net.process()
+
+		_, err := net.endpoints[0].(*consumerEndpoint).consumer.(*obcBatch).stack.GetBlock(1)
+		if accepted := err == nil; accepted != tc.accept {
+			t.Errorf("Request stamped %v ahead with a tolerance of 1s, expected accepted %v, got %v", tc.skew, tc.accept, accepted)
+		}
+		net.stop()
+	}
+}
+
+func TestVerifyWorkers(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.verifyworkers", 2)
+	b := newObcBatch(1, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		VerifyImpl: func(peerID *pb.PeerID, signature []byte, message []byte) error {
+			if string(signature) == "bad" {
+				return fmt.Errorf("bad signature")
+			}
+			return nil
+		},
+	})
+	defer b.Close()
+
+	for i, sig := range []string{"bad", "good"} {
+		vc := &ViewChange{View: 1, ReplicaId: uint64(i + 2), Signature: []byte(sig)}
+		pbftMsg, _ := proto.Marshal(&Message{Payload: &Message_ViewChange{ViewChange: vc}})
+		batchMsg, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_PbftMessage{PbftMessage: pbftMsg}})
+		b.RecvMsg(&pb.Message{Type: pb.Message_CONSENSUS, Payload: batchMsg}, &pb.PeerID{Name: fmt.Sprintf("vp%d", i+2)})
+	}
+	b.verifier.stop() // waits for verified messages to be queued
+	b.manager.Queue() <- nil
+
+	b.manager.Queue() <- workEvent(func() {
+		if _, ok := b.pbft.viewChangeStore[vcidx{1, 2}]; ok {
+			t.Errorf("View-change with a bad signature was accepted")
+		}
+		if _, ok := b.pbft.viewChangeStore[vcidx{1, 3}]; !ok {
+			t.Errorf("View-change verified by the workers was not accepted")
+		}
+		if b.pbft.misbehavior[2] != 1 || b.pbft.misbehavior[3] != 0 {
+			t.Errorf("Expected the bad signature of replica 2 to be reported, misbehavior scores %v", b.pbft.misbehavior)
+		}
+	})
+	b.manager.Queue() <- nil
+}
+
+// The workers verify while the event thread processes the verified messages,
+// run with -race to check they share no state
+func TestVerifyWorkersConcurrentWithEventThread(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.verifyworkers", 4)
+	b := newObcBatch(1, config, &omniProto{
+		UnicastImpl:   func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		BroadcastImpl: func(msg *pb.Message, peerType pb.PeerEndpoint_Type) error { return nil },
+		SignImpl:      func(msg []byte) ([]byte, error) { return msg, nil },
+		VerifyImpl: func(peerID *pb.PeerID, signature []byte, message []byte) error {
+			if string(signature) == "bad" {
+				return fmt.Errorf("bad signature")
+			}
+			return nil
+		},
+	})
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	for replica := uint64(2); replica <= 3; replica++ {
+		wg.Add(1)
+		go func(replica uint64) {
+			defer wg.Done()
+			for view := uint64(1); view <= 20; view++ {
+				sig := "good"
+				if replica == 2 && view%2 == 0 {
+					sig = "bad"
+				}
+				vc := &ViewChange{View: view, ReplicaId: replica, Signature: []byte(sig)}
+				pbftMsg, _ := proto.Marshal(&Message{Payload: &Message_ViewChange{ViewChange: vc}})
+				batchMsg, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_PbftMessage{PbftMessage: pbftMsg}})
+				b.RecvMsg(&pb.Message{Type: pb.Message_CONSENSUS, Payload: batchMsg}, &pb.PeerID{Name: fmt.Sprintf("vp%d", replica)})
+			}
+		}(replica)
+	}
+	wg.Wait()
+	b.verifier.stop()
+	b.manager.Queue() <- nil
+
+	b.manager.Queue() <- workEvent(func() {
+		if b.pbft.misbehavior[2] != 10 {
+			t.Errorf("Expected the 10 bad signatures of replica 2 to be reported, misbehavior score %d", b.pbft.misbehavior[2])
+		}
+	})
+	b.manager.Queue() <- nil
+}
+
+func TestReplyCacheRestart(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.replycache.size", 10)
+	config.Set("general.replycache.persistinterval", 1)
+	persist := &mockPersist{}
+	stack := &omniProto{
+		UnicastImpl:      func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		ExecuteImpl:      func(tag interface{}, txs []*pb.Transaction) {},
+		StoreStateImpl:   persist.StoreState,
+		DelStateImpl:     persist.DelState,
+		ReadStateImpl:    persist.ReadState,
+		ReadStateSetImpl: persist.ReadStateSet,
+	}
+	b := newObcBatch(1, config, stack)
+	b.manager.Queue() <- workEvent(func() {
+		b.execute(1, &RequestBatch{Batch: []*Request{createPbftReq(1, 0)}})
+	})
+	b.manager.Queue() <- nil
+	b.Close()
+
+	b = newObcBatch(1, config, stack)
+	defer b.Close()
+	// The client retransmits the transaction, which yields a request with a fresh timestamp
+	b.RecvMsg(createTxMsg(1), &pb.PeerID{Name: "vp1"})
+	b.manager.Queue() <- nil
+
+	b.manager.Queue() <- workEvent(func() {
+		if _, ok := b.replyCache.get(createPbftReq(1, 0)); !ok {
+			t.Errorf("Expected cached reply to survive the restart")
+		}
+		if b.reqStore.outstandingRequests.Len() != 0 {
+			t.Errorf("Retransmitted request was queued for ordering again")
+		}
+	})
+	b.manager.Queue() <- nil
+}
+
+// TestReplyModes checks that replies go out once a request is ordered, or
+// only once its batch is committed, in which case they carry its result
+func TestReplyModes(t *testing.T) {
+	tx := createTx(1)
+	tx.Uuid = "reply"
+	req := &Request{Timestamp: tx.Timestamp, ReplicaId: 1, Payload: marshalTx(tx)}
+	rawResult, _ := proto.Marshal(&pb.TransactionResult{Uuid: "reply"})
+
+	for _, mode := range []string{"commit", "execute"} {
+		config := loadConfig()
+		config.Set("general.replymode", mode)
+		b := newObcBatch(1, config, &omniProto{
+			ExecuteImpl:           func(tag interface{}, txs []*pb.Transaction) {},
+			GetBlockchainSizeImpl: func() uint64 { return 2 },
+			GetBlockImpl: func(id uint64) (*pb.Block, error) {
+				if id != 1 {
+					return nil, fmt.Errorf("Block %d not found", id)
+				}
+				return &pb.Block{Transactions: []*pb.Transaction{tx}}, nil
+			},
+		})
+		var replies []*Reply
+		b.manager.Queue() <- workEvent(func() {
+			b.onReply = func(r *Request, reply *Reply) {
+				replies = append(replies, reply)
+			}
+			seqNo := uint64(1)
+			b.pbft.currentExec = &seqNo
+			b.execute(seqNo, &RequestBatch{Batch: []*Request{req, createPbftReq(2, 0)}})
+		})
+		b.manager.Queue() <- workEvent(func() {
+			if mode == "execute" {
+				if len(replies) != 0 {
+					t.Errorf("Mode %s replied before the batch was committed: %v", mode, replies)
+				}
+				return
+			}
+			if len(replies) != 1 || replies[0].SeqNo != 1 || replies[0].Executed || replies[0].Result != nil {
+				t.Errorf("Mode %s expected a single acceptance reply at ordering, got %v", mode, replies)
+			}
+		})
+		b.manager.Queue() <- committedEvent{}
+		b.manager.Queue() <- workEvent(func() {
+			if len(replies) != 1 {
+				t.Errorf("Mode %s expected a single reply to our client's request, got %v", mode, replies)
+				return
+			}
+			if mode == "execute" && (!replies[0].Executed || !reflect.DeepEqual(replies[0].Result, rawResult)) {
+				t.Errorf("Mode %s expected the reply to carry the transaction result, got %v", mode, replies[0])
+			}
+		})
+		b.manager.Queue() <- nil
+		b.Close()
+	}
+}
+
+func TestSignedReplies(t *testing.T) {
+	sig := func(id uint64, msg []byte) []byte { return append([]byte(fmt.Sprintf("vp%d:", id)), msg...) }
+	verify := func(id uint64, signature []byte, msg []byte) error {
+		if !reflect.DeepEqual(signature, sig(id, msg)) {
+			return fmt.Errorf("bad signature")
+		}
+		return nil
+	}
+
+	req := createPbftReq(1, 1)
+	digest := hash(req)
+	var replies []*Reply
+	for id := uint64(0); id < 4; id++ {
+		config := loadConfig()
+		config.Set("general.signreplies", true)
+		config.Set("general.replycache.size", 10)
+		replicaID := id
+		b := newObcBatch(id, config, &omniProto{
+			ExecuteImpl: func(tag interface{}, txs []*pb.Transaction) {},
+			SignImpl:    func(msg []byte) ([]byte, error) { return sig(replicaID, msg), nil },
+		})
+		b.manager.Queue() <- workEvent(func() {
+			seqNo := uint64(1)
+			b.pbft.currentExec = &seqNo
+			b.execute(seqNo, &RequestBatch{Batch: []*Request{req}})
+			raw, _ := b.replyCache.get(req)
+			reply := &Reply{}
+			proto.Unmarshal(raw, reply)
+			replies = append(replies, reply)
+		})
+		b.manager.Queue() <- nil
+		b.Close()
+	}
+
+	f := 1
+	if reply, err := VerifySignedReplies(replies[:f+1], digest, f, verify); err != nil || reply.SeqNo != 1 {
+		t.Errorf("Expected f+1 signed replies to prove the request ordered at seqNo 1, got %v (%v)", reply, err)
+	}
+	if _, err := VerifySignedReplies([]*Reply{replies[0], replies[0]}, digest, f, verify); err == nil {
+		t.Errorf("Expected the same replica's reply twice not to count as a proof")
+	}
+
+	forged := *replies[1]
+	forged.SeqNo = 2
+	if _, err := VerifySignedReplies([]*Reply{replies[0], &forged}, digest, f, verify); err == nil {
+		t.Errorf("Expected a reply altered after signing not to count towards the proof")
+	}
+	if _, err := VerifySignedReplies([]*Reply{replies[0], &forged, replies[2]}, digest, f, verify); err != nil {
+		t.Errorf("Expected f+1 matching replies to prove the request despite a forged one: %v", err)
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(payload []byte) (*pb.Transaction, error) {
+	tx := &pb.Transaction{}
+	if err := json.Unmarshal(payload, tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func TestPayloadCodec(t *testing.T) {
+	RegisterPayloadCodec("json", jsonCodec{})
+	config := loadConfig()
+	config.Set("general.payloadcodec", "json")
+	var executed []*pb.Transaction
+	b := newObcBatch(0, config, &omniProto{
+		ExecuteImpl: func(tag interface{}, txs []*pb.Transaction) {
+			executed = txs
+		},
+	})
+	defer b.Close()
+
+	b.manager.Queue() <- workEvent(func() {
+		b.execute(1, &RequestBatch{Batch: []*Request{
+			{Timestamp: createTx(1).Timestamp, Payload: []byte(`{"uuid":"json-tx"}`), ReplicaId: 1},
+			createPbftReq(2, 1), // protobuf, which the codec rejects
+		}})
+	})
+	b.manager.Queue() <- nil
+
+	if len(executed) != 1 || executed[0].Uuid != "json-tx" {
+		t.Errorf("Expected only the JSON transaction to be executed, got %v", executed)
+	}
+}
+
+func TestTracedRequest(t *testing.T) {
+	var lock sync.Mutex
+	reached := make(map[string]map[uint64]bool)
+	validatorCount := 4
+	net := makeConsumerNetwork(validatorCount, obcBatchSizeOneHelper, func(ce *consumerEndpoint) {
+		ce.consumer.(*obcBatch).pbft.traceSink = func(ev traceEvent) {
+			lock.Lock()
+			defer lock.Unlock()
+			if ev.traceID != "trace-1" {
+				t.Errorf("Replica %d traced unexpected id %s", ev.replica, ev.traceID)
+			}
+			if reached[ev.stage] == nil {
+				reached[ev.stage] = make(map[uint64]bool)
+			}
+			reached[ev.stage][ev.replica] = true
+		}
+	})
+	defer net.stop()
+
+	tx := createTxMsg(1).Payload
+	if err := net.endpoints[1].(*consumerEndpoint).consumer.(*obcBatch).SubmitTraced(tx, "trace-1"); err != nil {
+		t.Fatalf("Could not submit traced request: %s", err)
+	}
+	net.process()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(reached[traceSubmitted]) != 1 || !reached[traceSubmitted][1] {
+		t.Errorf("Expected only replica 1 to trace the submission, got %v", reached[traceSubmitted])
+	}
+	for _, stage := range []string{tracePrePrepared, tracePrepared, traceCommitted, traceExecuting} {
+		if len(reached[stage]) != validatorCount {
+			t.Errorf("Expected every replica to trace stage %s, got %v", stage, reached[stage])
+		}
+	}
+
+	req := createPbftReq(1, 1)
+	digest := hash(req)
+	req.TraceId = "trace-1"
+	if hash(req) != digest {
+		t.Errorf("Trace id changed the request digest")
+	}
+}
+
+func TestReplicaSetMismatch(t *testing.T) {
+	validatorCount := 4
+	net := makeConsumerNetwork(validatorCount, func(id uint64, config *viper.Viper, stack consensus.Stack) pbftConsumer {
+		config.Set("general.batchsize", 1)
+		config.Set("general.replicaset.check", true)
+		if id == 3 {
+			// misconfigured, believing there are only three replicas
+			config.Set("general.N", 3)
+			config.Set("general.f", 0)
+		}
+		return newObcBatch(id, config, stack)
+	})
+	defer net.stop()
+
+	net.process()
+	for _, ep := range net.endpoints {
+		ce := ep.(*consumerEndpoint)
+		instance := ce.consumer.(*obcBatch).pbft
+		if confirmed := instance.replicaSetConfirmed; confirmed != (ce.id != 3) {
+			t.Errorf("Replica %d replica set confirmed %v", ce.id, confirmed)
+		}
+		if mismatch := instance.replicaSetMismatch; mismatch != (ce.id == 3) {
+			t.Errorf("Replica %d replica set mismatch %v", ce.id, mismatch)
+		}
+	}
+
+	broadcaster := net.endpoints[generateBroadcaster(validatorCount)].getHandle()
+	net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(1), broadcaster)
+	net.process()
+
+	for _, ep := range net.endpoints {
+		ce := ep.(*consumerEndpoint)
+		_, err := ce.consumer.(*obcBatch).stack.GetBlock(1)
+		if participated := err == nil; participated != (ce.id != 3) {
+			t.Errorf("Replica %d executed the request %v", ce.id, participated)
+		}
+	}
+}
+
+func TestProtocolVersionMismatch(t *testing.T) {
+	validatorCount := 4
+	net := makeConsumerNetwork(validatorCount, func(id uint64, config *viper.Viper, stack consensus.Stack) pbftConsumer {
+		config.Set("general.batchsize", 1)
+		config.Set("general.protocol.version", 1)
+		config.Set("general.protocol.minversion", 1)
+		if id == 3 {
+			// upgraded, no longer understanding version 1
+			config.Set("general.protocol.version", 2)
+			config.Set("general.protocol.minversion", 2)
+		}
+		return newObcBatch(id, config, stack)
+	})
+	defer net.stop()
+
+	net.process()
+	for _, ep := range net.endpoints {
+		ce := ep.(*consumerEndpoint)
+		instance := ce.consumer.(*obcBatch).pbft
+		for peer := uint64(0); peer < uint64(validatorCount); peer++ {
+			if peer == ce.id {
+				continue
+			}
+			if refused := instance.incompatible(peer); refused != (ce.id == 3 || peer == 3) {
+				t.Errorf("Replica %d refusing replica %d %v", ce.id, peer, refused)
+			}
+		}
+	}
+
+	broadcaster := net.endpoints[generateBroadcaster(validatorCount)].getHandle()
+	net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(1), broadcaster)
+	net.endpoints[3].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(2), broadcaster)
+	net.process()
+
+	for _, ep := range net.endpoints {
+		ce := ep.(*consumerEndpoint)
+		obc := ce.consumer.(*obcBatch)
+		_, err := obc.stack.GetBlock(1)
+		if participated := err == nil; participated != (ce.id != 3) {
+			t.Errorf("Replica %d executed the request %v", ce.id, participated)
+		}
+		if _, err := obc.stack.GetBlock(2); err == nil {
+			t.Errorf("Replica %d executed the request of the incompatible replica", ce.id)
+		}
+	}
+}
+
+func TestHelloOnEachConnection(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.protocol.version", 1)
+	var lock sync.Mutex
+	hellos := 0
+	b := newObcBatch(0, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error {
+			batchMsg := &BatchMessage{}
+			proto.Unmarshal(ocMsg.Payload, batchMsg)
+			msg := &Message{}
+			proto.Unmarshal(batchMsg.GetPbftMessage(), msg)
+			if msg.GetHello() != nil && peer.Name == "vp2" {
+				lock.Lock()
+				hellos++
+				lock.Unlock()
+			}
+			return nil
+		},
+	})
+	defer b.Close()
+	b.manager.Queue() <- nil
+	b.broadcaster.Wait()
+	lock.Lock()
+	initial := hellos
+	lock.Unlock()
+
+	// Replica 2 connects, drops and reconnects
+	for i := 0; i < 2; i++ {
+		b.Connected(&pb.PeerID{Name: "vp2"})
+	}
+	b.manager.Queue() <- nil
+	b.broadcaster.Wait()
+	lock.Lock()
+	defer lock.Unlock()
+	if hellos-initial != 2 {
+		t.Errorf("Expected a hello on each of the 2 connections of replica 2, sent %d", hellos-initial)
+	}
+}
+
+func TestShuffleBatches(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.shufflebatches", true)
+	var executed []string
+	b := newObcBatch(0, config, &omniProto{
+		ExecuteImpl: func(tag interface{}, txs []*pb.Transaction) {
+			executed = nil
+			for _, tx := range txs {
+				executed = append(executed, string(tx.Payload))
+			}
+		},
+	})
+	defer b.Close()
+
+	var arrival, reversed []*Request
+	for i := int64(1); i <= 8; i++ {
+		arrival = append(arrival, createPbftReq(i, 1))
+	}
+	for i := len(arrival) - 1; i >= 0; i-- {
+		reversed = append(reversed, arrival[i])
+	}
+	var expected, arrivalOrder []string
+	for _, req := range shuffleRequests(arrival) {
+		tx := &pb.Transaction{}
+		proto.Unmarshal(req.Payload, tx)
+		expected = append(expected, string(tx.Payload))
+	}
+	for i := range arrival {
+		arrivalOrder = append(arrivalOrder, fmt.Sprint(i+1))
+	}
+	if reflect.DeepEqual(expected, arrivalOrder) {
+		t.Fatalf("Shuffle left the batch in arrival order")
+	}
+
+	for n, reqs := range [][]*Request{arrival, reversed} {
+		b.manager.Queue() <- workEvent(func() {
+			b.execute(uint64(n+1), &RequestBatch{Batch: reqs})
+		})
+		b.manager.Queue() <- nil
+		if !reflect.DeepEqual(executed, expected) {
+			t.Errorf("Batch %d executed in order %v, expected the shuffle %v", n+1, executed, expected)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	validatorCount := 4
+	net := makeConsumerNetwork(validatorCount, obcBatchSizeOneHelper)
+	defer net.stop()
+
+	broadcaster := net.endpoints[generateBroadcaster(validatorCount)].getHandle()
+	net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(1), broadcaster)
+	net.process()
+
+	rec := httptest.NewRecorder()
+	NewMetricsHandler(net.endpoints[1].(*consumerEndpoint).consumer.(*obcBatch)).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Unexpected content type %s", ct)
+	}
+
+	sample := regexp.MustCompile(`^([a-z_]+)\{([a-z]+="[^"]*")(,[a-z]+="[^"]*")*\} [0-9.e+-]+$`)
+	samples := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+			continue
+		}
+		if !sample.MatchString(line) {
+			t.Errorf("Malformed metric line %q", line)
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		samples[line[:i]] = line[i+1:]
+	}
+
+	for series, value := range map[string]string{
+		`pbft_view{replica="1"}`:                                    "0",
+		`pbft_last_executed_sequence_number{replica="1"}`:           "1",
+		`pbft_view_changes_total{replica="1"}`:                      "0",
+		`pbft_request_queue_depth{replica="1"}`:                     "0",
+		`pbft_messages_received_total{replica="1",type="commit"}`:   "3",
+		`pbft_commit_latency_seconds_count{replica="1"}`:            "1",
+		`pbft_commit_latency_seconds_bucket{replica="1",le="+Inf"}`: "1",
+	} {
+		if samples[series] != value {
+			t.Errorf("Expected %s %s, got %q", series, value, samples[series])
+		}
+	}
+}
+
+func TestDegradedReadOnly(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.degraded.readonly", true)
+	invalidated := false
+	b := newObcBatch(0, config, &omniProto{
+		UnicastImpl:         func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		InvalidateStateImpl: func() { invalidated = true },
+	})
+	defer b.Close()
+	var statuses []quorumStatus
+	b.manager.Queue() <- workEvent(func() { b.pbft.quorumSink = func(s quorumStatus) { statuses = append(statuses, s) } })
+
+	heardFrom := func(replicas ...uint64) {
+		for _, id := range replicas {
+			b.manager.Queue() <- pbftMessageEvent{sender: id, msg: &Message{Payload: &Message_Checkpoint{Checkpoint: &Checkpoint{SequenceNumber: 10, ReplicaId: id, Id: "state"}}}}
+		}
+		b.manager.Queue() <- quorumCheckTimerEvent{}
+		b.manager.Queue() <- nil
+	}
+
+	// Replicas 2 and 3 are down, leaving 2 of the 3 replicas needed for a quorum
+	heardFrom(1)
+	if len(statuses) != 1 || !statuses[0].lost || statuses[0].live != 2 {
+		t.Fatalf("Expected a single loss of quorum with 2 replicas live, got %+v", statuses)
+	}
+	if err := b.RecvMsg(createTxMsg(1), &pb.PeerID{Name: "vp0"}); err != errNoQuorum {
+		t.Fatalf("Expected transactions to be turned away without quorum, got %v", err)
+	}
+	if invalidated {
+		t.Errorf("Ledger was invalidated, queries should be served from the committed state")
+	}
+
+	heardFrom(1)
+	if len(statuses) != 1 {
+		t.Errorf("Expected no further alert while quorum stays lost, got %+v", statuses)
+	}
+
+	// Replica 2 comes back
+	heardFrom(1, 2)
+	if len(statuses) != 2 || statuses[1].lost || statuses[1].live != 3 {
+		t.Fatalf("Expected quorum to be regained with 3 replicas live, got %+v", statuses)
+	}
+	if err := b.RecvMsg(createTxMsg(2), &pb.PeerID{Name: "vp0"}); err != nil {
+		t.Fatalf("Expected transactions to be admitted once quorum is regained, got %v", err)
+	}
+}
+
+func TestDigestChain(t *testing.T) {
+	validatorCount := 4
+	net := makeConsumerNetwork(validatorCount, func(id uint64, config *viper.Viper, stack consensus.Stack) pbftConsumer {
+		config.Set("general.batchsize", 1)
+		config.Set("general.digestchain", true)
+		return newObcBatch(id, config, stack)
+	})
+	defer net.stop()
+
+	broadcaster := net.endpoints[generateBroadcaster(validatorCount)].getHandle()
+	for n := 1; n <= 3; n++ {
+		net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(int64(n)), broadcaster)
+		net.process()
+	}
+
+	obc := net.endpoints[1].(*consumerEndpoint).consumer.(*obcBatch)
+	var metas []*Metadata
+	for n := uint64(1); n <= 3; n++ {
+		block, err := obc.stack.GetBlock(n)
+		if err != nil {
+			t.Fatalf("Could not retrieve block %d: %s", n, err)
+		}
+		meta := &Metadata{}
+		proto.Unmarshal(block.ConsensusMetadata, meta)
+		metas = append(metas, meta)
+	}
+	if metas[0].BatchDigest == "" || metas[0].PrevDigest != "" {
+		t.Fatalf("Expected the first batch to carry its digest and link to the empty digest, got %+v", metas[0])
+	}
+	if err := VerifyDigestChain(nil, metas); err != nil {
+		t.Fatalf("Expected the committed batches to form a chain: %s", err)
+	}
+	if err := VerifyDigestChain(nil, []*Metadata{metas[0], metas[2]}); err == nil {
+		t.Errorf("Gap in the chain was not detected")
+	}
+	if err := VerifyDigestChain(nil, []*Metadata{metas[1], metas[0]}); err == nil {
+		t.Errorf("Reordered chain was not detected")
+	}
+
+	// Replace the ledger head behind the replica's back
+	var breaks []error
+	obc.chainSink = func(replica uint64, err error) { breaks = append(breaks, err) }
+	block, _ := obc.stack.GetBlock(3)
+	tampered := *metas[2]
+	tampered.BatchDigest = "forged"
+	block.ConsensusMetadata, _ = proto.Marshal(&tampered)
+
+	net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(4), broadcaster)
+	net.process()
+	if len(breaks) != 1 {
+		t.Errorf("Expected the forged ledger head to be detected once on commit, got %v", breaks)
+	}
+}
+
+func TestCommitStreamResume(t *testing.T) {
+	validatorCount := 4
+	net := makeConsumerNetwork(validatorCount, obcBatchSizeOneHelper)
+	defer net.stop()
+	obc := net.endpoints[1].(*consumerEndpoint).consumer.(*obcBatch)
+
+	broadcaster := net.endpoints[generateBroadcaster(validatorCount)].getHandle()
+	commit := func(from, to int64) {
+		for n := from; n <= to; n++ {
+			net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(n), broadcaster)
+			net.process()
+		}
+	}
+	receive := func(entries <-chan *CommitEntry, seqNos ...uint64) {
+		for _, seqNo := range seqNos {
+			select {
+			case entry := <-entries:
+				if entry.SeqNo != seqNo {
+					t.Fatalf("Expected seqNo=%d from the commit stream, got %d", seqNo, entry.SeqNo)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for seqNo=%d from the commit stream", seqNo)
+			}
+		}
+	}
+
+	entries, cancel, err := obc.CommitStream(0)
+	if err != nil {
+		t.Fatalf("Could not open the commit stream: %s", err)
+	}
+	commit(1, 2)
+	receive(entries, 1, 2)
+	cancel()
+
+	// Committed while the subscriber is disconnected
+	commit(3, 4)
+
+	entries, cancel, err = obc.CommitStream(2)
+	if err != nil {
+		t.Fatalf("Could not resume the commit stream: %s", err)
+	}
+	defer cancel()
+	receive(entries, 3, 4)
+	commit(5, 5)
+	receive(entries, 5)
+
+	delete(net.mockLedgers[1].blocks, 1)
+	if _, _, err := obc.CommitStream(0); err != ErrResumePruned {
+		t.Errorf("Expected resuming before a pruned block to fail, got %v", err)
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	validatorCount := 4
+	replies := make(chan *Reply, 2)
+	net := makeConsumerNetwork(validatorCount, func(id uint64, config *viper.Viper, stack consensus.Stack) pbftConsumer {
+		config.Set("general.batchsize", 1)
+		config.Set("general.replymode", "execute")
+		op := newObcBatch(id, config, stack)
+		if id == 1 {
+			op.onReply = func(req *Request, reply *Reply) { replies <- reply }
+		}
+		return op
+	})
+	defer net.stop()
+
+	// Reads are served from the ledger the reader committed
+	hasTx := func(obc *obcBatch, uuid string) bool {
+		for n := uint64(1); n < obc.stack.GetBlockchainSize(); n++ {
+			block, _ := obc.stack.GetBlock(n)
+			for _, tx := range block.Transactions {
+				if tx.Uuid == uuid {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	broadcaster := net.endpoints[generateBroadcaster(validatorCount)].getHandle()
+	net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(1), broadcaster)
+	net.process()
+	token := (<-replies).SeqNo
+
+	reader := net.endpoints[2].(*consumerEndpoint).consumer.(*obcBatch)
+	if err := reader.AwaitToken(token, time.Second); err != nil {
+		t.Fatalf("Expected the write's token to be committed, got %v", err)
+	}
+	if !hasTx(reader, createTx(1).Uuid) {
+		t.Errorf("Expected the read to reflect the write")
+	}
+
+	// A read with the token of a write the reader has yet to commit waits for
+	// it, until the reader's clock passes its timeout
+	clock := time.Now()
+	reader.manager.Queue() <- workEvent(func() {
+		reader.pbft.now = func() time.Time { return clock }
+	})
+	held := func(count int) {
+		for {
+			waiting := make(chan int)
+			reader.manager.Queue() <- workEvent(func() { waiting <- len(reader.readWaiters) })
+			if <-waiting == count {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	timedOut := make(chan error)
+	go func() { timedOut <- reader.AwaitToken(token+1, time.Minute) }()
+	held(1)
+	reader.manager.Queue() <- workEvent(func() {
+		clock = clock.Add(time.Minute)
+	})
+	reader.manager.Queue() <- readTimerEvent{}
+	if err := <-timedOut; err != ErrTokenTimeout {
+		t.Errorf("Expected a read ahead of the committed writes to time out, got %v", err)
+	}
+
+	read := make(chan bool)
+	go func() {
+		err := reader.AwaitToken(token+1, time.Minute)
+		read <- err == nil && hasTx(reader, createTx(2).Uuid)
+	}()
+	held(1)
+	net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(2), broadcaster)
+	net.process()
+	if !<-read {
+		t.Errorf("Expected the held read to proceed and reflect the second write once committed")
+	}
+}
+
+// ledgerReplayer rebuilds a ledger from the replayed commit log
+type ledgerReplayer struct {
+	ledger *MockLedger
+	seqNos []uint64
+}
+
+func (lr *ledgerReplayer) Replay(entry *CommitEntry) error {
+	lr.seqNos = append(lr.seqNos, entry.SeqNo)
+	lr.ledger.BeginTxBatch(lr)
+	if _, err := lr.ledger.ExecTxs(lr, entry.Block.Transactions); err != nil {
+		return err
+	}
+	_, err := lr.ledger.CommitTxBatch(lr, entry.Block.ConsensusMetadata)
+	return err
+}
+
+func TestReplayLog(t *testing.T) {
+	validatorCount := 4
+	net := makeConsumerNetwork(validatorCount, obcBatchSizeOneHelper)
+	defer net.stop()
+	obc := net.endpoints[1].(*consumerEndpoint).consumer.(*obcBatch)
+
+	broadcaster := net.endpoints[generateBroadcaster(validatorCount)].getHandle()
+	for n := int64(1); n <= 3; n++ {
+		net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(n), broadcaster)
+		net.process()
+	}
+
+	replayer := &ledgerReplayer{ledger: NewMockLedger(nil)}
+	if err := obc.pbft.ReplayLog(0, replayer); err != nil {
+		t.Fatalf("Could not replay the commit log: %s", err)
+	}
+	if !reflect.DeepEqual(replayer.seqNos, []uint64{1, 2, 3}) {
+		t.Errorf("Expected seqNos 1 to 3 to be replayed, got %v", replayer.seqNos)
+	}
+	if !reflect.DeepEqual(replayer.ledger.GetBlockchainInfo(), net.mockLedgers[1].GetBlockchainInfo()) {
+		t.Errorf("Replayed ledger %v differs from the replica's %v", replayer.ledger.GetBlockchainInfo(), net.mockLedgers[1].GetBlockchainInfo())
+	}
+
+	replayer = &ledgerReplayer{ledger: NewMockLedger(nil)}
+	if err := obc.pbft.ReplayLog(2, replayer); err != nil {
+		t.Fatalf("Could not replay the commit log from seqNo=2: %s", err)
+	}
+	if !reflect.DeepEqual(replayer.seqNos, []uint64{2, 3}) {
+		t.Errorf("Expected seqNos 2 and 3 to be replayed, got %v", replayer.seqNos)
+	}
+
+	delete(net.mockLedgers[1].blocks, 1)
+	if err := obc.pbft.ReplayLog(1, &ledgerReplayer{ledger: NewMockLedger(nil)}); err != ErrReplayPruned {
+		t.Errorf("Expected replaying a pruned prefix to fail, got %v", err)
+	}
+}
+
+// deployedChaincode knows the chaincode of the names it holds deployed
+type deployedChaincode map[string]bool
+
+func (d deployedChaincode) Deployed(name string) bool {
+	return d[name]
+}
+
+func TestChaincodeCheck(t *testing.T) {
+	RegisterChaincodeLookup("test", deployedChaincode{"known": true})
+	defer delete(chaincodeLookups, "test")
+
+	config := loadConfig()
+	config.Set("general.chaincodecheck", "test")
+	b := newObcBatch(0, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+	})
+	defer b.Close()
+
+	chaincodeTx := func(tag int64, txType pb.Transaction_Type, name string) []byte {
+		tx := createTx(tag)
+		tx.Type = txType
+		tx.ChaincodeID, _ = proto.Marshal(&pb.ChaincodeID{Name: name})
+		return marshalTx(tx)
+	}
+
+	if err := b.RecvMsg(&pb.Message{Type: pb.Message_CHAIN_TRANSACTION, Payload: chaincodeTx(1, pb.Transaction_CHAINCODE_INVOKE, "unknown")}, &pb.PeerID{Name: "vp0"}); err == nil {
+		t.Errorf("Expected the invocation of chaincode which is not deployed to be rejected")
+	}
+	if err := b.RecvMsg(&pb.Message{Type: pb.Message_CHAIN_TRANSACTION, Payload: chaincodeTx(2, pb.Transaction_CHAINCODE_INVOKE, "known")}, &pb.PeerID{Name: "vp0"}); err != nil {
+		t.Errorf("Expected the invocation of deployed chaincode to be admitted, got %v", err)
+	}
+	if err := b.RecvMsg(&pb.Message{Type: pb.Message_CHAIN_TRANSACTION, Payload: chaincodeTx(3, pb.Transaction_CHAINCODE_DEPLOY, "unknown")}, &pb.PeerID{Name: "vp0"}); err != nil {
+		t.Errorf("Expected the deployment of new chaincode to be admitted, got %v", err)
+	}
+	b.manager.Queue() <- workEvent(func() {
+		if len(b.batchStore) != 2 {
+			t.Errorf("Expected the invocation and the deployment to be queued for ordering, batch store holds %d", len(b.batchStore))
+		}
+	})
+	b.manager.Queue() <- nil
+}
+
+func TestOversizedRequest(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.batchsize", 10)
+	config.Set("general.maxbatchbytes", 200)
+	config.Set("general.maxrequestbytes", 2000)
+	b := newObcBatch(0, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+	})
+	defer b.Close()
+
+	sizedReq := func(tag int64, size int) *Request {
+		tx := createTx(tag)
+		tx.Payload = make([]byte, size)
+		req := createPbftReq(tag, 1)
+		req.Payload = marshalTx(tx)
+		return req
+	}
+	for _, req := range []*Request{
+		createPbftReq(1, 1),
+		sizedReq(2, 1000), // larger than a batch, but a valid request
+		createPbftReq(3, 1),
+		sizedReq(4, 3000), // larger than any request may be
+	} {
+		payload, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_Request{Request: req}})
+		b.manager.Queue() <- batchMessageEvent{&pb.Message{Type: pb.Message_CONSENSUS, Payload: payload}, &pb.PeerID{Name: "vp1"}}
+	}
+
+	b.manager.Queue() <- workEvent(func() {
+		for n, tag := range []int64{1, 2} {
+			cert := b.pbft.certStore[msgID{v: 0, n: uint64(n + 1)}]
+			if cert == nil || cert.prePrepare == nil {
+				t.Fatalf("Expected the primary to pre-prepare seqNo=%d", n+1)
+			}
+			batch := cert.prePrepare.RequestBatch.GetBatch()
+			if len(batch) != 1 || batch[0].Timestamp.Seconds != tag {
+				t.Errorf("Expected seqNo=%d to order request %d alone, got %v", n+1, tag, batch)
+			}
+		}
+		if len(b.batchStore) != 1 {
+			t.Errorf("Expected the request after the oversized one to start a new batch, batch store holds %d", len(b.batchStore))
+		}
+		if l := b.reqStore.outstandingRequests.Len(); l != 3 {
+			t.Errorf("Expected the request above the maximum request size to be ignored, %d requests are outstanding", l)
+		}
+	})
+	b.manager.Queue() <- nil
+}
+
+// recordingSideEffect records the sequence numbers of the batches it is handed
+type recordingSideEffect struct {
+	seqNos []uint64
+}
+
+func (r *recordingSideEffect) Apply(seqNo uint64, txs []*pb.Transaction) {
+	r.seqNos = append(r.seqNos, seqNo)
+}
+
+func TestSideEffectFence(t *testing.T) {
+	effect := &recordingSideEffect{}
+	RegisterSideEffect("record", effect)
+	defer delete(sideEffects, "record")
+
+	config := loadConfig()
+	config.Set("general.sideeffect", "record")
+	persist := &mockPersist{}
+	stack := &omniProto{
+		UnicastImpl:      func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		ExecuteImpl:      func(tag interface{}, txs []*pb.Transaction) {},
+		StoreStateImpl:   persist.StoreState,
+		DelStateImpl:     persist.DelState,
+		ReadStateImpl:    persist.ReadState,
+		ReadStateSetImpl: persist.ReadStateSet,
+	}
+	execute := func(b *obcBatch, seqNo uint64) {
+		b.manager.Queue() <- workEvent(func() {
+			fired := len(effect.seqNos)
+			b.pbft.currentExec = &seqNo
+			b.execute(seqNo, &RequestBatch{Batch: []*Request{createPbftReq(int64(seqNo), 0)}})
+			if len(effect.seqNos) != fired {
+				t.Errorf("The side effects of seqNo=%d fired before it was committed", seqNo)
+			}
+		})
+		b.manager.Queue() <- committedEvent{}
+	}
+
+	b := newObcBatch(1, config, stack)
+	execute(b, 1)
+	execute(b, 2)
+	b.manager.Queue() <- nil
+	b.Close()
+
+	// After the crash, seqNo=2 is executed again
+	b = newObcBatch(1, config, stack)
+	defer b.Close()
+	execute(b, 2)
+	execute(b, 3)
+	b.manager.Queue() <- nil
+
+	if expected := []uint64{1, 2, 3}; !reflect.DeepEqual(effect.seqNos, expected) {
+		t.Errorf("Expected the side effects of seqNos %v exactly once and in order, got %v", expected, effect.seqNos)
+	}
+}
+
+// orgQuotas attributes transactions to the organization their cert names
+type orgQuotas map[string]Quota
+
+func (q orgQuotas) Org(payload []byte) string {
+	tx := &pb.Transaction{}
+	proto.Unmarshal(payload, tx)
+	return string(tx.Cert)
+}
+
+func (q orgQuotas) Quota(org string) Quota {
+	return q[org]
+}
+
+func TestRequestQuota(t *testing.T) {
+	RegisterQuotaManager("test", orgQuotas{"org1": {Requests: 2}, "org2": {Requests: 10}})
+	defer delete(quotaManagers, "test")
+
+	validatorCount := 4
+	net := makeConsumerNetwork(validatorCount, obcBatchHelper, func(ce *consumerEndpoint) {
+		config := loadConfig()
+		config.Set("general.quota.manager", "test")
+		ce.consumer.(*obcBatch).quotas = newQuotas(config, ce.consumer.(*obcBatch).pbft.K)
+	})
+	defer net.stop()
+
+	broadcaster := net.endpoints[generateBroadcaster(validatorCount)].getHandle()
+	tag := int64(0)
+	submit := func(replica int, org string) error {
+		tag++
+		tx := createTx(tag)
+		tx.Cert = []byte(org)
+		return net.endpoints[replica].(*consumerEndpoint).consumer.RecvMsg(&pb.Message{Type: pb.Message_CHAIN_TRANSACTION, Payload: marshalTx(tx)}, broadcaster)
+	}
+
+	// Each replica takes in org1 transactions, they are charged as they execute
+	for i := 0; i < validatorCount; i++ {
+		if err := submit(i, "org1"); err != nil {
+			t.Errorf("Expected replica %d to take in an org1 transaction before its quota is used, got %v", i, err)
+		}
+		if err := submit(i, "org2"); err != nil {
+			t.Errorf("Expected replica %d to take in an org2 transaction, got %v", i, err)
+		}
+	}
+	net.process()
+
+	for _, ep := range net.endpoints {
+		ce := ep.(*consumerEndpoint)
+		op := ce.consumer.(*obcBatch)
+		orgs := make(map[string]int)
+		for seqNo := uint64(1); seqNo <= op.pbft.lastExec; seqNo++ {
+			block, err := op.stack.GetBlock(seqNo)
+			if err != nil {
+				t.Fatalf("Replica %d could not get block %d: %v", ce.id, seqNo, err)
+			}
+			for _, tx := range block.Transactions {
+				orgs[string(tx.Cert)]++
+			}
+		}
+		if orgs["org1"] != 2 || orgs["org2"] != validatorCount {
+			t.Errorf("Replica %d expected 2 org1 and %d org2 transactions ordered, got %v", ce.id, validatorCount, orgs)
+		}
+	}
+
+	// Once org1's usage is committed, intake turns its transactions away
+	if op := net.endpoints[3].(*consumerEndpoint).consumer.(*obcBatch); op.pbft.lastExec%op.pbft.K == 0 {
+		t.Fatalf("Expected the transactions to execute within the first window, lastExec=%d", op.pbft.lastExec)
+	}
+	if err := submit(3, "org1"); err == nil {
+		t.Errorf("Expected replica 3 to turn away an org1 transaction over its quota")
+	}
+	if err := submit(3, "org2"); err != nil {
+		t.Errorf("Expected replica 3 to take in an org2 transaction within its quota, got %v", err)
+	}
+}
+
+// recordingSpeculator records the calls of the commit order pinning
+type recordingSpeculator struct {
+	calls []string
+}
+
+func (s *recordingSpeculator) Speculate(seqNo uint64, txs []*pb.Transaction) {
+	s.calls = append(s.calls, fmt.Sprintf("speculate %d", seqNo))
+}
+
+func (s *recordingSpeculator) Confirm(seqNo uint64) {
+	s.calls = append(s.calls, fmt.Sprintf("confirm %d", seqNo))
+}
+
+func (s *recordingSpeculator) Discard(seqNo uint64) {
+	s.calls = append(s.calls, fmt.Sprintf("discard %d", seqNo))
+}
+
+func TestSpeculationPinnedToCommitOrder(t *testing.T) {
+	speculator := &recordingSpeculator{}
+	RegisterSpeculator("record", speculator)
+	defer delete(speculators, "record")
+
+	config := loadConfig()
+	config.Set("general.speculator", "record")
+	var executed []string
+	b := newObcBatch(1, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		SignImpl:    func(msg []byte) ([]byte, error) { return msg, nil },
+		VerifyImpl:  func(peerID *pb.PeerID, signature []byte, message []byte) error { return nil },
+		ExecuteImpl: func(tag interface{}, txs []*pb.Transaction) {
+			for _, tx := range txs {
+				executed = append(executed, string(tx.Payload))
+			}
+		},
+	})
+	b.pbft.requestTimeout = 10 * time.Second
+	defer b.Close()
+
+	batches := make(map[uint64]*RequestBatch)
+	prePrepare := func(n uint64) {
+		batches[n] = &RequestBatch{Batch: []*Request{createPbftReq(int64(n), 0)}}
+		preprep := &PrePrepare{
+			View:           0,
+			SequenceNumber: n,
+			BatchDigest:    hash(batches[n]),
+			RequestBatch:   batches[n],
+			ReplicaId:      0,
+		}
+		b.manager.Queue() <- pbftMessageEvent{msg: &Message{Payload: &Message_PrePrepare{PrePrepare: preprep}}, sender: 0}
+	}
+	execute := func(n uint64) {
+		b.manager.Queue() <- workEvent(func() {
+			b.pbft.currentExec = &n
+			b.execute(n, batches[n])
+		})
+	}
+
+	// The speculation guesses seqNo=2 comes first, the agreed order differs
+	prePrepare(2)
+	prePrepare(1)
+	execute(1)
+	execute(2)
+	// Then it follows the agreed order
+	prePrepare(3)
+	prePrepare(4)
+	execute(3)
+	execute(4)
+	b.manager.Queue() <- nil
+
+	if expected := []string{"1", "2", "3", "4"}; !reflect.DeepEqual(executed, expected) {
+		t.Errorf("Expected the committed state to follow the agreed order %v, executed %v", expected, executed)
+	}
+	expected := []string{"speculate 2", "speculate 1", "discard 1", "speculate 3", "speculate 4", "confirm 3", "confirm 4"}
+	if !reflect.DeepEqual(speculator.calls, expected) {
+		t.Errorf("Expected speculation %v, got %v", expected, speculator.calls)
+	}
+}
+
+func TestSoftMemoryBatchCut(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.batchsize", 10)
+	config.Set("general.timeout.batch", "1h")
+	config.Set("general.flowcontrol.maxbytes", 10000)
+	config.Set("general.flowcontrol.softbytes", 2500)
+	b := newObcBatch(0, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+	})
+	defer b.Close()
+
+	forward := func(tag int64) {
+		tx := createTx(tag)
+		tx.Payload = make([]byte, 1000)
+		req := createPbftReq(tag, 1)
+		req.Payload = marshalTx(tx)
+		payload, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_Request{Request: req}})
+		b.manager.Queue() <- batchMessageEvent{&pb.Message{Type: pb.Message_CONSENSUS, Payload: payload}, &pb.PeerID{Name: "vp1"}}
+	}
+
+	forward(1)
+	forward(2)
+	b.manager.Queue() <- workEvent(func() {
+		if _, ok := b.pbft.certStore[msgID{v: 0, n: 1}]; ok || len(b.batchStore) != 2 {
+			t.Errorf("Expected the primary to wait for the batch to fill below the soft limit, batch store holds %d", len(b.batchStore))
+		}
+	})
+
+	forward(3)
+	b.manager.Queue() <- workEvent(func() {
+		cert := b.pbft.certStore[msgID{v: 0, n: 1}]
+		if cert == nil || cert.prePrepare == nil || len(cert.prePrepare.RequestBatch.GetBatch()) != 3 {
+			t.Fatalf("Expected the primary to cut a batch of the 3 requests above the soft limit")
+		}
+		if len(b.batchStore) != 0 || b.batchTimerActive {
+			t.Errorf("Expected the early cut to leave no batch waiting on the timer")
+		}
+	})
+	b.manager.Queue() <- nil
+}
+
+func TestPersistBatchStorePerRequest(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.batchsize", 3)
+	config.Set("general.persistbatch", true)
+	config.Set("general.timeout.batch", "1h")
+	persist := &mockPersist{}
+	writes := 0
+	b := newObcBatch(0, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		SignImpl:    func(msg []byte) ([]byte, error) { return msg, nil },
+		VerifyImpl:  func(peerID *pb.PeerID, signature []byte, message []byte) error { return nil },
+		StoreStateImpl: func(key string, value []byte) error {
+			if strings.HasPrefix(key, batchStorePrefix) {
+				writes++
+			}
+			return persist.StoreState(key, value)
+		},
+		DelStateImpl:     persist.DelState,
+		ReadStateImpl:    persist.ReadState,
+		ReadStateSetImpl: persist.ReadStateSet,
+	})
+	defer b.Close()
+
+	persisted := func() int {
+		set, _ := persist.ReadStateSet(batchStorePrefix)
+		return len(set)
+	}
+	for i := int64(1); i <= 2; i++ {
+		b.RecvMsg(createTxMsg(i), &pb.PeerID{Name: "vp0"})
+	}
+	b.manager.Queue() <- nil
+	if writes != 2 || persisted() != 2 {
+		t.Errorf("Expected each queued request to be written once under its own key, %d writes for %d keys", writes, persisted())
+	}
+
+	// Cutting the batch deletes its requests
+	b.RecvMsg(createTxMsg(3), &pb.PeerID{Name: "vp0"})
+	b.manager.Queue() <- nil
+	if writes != 3 || persisted() != 0 {
+		t.Errorf("Expected the cut batch to leave no persisted requests, %d writes and %d keys left", writes, persisted())
+	}
+}
+
+func TestPersistedBatchSurvivesPrimaryCrash(t *testing.T) {
+	validatorCount := 4
+	makeConsumer := func(id uint64, config *viper.Viper, stack consensus.Stack) pbftConsumer {
+		config.Set("general.batchsize", 2)
+		config.Set("general.persistbatch", true)
+		config.Set("general.timeout.batch", "1h")
+		return newObcBatch(id, config, stack)
+	}
+	net := makeConsumerNetwork(validatorCount, makeConsumer)
+	defer net.stop()
+
+	// The primary queues the request for its batch, but crashes before anyone receives it
+	primary := net.endpoints[0].(*consumerEndpoint)
+	primary.consumer.RecvMsg(createTxMsg(1), net.endpoints[1].getHandle())
+	primary.consumer.getManager().Queue() <- nil
+	primary.consumer.(*obcBatch).broadcaster.Wait()
+	net.clearMessages()
+	if l := len(primary.consumer.(*obcBatch).batchStore); l != 1 {
+		t.Fatalf("Expected the primary to assemble a batch of one request, got %d", l)
+	}
+	stack := primary.consumer.(*obcBatch).stack
+	primary.consumer.Close()
+
+	// The backups move on to primary 1 while the crashed primary is down
+	for _, ep := range net.endpoints[1:] {
+		b := ep.(*consumerEndpoint).consumer.(*obcBatch)
+		b.manager.Queue() <- workEvent(func() { b.pbft.sendViewChange(ViewChange_MANUAL) })
+		b.manager.Queue() <- nil
+	}
+
+	primary.consumer = makeConsumer(0, loadConfig(), stack)
+	primary.consumer.getManager().Queue() <- nil
+
+	// Another request fills the batch of the new primary
+	net.endpoints[2].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(2), net.endpoints[2].getHandle())
+	net.process()
+
+	for _, ep := range net.endpoints {
+		ce := ep.(*consumerEndpoint)
+		if view := ce.consumer.getPBFTCore().view; view != 1 {
+			t.Errorf("Expected replica %d in view 1, got %d", ce.id, view)
+		}
+		block, err := ce.consumer.(*obcBatch).stack.GetBlock(1)
+		if err != nil || len(block.Transactions) != 2 {
+			t.Errorf("Expected replica %d to commit the request of the crashed primary under the new primary", ce.id)
+		}
+	}
+}
+
+func TestDrainRequests(t *testing.T) {
+	validatorCount := 4
+	net := makeConsumerNetwork(validatorCount, obcBatchHelper, func(ce *consumerEndpoint) {
+		ce.consumer.(*obcBatch).batchSize = 1
+	})
+	defer net.stop()
+
+	// Replica 1 holds a request, which the primary never learns of
+	backup := net.endpoints[1].(*consumerEndpoint).consumer.(*obcBatch)
+	backup.manager.Queue() <- workEvent(func() {
+		backup.reqStore.storeOutstanding(createPbftReq(1, 1))
+	})
+	backup.DrainRequests()
+
+	queued := -1
+	backup.manager.Queue() <- workEvent(func() {
+		queued = backup.reqStore.outstandingRequests.Len()
+	})
+	backup.manager.Queue() <- nil
+	if queued != 0 {
+		t.Fatalf("Expected replica 1 to hold no requests after draining, holds %d", queued)
+	}
+
+	net.process()
+	for _, ep := range net.endpoints {
+		ce := ep.(*consumerEndpoint)
+		block, err := ce.consumer.(*obcBatch).stack.GetBlock(1)
+		if err != nil || len(block.Transactions) != 1 {
+			t.Errorf("Replica %d expected to execute the drained request: %v", ce.id, err)
+		}
+	}
+}
+
+func TestDumpCertStoreOnEventThread(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.batchsize", 1)
+	b := newObcBatch(0, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		SignImpl:    func(msg []byte) ([]byte, error) { return msg, nil },
+		VerifyImpl:  func(peerID *pb.PeerID, signature []byte, message []byte) error { return nil },
+	})
+	defer b.Close()
+
+	b.RecvMsg(createTxMsg(1), &pb.PeerID{Name: "vp0"})
+	dump := b.DumpCertStore()
+	if len(dump) != 1 || dump[0].SequenceNumber != 1 || !dump[0].PrePrepared {
+		t.Fatalf("Expected the dump to hold the primary's pre-prepare, got %+v", dump)
+	}
+
+	// The dump is a copy, later messages do not change it
+	b.RecvMsg(createTxMsg(2), &pb.PeerID{Name: "vp0"})
+	if len(b.DumpCertStore()) != 2 || len(dump) != 1 {
+		t.Errorf("Expected a new dump to hold both pre-prepares and the earlier one to be unchanged")
+	}
+}
+
+func TestCancelPendingRequest(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.batchsize", 2)
+	b := newObcBatch(0, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		SignImpl:    func(msg []byte) ([]byte, error) { return msg, nil },
+		VerifyImpl:  func(peerID *pb.PeerID, signature []byte, message []byte) error { return nil },
+	})
+	defer b.Close()
+
+	// The primary queues the requests for its next batch
+	b.RecvMsg(createTxMsg(1), &pb.PeerID{Name: "vp0"})
+	pending := b.PendingRequests()
+	if len(pending) != 1 || pending[0].ReplicaId != 0 {
+		t.Fatalf("Expected the queued request to be pending, got %+v", pending)
+	}
+	cancelled := pending[0].Digest
+	if err := b.CancelRequest(cancelled); err != nil {
+		t.Fatalf("Could not cancel pending request: %s", err)
+	}
+	if pending = b.PendingRequests(); len(pending) != 0 {
+		t.Errorf("Expected no request to remain pending, got %+v", pending)
+	}
+	if err := b.CancelRequest(cancelled); err == nil {
+		t.Errorf("Expected cancelling a request no longer held to fail")
+	}
+
+	// The next batch is cut without the cancelled request
+	b.RecvMsg(createTxMsg(2), &pb.PeerID{Name: "vp0"})
+	ordered := b.PendingRequests()[0].Digest
+	b.RecvMsg(createTxMsg(3), &pb.PeerID{Name: "vp0"})
+	if err := b.CancelRequest(ordered); err == nil {
+		t.Errorf("Expected cancelling an ordered request to fail")
+	}
+	b.manager.Queue() <- workEvent(func() {
+		cert := b.pbft.certStore[msgID{0, 1}]
+		if cert == nil || cert.prePrepare == nil {
+			t.Fatalf("Expected the primary to pre-prepare the next batch")
+		}
+		batch := cert.prePrepare.RequestBatch.GetBatch()
+		if len(batch) != 2 || hash(batch[0]) == cancelled || hash(batch[1]) == cancelled {
+			t.Errorf("Expected the batch to hold only the 2 requests which were not cancelled, got %d requests", len(batch))
+		}
+	})
+	b.manager.Queue() <- nil
+}
+
+func TestRequestLifetime(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.timeout.requestlifetime", "300ms")
+	b := newObcBatch(1, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		SignImpl:    func(msg []byte) ([]byte, error) { return msg, nil },
+		VerifyImpl:  func(peerID *pb.PeerID, signature []byte, message []byte) error { return nil },
+	})
+	b.pbft.requestTimeout = 50 * time.Millisecond
+	defer b.Close()
+
+	dropped := make(chan *Reply, 1)
+	b.manager.Queue() <- workEvent(func() {
+		b.onReply = func(req *Request, reply *Reply) { dropped <- reply }
+	})
+
+	// The other replicas are silent, so the request can not be ordered, even after a view change
+	submitted := time.Now()
+	b.RecvMsg(createTxMsg(1), &pb.PeerID{Name: "vp1"})
+
+	select {
+	case reply := <-dropped:
+		if !reply.Dropped || reply.Executed {
+			t.Errorf("Expected a dropped reply, got %v", reply)
+		}
+		if elapsed := time.Since(submitted); elapsed < 300*time.Millisecond {
+			t.Errorf("Expected the request to be dropped once its lifetime passed, was dropped after %v", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the client to be notified that its request was dropped")
+	}
+
+	b.manager.Queue() <- workEvent(func() {
+		if b.pbft.activeView {
+			t.Errorf("Expected the unordered request to cause a view change")
+		}
+		if b.reqStore.outstandingRequests.Len() != 0 {
+			t.Errorf("Expected the expired request to be dropped from the request store")
+		}
+	})
+	b.manager.Queue() <- nil
+}
+
+func TestRequestLifetimeBatched(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.batchsize", 1)
+	config.Set("general.timeout.requestlifetime", "300ms")
+	b := newObcBatch(0, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		SignImpl:    func(msg []byte) ([]byte, error) { return msg, nil },
+		VerifyImpl:  func(peerID *pb.PeerID, signature []byte, message []byte) error { return nil },
+	})
+	defer b.Close()
+
+	dropped := make(chan *Reply, 1)
+	b.manager.Queue() <- workEvent(func() {
+		b.onReply = func(req *Request, reply *Reply) { dropped <- reply }
+	})
+
+	// The primary pre-prepares the request, but the silent backups never let it commit
+	b.RecvMsg(createTxMsg(1), &pb.PeerID{Name: "vp0"})
+	b.manager.Queue() <- workEvent(func() {
+		if len(b.pbft.certStore) != 1 {
+			t.Errorf("Expected the primary to pre-prepare the request, has %d certificates", len(b.pbft.certStore))
+		}
+	})
+
+	select {
+	case reply := <-dropped:
+		if !reply.Dropped || reply.Executed {
+			t.Errorf("Expected a dropped reply, got %v", reply)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the client to be notified that its batched request was dropped")
+	}
+
+	b.manager.Queue() <- workEvent(func() {
+		if b.reqStore.pendingRequests.Len() != 0 || b.reqStore.outstandingRequests.Len() != 0 {
+			t.Errorf("Expected the expired request to be dropped from the request store")
+		}
+	})
+	b.manager.Queue() <- nil
+}
+
+// adminAuthorizer accepts the reconfigurations carrying the credential
+type adminAuthorizer []byte
+
+func (credential adminAuthorizer) Authorize(settings []*ConfigSetting, presented []byte) error {
+	if !bytes.Equal(presented, credential) {
+		return fmt.Errorf("invalid credential")
+	}
+	return nil
+}
+
+func TestReconfigureBatchSize(t *testing.T) {
+	validatorCount := 4
+	net := makeConsumerNetwork(validatorCount, obcBatchHelper, func(ce *consumerEndpoint) {
+		ce.consumer.(*obcBatch).batchSize = 2
+		ce.consumer.(*obcBatch).pbft.K = 2
+		ce.consumer.(*obcBatch).reconfigAuth = adminAuthorizer("admin")
+	})
+	defer net.stop()
+
+	reconfigurer, ok := net.endpoints[1].(*consumerEndpoint).consumer.(consensus.Reconfigurer)
+	if !ok {
+		t.Fatalf("Expected the consenter to be a Reconfigurer")
+	}
+	if err := reconfigurer.SubmitReconfiguration(map[string]string{"general.K": "4"}, []byte("admin")); err == nil {
+		t.Errorf("Expected the checkpoint period to be refused for reconfiguration")
+	}
+	if err := reconfigurer.SubmitReconfiguration(map[string]string{"general.batchsize": "1"}, []byte("client")); err == nil {
+		t.Errorf("Expected a reconfiguration without the administrator's credential to be refused")
+	}
+
+	broadcaster := net.endpoints[generateBroadcaster(validatorCount)].getHandle()
+	submit := func(tags ...int64) {
+		for _, tag := range tags {
+			net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(tag), broadcaster)
+		}
+		net.process()
+	}
+
+	// a reconfiguration forwarded without the credential is ignored
+	forged, _ := proto.Marshal(&Reconfiguration{Settings: []*ConfigSetting{{Key: "general.batchsize", Value: "3"}}})
+	forgedReq := createPbftReq(99, 1)
+	forgedReq.Payload, forgedReq.Reconfiguration = forged, true
+	payload, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_Request{Request: forgedReq}})
+	net.endpoints[0].(*consumerEndpoint).consumer.RecvMsg(&pb.Message{Type: pb.Message_CONSENSUS, Payload: payload}, net.endpoints[1].getHandle())
+	net.process()
+
+	// ordered at seqNo 1, the new batch size takes effect after the checkpoint at seqNo 2
+	if err := reconfigurer.SubmitReconfiguration(map[string]string{"general.batchsize": "1"}, []byte("admin")); err != nil {
+		t.Fatalf("Expected the batch size to be reconfigurable: %s", err)
+	}
+	submit(1)
+	submit(2, 3)
+	submit(4, 5)
+
+	for _, ep := range net.endpoints {
+		ce := ep.(*consumerEndpoint)
+		op := ce.consumer.(*obcBatch)
+		if op.batchSize != 1 || op.reconfiguredAt != 2 {
+			t.Errorf("Replica %d has batch size %d from checkpoint seqNo=%d, expected batch size 1 from checkpoint seqNo=2", ce.id, op.batchSize, op.reconfiguredAt)
+		}
+		for n, expected := range []int{1, 2, 1, 1} {
+			block, err := op.stack.GetBlock(uint64(n + 1))
+			if err != nil {
+				t.Fatalf("Replica %d could not retrieve block %d: %s", ce.id, n+1, err)
+			}
+			if len(block.Transactions) != expected {
+				t.Errorf("Replica %d executed %d transactions at seqNo=%d, expected %d", ce.id, len(block.Transactions), n+1, expected)
+			}
+		}
+	}
+
+	// the checkpointed state carries the settings to a replica which transfers it
+	block, _ := net.endpoints[0].(*consumerEndpoint).consumer.(*obcBatch).stack.GetBlock(4)
+	head := &Metadata{}
+	proto.Unmarshal(block.ConsensusMetadata, head)
+	if head.Reconfigured == nil || head.Reconfigured.SequenceNumber != 2 {
+		t.Fatalf("Expected the metadata of seqNo=4 to record the reconfiguration at checkpoint seqNo=2, got %v", head)
+	}
+	b := newObcBatch(0, loadConfig(), &omniProto{
+		UnicastImpl:              func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		GetBlockHeadMetadataImpl: func() ([]byte, error) { return block.ConsensusMetadata, nil },
+	})
+	defer b.Close()
+	b.adoptReconfigurations(b.headMetadata())
+	if b.batchSize != 1 || b.reconfiguredAt != 2 {
+		t.Errorf("Expected state transfer to adopt batch size 1 from checkpoint seqNo=2, got batch size %d from %d", b.batchSize, b.reconfiguredAt)
+	}
+}
+
+func TestExecutionFailureRetried(t *testing.T) {
+	validatorCount := 4
+	var mutex sync.Mutex
+	failures := 2
+	net := makeConsumerNetwork(validatorCount, obcBatchHelper, func(ce *consumerEndpoint) {
+		ce.consumer.(*obcBatch).pbft.execMaxAttempts = 3
+		ce.consumer.(*obcBatch).pbft.execRetryBackoff = 10 * time.Millisecond
+		if ce.id != 2 {
+			return
+		}
+		// the ledger of replica 2 fails its first two executions
+		ce.execTxResult = func(txs []*pb.Transaction) ([]byte, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if failures > 0 {
+				failures--
+				return nil, fmt.Errorf("ledger unavailable")
+			}
+			return []byte("result"), nil
+		}
+	})
+	defer net.stop()
+
+	broadcaster := net.endpoints[generateBroadcaster(validatorCount)].getHandle()
+	net.endpoints[1].(*consumerEndpoint).consumer.RecvMsg(createTxMsg(1), broadcaster)
+	net.process()
+	time.Sleep(100 * time.Millisecond)
+	net.process()
+
+	mutex.Lock()
+	if failures != 0 {
+		t.Errorf("Expected replica 2 to retry its failed executions, %d failures were not reached", failures)
+	}
+	mutex.Unlock()
+	for _, ep := range net.endpoints {
+		ce := ep.(*consumerEndpoint)
+		op := ce.consumer.(*obcBatch)
+		if op.pbft.lastExec != 1 {
+			t.Errorf("Replica %d expected to execute seqNo=1, lastExec=%d", ce.id, op.pbft.lastExec)
+		}
+		block, err := op.stack.GetBlock(1)
+		if err != nil || len(block.Transactions) != 1 {
+			t.Errorf("Replica %d expected to commit the transaction exactly once at seqNo=1: %v", ce.id, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/util"
+)
+
+// beaconEpoch is a primary order drawn from a random beacon, in effect from view beacon.Since on
+type beaconEpoch struct {
+	beacon Beacon
+	order  []uint64
+}
+
+// beaconOrder permutes the replicas by the digest of the checkpoint seeding
+// the beacon, keeping the primary of the view before the epoch from leading
+// it again.  The checkpoint is committed state, so the only choice a faulty
+// primary has over the seed is which of the few checkpoints its new view
+// could start from
+func beaconOrder(b Beacon, N int) []uint64 {
+	seed := util.ComputeCryptoHash([]byte(fmt.Sprintf("%d:%s", b.SequenceNumber, b.Id)))
+	perm := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed[:8])))).Perm(N)
+	order := make([]uint64, N)
+	for i, id := range perm {
+		order[i] = uint64(id)
+	}
+	if N > 1 && order[0] == b.Previous {
+		order[0], order[1] = order[1], order[0]
+	}
+	return order
+}
+
+// installBeacon draws the primaries of the views after the new view from
+// the checkpoint it starts from
+func (instance *pbftCore) installBeacon(nv *NewView) {
+	cp, _, _ := instance.selectInitialCheckpoint(canonicalViewChanges(nv.Vset))
+	instance.addBeacon(Beacon{
+		Since:          nv.View + 1,
+		SequenceNumber: cp.SequenceNumber,
+		Id:             cp.Id,
+		Previous:       instance.primary(nv.View),
+	})
+}
+
+func (instance *pbftCore) addBeacon(b Beacon) {
+	for len(instance.beacons) > 0 && instance.beacons[len(instance.beacons)-1].beacon.Since >= b.Since {
+		instance.beacons = instance.beacons[:len(instance.beacons)-1]
+	}
+	epoch := beaconEpoch{beacon: b, order: beaconOrder(b, instance.replicaCount)}
+	instance.beacons = append(instance.beacons, epoch)
+	if len(instance.beacons) > 2 {
+		instance.beacons = instance.beacons[len(instance.beacons)-2:]
+	}
+	logger.Debugf("Replica %d drew primary %d for view %d from checkpoint seqNo=%d", instance.id, epoch.order[0], b.Since, b.SequenceNumber)
+	instance.persistBeacons()
+}
+
+// latestBeacon is the beacon we advertise in our view-changes, nil before any
+func (instance *pbftCore) latestBeacon() *Beacon {
+	if len(instance.beacons) == 0 {
+		return nil
+	}
+	b := instance.beacons[len(instance.beacons)-1].beacon
+	return &b
+}
+
+// learnBeacon adopts the newest beacon which f+1 view-changes for view v
+// report, so that a replica which missed a new view derives the same
+// primary for v as the replicas which accepted it
+func (instance *pbftCore) learnBeacon(v uint64) {
+	reports := make(map[Beacon]int)
+	for idx, vc := range instance.viewChangeStore {
+		if idx.v == v && vc.Beacon != nil {
+			reports[*vc.Beacon]++
+		}
+	}
+	var newest *Beacon
+	for b, count := range reports {
+		if count >= instance.f+1 && (newest == nil || b.Since > newest.Since) {
+			b := b
+			newest = &b
+		}
+	}
+	if newest == nil || newest.Previous >= uint64(instance.replicaCount) {
+		return
+	}
+	if latest := instance.latestBeacon(); latest != nil && latest.Since >= newest.Since {
+		return
+	}
+	logger.Infof("Replica %d adopting the beacon of view %d from f+1 view-changes", instance.id, newest.Since)
+	instance.addBeacon(*newest)
+}
+
+// beaconPrimary returns the primary of view n from the latest beacon in effect, false before any
+func (instance *pbftCore) beaconPrimary(n uint64) (uint64, bool) {
+	for i := len(instance.beacons) - 1; i >= 0; i-- {
+		epoch := instance.beacons[i]
+		if epoch.beacon.Since <= n {
+			return epoch.order[(n-epoch.beacon.Since)%uint64(len(epoch.order))], true
+		}
+	}
+	return 0, false
+}
+
+func (instance *pbftCore) persistBeacons() {
+	var entries []string
+	for _, epoch := range instance.beacons {
+		b := epoch.beacon
+		entries = append(entries, fmt.Sprintf("%d:%d:%d:%s", b.Since, b.Previous, b.SequenceNumber, b.Id))
+	}
+	instance.consumer.StoreState("beacon", []byte(strings.Join(entries, ",")))
+}
+
+func (instance *pbftCore) restoreBeacons() {
+	raw, err := instance.consumer.ReadState("beacon")
+	if err != nil || len(raw) == 0 {
+		return
+	}
+	var beacons []beaconEpoch
+	for _, entry := range strings.Split(string(raw), ",") {
+		parts := strings.SplitN(entry, ":", 4)
+		if len(parts) != 4 {
+			instance.damagedState("beacon", fmt.Errorf("malformed beacon entry %q", entry))
+			return
+		}
+		var fields [3]uint64
+		for i := range fields {
+			if fields[i], err = strconv.ParseUint(parts[i], 10, 64); err != nil {
+				instance.damagedState("beacon", err)
+				return
+			}
+		}
+		b := Beacon{Since: fields[0], Previous: fields[1], SequenceNumber: fields[2], Id: parts[3]}
+		if b.Previous >= uint64(instance.replicaCount) {
+			instance.damagedState("beacon", fmt.Errorf("malformed beacon entry %q", entry))
+			return
+		}
+		beacons = append(beacons, beaconEpoch{beacon: b, order: beaconOrder(b, instance.replicaCount)})
+	}
+	instance.beacons = beacons
+}
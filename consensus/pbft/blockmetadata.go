@@ -0,0 +1,65 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/viper"
+)
+
+// BlockMetadataSource supplies the application-defined metadata of a request
+// batch when the primary cuts it.  The metadata is covered by the batch
+// digest, and committed with the batch's block.
+type BlockMetadataSource func(txs []*pb.Transaction) []byte
+
+var blockMetadataSources = map[string]BlockMetadataSource{}
+
+// RegisterBlockMetadataSource makes a source selectable through
+// general.blockmetadata, it must be called before the plugin is created
+func RegisterBlockMetadataSource(name string, source BlockMetadataSource) {
+	blockMetadataSources[name] = source
+}
+
+// newBlockMetadataSource returns the source selected by general.blockmetadata,
+// or nil if none is
+func newBlockMetadataSource(config *viper.Viper) BlockMetadataSource {
+	name := config.GetString("general.blockmetadata")
+	if name == "" {
+		return nil
+	}
+	source, ok := blockMetadataSources[name]
+	if !ok {
+		panic(fmt.Errorf("Unknown block metadata source: %s", name))
+	}
+	return source
+}
+
+// attachBlockMetadata has the metadata source annotate a request batch we cut
+func (op *obcBatch) attachBlockMetadata(reqBatch *RequestBatch) {
+	if op.blockMetadata == nil {
+		return
+	}
+	var txs []*pb.Transaction
+	for _, req := range reqBatch.Batch {
+		if tx, err := op.codec.Decode(req.Payload); err == nil {
+			txs = append(txs, tx)
+		}
+	}
+	reqBatch.Metadata = op.blockMetadata(txs)
+}
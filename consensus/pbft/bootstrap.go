@@ -0,0 +1,202 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Bootstrap has a new replica catch up from a peer the operator trusts.  Every
+// replica is asked for its view, its stable checkpoint with the checkpoint
+// messages of the quorum which certified it, and the batches committed above
+// it with their commit certificates.  As these messages are not signed, a
+// reply only vouches for its sender, so the peer's checkpoint is only adopted
+// once f+1 replicas, the peer among them, returned it, and a batch once f+1
+// replicas returned it.  We then state transfer to the checkpoint and execute
+// the committed batches, rather than waiting to learn of the network's
+// progress from its checkpoints.  Bootstrapping is given up after
+// general.timeout.bootstrap.  Like ProcessEvent, it must be called on the
+// event thread.
+func (instance *pbftCore) Bootstrap(peer uint64) error {
+	if peer == instance.id || peer >= uint64(instance.N) {
+		return fmt.Errorf("Replica %d can not bootstrap from replica %d", instance.id, peer)
+	}
+	instance.bootstrapping = true
+	instance.bootstrapPeer = peer
+	instance.bootstrapReplies = make(map[uint64]*BootstrapReply)
+	instance.bootstrapTimer.Reset(instance.bootstrapTimeout, bootstrapTimerEvent{})
+
+	logger.Infof("Replica %d bootstrapping from trusted replica %d", instance.id, peer)
+	return instance.innerBroadcast(&Message{Payload: &Message_BootstrapRequest{BootstrapRequest: &BootstrapRequest{
+		ReplicaId: instance.id,
+	}}})
+}
+
+// bootstrapTimedOut gives up on bootstrapping, we catch up through the checkpoints of the network instead
+func (instance *pbftCore) bootstrapTimedOut() {
+	if !instance.bootstrapping {
+		return
+	}
+	logger.Warningf("Replica %d gave up bootstrapping from replica %d, %d replicas replied", instance.id, instance.bootstrapPeer, len(instance.bootstrapReplies))
+	instance.bootstrapping = false
+	instance.bootstrapReplies = nil
+}
+
+// recvBootstrapRequest returns our stable checkpoint, and the batches we hold
+// committed above it, to a replica bootstrapping from us
+func (instance *pbftCore) recvBootstrapRequest(br *BootstrapRequest) error {
+	if len(instance.stableCert) == 0 {
+		logger.Debugf("Replica %d holds no stable checkpoint for replica %d to bootstrap from", instance.id, br.ReplicaId)
+		return nil
+	}
+	chkpt := instance.stableCert[0]
+	reply := &BootstrapReply{
+		ReplicaId:      instance.id,
+		ReplicaSet:     instance.replicaSetDigest,
+		View:           instance.view,
+		SequenceNumber: chkpt.SequenceNumber,
+		Id:             chkpt.Id,
+		Certificate:    instance.stableCert,
+	}
+	for idx, cert := range instance.certStore {
+		if idx.n <= chkpt.SequenceNumber || cert.prePrepare == nil || !instance.committed(cert.digest, idx.v, idx.n) {
+			continue
+		}
+		reply.Batches = append(reply.Batches, &CommittedBatch{
+			View:           idx.v,
+			SequenceNumber: idx.n,
+			RequestBatch:   instance.reqBatchStore[cert.digest],
+			Commits:        cert.commit,
+		})
+	}
+
+	msgPacked, err := proto.Marshal(&Message{Payload: &Message_BootstrapReply{BootstrapReply: reply}})
+	if err != nil {
+		return fmt.Errorf("Error marshalling bootstrap-reply message: %v", err)
+	}
+	logger.Infof("Replica %d bootstrapping replica %d from seqNo=%d with %d committed batches", instance.id, br.ReplicaId, chkpt.SequenceNumber, len(reply.Batches))
+	return instance.consumer.unicast(msgPacked, br.ReplicaId)
+}
+
+// recvBootstrapReply records a bootstrap reply, and catches up once f+1
+// replies, the trusted peer's among them, agree on its checkpoint
+func (instance *pbftCore) recvBootstrapReply(br *BootstrapReply) {
+	if !instance.bootstrapping {
+		logger.Warningf("Replica %d ignoring bootstrap-reply from replica %d, it is not bootstrapping", instance.id, br.ReplicaId)
+		return
+	}
+	if br.ReplicaSet != instance.replicaSetDigest {
+		logger.Warningf("Replica %d ignoring bootstrap-reply from replica %d, whose replica set %s differs from ours %s", instance.id, br.ReplicaId, br.ReplicaSet, instance.replicaSetDigest)
+		return
+	}
+	if !instance.checkpointCertAttesters(br.SequenceNumber, br.Id, br.Certificate)[br.ReplicaId] {
+		logger.Warningf("Replica %d ignoring bootstrap-reply from replica %d, its certificate for checkpoint seqNo=%d is invalid or lacks its own checkpoint", instance.id, br.ReplicaId, br.SequenceNumber)
+		return
+	}
+	instance.bootstrapReplies[br.ReplicaId] = br
+
+	trusted := instance.bootstrapReplies[instance.bootstrapPeer]
+	if trusted == nil {
+		return
+	}
+	var matching []*BootstrapReply
+	for _, reply := range instance.bootstrapReplies {
+		if reply.SequenceNumber == trusted.SequenceNumber && reply.Id == trusted.Id {
+			matching = append(matching, reply)
+		}
+	}
+	if len(matching) < instance.f+1 {
+		return
+	}
+	instance.bootstrapping = false
+	instance.bootstrapReplies = nil
+	instance.bootstrapTimer.Stop()
+
+	// at least one of the f+1 highest views is reported by a correct replica
+	var views []uint64
+	for _, reply := range matching {
+		views = append(views, reply.View)
+	}
+	sort.Sort(sort.Reverse(sortableUint64Slice(views)))
+	view := views[instance.f]
+
+	logger.Infof("Replica %d bootstrapped from replica %d and %d others to view %d, stable checkpoint seqNo=%d", instance.id, trusted.ReplicaId, len(matching)-1, view, trusted.SequenceNumber)
+	if view > instance.view {
+		instance.view = view
+		instance.persistViewNumber()
+		instance.publishView()
+	}
+
+	if trusted.SequenceNumber > instance.h && trusted.SequenceNumber > instance.lastExec {
+		instance.skipAhead(trusted.SequenceNumber)
+		var replicas []uint64
+		for _, reply := range matching {
+			replicas = append(replicas, reply.ReplicaId)
+		}
+		sort.Sort(sortableUint64Slice(replicas))
+		snapshotID, _ := base64.StdEncoding.DecodeString(trusted.Id)
+		target := &stateUpdateTarget{
+			checkpointMessage: checkpointMessage{
+				seqNo: trusted.SequenceNumber,
+				id:    snapshotID,
+			},
+			replicas: replicas,
+		}
+		instance.updateHighStateTarget(target)
+		instance.retryStateTransfer(target)
+	}
+
+	for _, cb := range trusted.Batches {
+		if cb.SequenceNumber <= instance.lastExec || !instance.inW(cb.SequenceNumber) {
+			continue
+		}
+		digest, err := instance.verifyCommittedBatch(cb)
+		if err != nil {
+			logger.Warningf("Replica %d ignoring bootstrapped batch for view=%d/seqNo=%d: %s", instance.id, cb.View, cb.SequenceNumber, err)
+			continue
+		}
+		if vouchers := instance.bootstrapVouchers(matching, cb, digest); vouchers < instance.f+1 {
+			logger.Warningf("Replica %d ignoring bootstrapped batch for view=%d/seqNo=%d, only %d replicas returned it", instance.id, cb.View, cb.SequenceNumber, vouchers)
+			continue
+		}
+		if !instance.getCert(cb.View, cb.SequenceNumber).certified {
+			instance.adoptCommittedBatch(cb, digest)
+		}
+	}
+	instance.executeOutstanding()
+}
+
+// bootstrapVouchers counts the replies returning a valid commit certificate for the batch
+func (instance *pbftCore) bootstrapVouchers(replies []*BootstrapReply, batch *CommittedBatch, digest string) int {
+	vouchers := 0
+	for _, reply := range replies {
+		for _, cb := range reply.Batches {
+			if cb.View != batch.View || cb.SequenceNumber != batch.SequenceNumber {
+				continue
+			}
+			if d, err := instance.verifyCommittedBatch(cb); err == nil && d == digest {
+				vouchers++
+				break
+			}
+		}
+	}
+	return vouchers
+}
@@ -23,6 +23,8 @@ import (
 
 	"github.com/hyperledger/fabric/consensus"
 	pb "github.com/hyperledger/fabric/protos"
+
+	"github.com/golang/protobuf/proto"
 )
 
 type communicator interface {
@@ -34,6 +36,7 @@ type broadcaster struct {
 	comm communicator
 
 	f        int
+	coalesce time.Duration // how long to gather consensus messages for a peer into one bundle, 0 disables
 	msgChans map[uint64]chan *sendRequest
 	closed   sync.WaitGroup
 	closedCh chan struct{}
@@ -44,13 +47,14 @@ type sendRequest struct {
 	done chan bool
 }
 
-func newBroadcaster(self uint64, N int, f int, c communicator) *broadcaster {
+func newBroadcaster(self uint64, N int, f int, coalesce time.Duration, c communicator) *broadcaster {
 	queueSize := 10 // XXX increase after testing
 
 	chans := make(map[uint64]chan *sendRequest)
 	b := &broadcaster{
 		comm:     c,
 		f:        f,
+		coalesce: coalesce,
 		msgChans: chans,
 		closedCh: make(chan struct{}),
 	}
@@ -106,6 +110,55 @@ func (b *broadcaster) drainerSend(dest uint64, send *sendRequest, successLastTim
 
 }
 
+// drainerSendBundle sends several consensus messages to a replica in a single
+// bundle, which the receiving obcBatch splits back into the individual messages
+func (b *broadcaster) drainerSendBundle(dest uint64, sends []*sendRequest, successLastTime bool) bool {
+	if len(sends) == 1 {
+		return b.drainerSend(dest, sends[0], successLastTime)
+	}
+
+	bundle := &Bundle{}
+	for _, send := range sends {
+		bundle.Payloads = append(bundle.Payloads, send.msg.Payload)
+	}
+	payload, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_Bundle{Bundle: bundle}})
+	done := make(chan bool, 1)
+	b.closed.Add(1)
+	success := b.drainerSend(dest, &sendRequest{
+		msg:  &pb.Message{Type: pb.Message_CONSENSUS, Payload: payload},
+		done: done,
+	}, successLastTime)
+	<-done
+
+	for _, send := range sends {
+		send.done <- success
+		b.closed.Done()
+	}
+	return success
+}
+
+// coalesceFrom gathers the consensus messages for a replica which arrive within
+// the coalescing window after the first, returning any other message separately
+func (b *broadcaster) coalesceFrom(destChan chan *sendRequest, first *sendRequest) (bundle []*sendRequest, next *sendRequest) {
+	bundle = []*sendRequest{first}
+	window := time.NewTimer(b.coalesce)
+	defer window.Stop()
+
+	for {
+		select {
+		case send := <-destChan:
+			if send.msg.Type != pb.Message_CONSENSUS {
+				return bundle, send
+			}
+			bundle = append(bundle, send)
+		case <-window.C:
+			return bundle, nil
+		case <-b.closedCh:
+			return bundle, nil
+		}
+	}
+}
+
 func (b *broadcaster) drainer(dest uint64) {
 	successLastTime := false
 	destChan := b.msgChans[dest] // Avoid doing the map lookup every send
@@ -113,7 +166,15 @@ func (b *broadcaster) drainer(dest uint64) {
 	for {
 		select {
 		case send := <-destChan:
-			successLastTime = b.drainerSend(dest, send, successLastTime)
+			if b.coalesce == 0 || send.msg.Type != pb.Message_CONSENSUS {
+				successLastTime = b.drainerSend(dest, send, successLastTime)
+				continue
+			}
+			bundle, next := b.coalesceFrom(destChan, send)
+			successLastTime = b.drainerSendBundle(dest, bundle, successLastTime)
+			if next != nil {
+				successLastTime = b.drainerSend(dest, next, successLastTime)
+			}
 		case <-b.closedCh:
 			for {
 				// Drain the message channel to free calling waiters before we shut down
@@ -18,10 +18,13 @@ package pbft
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	pb "github.com/hyperledger/fabric/protos"
+
+	"github.com/golang/protobuf/proto"
 )
 
 type mockMsg struct {
@@ -69,7 +72,7 @@ func TestBroadcast(t *testing.T) {
 		}
 	}()
 
-	b := newBroadcaster(1, 4, 1, m)
+	b := newBroadcaster(1, 4, 1, 0, m)
 
 	msg := &pb.Message{Payload: []byte("hi")}
 	b.Broadcast(msg)
@@ -123,7 +126,7 @@ func TestBroadcastStuck(t *testing.T) {
 		}
 	}()
 
-	b := newBroadcaster(1, 4, 1, m)
+	b := newBroadcaster(1, 4, 1, 0, m)
 
 	maxc := 20
 	for c := 0; c < maxc; c++ {
@@ -168,7 +171,7 @@ func TestBroadcastUnicast(t *testing.T) {
 		}
 	}()
 
-	b := newBroadcaster(1, 4, 1, m)
+	b := newBroadcaster(1, 4, 1, 0, m)
 
 	msg := &pb.Message{Payload: []byte("hi")}
 	b.Unicast(msg, 0)
@@ -206,7 +209,7 @@ func TestBroadcastAllFail(t *testing.T) {
 		done: make(chan struct{}),
 	}
 
-	b := newBroadcaster(1, 4, 1, m)
+	b := newBroadcaster(1, 4, 1, 0, m)
 
 	maxc := 20
 	for c := 0; c < maxc; c++ {
@@ -250,7 +253,7 @@ func TestBroadcastIndefinitelyStuck(t *testing.T) {
 		done: make(chan struct{}),
 	}
 
-	b := newBroadcaster(1, 4, 1, m)
+	b := newBroadcaster(1, 4, 1, 0, m)
 
 	broadcastDone := make(chan struct{})
 
@@ -272,3 +275,56 @@ func TestBroadcastIndefinitelyStuck(t *testing.T) {
 	close(m.done)
 	b.Close()
 }
+
+func TestBroadcastCoalesce(t *testing.T) {
+	m := &mockComm{
+		self:  1,
+		n:     4,
+		msgCh: make(chan mockMsg, 10),
+	}
+	b := newBroadcaster(1, 4, 1, 100*time.Millisecond, m)
+	defer b.Close()
+
+	count := 5
+	wg := &sync.WaitGroup{}
+	for i := 0; i < count; i++ {
+		payload, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_Request{Request: createPbftReq(int64(i+1), 1)}})
+		wg.Add(1)
+		go func() {
+			b.Unicast(&pb.Message{Type: pb.Message_CONSENSUS, Payload: payload}, 0)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	var sent mockMsg
+	select {
+	case sent = <-m.msgCh:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a bundle to have been sent")
+	}
+	select {
+	case extra := <-m.msgCh:
+		t.Fatalf("Expected a single network write, got another message %v", extra.msg)
+	default:
+	}
+
+	batchMsg := &BatchMessage{}
+	if err := proto.Unmarshal(sent.msg.Payload, batchMsg); err != nil || batchMsg.GetBundle() == nil {
+		t.Fatalf("Expected a bundle, got %v (%v)", batchMsg, err)
+	}
+	if l := len(batchMsg.GetBundle().Payloads); l != count {
+		t.Fatalf("Expected bundle of %d messages, got %d", count, l)
+	}
+
+	// The receiver handles every bundled message on its own
+	r := newObcBatch(0, loadConfig(), &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+	})
+	defer r.Close()
+	r.manager.Queue() <- batchMessageEvent{sent.msg, &pb.PeerID{Name: "vp1"}}
+	r.manager.Queue() <- nil
+	if l := r.reqStore.outstandingRequests.Len(); l != count {
+		t.Errorf("Expected %d requests processed from the bundle, got %d", count, l)
+	}
+}
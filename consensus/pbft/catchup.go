@@ -0,0 +1,44 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+// raiseCatchUpBarrier withholds the votes of a replica restarting from
+// persisted state, which may lag the network, until it caught up
+func (instance *pbftCore) raiseCatchUpBarrier() {
+	if !instance.catchUpBarrier || instance.lastExec == 0 {
+		return
+	}
+	logger.Infof("Replica %d restarted at seqNo=%d, withholding its votes until it caught up with the network", instance.id, instance.lastExec)
+	instance.catchingUp = true
+}
+
+// liftCatchUpBarrier resumes voting once we learnt where the network stands,
+// from a stable checkpoint, a new view or a state transfer, and executed into
+// its watermark window, so that we never vote on sequence numbers the network
+// has moved past
+func (instance *pbftCore) liftCatchUpBarrier(from string) {
+	if !instance.catchingUp || instance.lastExec < instance.h {
+		return
+	}
+	logger.Infof("Replica %d caught up with the network at seqNo=%d through %s, resuming voting", instance.id, instance.lastExec, from)
+	instance.catchingUp = false
+}
+
+// withholdingVotes reports whether we neither pre-prepare, prepare nor commit
+func (instance *pbftCore) withholdingVotes() bool {
+	return instance.silenced || instance.catchingUp
+}
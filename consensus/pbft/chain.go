@@ -0,0 +1,78 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// logChainBreak is the default digest chain sink, a break means the ledger
+// head is not the batch we last committed
+func logChainBreak(replica uint64, err error) {
+	logger.Criticalf("Replica %d found the batch digest chain broken: %s", replica, err)
+}
+
+// verifyChainLink checks that next follows prev in the digest chain, a prev
+// without a digest standing for the genesis link
+func verifyChainLink(prev, next *Metadata) error {
+	if next.PrevDigest != prev.BatchDigest {
+		return fmt.Errorf("batch of seqNo=%d links to %q, the batch before it is %q", next.SeqNo, next.PrevDigest, prev.BatchDigest)
+	}
+	if prev.BatchDigest != "" && next.SeqNo <= prev.SeqNo {
+		return fmt.Errorf("batch of seqNo=%d follows seqNo=%d", next.SeqNo, prev.SeqNo)
+	}
+	return nil
+}
+
+// VerifyDigestChain checks the consensus metadata of consecutive committed
+// blocks, the first of which must follow prev, or be the first of the chain
+// when prev is nil
+func VerifyDigestChain(prev *Metadata, metas []*Metadata) error {
+	if prev == nil {
+		prev = &Metadata{}
+	}
+	for _, next := range metas {
+		if err := verifyChainLink(prev, next); err != nil {
+			return err
+		}
+		prev = next
+	}
+	return nil
+}
+
+// headMetadata returns the consensus metadata of the ledger head, empty when
+// there is none
+func (op *obcBatch) headMetadata() *Metadata {
+	meta := &Metadata{}
+	if raw, err := op.stack.GetBlockHeadMetadata(); err == nil {
+		proto.Unmarshal(raw, meta)
+	}
+	return meta
+}
+
+// chainLink links the metadata of a batch we are about to execute to the
+// batch we last committed, after checking that the ledger head still is that
+// batch, a gap or reorder showing as a mismatch
+func (op *obcBatch) chainLink(meta *Metadata, reqBatch *RequestBatch) {
+	if head := op.headMetadata(); head.BatchDigest != op.chainHead {
+		op.chainSink(op.pbft.id, fmt.Errorf("ledger head of seqNo=%d is batch %q, we last committed %q", head.SeqNo, head.BatchDigest, op.chainHead))
+	}
+	meta.BatchDigest = hash(reqBatch)
+	meta.PrevDigest = op.chainHead
+}
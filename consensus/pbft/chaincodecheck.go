@@ -0,0 +1,78 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/viper"
+)
+
+// ChaincodeLookup reports whether chaincode of the given name is deployed,
+// as the consumer knows from its state.  It is called concurrently from
+// RecvMsg.
+type ChaincodeLookup interface {
+	Deployed(name string) bool
+}
+
+var chaincodeLookups = map[string]ChaincodeLookup{}
+
+// RegisterChaincodeLookup makes a lookup selectable through
+// general.chaincodecheck, it must be called before the plugin is created
+func RegisterChaincodeLookup(name string, lookup ChaincodeLookup) {
+	chaincodeLookups[name] = lookup
+}
+
+// newChaincodeLookup returns the lookup selected by general.chaincodecheck,
+// or nil if invocations are not checked
+func newChaincodeLookup(config *viper.Viper) ChaincodeLookup {
+	name := config.GetString("general.chaincodecheck")
+	if name == "" {
+		return nil
+	}
+	lookup, ok := chaincodeLookups[name]
+	if !ok {
+		panic(fmt.Errorf("Unknown chaincode lookup: %s", name))
+	}
+	return lookup
+}
+
+// checkChaincode turns away the invocation of chaincode which is not
+// deployed, if invocations are checked.  Deployments, and confidential
+// transactions, whose chaincode ID is encrypted, pass.
+func (op *obcBatch) checkChaincode(payload []byte) error {
+	if op.chaincodeLookup == nil {
+		return nil
+	}
+	tx := &pb.Transaction{}
+	if err := proto.Unmarshal(payload, tx); err != nil {
+		return nil
+	}
+	if tx.Type != pb.Transaction_CHAINCODE_INVOKE || tx.ConfidentialityLevel != pb.ConfidentialityLevel_PUBLIC {
+		return nil
+	}
+	id := &pb.ChaincodeID{}
+	if err := proto.Unmarshal(tx.ChaincodeID, id); err != nil {
+		return fmt.Errorf("PBFT refuses to order an invocation of an undecodable chaincode ID: %s", err)
+	}
+	if !op.chaincodeLookup.Deployed(id.Name) {
+		return fmt.Errorf("PBFT refuses to order an invocation of chaincode %q, which is not deployed", id.Name)
+	}
+	return nil
+}
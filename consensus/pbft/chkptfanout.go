@@ -0,0 +1,101 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"math/rand"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// sendCheckpoint hands our checkpoint to every replica, or with a checkpoint
+// fanout to that many replicas and those which already sent us theirs.  Every
+// replica answers a checkpoint with its own, so the replicas exchange their
+// checkpoints pairwise instead of all to all.  The recipients follow us in a
+// random order of the replicas which all of them derive from the sequence
+// number, which pairs every replica with twice the fanout others, enough for a
+// quorum as the fanout is at least f.  Should our previous checkpoint not have
+// become stable, we fall back to broadcasting
+func (instance *pbftCore) sendCheckpoint(chkpt *Checkpoint) {
+	msg := &Message{Payload: &Message_Checkpoint{Checkpoint: chkpt}}
+	if instance.chkptFanout <= 0 || 2*instance.chkptFanout >= instance.N-1 {
+		instance.innerBroadcast(msg)
+		return
+	}
+	for n := range instance.chkpts {
+		if n > instance.h && n < chkpt.SequenceNumber {
+			logger.Debugf("Replica %d broadcasting checkpoint for seqNo=%d, its checkpoint for seqNo=%d is not stable", instance.id, chkpt.SequenceNumber, n)
+			instance.innerBroadcast(msg)
+			return
+		}
+	}
+
+	targets := make(map[uint64]bool)
+	order := rand.New(rand.NewSource(int64(chkpt.SequenceNumber))).Perm(instance.N)
+	for pos, id := range order {
+		if uint64(id) != instance.id {
+			continue
+		}
+		for i := 1; i <= instance.chkptFanout; i++ {
+			targets[uint64(order[(pos+i)%instance.N])] = true
+		}
+	}
+	for other := range instance.checkpointStore {
+		if other.SequenceNumber == chkpt.SequenceNumber && other.ReplicaId != instance.id {
+			targets[other.ReplicaId] = true
+		}
+	}
+	for id := range targets {
+		instance.unicastCheckpoint(chkpt, id)
+	}
+}
+
+// answerCheckpoint sends our checkpoint to a replica which sent us its own
+// checkpoint for the same sequence number, unless it already has ours
+func (instance *pbftCore) answerCheckpoint(chkpt *Checkpoint) {
+	if instance.chkptFanout <= 0 || chkpt.ReplicaId == instance.id {
+		return
+	}
+	id, ok := instance.chkpts[chkpt.SequenceNumber]
+	if !ok || instance.chkptSentTo[chkpt.SequenceNumber][chkpt.ReplicaId] {
+		return
+	}
+	instance.unicastCheckpoint(&Checkpoint{
+		SequenceNumber: chkpt.SequenceNumber,
+		ReplicaId:      instance.id,
+		Id:             id,
+	}, chkpt.ReplicaId)
+}
+
+func (instance *pbftCore) unicastCheckpoint(chkpt *Checkpoint, receiver uint64) {
+	sent, ok := instance.chkptSentTo[chkpt.SequenceNumber]
+	if !ok {
+		sent = make(map[uint64]bool)
+		instance.chkptSentTo[chkpt.SequenceNumber] = sent
+	}
+	if sent[receiver] {
+		return
+	}
+	sent[receiver] = true
+
+	msgPacked, err := proto.Marshal(&Message{Payload: &Message_Checkpoint{Checkpoint: chkpt}})
+	if err != nil {
+		logger.Errorf("Replica %d could not marshal checkpoint for seqNo=%d: %v", instance.id, chkpt.SequenceNumber, err)
+		return
+	}
+	instance.consumer.unicast(msgPacked, receiver)
+}
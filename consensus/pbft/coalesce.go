@@ -0,0 +1,60 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+// recordExecLoad notes the requests of the batch we execute at seqNo n, the
+// load checkpoint coalescing derives the checkpoint period from
+func (instance *pbftCore) recordExecLoad(n uint64, reqBatch *RequestBatch) {
+	if instance.coalesceMaxK == 0 {
+		return
+	}
+	instance.execLoad[n] = len(reqBatch.GetBatch())
+	for seqNo := range instance.execLoad {
+		if seqNo+instance.K <= n {
+			delete(instance.execLoad, seqNo)
+		}
+	}
+}
+
+// checkpointPeriod is the checkpoint period at seqNo n, a multiple of K.  It
+// only depends on the batches ordered in the K sequence numbers up to n, so
+// that the replicas agree on it; lacking some, it is K.
+func (instance *pbftCore) checkpointPeriod(n uint64) uint64 {
+	if instance.coalesceMaxK == 0 || n < instance.K {
+		return instance.K
+	}
+	requests := 0
+	for seqNo := n - instance.K + 1; seqNo <= n; seqNo++ {
+		load, ok := instance.execLoad[seqNo]
+		if !ok {
+			return instance.K
+		}
+		requests += load
+	}
+	period := instance.K
+	for period < instance.coalesceMaxK && requests >= instance.coalesceLoad*int(period) {
+		period *= 2
+	}
+	return period
+}
+
+// checkpointDue reports whether we checkpoint seqNo n, a multiple of K.  As
+// the periods are power of two multiples of K, every multiple of the longest
+// period is checkpointed, keeping the stable checkpoints within half the log.
+func (instance *pbftCore) checkpointDue(n uint64) bool {
+	return n%instance.checkpointPeriod(n) == 0
+}
@@ -0,0 +1,65 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/viper"
+)
+
+// PayloadCodec decodes the opaque payload of a request into the transaction
+// which is handed to the stack for execution
+type PayloadCodec interface {
+	Decode(payload []byte) (*pb.Transaction, error)
+}
+
+// protoCodec decodes payloads holding a marshaled pb.Transaction
+type protoCodec struct{}
+
+func (protoCodec) Decode(payload []byte) (*pb.Transaction, error) {
+	tx := &pb.Transaction{}
+	if err := proto.Unmarshal(payload, tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+var payloadCodecs = map[string]PayloadCodec{
+	"protobuf": protoCodec{},
+}
+
+// RegisterPayloadCodec makes a codec selectable through general.payloadcodec,
+// it must be called before the plugin is created
+func RegisterPayloadCodec(name string, codec PayloadCodec) {
+	payloadCodecs[name] = codec
+}
+
+// newPayloadCodec returns the codec selected by general.payloadcodec, defaulting to protobuf
+func newPayloadCodec(config *viper.Viper) PayloadCodec {
+	name := config.GetString("general.payloadcodec")
+	if name == "" {
+		name = "protobuf"
+	}
+	codec, ok := payloadCodecs[name]
+	if !ok {
+		panic(fmt.Errorf("Unknown payload codec: %s", name))
+	}
+	return codec
+}
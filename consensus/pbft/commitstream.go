@@ -0,0 +1,258 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/hyperledger/fabric/protos"
+)
+
+// commitStreamFetch is the number of blocks a commit stream reads from the
+// ledger at a time
+const commitStreamFetch = 64
+
+// CommitEntry is a committed batch, as delivered by a commit stream
+type CommitEntry struct {
+	SeqNo uint64
+	Block *pb.Block
+}
+
+// ErrResumePruned is returned when a commit stream can not resume from the
+// requested sequence number, as the ledger no longer holds the blocks after it
+var ErrResumePruned = fmt.Errorf("PBFT commit stream resume point was pruned from the ledger")
+
+// ErrReplayPruned is returned when the commit log can not be replayed from
+// the requested sequence number, as the ledger no longer holds its prefix
+var ErrReplayPruned = fmt.Errorf("PBFT commit log replay start was pruned from the ledger")
+
+// Consumer rebuilds derived state, such as indexes, from the replayed
+// commit log
+type Consumer interface {
+	Replay(entry *CommitEntry) error
+}
+
+// commitLog is implemented by the consumers of pbftCore which keep the
+// committed batches, such as in a ledger, for them to be replayed
+type commitLog interface {
+	resumeCommitLog(after uint64) (uint64, error)               // number of the first block committed after seqNo after
+	readCommitLog(from uint64, max int) ([]*CommitEntry, error) // up to max blocks, from block number from
+}
+
+// commitSubscriber is a commit stream, woken when a block is committed
+type commitSubscriber struct {
+	entries chan *CommitEntry
+	notify  chan struct{}
+	done    chan struct{}
+}
+
+// CommitStream delivers, in order and without gaps, the batches committed
+// after the sequence number a subscriber last acknowledged.  It first replays
+// those the ledger already holds, then delivers live ones, until cancelled.
+// The channel is closed should the ledger fail to return a block.
+func (op *obcBatch) CommitStream(after uint64) (<-chan *CommitEntry, func(), error) {
+	type result struct {
+		start uint64
+		err   error
+	}
+	sub := &commitSubscriber{
+		entries: make(chan *CommitEntry),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	res := make(chan result)
+	op.manager.Queue() <- workEvent(func() {
+		start, err := op.resumeBlock(after)
+		if err == nil {
+			op.commitSubs[sub] = true
+		}
+		res <- result{start, err}
+	})
+	r := <-res
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	go op.pumpCommitStream(sub, r.start)
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			close(sub.done)
+			op.manager.Queue() <- workEvent(func() { delete(op.commitSubs, sub) })
+		})
+	}
+	return sub.entries, cancel, nil
+}
+
+// resumeBlock returns the number of the first block committed after seqNo,
+// scanning back from the ledger head
+func (op *obcBatch) resumeBlock(seqNo uint64) (uint64, error) {
+	n := op.stack.GetBlockchainSize()
+	for n > 1 {
+		block, err := op.stack.GetBlock(n - 1)
+		if err != nil {
+			logger.Warningf("Replica %d can not resume commit stream after seqNo=%d, block %d is missing: %s", op.pbft.id, seqNo, n-1, err)
+			return 0, ErrResumePruned
+		}
+		meta := &Metadata{}
+		proto.Unmarshal(block.ConsensusMetadata, meta)
+		if meta.SeqNo <= seqNo {
+			break
+		}
+		n--
+	}
+	return n, nil
+}
+
+// commitEntries reads up to max committed blocks from the ledger, starting
+// with block number from
+func (op *obcBatch) commitEntries(from uint64, max int) ([]*CommitEntry, error) {
+	var entries []*CommitEntry
+	for n := from; n < op.stack.GetBlockchainSize() && len(entries) < max; n++ {
+		block, err := op.stack.GetBlock(n)
+		if err != nil {
+			return entries, err
+		}
+		meta := &Metadata{}
+		proto.Unmarshal(block.ConsensusMetadata, meta)
+		entries = append(entries, &CommitEntry{SeqNo: meta.SeqNo, Block: block})
+	}
+	return entries, nil
+}
+
+// notifyCommitSubs wakes the commit streams once blocks were committed
+func (op *obcBatch) notifyCommitSubs() {
+	for sub := range op.commitSubs {
+		select {
+		case sub.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pumpCommitStream delivers the blocks from number next on, reading them
+// from the ledger on the event thread, and waiting for commits once it
+// caught up
+func (op *obcBatch) pumpCommitStream(sub *commitSubscriber, next uint64) {
+	defer close(sub.entries)
+	for {
+		type result struct {
+			entries []*CommitEntry
+			err     error
+		}
+		res := make(chan result, 1)
+		select {
+		case op.manager.Queue() <- workEvent(func() {
+			entries, err := op.commitEntries(next, commitStreamFetch)
+			res <- result{entries, err}
+		}):
+		case <-sub.done:
+			return
+		}
+		r := <-res
+
+		for _, entry := range r.entries {
+			select {
+			case sub.entries <- entry:
+				next++
+			case <-sub.done:
+				return
+			}
+		}
+		if r.err != nil {
+			logger.Errorf("Replica %d closing commit stream, could not read block %d: %s", op.pbft.id, next, r.err)
+			return
+		}
+		if len(r.entries) == commitStreamFetch {
+			continue
+		}
+
+		select {
+		case <-sub.notify:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// resumeCommitLog returns the number of the first block committed after
+// seqNo, read on the event thread
+func (op *obcBatch) resumeCommitLog(after uint64) (uint64, error) {
+	type result struct {
+		next uint64
+		err  error
+	}
+	res := make(chan result)
+	op.manager.Queue() <- workEvent(func() {
+		next, err := op.resumeBlock(after)
+		res <- result{next, err}
+	})
+	r := <-res
+	return r.next, r.err
+}
+
+// readCommitLog reads up to max committed blocks from block number from on,
+// on the event thread
+func (op *obcBatch) readCommitLog(from uint64, max int) ([]*CommitEntry, error) {
+	type result struct {
+		entries []*CommitEntry
+		err     error
+	}
+	res := make(chan result)
+	op.manager.Queue() <- workEvent(func() {
+		entries, err := op.commitEntries(from, max)
+		res <- result{entries, err}
+	})
+	r := <-res
+	return r.entries, r.err
+}
+
+// ReplayLog feeds the committed batches from sequence number from on, in
+// order, into a consumer, up to those committed when it reaches the head
+// of the ledger.  An error of the consumer stops the replay and is returned.
+// It reads the log through the event thread, so it must not run on it.
+func (instance *pbftCore) ReplayLog(from uint64, into Consumer) error {
+	log, ok := instance.consumer.(commitLog)
+	if !ok {
+		return fmt.Errorf("PBFT replica %d keeps no commit log to replay", instance.id)
+	}
+	after := from
+	if after > 0 {
+		after--
+	}
+	next, err := log.resumeCommitLog(after)
+	if err != nil {
+		return ErrReplayPruned
+	}
+	for {
+		entries, err := log.readCommitLog(next, commitStreamFetch)
+		for _, entry := range entries {
+			if err := into.Replay(entry); err != nil {
+				return err
+			}
+			next++
+		}
+		if err != nil {
+			return fmt.Errorf("could not read block %d of the commit log: %s", next, err)
+		}
+		if len(entries) < commitStreamFetch {
+			return nil
+		}
+	}
+}
@@ -51,6 +51,14 @@ func (d *deduplicator) Request(req *Request) bool {
 	return true
 }
 
+// IsLatest returns true if this Request is newer than any previously
+// received or executed request of the submitting replica, without
+// recording it, as Request does.
+func (d *deduplicator) IsLatest(req *Request) bool {
+	reqTime := time.Unix(req.Timestamp.Seconds, int64(req.Timestamp.Nanos))
+	return reqTime.After(d.reqTimestamps[req.ReplicaId]) && reqTime.After(d.execTimestamps[req.ReplicaId])
+}
+
 // Execute updates the executed request timestamp for the submitting
 // replica.  If the request is older than any previously executed
 // request from the same replica, Execute() will return false,
@@ -0,0 +1,61 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"encoding/base64"
+
+	"github.com/hyperledger/fabric/core/util"
+)
+
+// minDigestBytes is the shortest truncated digest we accept, 128 bits
+const minDigestBytes = 16
+
+// fullDigestBytes is the length of an untruncated hash
+func fullDigestBytes() int {
+	return len(util.ComputeCryptoHash(nil))
+}
+
+// batchDigest is the digest by which replicas agree on reqBatch, its hash
+// truncated to the configured digest length
+func (instance *pbftCore) batchDigest(reqBatch *RequestBatch) string {
+	return truncatedBatchDigest(reqBatch, instance.digestBytes)
+}
+
+// truncatedBatchDigest is the hash of reqBatch truncated to digestBytes, 0 for the full hash
+func truncatedBatchDigest(reqBatch *RequestBatch, digestBytes int) string {
+	digest := hash(reqBatch)
+	if digestBytes == 0 || digest == "" {
+		return digest
+	}
+	raw, _ := base64.StdEncoding.DecodeString(digest)
+	if len(raw) <= digestBytes {
+		return digest
+	}
+	return base64.StdEncoding.EncodeToString(raw[:digestBytes])
+}
+
+// validDigestLength reports whether a batch digest carried in an agreement
+// message has the length we truncate digests to, so that a replica configured
+// with another length is refused rather than never matching.  The empty
+// digest of a null request is always valid.
+func (instance *pbftCore) validDigestLength(digest string) bool {
+	if digest == "" {
+		return true
+	}
+	return len(digest) == len(instance.batchDigest(&RequestBatch{}))
+}
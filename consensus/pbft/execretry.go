@@ -0,0 +1,72 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+)
+
+// execFailedEvent is sent by the consumer, instead of an execDoneEvent, when
+// an execution failed and left no trace on the state
+type execFailedEvent struct {
+	seqNo uint64
+	err   error
+}
+
+// execRetryTimerEvent is sent when a failed execution is due to be retried
+type execRetryTimerEvent struct {
+	seqNo uint64
+}
+
+// PermanentExecError is reported by a consumer for an execution failure
+// which retrying cannot cure, any other error is deemed transient
+type PermanentExecError struct {
+	Err error
+}
+
+func (e *PermanentExecError) Error() string {
+	return fmt.Sprintf("permanent execution failure: %s", e.Err)
+}
+
+// execFailedHandler retries a failed execution after a backoff, doubling with
+// every attempt, until general.execretry.maxattempts is reached or the
+// consumer reports the failure as permanent, when it abandons the execution
+func (instance *pbftCore) execFailedHandler(seqNo uint64, err error) {
+	if instance.currentExec == nil || *instance.currentExec != seqNo {
+		return
+	}
+	instance.execTimer.Stop()
+	instance.execAttempts++
+
+	if _, permanent := err.(*PermanentExecError); permanent || instance.execAttempts >= instance.execMaxAttempts {
+		instance.abandonExecution(seqNo, fmt.Sprintf("failed after %d attempts (%s)", instance.execAttempts, err))
+		return
+	}
+	backoff := instance.execRetryBackoff << uint(instance.execAttempts-1)
+	logger.Warningf("Replica %d execution of seqNo=%d failed (%s), retrying in %v, attempt %d of %d",
+		instance.id, seqNo, err, backoff, instance.execAttempts+1, instance.execMaxAttempts)
+	instance.execRetryTimer.Reset(backoff, execRetryTimerEvent{seqNo})
+}
+
+// retryExecution hands a failed request batch to the consumer again
+func (instance *pbftCore) retryExecution(seqNo uint64) {
+	if instance.currentExec == nil || *instance.currentExec != seqNo {
+		return
+	}
+	logger.Infof("Replica %d retrying execution of seqNo=%d", instance.id, seqNo)
+	instance.startExecution(seqNo, instance.execBatch)
+}
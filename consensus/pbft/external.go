@@ -41,6 +41,12 @@ type executedEvent struct {
 	tag interface{}
 }
 
+// executionFailedEvent is sent when a requested execution fails
+type executionFailedEvent struct {
+	tag interface{}
+	err error
+}
+
 // commitedEvent is sent when a requested commit completes
 type committedEvent struct {
 	tag    interface{}
@@ -68,6 +74,11 @@ func (eer *externalEventReceiver) Executed(tag interface{}) {
 	eer.manager.Queue() <- executedEvent{tag}
 }
 
+// ExecutionFailed is called instead of Executed when Execute fails
+func (eer *externalEventReceiver) ExecutionFailed(tag interface{}, err error) {
+	eer.manager.Queue() <- executionFailedEvent{tag, err}
+}
+
 // Committed is called whenever Commit completes, no-op for noops as it uses the legacy synchronous api
 func (eer *externalEventReceiver) Committed(tag interface{}, target *pb.BlockchainInfo) {
 	eer.manager.Queue() <- committedEvent{tag, target}
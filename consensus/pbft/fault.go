@@ -0,0 +1,70 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/consensus/util/events"
+)
+
+// FaultKind is a fault InjectFault makes a replica suffer
+type FaultKind interface {
+	isFaultKind()
+}
+
+// DropCommits makes the replica drop the next N commits it receives from other replicas
+type DropCommits struct {
+	N int
+}
+
+// DelayExecution makes the replica hold back execution for Delay
+type DelayExecution struct {
+	Delay time.Duration
+}
+
+// ForceViewChange makes the replica send a view-change right away
+type ForceViewChange struct{}
+
+func (DropCommits) isFaultKind()     {}
+func (DelayExecution) isFaultKind()  {}
+func (ForceViewChange) isFaultKind() {}
+
+var errFaultInjectionDisabled = fmt.Errorf("PBFT fault injection is disabled, set general.faultinjection to enable it")
+
+// InjectFault makes the replica suffer a fault, for chaos testing, when
+// general.faultinjection enables it.  Like ProcessEvent, it must be called
+// on the event thread, and the returned event delivered.
+func (instance *pbftCore) InjectFault(fault FaultKind) (events.Event, error) {
+	if !instance.faultInjection {
+		return nil, errFaultInjectionDisabled
+	}
+	logger.Warningf("Replica %d injected with fault %T%+v", instance.id, fault, fault)
+
+	switch f := fault.(type) {
+	case DropCommits:
+		instance.faultDropCommits += f.N
+	case DelayExecution:
+		instance.faultExecDelayedUntil = instance.now().Add(f.Delay)
+	case ForceViewChange:
+		return instance.sendViewChange(ViewChange_MANUAL), nil
+	default:
+		return nil, fmt.Errorf("unknown fault %T", fault)
+	}
+	return nil, nil
+}
@@ -53,12 +53,14 @@ func TestFuzz(t *testing.T) {
 
 	logging.SetBackend(logging.InitForTesting(logging.ERROR))
 
+	config := loadConfig()
+	config.Set("general.debug.invariants", true)
 	mock := newFuzzMock()
-	primary, pmanager := createRunningPbftWithManager(0, loadConfig(), mock)
+	primary, pmanager := createRunningPbftWithManager(0, config, mock)
 	defer primary.close()
 	defer pmanager.Halt()
 	mock = newFuzzMock()
-	backup, bmanager := createRunningPbftWithManager(1, loadConfig(), mock)
+	backup, bmanager := createRunningPbftWithManager(1, config, mock)
 	defer backup.close()
 	defer bmanager.Halt()
 
@@ -136,7 +138,9 @@ func TestMinimalFuzz(t *testing.T) {
 	}
 
 	validatorCount := 4
-	net := makePBFTNetwork(validatorCount, nil)
+	config := loadConfig()
+	config.Set("general.debug.invariants", true)
+	net := makePBFTNetwork(validatorCount, config)
 	defer net.stop()
 	fuzzer := &protoFuzzer{r: rand.New(rand.NewSource(0))}
 	net.filterFn = fuzzer.fuzzPacket
@@ -175,7 +179,7 @@ func TestMinimalFuzz(t *testing.T) {
 		if noExec > 1 {
 			noExec = 0
 			for _, ep := range net.endpoints {
-				ep.(*pbftEndpoint).pbft.sendViewChange()
+				ep.(*pbftEndpoint).pbft.sendViewChange(ViewChange_MANUAL)
 			}
 			err = net.process()
 			if err != nil {
@@ -183,6 +187,7 @@ func TestMinimalFuzz(t *testing.T) {
 			}
 		}
 	}
+	net.assertNoPrematureExecution(t, 1)
 }
 
 type protoFuzzer struct {
@@ -264,6 +269,9 @@ func (f *protoFuzzer) Fuzz(v reflect.Value) {
 		}
 		v.SetString(str)
 		return
+	case reflect.Bool:
+		v.SetBool(!v.Bool())
+		return
 	case reflect.Ptr:
 		if !v.IsNil() {
 			f.Fuzz(v.Elem())
@@ -0,0 +1,119 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"encoding/base64"
+	"sort"
+)
+
+// gossipTimerEvent is sent when the next gossip of our stable checkpoint is due
+type gossipTimerEvent struct{}
+
+// recordStableCert keeps the checkpoint messages which made chkpt stable, to
+// gossip them along with it
+func (instance *pbftCore) recordStableCert(chkpt *Checkpoint) {
+	var cert []*Checkpoint
+	for testChkpt := range instance.checkpointStore {
+		if testChkpt.SequenceNumber == chkpt.SequenceNumber && testChkpt.Id == chkpt.Id {
+			c := testChkpt
+			cert = append(cert, &c)
+		}
+	}
+	instance.stableCert = cert
+}
+
+// gossipCheckpoint broadcasts our stable checkpoint with its certificate, so
+// that replicas which missed the checkpoint messages learn of it
+func (instance *pbftCore) gossipCheckpoint() {
+	if len(instance.stableCert) == 0 {
+		return
+	}
+	chkpt := instance.stableCert[0]
+	logger.Debugf("Replica %d gossiping stable checkpoint seqNo=%d", instance.id, chkpt.SequenceNumber)
+	instance.innerBroadcast(&Message{Payload: &Message_CheckpointGossip{CheckpointGossip: &CheckpointGossip{
+		ReplicaId:      instance.id,
+		SequenceNumber: chkpt.SequenceNumber,
+		Id:             chkpt.Id,
+		Certificate:    instance.stableCert,
+	}}})
+}
+
+// checkpointCertAttesters returns the replicas whose checkpoint messages in
+// cert certify checkpoint id at seqNo, or nil unless they are a quorum
+func (instance *pbftCore) checkpointCertAttesters(seqNo uint64, id string, cert []*Checkpoint) map[uint64]bool {
+	if _, err := base64.StdEncoding.DecodeString(id); err != nil {
+		return nil
+	}
+	attesters := make(map[uint64]bool)
+	for _, chkpt := range cert {
+		if chkpt.SequenceNumber != seqNo || chkpt.Id != id || chkpt.ReplicaId >= uint64(instance.N) {
+			return nil
+		}
+		attesters[chkpt.ReplicaId] = true
+	}
+	if len(attesters) < instance.intersectionQuorum() {
+		return nil
+	}
+	return attesters
+}
+
+// validGossipCertificate reports whether the gossiped checkpoint comes with
+// the checkpoint messages of a quorum, the sender among them.  Checkpoint
+// messages are not signed, so the certificate vouches for the sender alone.
+func (instance *pbftCore) validGossipCertificate(g *CheckpointGossip) bool {
+	return instance.checkpointCertAttesters(g.SequenceNumber, g.Id, g.Certificate)[g.ReplicaId]
+}
+
+// recvCheckpointGossip state transfers to a stable checkpoint above our high
+// watermark once f+1 replicas gossip it, as one of them is correct
+func (instance *pbftCore) recvCheckpointGossip(g *CheckpointGossip) {
+	if !instance.validGossipCertificate(g) {
+		logger.Warningf("Replica %d received checkpoint gossip from replica %d with an invalid certificate for seqNo=%d", instance.id, g.ReplicaId, g.SequenceNumber)
+		return
+	}
+	if g.SequenceNumber <= instance.h+instance.L {
+		delete(instance.gossipChkpts, g.ReplicaId)
+		return
+	}
+	instance.gossipChkpts[g.ReplicaId] = g
+
+	var replicas []uint64
+	for id, other := range instance.gossipChkpts {
+		if other.SequenceNumber == g.SequenceNumber && other.Id == g.Id {
+			replicas = append(replicas, id)
+		}
+	}
+	if len(replicas) < instance.f+1 {
+		return
+	}
+	sort.Sort(sortableUint64Slice(replicas))
+
+	logger.Warningf("Replica %d is out of date, replicas %v gossip stable checkpoint seqNo=%d but our high watermark is %d", instance.id, replicas, g.SequenceNumber, instance.h+instance.L)
+	instance.gossipChkpts = make(map[uint64]*CheckpointGossip)
+	instance.skipAhead(g.SequenceNumber)
+	snapshotID, _ := base64.StdEncoding.DecodeString(g.Id)
+	target := &stateUpdateTarget{
+		checkpointMessage: checkpointMessage{
+			seqNo: g.SequenceNumber,
+			id:    snapshotID,
+		},
+		replicas: replicas,
+	}
+	instance.updateHighStateTarget(target)
+	instance.retryStateTransfer(target)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import "fmt"
+
+// checkInvariants asserts the internal consistency of the replica after an
+// event was processed and panics on the first violation, it is only run when
+// general.debug.invariants is set
+func (instance *pbftCore) checkInvariants() {
+	if err := instance.invariantViolation(); err != nil {
+		logger.Criticalf("Replica %d violated invariant: %s", instance.id, err)
+		panic(fmt.Errorf("Replica %d violated invariant: %s", instance.id, err))
+	}
+}
+
+func (instance *pbftCore) invariantViolation() error {
+	if instance.h%instance.K != 0 {
+		return fmt.Errorf("low watermark %d is not a multiple of the checkpoint period %d", instance.h, instance.K)
+	}
+	if instance.lastExec > instance.h+instance.L {
+		return fmt.Errorf("executed seqNo=%d beyond the high watermark %d", instance.lastExec, instance.h+instance.L)
+	}
+
+	for idx, cert := range instance.certStore {
+		if idx.n <= instance.h || idx.n > instance.h+instance.L {
+			return fmt.Errorf("certificate for view=%d/seqNo=%d outside the watermarks %d-%d", idx.v, idx.n, instance.h, instance.h+instance.L)
+		}
+		if len(cert.prepare) > instance.N || len(cert.commit) > instance.N {
+			return fmt.Errorf("certificate for view=%d/seqNo=%d holds %d prepares and %d commits from %d replicas", idx.v, idx.n, len(cert.prepare), len(cert.commit), instance.N)
+		}
+		if pp := cert.prePrepare; pp != nil && (pp.View != idx.v || pp.SequenceNumber != idx.n || pp.BatchDigest != cert.digest) {
+			return fmt.Errorf("certificate for view=%d/seqNo=%d holds pre-prepare for view=%d/seqNo=%d", idx.v, idx.n, pp.View, pp.SequenceNumber)
+		}
+	}
+
+	if instance.currentExec != nil && *instance.currentExec != instance.invariantExec {
+		n := *instance.currentExec
+		committed := false
+		for idx, cert := range instance.certStore {
+			if idx.n == n && instance.committed(cert.digest, idx.v, n) {
+				committed = true
+				break
+			}
+		}
+		if !committed {
+			return fmt.Errorf("executing seqNo=%d without a commit certificate", n)
+		}
+		instance.invariantExec = n
+	}
+
+	for idx, vc := range instance.viewChangeStore {
+		if idx.v != vc.View || idx.id != vc.ReplicaId {
+			return fmt.Errorf("view-change from replica %d for view %d stored as replica %d, view %d", vc.ReplicaId, vc.View, idx.id, idx.v)
+		}
+	}
+	if instance.view < instance.highActiveView {
+		return fmt.Errorf("in view %d, but has already been active in view %d", instance.view, instance.highActiveView)
+	}
+	if !instance.activeView && instance.view == instance.highActiveView {
+		return fmt.Errorf("changing to view %d, which it has already been active in", instance.view)
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import "time"
+
+// lifetimeTimerEvent is sent when the oldest outstanding request may have outlived the request lifetime
+type lifetimeTimerEvent struct{}
+
+// requestExpiry is when a request, stamped by the replica which received it,
+// outlives the request lifetime
+func (op *obcBatch) requestExpiry(req *Request) (time.Time, bool) {
+	if req.Timestamp == nil {
+		return time.Time{}, false
+	}
+	return time.Unix(req.Timestamp.Seconds, int64(req.Timestamp.Nanos)).Add(op.requestLifetime), true
+}
+
+// expirable returns the requests which were not yet executed, the outstanding
+// ones, those a batch holds and those buffered for the view change
+func (op *obcBatch) expirable() []*Request {
+	var reqs []*Request
+	for e := op.reqStore.outstandingRequests.order.Front(); e != nil; e = e.Next() {
+		reqs = append(reqs, e.Value.(requestContainer).req)
+	}
+	for e := op.reqStore.pendingRequests.order.Front(); e != nil; e = e.Next() {
+		if rc := e.Value.(requestContainer); !op.reqStore.outstandingRequests.has(rc.key) {
+			reqs = append(reqs, rc.req)
+		}
+	}
+	return append(reqs, op.viewChangeBuffer...)
+}
+
+// armLifetimeTimer schedules the next expiry check for the earliest request to outlive the request lifetime
+func (op *obcBatch) armLifetimeTimer() {
+	if op.requestLifetime == 0 {
+		return
+	}
+	var earliest time.Time
+	for _, req := range op.expirable() {
+		if expiry, ok := op.requestExpiry(req); ok && (earliest.IsZero() || expiry.Before(earliest)) {
+			earliest = expiry
+		}
+	}
+	op.lifetimeDeadline = time.Time{}
+	if earliest.IsZero() {
+		op.lifetimeTimer.Stop()
+		return
+	}
+	op.setLifetimeDeadline(earliest)
+}
+
+// watchLifetime brings the next expiry check forward if the request outlives the request lifetime first
+func (op *obcBatch) watchLifetime(req *Request) {
+	if op.requestLifetime == 0 {
+		return
+	}
+	if expiry, ok := op.requestExpiry(req); ok && (op.lifetimeDeadline.IsZero() || expiry.Before(op.lifetimeDeadline)) {
+		op.setLifetimeDeadline(expiry)
+	}
+}
+
+func (op *obcBatch) setLifetimeDeadline(deadline time.Time) {
+	op.lifetimeDeadline = deadline
+	wait := deadline.Sub(op.pbft.now())
+	if wait < 0 {
+		wait = 0
+	}
+	op.lifetimeTimer.Reset(wait, lifetimeTimerEvent{})
+}
+
+// dropExpiredRequests drops the requests which outlived the request lifetime
+// without executing, whatever the view, and tells the clients which submitted
+// them through us.  We take those we are assembling into a batch out of it,
+// but a batch we already handed to consensus may still commit, in which case
+// the client gets the executed reply as well
+func (op *obcBatch) dropExpiredRequests() {
+	now := op.pbft.now()
+	var expired []*Request
+	for _, req := range op.expirable() {
+		if expiry, ok := op.requestExpiry(req); ok && !expiry.After(now) {
+			expired = append(expired, req)
+		}
+	}
+	if len(expired) == 0 {
+		op.armLifetimeTimer()
+		return
+	}
+
+	for _, req := range expired {
+		logger.Warningf("Replica %d dropping request %s, which was not executed within the request lifetime of %v", op.pbft.id, hash(req), op.requestLifetime)
+		if req.ReplicaId == op.pbft.id {
+			op.onReply(req, &Reply{Dropped: true})
+		}
+	}
+	op.forget(expired)
+}
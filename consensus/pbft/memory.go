@@ -0,0 +1,117 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"github.com/golang/protobuf/proto"
+
+	"github.com/hyperledger/fabric/consensus"
+	"github.com/hyperledger/fabric/consensus/util/events"
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/viper"
+)
+
+var memoryInstance consensus.Consenter // singleton service
+
+// GetMemoryPlugin returns the handle to the memory Consenter singleton
+func GetMemoryPlugin(c consensus.Stack) (consensus.Consenter, error) {
+	if memoryInstance == nil {
+		memoryInstance = newObcMemory(config, c)
+	}
+	return memoryInstance, nil
+}
+
+// obcMemory is a Consenter for a lone validator, which orders the client
+// transactions it receives through the in-memory orderer, one per batch, with
+// no replication and no fault tolerance
+type obcMemory struct {
+	obcGeneric
+	externalEventReceiver
+
+	manager events.Manager
+	orderer *memoryOrderer
+	codec   PayloadCodec
+}
+
+func newObcMemory(config *viper.Viper, stack consensus.Stack) *obcMemory {
+	op := &obcMemory{
+		obcGeneric: obcGeneric{stack: stack},
+		codec:      newPayloadCodec(config),
+	}
+	op.orderer = newMemoryOrderer(0, config, op)
+	if seqNo, err := op.getLastSeqNo(); err == nil {
+		op.orderer.seqNo = seqNo
+	}
+	logger.Infof("Memory orderer resuming after seqNo=%d", op.orderer.seqNo)
+
+	op.manager = events.NewManagerImpl()
+	op.manager.SetReceiver(op)
+	op.externalEventReceiver.manager = op.manager
+	op.manager.Start()
+	return op
+}
+
+// Close tells us to release resources we are holding
+func (op *obcMemory) Close() {
+	op.orderer.Close()
+	op.manager.Halt()
+}
+
+// execute hands an ordered batch to the stack, whose completion we learn through Executed
+func (op *obcMemory) execute(seqNo uint64, reqBatch *RequestBatch) {
+	var txs []*pb.Transaction
+	for _, req := range reqBatch.GetBatch() {
+		tx, err := op.codec.Decode(req.Payload)
+		if err != nil {
+			logger.Errorf("Memory orderer could not decode transaction, skipping it: %s", err)
+			continue
+		}
+		txs = append(txs, tx)
+	}
+	meta, _ := proto.Marshal(&Metadata{SeqNo: seqNo})
+	logger.Debugf("Memory orderer executing seqNo=%d containing %d transactions", seqNo, len(txs))
+	op.stack.Execute(meta, txs)
+}
+
+// ProcessEvent orders client transactions and commits their executions
+func (op *obcMemory) ProcessEvent(event events.Event) events.Event {
+	switch et := event.(type) {
+	case batchMessageEvent:
+		if et.msg.Type != pb.Message_CHAIN_TRANSACTION {
+			logger.Debugf("Memory orderer ignoring message of type %v", et.msg.Type)
+			return nil
+		}
+		tx, err := op.codec.Decode(et.msg.Payload)
+		if err != nil {
+			logger.Errorf("Memory orderer could not decode transaction: %s", err)
+			return nil
+		}
+		req := &Request{Timestamp: tx.Timestamp, Payload: et.msg.Payload}
+		return op.orderer.Submit(&RequestBatch{Batch: []*Request{req}})
+	case executedEvent:
+		op.stack.Commit(nil, et.tag.([]byte))
+	case executionFailedEvent:
+		// the stack rolled the batch back, it is skipped
+		logger.Warningf("Memory orderer execution failed, skipping it: %s", et.err)
+		return op.orderer.ProcessEvent(execDoneEvent{})
+	case committedEvent:
+		return op.orderer.ProcessEvent(execDoneEvent{})
+	default:
+		logger.Debugf("Memory orderer ignoring event %T", event)
+	}
+	return nil
+}
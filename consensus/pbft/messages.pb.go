@@ -20,9 +20,23 @@ It has these top-level messages:
 	PQset
 	NewView
 	FetchRequestBatch
+	RangeFetch
+	CommittedBatch
+	RangeReturn
+	ConsistencyProbe
+	ProbeReply
+	VoteBatch
+	Hello
+	CheckpointGossip
+	BootstrapRequest
+	BootstrapReply
 	RequestBatch
+	Bundle
+	RequestAck
 	BatchMessage
 	Metadata
+	Reply
+	ReplicaSet
 */
 package pbft
 
@@ -36,6 +50,54 @@ var _ = proto.Marshal
 var _ = fmt.Errorf
 var _ = math.Inf
 
+// Why the replica initiated the view change, for the operators only
+type ViewChange_Reason int32
+
+const (
+	ViewChange_UNSPECIFIED          ViewChange_Reason = 0
+	ViewChange_REQUEST_TIMEOUT      ViewChange_Reason = 1
+	ViewChange_NEW_VIEW_TIMEOUT     ViewChange_Reason = 2
+	ViewChange_NULL_REQUEST_TIMEOUT ViewChange_Reason = 3
+	ViewChange_EQUIVOCATION         ViewChange_Reason = 4
+	ViewChange_INVALID_NEW_VIEW     ViewChange_Reason = 5
+	ViewChange_VIEW_CYCLE           ViewChange_Reason = 6
+	ViewChange_CENSORSHIP           ViewChange_Reason = 7
+	ViewChange_SLOW_PRIMARY         ViewChange_Reason = 8
+	ViewChange_MANUAL               ViewChange_Reason = 9
+	ViewChange_JOINED               ViewChange_Reason = 10
+)
+
+var ViewChange_Reason_name = map[int32]string{
+	0:  "UNSPECIFIED",
+	1:  "REQUEST_TIMEOUT",
+	2:  "NEW_VIEW_TIMEOUT",
+	3:  "NULL_REQUEST_TIMEOUT",
+	4:  "EQUIVOCATION",
+	5:  "INVALID_NEW_VIEW",
+	6:  "VIEW_CYCLE",
+	7:  "CENSORSHIP",
+	8:  "SLOW_PRIMARY",
+	9:  "MANUAL",
+	10: "JOINED",
+}
+var ViewChange_Reason_value = map[string]int32{
+	"UNSPECIFIED":          0,
+	"REQUEST_TIMEOUT":      1,
+	"NEW_VIEW_TIMEOUT":     2,
+	"NULL_REQUEST_TIMEOUT": 3,
+	"EQUIVOCATION":         4,
+	"INVALID_NEW_VIEW":     5,
+	"VIEW_CYCLE":           6,
+	"CENSORSHIP":           7,
+	"SLOW_PRIMARY":         8,
+	"MANUAL":               9,
+	"JOINED":               10,
+}
+
+func (x ViewChange_Reason) String() string {
+	return proto.EnumName(ViewChange_Reason_name, int32(x))
+}
+
 type Message struct {
 	// Types that are valid to be assigned to Payload:
 	//	*Message_RequestBatch
@@ -47,6 +109,16 @@ type Message struct {
 	//	*Message_NewView
 	//	*Message_FetchRequestBatch
 	//	*Message_ReturnRequestBatch
+	//	*Message_ReplicaSet
+	//	*Message_RangeFetch
+	//	*Message_RangeReturn
+	//	*Message_ConsistencyProbe
+	//	*Message_ProbeReply
+	//	*Message_VoteBatch
+	//	*Message_Hello
+	//	*Message_CheckpointGossip
+	//	*Message_BootstrapRequest
+	//	*Message_BootstrapReply
 	Payload isMessage_Payload `protobuf_oneof:"payload"`
 }
 
@@ -85,6 +157,36 @@ type Message_FetchRequestBatch struct {
 type Message_ReturnRequestBatch struct {
 	ReturnRequestBatch *RequestBatch `protobuf:"bytes,9,opt,name=return_request_batch,oneof"`
 }
+type Message_ReplicaSet struct {
+	ReplicaSet *ReplicaSet `protobuf:"bytes,10,opt,name=replica_set,oneof"`
+}
+type Message_RangeFetch struct {
+	RangeFetch *RangeFetch `protobuf:"bytes,11,opt,name=range_fetch,oneof"`
+}
+type Message_RangeReturn struct {
+	RangeReturn *RangeReturn `protobuf:"bytes,12,opt,name=range_return,oneof"`
+}
+type Message_ConsistencyProbe struct {
+	ConsistencyProbe *ConsistencyProbe `protobuf:"bytes,13,opt,name=consistency_probe,oneof"`
+}
+type Message_ProbeReply struct {
+	ProbeReply *ProbeReply `protobuf:"bytes,14,opt,name=probe_reply,oneof"`
+}
+type Message_VoteBatch struct {
+	VoteBatch *VoteBatch `protobuf:"bytes,15,opt,name=vote_batch,oneof"`
+}
+type Message_Hello struct {
+	Hello *Hello `protobuf:"bytes,16,opt,name=hello,oneof"`
+}
+type Message_CheckpointGossip struct {
+	CheckpointGossip *CheckpointGossip `protobuf:"bytes,17,opt,name=checkpoint_gossip,oneof"`
+}
+type Message_BootstrapRequest struct {
+	BootstrapRequest *BootstrapRequest `protobuf:"bytes,18,opt,name=bootstrap_request,oneof"`
+}
+type Message_BootstrapReply struct {
+	BootstrapReply *BootstrapReply `protobuf:"bytes,19,opt,name=bootstrap_reply,oneof"`
+}
 
 func (*Message_RequestBatch) isMessage_Payload()       {}
 func (*Message_PrePrepare) isMessage_Payload()         {}
@@ -95,6 +197,16 @@ func (*Message_ViewChange) isMessage_Payload()         {}
 func (*Message_NewView) isMessage_Payload()            {}
 func (*Message_FetchRequestBatch) isMessage_Payload()  {}
 func (*Message_ReturnRequestBatch) isMessage_Payload() {}
+func (*Message_ReplicaSet) isMessage_Payload()         {}
+func (*Message_RangeFetch) isMessage_Payload()         {}
+func (*Message_RangeReturn) isMessage_Payload()        {}
+func (*Message_ConsistencyProbe) isMessage_Payload()   {}
+func (*Message_ProbeReply) isMessage_Payload()         {}
+func (*Message_VoteBatch) isMessage_Payload()          {}
+func (*Message_Hello) isMessage_Payload()              {}
+func (*Message_CheckpointGossip) isMessage_Payload()   {}
+func (*Message_BootstrapRequest) isMessage_Payload()   {}
+func (*Message_BootstrapReply) isMessage_Payload()     {}
 
 func (m *Message) GetPayload() isMessage_Payload {
 	if m != nil {
@@ -166,6 +278,76 @@ func (m *Message) GetReturnRequestBatch() *RequestBatch {
 	return nil
 }
 
+func (m *Message) GetReplicaSet() *ReplicaSet {
+	if x, ok := m.GetPayload().(*Message_ReplicaSet); ok {
+		return x.ReplicaSet
+	}
+	return nil
+}
+
+func (m *Message) GetRangeFetch() *RangeFetch {
+	if x, ok := m.GetPayload().(*Message_RangeFetch); ok {
+		return x.RangeFetch
+	}
+	return nil
+}
+
+func (m *Message) GetRangeReturn() *RangeReturn {
+	if x, ok := m.GetPayload().(*Message_RangeReturn); ok {
+		return x.RangeReturn
+	}
+	return nil
+}
+
+func (m *Message) GetConsistencyProbe() *ConsistencyProbe {
+	if x, ok := m.GetPayload().(*Message_ConsistencyProbe); ok {
+		return x.ConsistencyProbe
+	}
+	return nil
+}
+
+func (m *Message) GetProbeReply() *ProbeReply {
+	if x, ok := m.GetPayload().(*Message_ProbeReply); ok {
+		return x.ProbeReply
+	}
+	return nil
+}
+
+func (m *Message) GetVoteBatch() *VoteBatch {
+	if x, ok := m.GetPayload().(*Message_VoteBatch); ok {
+		return x.VoteBatch
+	}
+	return nil
+}
+
+func (m *Message) GetHello() *Hello {
+	if x, ok := m.GetPayload().(*Message_Hello); ok {
+		return x.Hello
+	}
+	return nil
+}
+
+func (m *Message) GetCheckpointGossip() *CheckpointGossip {
+	if x, ok := m.GetPayload().(*Message_CheckpointGossip); ok {
+		return x.CheckpointGossip
+	}
+	return nil
+}
+
+func (m *Message) GetBootstrapRequest() *BootstrapRequest {
+	if x, ok := m.GetPayload().(*Message_BootstrapRequest); ok {
+		return x.BootstrapRequest
+	}
+	return nil
+}
+
+func (m *Message) GetBootstrapReply() *BootstrapReply {
+	if x, ok := m.GetPayload().(*Message_BootstrapReply); ok {
+		return x.BootstrapReply
+	}
+	return nil
+}
+
 // XXX_OneofFuncs is for the internal use of the proto package.
 func (*Message) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer) error, func(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error), []interface{}) {
 	return _Message_OneofMarshaler, _Message_OneofUnmarshaler, []interface{}{
@@ -178,6 +360,16 @@ func (*Message) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer) error
 		(*Message_NewView)(nil),
 		(*Message_FetchRequestBatch)(nil),
 		(*Message_ReturnRequestBatch)(nil),
+		(*Message_ReplicaSet)(nil),
+		(*Message_RangeFetch)(nil),
+		(*Message_RangeReturn)(nil),
+		(*Message_ConsistencyProbe)(nil),
+		(*Message_ProbeReply)(nil),
+		(*Message_VoteBatch)(nil),
+		(*Message_Hello)(nil),
+		(*Message_CheckpointGossip)(nil),
+		(*Message_BootstrapRequest)(nil),
+		(*Message_BootstrapReply)(nil),
 	}
 }
 
@@ -230,6 +422,56 @@ func _Message_OneofMarshaler(msg proto.Message, b *proto.Buffer) error {
 		if err := b.EncodeMessage(x.ReturnRequestBatch); err != nil {
 			return err
 		}
+	case *Message_ReplicaSet:
+		b.EncodeVarint(10<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.ReplicaSet); err != nil {
+			return err
+		}
+	case *Message_RangeFetch:
+		b.EncodeVarint(11<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.RangeFetch); err != nil {
+			return err
+		}
+	case *Message_RangeReturn:
+		b.EncodeVarint(12<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.RangeReturn); err != nil {
+			return err
+		}
+	case *Message_ConsistencyProbe:
+		b.EncodeVarint(13<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.ConsistencyProbe); err != nil {
+			return err
+		}
+	case *Message_ProbeReply:
+		b.EncodeVarint(14<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.ProbeReply); err != nil {
+			return err
+		}
+	case *Message_VoteBatch:
+		b.EncodeVarint(15<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.VoteBatch); err != nil {
+			return err
+		}
+	case *Message_Hello:
+		b.EncodeVarint(16<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Hello); err != nil {
+			return err
+		}
+	case *Message_CheckpointGossip:
+		b.EncodeVarint(17<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.CheckpointGossip); err != nil {
+			return err
+		}
+	case *Message_BootstrapRequest:
+		b.EncodeVarint(18<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.BootstrapRequest); err != nil {
+			return err
+		}
+	case *Message_BootstrapReply:
+		b.EncodeVarint(19<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.BootstrapReply); err != nil {
+			return err
+		}
 	case nil:
 	default:
 		return fmt.Errorf("Message.Payload has unexpected type %T", x)
@@ -312,16 +554,99 @@ func _Message_OneofUnmarshaler(msg proto.Message, tag, wire int, b *proto.Buffer
 		err := b.DecodeMessage(msg)
 		m.Payload = &Message_ReturnRequestBatch{msg}
 		return true, err
+	case 10: // payload.replica_set
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(ReplicaSet)
+		err := b.DecodeMessage(msg)
+		m.Payload = &Message_ReplicaSet{msg}
+		return true, err
+	case 11: // payload.range_fetch
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(RangeFetch)
+		err := b.DecodeMessage(msg)
+		m.Payload = &Message_RangeFetch{msg}
+		return true, err
+	case 12: // payload.range_return
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(RangeReturn)
+		err := b.DecodeMessage(msg)
+		m.Payload = &Message_RangeReturn{msg}
+		return true, err
+	case 13: // payload.consistency_probe
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(ConsistencyProbe)
+		err := b.DecodeMessage(msg)
+		m.Payload = &Message_ConsistencyProbe{msg}
+		return true, err
+	case 14: // payload.probe_reply
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(ProbeReply)
+		err := b.DecodeMessage(msg)
+		m.Payload = &Message_ProbeReply{msg}
+		return true, err
+	case 15: // payload.vote_batch
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(VoteBatch)
+		err := b.DecodeMessage(msg)
+		m.Payload = &Message_VoteBatch{msg}
+		return true, err
+	case 16: // payload.hello
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(Hello)
+		err := b.DecodeMessage(msg)
+		m.Payload = &Message_Hello{msg}
+		return true, err
+	case 17: // payload.checkpoint_gossip
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(CheckpointGossip)
+		err := b.DecodeMessage(msg)
+		m.Payload = &Message_CheckpointGossip{msg}
+		return true, err
+	case 18: // payload.bootstrap_request
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(BootstrapRequest)
+		err := b.DecodeMessage(msg)
+		m.Payload = &Message_BootstrapRequest{msg}
+		return true, err
+	case 19: // payload.bootstrap_reply
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(BootstrapReply)
+		err := b.DecodeMessage(msg)
+		m.Payload = &Message_BootstrapReply{msg}
+		return true, err
 	default:
 		return false, nil
 	}
 }
 
 type Request struct {
-	Timestamp *google_protobuf.Timestamp `protobuf:"bytes,1,opt,name=timestamp" json:"timestamp,omitempty"`
-	Payload   []byte                     `protobuf:"bytes,2,opt,name=payload,proto3" json:"payload,omitempty"`
-	ReplicaId uint64                     `protobuf:"varint,3,opt,name=replica_id" json:"replica_id,omitempty"`
-	Signature []byte                     `protobuf:"bytes,4,opt,name=signature,proto3" json:"signature,omitempty"`
+	Timestamp       *google_protobuf.Timestamp `protobuf:"bytes,1,opt,name=timestamp" json:"timestamp,omitempty"`
+	Payload         []byte                     `protobuf:"bytes,2,opt,name=payload,proto3" json:"payload,omitempty"`
+	ReplicaId       uint64                     `protobuf:"varint,3,opt,name=replica_id" json:"replica_id,omitempty"`
+	Signature       []byte                     `protobuf:"bytes,4,opt,name=signature,proto3" json:"signature,omitempty"`
+	TraceId         string                     `protobuf:"bytes,5,opt,name=trace_id" json:"trace_id,omitempty"`
+	Tag             string                     `protobuf:"bytes,6,opt,name=tag" json:"tag,omitempty"`
+	Reconfiguration bool                       `protobuf:"varint,7,opt,name=reconfiguration" json:"reconfiguration,omitempty"`
 }
 
 func (m *Request) Reset()         { *m = Request{} }
@@ -335,12 +660,41 @@ func (m *Request) GetTimestamp() *google_protobuf.Timestamp {
 	return nil
 }
 
+type Reconfiguration struct {
+	Settings       []*ConfigSetting `protobuf:"bytes,1,rep,name=settings" json:"settings,omitempty"`
+	SequenceNumber uint64           `protobuf:"varint,2,opt,name=sequence_number" json:"sequence_number,omitempty"`
+	Credential     []byte           `protobuf:"bytes,3,opt,name=credential,proto3" json:"credential,omitempty"`
+}
+
+func (m *Reconfiguration) Reset()         { *m = Reconfiguration{} }
+func (m *Reconfiguration) String() string { return proto.CompactTextString(m) }
+func (*Reconfiguration) ProtoMessage()    {}
+
+func (m *Reconfiguration) GetSettings() []*ConfigSetting {
+	if m != nil {
+		return m.Settings
+	}
+	return nil
+}
+
+type ConfigSetting struct {
+	Key   string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Value string `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+}
+
+func (m *ConfigSetting) Reset()         { *m = ConfigSetting{} }
+func (m *ConfigSetting) String() string { return proto.CompactTextString(m) }
+func (*ConfigSetting) ProtoMessage()    {}
+
 type PrePrepare struct {
-	View           uint64        `protobuf:"varint,1,opt,name=view" json:"view,omitempty"`
-	SequenceNumber uint64        `protobuf:"varint,2,opt,name=sequence_number" json:"sequence_number,omitempty"`
-	BatchDigest    string        `protobuf:"bytes,3,opt,name=batch_digest" json:"batch_digest,omitempty"`
-	RequestBatch   *RequestBatch `protobuf:"bytes,4,opt,name=request_batch" json:"request_batch,omitempty"`
-	ReplicaId      uint64        `protobuf:"varint,5,opt,name=replica_id" json:"replica_id,omitempty"`
+	View                     uint64        `protobuf:"varint,1,opt,name=view" json:"view,omitempty"`
+	SequenceNumber           uint64        `protobuf:"varint,2,opt,name=sequence_number" json:"sequence_number,omitempty"`
+	BatchDigest              string        `protobuf:"bytes,3,opt,name=batch_digest" json:"batch_digest,omitempty"`
+	RequestBatch             *RequestBatch `protobuf:"bytes,4,opt,name=request_batch" json:"request_batch,omitempty"`
+	ReplicaId                uint64        `protobuf:"varint,5,opt,name=replica_id" json:"replica_id,omitempty"`
+	RequestDigests           []string      `protobuf:"bytes,6,rep,name=request_digests" json:"request_digests,omitempty"`
+	CheckpointSequenceNumber uint64        `protobuf:"varint,7,opt,name=checkpoint_sequence_number" json:"checkpoint_sequence_number,omitempty"`
+	CheckpointId             string        `protobuf:"bytes,8,opt,name=checkpoint_id" json:"checkpoint_id,omitempty"`
 }
 
 func (m *PrePrepare) Reset()         { *m = PrePrepare{} }
@@ -395,20 +749,41 @@ func (m *Checkpoint) Reset()         { *m = Checkpoint{} }
 func (m *Checkpoint) String() string { return proto.CompactTextString(m) }
 func (*Checkpoint) ProtoMessage()    {}
 
+type Beacon struct {
+	Since          uint64 `protobuf:"varint,1,opt,name=since" json:"since,omitempty"`
+	SequenceNumber uint64 `protobuf:"varint,2,opt,name=sequence_number" json:"sequence_number,omitempty"`
+	Id             string `protobuf:"bytes,3,opt,name=id" json:"id,omitempty"`
+	Previous       uint64 `protobuf:"varint,4,opt,name=previous" json:"previous,omitempty"`
+}
+
+func (m *Beacon) Reset()         { *m = Beacon{} }
+func (m *Beacon) String() string { return proto.CompactTextString(m) }
+func (*Beacon) ProtoMessage()    {}
+
 type ViewChange struct {
-	View      uint64           `protobuf:"varint,1,opt,name=view" json:"view,omitempty"`
-	H         uint64           `protobuf:"varint,2,opt,name=h" json:"h,omitempty"`
-	Cset      []*ViewChange_C  `protobuf:"bytes,3,rep,name=cset" json:"cset,omitempty"`
-	Pset      []*ViewChange_PQ `protobuf:"bytes,4,rep,name=pset" json:"pset,omitempty"`
-	Qset      []*ViewChange_PQ `protobuf:"bytes,5,rep,name=qset" json:"qset,omitempty"`
-	ReplicaId uint64           `protobuf:"varint,6,opt,name=replica_id" json:"replica_id,omitempty"`
-	Signature []byte           `protobuf:"bytes,7,opt,name=signature,proto3" json:"signature,omitempty"`
+	View      uint64            `protobuf:"varint,1,opt,name=view" json:"view,omitempty"`
+	H         uint64            `protobuf:"varint,2,opt,name=h" json:"h,omitempty"`
+	Cset      []*ViewChange_C   `protobuf:"bytes,3,rep,name=cset" json:"cset,omitempty"`
+	Pset      []*ViewChange_PQ  `protobuf:"bytes,4,rep,name=pset" json:"pset,omitempty"`
+	Qset      []*ViewChange_PQ  `protobuf:"bytes,5,rep,name=qset" json:"qset,omitempty"`
+	ReplicaId uint64            `protobuf:"varint,6,opt,name=replica_id" json:"replica_id,omitempty"`
+	Signature []byte            `protobuf:"bytes,7,opt,name=signature,proto3" json:"signature,omitempty"`
+	Compact   bool              `protobuf:"varint,8,opt,name=compact" json:"compact,omitempty"`
+	Reason    ViewChange_Reason `protobuf:"varint,9,opt,name=reason,enum=pbft.ViewChange_Reason" json:"reason,omitempty"`
+	Beacon    *Beacon           `protobuf:"bytes,10,opt,name=beacon" json:"beacon,omitempty"`
 }
 
 func (m *ViewChange) Reset()         { *m = ViewChange{} }
 func (m *ViewChange) String() string { return proto.CompactTextString(m) }
 func (*ViewChange) ProtoMessage()    {}
 
+func (m *ViewChange) GetBeacon() *Beacon {
+	if m != nil {
+		return m.Beacon
+	}
+	return nil
+}
+
 func (m *ViewChange) GetCset() []*ViewChange_C {
 	if m != nil {
 		return m.Cset
@@ -499,8 +874,169 @@ func (m *FetchRequestBatch) Reset()         { *m = FetchRequestBatch{} }
 func (m *FetchRequestBatch) String() string { return proto.CompactTextString(m) }
 func (*FetchRequestBatch) ProtoMessage()    {}
 
+type RangeFetch struct {
+	Start     uint64 `protobuf:"varint,1,opt,name=start" json:"start,omitempty"`
+	End       uint64 `protobuf:"varint,2,opt,name=end" json:"end,omitempty"`
+	ReplicaId uint64 `protobuf:"varint,3,opt,name=replica_id" json:"replica_id,omitempty"`
+}
+
+func (m *RangeFetch) Reset()         { *m = RangeFetch{} }
+func (m *RangeFetch) String() string { return proto.CompactTextString(m) }
+func (*RangeFetch) ProtoMessage()    {}
+
+type CommittedBatch struct {
+	View           uint64        `protobuf:"varint,1,opt,name=view" json:"view,omitempty"`
+	SequenceNumber uint64        `protobuf:"varint,2,opt,name=sequence_number" json:"sequence_number,omitempty"`
+	RequestBatch   *RequestBatch `protobuf:"bytes,3,opt,name=request_batch" json:"request_batch,omitempty"`
+	Commits        []*Commit     `protobuf:"bytes,4,rep,name=commits" json:"commits,omitempty"`
+}
+
+func (m *CommittedBatch) Reset()         { *m = CommittedBatch{} }
+func (m *CommittedBatch) String() string { return proto.CompactTextString(m) }
+func (*CommittedBatch) ProtoMessage()    {}
+
+func (m *CommittedBatch) GetRequestBatch() *RequestBatch {
+	if m != nil {
+		return m.RequestBatch
+	}
+	return nil
+}
+
+func (m *CommittedBatch) GetCommits() []*Commit {
+	if m != nil {
+		return m.Commits
+	}
+	return nil
+}
+
+type RangeReturn struct {
+	Batches   []*CommittedBatch `protobuf:"bytes,1,rep,name=batches" json:"batches,omitempty"`
+	ReplicaId uint64            `protobuf:"varint,2,opt,name=replica_id" json:"replica_id,omitempty"`
+}
+
+func (m *RangeReturn) Reset()         { *m = RangeReturn{} }
+func (m *RangeReturn) String() string { return proto.CompactTextString(m) }
+func (*RangeReturn) ProtoMessage()    {}
+
+func (m *RangeReturn) GetBatches() []*CommittedBatch {
+	if m != nil {
+		return m.Batches
+	}
+	return nil
+}
+
+type ConsistencyProbe struct {
+	Nonce          uint64 `protobuf:"varint,1,opt,name=nonce" json:"nonce,omitempty"`
+	SequenceNumber uint64 `protobuf:"varint,2,opt,name=sequence_number" json:"sequence_number,omitempty"`
+	ReplicaId      uint64 `protobuf:"varint,3,opt,name=replica_id" json:"replica_id,omitempty"`
+}
+
+func (m *ConsistencyProbe) Reset()         { *m = ConsistencyProbe{} }
+func (m *ConsistencyProbe) String() string { return proto.CompactTextString(m) }
+func (*ConsistencyProbe) ProtoMessage()    {}
+
+type ProbeReply struct {
+	Nonce          uint64 `protobuf:"varint,1,opt,name=nonce" json:"nonce,omitempty"`
+	SequenceNumber uint64 `protobuf:"varint,2,opt,name=sequence_number" json:"sequence_number,omitempty"`
+	Id             string `protobuf:"bytes,3,opt,name=id" json:"id,omitempty"`
+	ReplicaId      uint64 `protobuf:"varint,4,opt,name=replica_id" json:"replica_id,omitempty"`
+}
+
+func (m *ProbeReply) Reset()         { *m = ProbeReply{} }
+func (m *ProbeReply) String() string { return proto.CompactTextString(m) }
+func (*ProbeReply) ProtoMessage()    {}
+
+type VoteBatch struct {
+	Prepares  []*Prepare `protobuf:"bytes,1,rep,name=prepares" json:"prepares,omitempty"`
+	Commits   []*Commit  `protobuf:"bytes,2,rep,name=commits" json:"commits,omitempty"`
+	ReplicaId uint64     `protobuf:"varint,3,opt,name=replica_id" json:"replica_id,omitempty"`
+}
+
+func (m *VoteBatch) Reset()         { *m = VoteBatch{} }
+func (m *VoteBatch) String() string { return proto.CompactTextString(m) }
+func (*VoteBatch) ProtoMessage()    {}
+
+func (m *VoteBatch) GetPrepares() []*Prepare {
+	if m != nil {
+		return m.Prepares
+	}
+	return nil
+}
+
+func (m *VoteBatch) GetCommits() []*Commit {
+	if m != nil {
+		return m.Commits
+	}
+	return nil
+}
+
+type Hello struct {
+	ReplicaId          uint64 `protobuf:"varint,1,opt,name=replica_id" json:"replica_id,omitempty"`
+	ProtocolVersion    uint32 `protobuf:"varint,2,opt,name=protocol_version" json:"protocol_version,omitempty"`
+	MinProtocolVersion uint32 `protobuf:"varint,3,opt,name=min_protocol_version" json:"min_protocol_version,omitempty"`
+}
+
+func (m *Hello) Reset()         { *m = Hello{} }
+func (m *Hello) String() string { return proto.CompactTextString(m) }
+func (*Hello) ProtoMessage()    {}
+
+type CheckpointGossip struct {
+	ReplicaId      uint64        `protobuf:"varint,1,opt,name=replica_id" json:"replica_id,omitempty"`
+	SequenceNumber uint64        `protobuf:"varint,2,opt,name=sequence_number" json:"sequence_number,omitempty"`
+	Id             string        `protobuf:"bytes,3,opt,name=id" json:"id,omitempty"`
+	Certificate    []*Checkpoint `protobuf:"bytes,4,rep,name=certificate" json:"certificate,omitempty"`
+}
+
+func (m *CheckpointGossip) Reset()         { *m = CheckpointGossip{} }
+func (m *CheckpointGossip) String() string { return proto.CompactTextString(m) }
+func (*CheckpointGossip) ProtoMessage()    {}
+
+func (m *CheckpointGossip) GetCertificate() []*Checkpoint {
+	if m != nil {
+		return m.Certificate
+	}
+	return nil
+}
+
+type BootstrapRequest struct {
+	ReplicaId uint64 `protobuf:"varint,1,opt,name=replica_id" json:"replica_id,omitempty"`
+}
+
+func (m *BootstrapRequest) Reset()         { *m = BootstrapRequest{} }
+func (m *BootstrapRequest) String() string { return proto.CompactTextString(m) }
+func (*BootstrapRequest) ProtoMessage()    {}
+
+type BootstrapReply struct {
+	ReplicaId      uint64            `protobuf:"varint,1,opt,name=replica_id" json:"replica_id,omitempty"`
+	ReplicaSet     string            `protobuf:"bytes,2,opt,name=replica_set" json:"replica_set,omitempty"`
+	View           uint64            `protobuf:"varint,3,opt,name=view" json:"view,omitempty"`
+	SequenceNumber uint64            `protobuf:"varint,4,opt,name=sequence_number" json:"sequence_number,omitempty"`
+	Id             string            `protobuf:"bytes,5,opt,name=id" json:"id,omitempty"`
+	Certificate    []*Checkpoint     `protobuf:"bytes,6,rep,name=certificate" json:"certificate,omitempty"`
+	Batches        []*CommittedBatch `protobuf:"bytes,7,rep,name=batches" json:"batches,omitempty"`
+}
+
+func (m *BootstrapReply) Reset()         { *m = BootstrapReply{} }
+func (m *BootstrapReply) String() string { return proto.CompactTextString(m) }
+func (*BootstrapReply) ProtoMessage()    {}
+
+func (m *BootstrapReply) GetCertificate() []*Checkpoint {
+	if m != nil {
+		return m.Certificate
+	}
+	return nil
+}
+
+func (m *BootstrapReply) GetBatches() []*CommittedBatch {
+	if m != nil {
+		return m.Batches
+	}
+	return nil
+}
+
 type RequestBatch struct {
-	Batch []*Request `protobuf:"bytes,1,rep,name=batch" json:"batch,omitempty"`
+	Batch    []*Request `protobuf:"bytes,1,rep,name=batch" json:"batch,omitempty"`
+	Metadata []byte     `protobuf:"bytes,2,opt,name=metadata,proto3" json:"metadata,omitempty"`
 }
 
 func (m *RequestBatch) Reset()         { *m = RequestBatch{} }
@@ -514,12 +1050,32 @@ func (m *RequestBatch) GetBatch() []*Request {
 	return nil
 }
 
+type Bundle struct {
+	Payloads [][]byte `protobuf:"bytes,1,rep,name=payloads,proto3" json:"payloads,omitempty"`
+}
+
+func (m *Bundle) Reset()         { *m = Bundle{} }
+func (m *Bundle) String() string { return proto.CompactTextString(m) }
+func (*Bundle) ProtoMessage()    {}
+
+type RequestAck struct {
+	View          uint64 `protobuf:"varint,1,opt,name=view" json:"view,omitempty"`
+	RequestDigest string `protobuf:"bytes,2,opt,name=request_digest" json:"request_digest,omitempty"`
+	ReplicaId     uint64 `protobuf:"varint,3,opt,name=replica_id" json:"replica_id,omitempty"`
+}
+
+func (m *RequestAck) Reset()         { *m = RequestAck{} }
+func (m *RequestAck) String() string { return proto.CompactTextString(m) }
+func (*RequestAck) ProtoMessage()    {}
+
 type BatchMessage struct {
 	// Types that are valid to be assigned to Payload:
 	//	*BatchMessage_Request
 	//	*BatchMessage_RequestBatch
 	//	*BatchMessage_PbftMessage
 	//	*BatchMessage_Complaint
+	//	*BatchMessage_RequestAck
+	//	*BatchMessage_Bundle
 	Payload isBatchMessage_Payload `protobuf_oneof:"payload"`
 }
 
@@ -543,11 +1099,19 @@ type BatchMessage_PbftMessage struct {
 type BatchMessage_Complaint struct {
 	Complaint *Request `protobuf:"bytes,4,opt,name=complaint,oneof"`
 }
+type BatchMessage_RequestAck struct {
+	RequestAck *RequestAck `protobuf:"bytes,5,opt,name=request_ack,oneof"`
+}
+type BatchMessage_Bundle struct {
+	Bundle *Bundle `protobuf:"bytes,6,opt,name=bundle,oneof"`
+}
 
 func (*BatchMessage_Request) isBatchMessage_Payload()      {}
 func (*BatchMessage_RequestBatch) isBatchMessage_Payload() {}
 func (*BatchMessage_PbftMessage) isBatchMessage_Payload()  {}
 func (*BatchMessage_Complaint) isBatchMessage_Payload()    {}
+func (*BatchMessage_RequestAck) isBatchMessage_Payload()   {}
+func (*BatchMessage_Bundle) isBatchMessage_Payload()       {}
 
 func (m *BatchMessage) GetPayload() isBatchMessage_Payload {
 	if m != nil {
@@ -584,6 +1148,20 @@ func (m *BatchMessage) GetComplaint() *Request {
 	return nil
 }
 
+func (m *BatchMessage) GetRequestAck() *RequestAck {
+	if x, ok := m.GetPayload().(*BatchMessage_RequestAck); ok {
+		return x.RequestAck
+	}
+	return nil
+}
+
+func (m *BatchMessage) GetBundle() *Bundle {
+	if x, ok := m.GetPayload().(*BatchMessage_Bundle); ok {
+		return x.Bundle
+	}
+	return nil
+}
+
 // XXX_OneofFuncs is for the internal use of the proto package.
 func (*BatchMessage) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer) error, func(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error), []interface{}) {
 	return _BatchMessage_OneofMarshaler, _BatchMessage_OneofUnmarshaler, []interface{}{
@@ -591,6 +1169,8 @@ func (*BatchMessage) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer)
 		(*BatchMessage_RequestBatch)(nil),
 		(*BatchMessage_PbftMessage)(nil),
 		(*BatchMessage_Complaint)(nil),
+		(*BatchMessage_RequestAck)(nil),
+		(*BatchMessage_Bundle)(nil),
 	}
 }
 
@@ -616,6 +1196,16 @@ func _BatchMessage_OneofMarshaler(msg proto.Message, b *proto.Buffer) error {
 		if err := b.EncodeMessage(x.Complaint); err != nil {
 			return err
 		}
+	case *BatchMessage_RequestAck:
+		b.EncodeVarint(5<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.RequestAck); err != nil {
+			return err
+		}
+	case *BatchMessage_Bundle:
+		b.EncodeVarint(6<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Bundle); err != nil {
+			return err
+		}
 	case nil:
 	default:
 		return fmt.Errorf("BatchMessage.Payload has unexpected type %T", x)
@@ -657,15 +1247,93 @@ func _BatchMessage_OneofUnmarshaler(msg proto.Message, tag, wire int, b *proto.B
 		err := b.DecodeMessage(msg)
 		m.Payload = &BatchMessage_Complaint{msg}
 		return true, err
+	case 5: // payload.request_ack
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(RequestAck)
+		err := b.DecodeMessage(msg)
+		m.Payload = &BatchMessage_RequestAck{msg}
+		return true, err
+	case 6: // payload.bundle
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(Bundle)
+		err := b.DecodeMessage(msg)
+		m.Payload = &BatchMessage_Bundle{msg}
+		return true, err
 	default:
 		return false, nil
 	}
 }
 
 type Metadata struct {
-	SeqNo uint64 `protobuf:"varint,1,opt,name=seqNo" json:"seqNo,omitempty"`
+	SeqNo         uint64             `protobuf:"varint,1,opt,name=seqNo" json:"seqNo,omitempty"`
+	BlockMetadata []byte             `protobuf:"bytes,2,opt,name=block_metadata,proto3" json:"block_metadata,omitempty"`
+	BatchDigest   string             `protobuf:"bytes,3,opt,name=batch_digest" json:"batch_digest,omitempty"`
+	PrevDigest    string             `protobuf:"bytes,4,opt,name=prev_digest" json:"prev_digest,omitempty"`
+	Reconfigured  *Reconfiguration   `protobuf:"bytes,5,opt,name=reconfigured" json:"reconfigured,omitempty"`
+	Scheduled     []*Reconfiguration `protobuf:"bytes,6,rep,name=scheduled" json:"scheduled,omitempty"`
+	QuotaWindow   uint64             `protobuf:"varint,7,opt,name=quota_window" json:"quota_window,omitempty"`
+	QuotaUsage    []*QuotaUsage      `protobuf:"bytes,8,rep,name=quota_usage" json:"quota_usage,omitempty"`
 }
 
 func (m *Metadata) Reset()         { *m = Metadata{} }
 func (m *Metadata) String() string { return proto.CompactTextString(m) }
 func (*Metadata) ProtoMessage()    {}
+
+func (m *Metadata) GetReconfigured() *Reconfiguration {
+	if m != nil {
+		return m.Reconfigured
+	}
+	return nil
+}
+
+func (m *Metadata) GetScheduled() []*Reconfiguration {
+	if m != nil {
+		return m.Scheduled
+	}
+	return nil
+}
+
+func (m *Metadata) GetQuotaUsage() []*QuotaUsage {
+	if m != nil {
+		return m.QuotaUsage
+	}
+	return nil
+}
+
+type QuotaUsage struct {
+	Org      string `protobuf:"bytes,1,opt,name=org" json:"org,omitempty"`
+	Requests uint64 `protobuf:"varint,2,opt,name=requests" json:"requests,omitempty"`
+	Bytes    uint64 `protobuf:"varint,3,opt,name=bytes" json:"bytes,omitempty"`
+}
+
+func (m *QuotaUsage) Reset()         { *m = QuotaUsage{} }
+func (m *QuotaUsage) String() string { return proto.CompactTextString(m) }
+func (*QuotaUsage) ProtoMessage()    {}
+
+type Reply struct {
+	SeqNo         uint64 `protobuf:"varint,1,opt,name=seqNo" json:"seqNo,omitempty"`
+	Executed      bool   `protobuf:"varint,2,opt,name=executed" json:"executed,omitempty"`
+	Result        []byte `protobuf:"bytes,3,opt,name=result,proto3" json:"result,omitempty"`
+	RequestDigest string `protobuf:"bytes,4,opt,name=request_digest" json:"request_digest,omitempty"`
+	View          uint64 `protobuf:"varint,5,opt,name=view" json:"view,omitempty"`
+	ReplicaId     uint64 `protobuf:"varint,6,opt,name=replica_id" json:"replica_id,omitempty"`
+	Signature     []byte `protobuf:"bytes,7,opt,name=signature,proto3" json:"signature,omitempty"`
+	Dropped       bool   `protobuf:"varint,8,opt,name=dropped" json:"dropped,omitempty"`
+}
+
+func (m *Reply) Reset()         { *m = Reply{} }
+func (m *Reply) String() string { return proto.CompactTextString(m) }
+func (*Reply) ProtoMessage()    {}
+
+type ReplicaSet struct {
+	ReplicaId uint64 `protobuf:"varint,1,opt,name=replica_id" json:"replica_id,omitempty"`
+	Digest    string `protobuf:"bytes,2,opt,name=digest" json:"digest,omitempty"`
+}
+
+func (m *ReplicaSet) Reset()         { *m = ReplicaSet{} }
+func (m *ReplicaSet) String() string { return proto.CompactTextString(m) }
+func (*ReplicaSet) ProtoMessage()    {}
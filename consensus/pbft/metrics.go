@@ -0,0 +1,225 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// commitLatencyBuckets are the upper bounds, in seconds, of the commit latency histogram
+var commitLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// latencyHistogram counts observed latencies into commitLatencyBuckets
+type latencyHistogram struct {
+	counts []uint64 // per bucket, the last one counting latencies above every bound
+	sum    time.Duration
+	count  uint64
+}
+
+func (h *latencyHistogram) observe(latency time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(commitLatencyBuckets)+1)
+	}
+	i := sort.SearchFloat64s(commitLatencyBuckets, latency.Seconds())
+	h.counts[i]++
+	h.sum += latency
+	h.count++
+}
+
+// Histogram is a snapshot of a latency histogram, with cumulative bucket counts
+type Histogram struct {
+	Bounds []float64 // bucket upper bounds in seconds
+	Counts []uint64  // observations at or below the corresponding bound
+	Sum    float64   // total of the observations in seconds
+	Count  uint64    // number of observations
+}
+
+func (h *latencyHistogram) snapshot() Histogram {
+	snap := Histogram{
+		Bounds: commitLatencyBuckets,
+		Counts: make([]uint64, len(commitLatencyBuckets)),
+		Sum:    h.sum.Seconds(),
+		Count:  h.count,
+	}
+	var cumulative uint64
+	for i := range commitLatencyBuckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		snap.Counts[i] = cumulative
+	}
+	return snap
+}
+
+// Metrics is a snapshot of the counters of a replica
+type Metrics struct {
+	Replica          uint64
+	View             uint64
+	LastExec         uint64
+	ViewChanges      uint64            // view changes this replica initiated
+	ViewChangeCauses map[string]uint64 // of ViewChanges, those initiated for each reason
+	MessagesReceived map[string]uint64 // consensus messages received, by type
+	QueueDepth       int               // client requests waiting to be ordered
+	CommitLatency    Histogram         // time from pre-prepare to commit
+
+	SlowPrimaryViewChanges uint64 // of ViewChanges, those initiated because the primary was slow rather than faulty
+}
+
+// MetricsSource is implemented by consenters which expose their metrics
+type MetricsSource interface {
+	Metrics() Metrics
+}
+
+// Metrics returns a snapshot of the replica's counters.  It must run on the
+// event thread.
+func (instance *pbftCore) Metrics() Metrics {
+	m := Metrics{
+		Replica:          instance.id,
+		View:             instance.view,
+		LastExec:         instance.lastExec,
+		ViewChanges:      instance.viewChanges,
+		ViewChangeCauses: make(map[string]uint64, len(instance.viewChangeReasons)),
+		MessagesReceived: make(map[string]uint64, len(instance.msgsReceived)),
+		CommitLatency:    instance.commitLatencies.snapshot(),
+
+		SlowPrimaryViewChanges: instance.viewChangeReasons[ViewChange_SLOW_PRIMARY],
+	}
+	if queue, ok := instance.consumer.(requestQueue); ok {
+		m.QueueDepth = len(queue.queued())
+	}
+	for reason, count := range instance.viewChangeReasons {
+		m.ViewChangeCauses[reason.String()] = count
+	}
+	for msgType, count := range instance.msgsReceived {
+		m.MessagesReceived[msgType] = count
+	}
+	return m
+}
+
+// messageType names the payload of a consensus message for the metrics
+func messageType(msg *Message) string {
+	switch msg.GetPayload().(type) {
+	case *Message_RequestBatch:
+		return "request_batch"
+	case *Message_PrePrepare:
+		return "pre_prepare"
+	case *Message_Prepare:
+		return "prepare"
+	case *Message_Commit:
+		return "commit"
+	case *Message_Checkpoint:
+		return "checkpoint"
+	case *Message_ViewChange:
+		return "view_change"
+	case *Message_NewView:
+		return "new_view"
+	case *Message_FetchRequestBatch:
+		return "fetch_request_batch"
+	case *Message_ReturnRequestBatch:
+		return "return_request_batch"
+	case *Message_ReplicaSet:
+		return "replica_set"
+	case *Message_RangeFetch:
+		return "range_fetch"
+	case *Message_RangeReturn:
+		return "range_return"
+	case *Message_ConsistencyProbe:
+		return "consistency_probe"
+	case *Message_ProbeReply:
+		return "probe_reply"
+	case *Message_VoteBatch:
+		return "vote_batch"
+	case *Message_Hello:
+		return "hello"
+	case *Message_CheckpointGossip:
+		return "checkpoint_gossip"
+	case *Message_BootstrapRequest:
+		return "bootstrap_request"
+	case *Message_BootstrapReply:
+		return "bootstrap_reply"
+	}
+	return "unknown"
+}
+
+type metricsHandler struct {
+	source MetricsSource
+}
+
+// NewMetricsHandler serves the metrics of source in the Prometheus text
+// exposition format.  The snapshot is only taken when the handler is scraped.
+func NewMetricsHandler(source MetricsSource) http.Handler {
+	return &metricsHandler{source: source}
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(formatMetrics(h.source.Metrics()))
+}
+
+// formatMetrics renders a snapshot in the Prometheus text exposition format
+func formatMetrics(m Metrics) []byte {
+	var buf bytes.Buffer
+	replica := fmt.Sprintf(`replica="%d"`, m.Replica)
+	family := func(name, kind, help string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	family("pbft_view", "gauge", "Current view of the replica.")
+	fmt.Fprintf(&buf, "pbft_view{%s} %d\n", replica, m.View)
+	family("pbft_last_executed_sequence_number", "gauge", "Sequence number of the last executed request batch.")
+	fmt.Fprintf(&buf, "pbft_last_executed_sequence_number{%s} %d\n", replica, m.LastExec)
+	family("pbft_view_changes_total", "counter", "View changes initiated by the replica.")
+	fmt.Fprintf(&buf, "pbft_view_changes_total{%s} %d\n", replica, m.ViewChanges)
+	family("pbft_slow_primary_view_changes_total", "counter", "View changes initiated by the replica because the primary was slow.")
+	fmt.Fprintf(&buf, "pbft_slow_primary_view_changes_total{%s} %d\n", replica, m.SlowPrimaryViewChanges)
+	family("pbft_view_change_causes_total", "counter", "View changes initiated by the replica, by reason.")
+	var reasons []string
+	for reason := range m.ViewChangeCauses {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(&buf, "pbft_view_change_causes_total{%s,reason=\"%s\"} %d\n", replica, reason, m.ViewChangeCauses[reason])
+	}
+	family("pbft_request_queue_depth", "gauge", "Client requests waiting to be ordered.")
+	fmt.Fprintf(&buf, "pbft_request_queue_depth{%s} %d\n", replica, m.QueueDepth)
+
+	family("pbft_messages_received_total", "counter", "Consensus messages received, by type.")
+	var msgTypes []string
+	for msgType := range m.MessagesReceived {
+		msgTypes = append(msgTypes, msgType)
+	}
+	sort.Strings(msgTypes)
+	for _, msgType := range msgTypes {
+		fmt.Fprintf(&buf, "pbft_messages_received_total{%s,type=\"%s\"} %d\n", replica, msgType, m.MessagesReceived[msgType])
+	}
+
+	family("pbft_commit_latency_seconds", "histogram", "Time from pre-prepare to commit of request batches.")
+	for i, bound := range m.CommitLatency.Bounds {
+		fmt.Fprintf(&buf, "pbft_commit_latency_seconds_bucket{%s,le=\"%s\"} %d\n", replica, strconv.FormatFloat(bound, 'g', -1, 64), m.CommitLatency.Counts[i])
+	}
+	fmt.Fprintf(&buf, "pbft_commit_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", replica, m.CommitLatency.Count)
+	fmt.Fprintf(&buf, "pbft_commit_latency_seconds_sum{%s} %s\n", replica, strconv.FormatFloat(m.CommitLatency.Sum, 'g', -1, 64))
+	fmt.Fprintf(&buf, "pbft_commit_latency_seconds_count{%s} %d\n", replica, m.CommitLatency.Count)
+
+	return buf.Bytes()
+}
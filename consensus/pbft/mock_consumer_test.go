@@ -119,6 +119,18 @@ func (cnet *consumerNetwork) GetLedgerByPeerID(peerID *pb.PeerID) (consensus.Rea
 	return cnet.mockLedgers[id], true
 }
 
+// skewClocks offsets the clock of each replica by the duration at its index,
+// to pass as an initFN of makeConsumerNetwork
+func skewClocks(offsets ...time.Duration) func(*consumerEndpoint) {
+	return func(ce *consumerEndpoint) {
+		if int(ce.id) >= len(offsets) {
+			return
+		}
+		offset := offsets[ce.id]
+		ce.consumer.getPBFTCore().now = func() time.Time { return time.Now().Add(offset) }
+	}
+}
+
 func makeConsumerNetwork(N int, makeConsumer func(id uint64, config *viper.Viper, stack consensus.Stack) pbftConsumer, initFNs ...func(*consumerEndpoint)) *consumerNetwork {
 	twl := consumerNetwork{mockLedgers: make([]*MockLedger, N)}
 
@@ -132,7 +132,9 @@ func (mock *MockLedger) Execute(tag interface{}, txs []*protos.Transaction) {
 
 		_, err := mock.ExecTxs(mock, txs)
 		if err != nil {
-			panic(err)
+			mock.RollbackTxBatch(mock)
+			mock.ce.consumer.ExecutionFailed(tag, err)
+			return
 		}
 		mock.ce.consumer.Executed(tag)
 	}()
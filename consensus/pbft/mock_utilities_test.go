@@ -98,7 +98,7 @@ func (p *mockPersist) DelState(key string) {
 
 func createRunningPbftWithManager(id uint64, config *viper.Viper, stack innerStack) (*pbftCore, events.Manager) {
 	manager := events.NewManagerImpl()
-	core := newPbftCore(id, loadConfig(), stack, events.NewTimerFactoryImpl(manager))
+	core := newPbftCore(id, config, stack, events.NewTimerFactoryImpl(manager))
 	manager.SetReceiver(core)
 	manager.Start()
 	return core, manager
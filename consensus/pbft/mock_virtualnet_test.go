@@ -0,0 +1,329 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+
+	"github.com/hyperledger/fabric/consensus/util/events"
+	pb "github.com/hyperledger/fabric/protos"
+)
+
+// unreachable marks a link of the latency matrix which drops every message
+const unreachable = time.Duration(-1)
+
+// virtualEvent is an event due for a replica at a point in virtual time
+type virtualEvent struct {
+	at       time.Duration
+	seq      uint64 // scheduling order, breaks ties between events due at once
+	receiver uint64
+	event    events.Event
+	timer    *virtualTimer // set for timer events, which the timer may cancel
+	gen      uint64        // generation of the timer which scheduled the event
+}
+
+type virtualQueue []*virtualEvent
+
+func (q virtualQueue) Len() int { return len(q) }
+func (q virtualQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+func (q virtualQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *virtualQueue) Push(x interface{}) { *q = append(*q, x.(*virtualEvent)) }
+func (q *virtualQueue) Pop() interface{} {
+	old := *q
+	ev := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return ev
+}
+
+// virtualTimer fires its event to its replica once the virtual clock reaches
+// the deadline
+type virtualTimer struct {
+	net     *virtualNet
+	replica uint64
+	gen     uint64 // bumped to cancel the pending event
+	armed   bool
+}
+
+func (vt *virtualTimer) SoftReset(duration time.Duration, event events.Event) {
+	if !vt.armed {
+		vt.Reset(duration, event)
+	}
+}
+
+func (vt *virtualTimer) Reset(duration time.Duration, event events.Event) {
+	vt.gen++
+	vt.armed = true
+	vt.net.scheduleFrom(vt.replica, &virtualEvent{at: vt.net.now + duration, receiver: vt.replica, event: event, timer: vt, gen: vt.gen})
+}
+
+func (vt *virtualTimer) Stop() {
+	vt.gen++
+	vt.armed = false
+}
+
+func (vt *virtualTimer) Halt() {
+	vt.Stop()
+}
+
+type virtualTimerFactory struct {
+	net     *virtualNet
+	replica uint64
+}
+
+func (vtf *virtualTimerFactory) CreateTimer() events.Timer {
+	return &virtualTimer{net: vtf.net, replica: vtf.replica}
+}
+
+// virtualReplica is the consumer of one pbftCore in a virtualNet
+type virtualReplica struct {
+	id       uint64
+	net      *virtualNet
+	pbft     *pbftCore
+	executed []uint64
+	mockPersist
+
+	pending     []*virtualEvent // events caused while the replicas step concurrently
+	pendingSent []func()        // sent hook calls held back while the replicas step concurrently
+}
+
+func (vr *virtualReplica) broadcast(msgPayload []byte) {
+	for _, r := range vr.net.replicas {
+		if r.id != vr.id {
+			vr.unicast(msgPayload, r.id)
+		}
+	}
+}
+
+func (vr *virtualReplica) unicast(msgPayload []byte, receiverID uint64) error {
+	latency := vr.net.latency[vr.id][receiverID]
+	if latency == unreachable {
+		return nil
+	}
+	msg := &Message{}
+	if err := proto.Unmarshal(msgPayload, msg); err != nil {
+		vr.net.t.Fatalf("Replica %d sent a message which did not unmarshal: %s", vr.id, err)
+	}
+	if sent := vr.net.sent; sent != nil {
+		if vr.net.stepping {
+			vr.pendingSent = append(vr.pendingSent, func() { sent(vr.id, receiverID, msg) })
+		} else {
+			sent(vr.id, receiverID, msg)
+		}
+	}
+	vr.net.scheduleFrom(vr.id, &virtualEvent{at: vr.net.now + latency, receiver: receiverID, event: &pbftMessage{msg: msg, sender: vr.id}})
+	return nil
+}
+
+func (vr *virtualReplica) execute(seqNo uint64, reqBatch *RequestBatch) {
+	if vr.net.execError != nil {
+		vr.net.hookLock.Lock()
+		err := vr.net.execError(vr.id, seqNo)
+		vr.net.hookLock.Unlock()
+		if err != nil {
+			vr.net.scheduleFrom(vr.id, &virtualEvent{at: vr.net.now, receiver: vr.id, event: execFailedEvent{seqNo: seqNo, err: err}})
+			return
+		}
+	}
+	vr.executed = append(vr.executed, seqNo)
+	vr.net.scheduleFrom(vr.id, &virtualEvent{at: vr.net.now, receiver: vr.id, event: execDoneEvent{}})
+}
+
+func (vr *virtualReplica) getState() []byte {
+	return []byte(fmt.Sprintf("%d", len(vr.executed)))
+}
+
+func (vr *virtualReplica) getLastSeqNo() (uint64, error) {
+	if len(vr.executed) == 0 {
+		return 0, fmt.Errorf("no execution yet")
+	}
+	return vr.executed[len(vr.executed)-1], nil
+}
+
+func (vr *virtualReplica) skipTo(seqNo uint64, snapshotID []byte, peers []uint64) {
+	if !vr.net.stateTransfer {
+		vr.net.t.Errorf("Replica %d unexpectedly initiated state transfer to %d", vr.id, seqNo)
+		return
+	}
+	// The transferred state covers every execution up to seqNo
+	vr.executed = vr.executed[:0]
+	for n := uint64(1); n <= seqNo; n++ {
+		vr.executed = append(vr.executed, n)
+	}
+	vr.net.scheduleFrom(vr.id, &virtualEvent{at: vr.net.now + vr.net.transferLatency, receiver: vr.id, event: stateUpdatedEvent{
+		chkpt:  &checkpointMessage{seqNo: seqNo, id: snapshotID},
+		target: &pb.BlockchainInfo{},
+	}})
+}
+
+func (vr *virtualReplica) sign(msg []byte) ([]byte, error) { return msg, nil }
+func (vr *virtualReplica) verify(senderID uint64, signature []byte, message []byte) error {
+	return nil
+}
+func (vr *virtualReplica) invalidateState() {}
+func (vr *virtualReplica) validateState()   {}
+
+// virtualNet runs pbftCore replicas on a virtual clock.  A message from i to
+// j is delivered latency[i][j] after it is sent, and timers fire exactly at
+// their deadline, so runs are deterministic and take no wall clock time.
+type virtualNet struct {
+	t        *testing.T
+	now      time.Duration // virtual time since the network started
+	seq      uint64
+	queue    virtualQueue
+	latency  [][]time.Duration
+	replicas []*virtualReplica
+
+	sent            func(sender, receiver uint64, msg *Message) // observes every message put on a link
+	stateTransfer   bool                                        // whether replicas may catch up through state transfer, otherwise it fails the test
+	transferLatency time.Duration                               // virtual time a state transfer takes
+	execError       func(replica, seqNo uint64) error           // fails an execution when it returns an error, if set
+	hookLock        sync.Mutex                                  // serializes the execError calls of concurrently stepping replicas
+
+	parallel bool // let the replicas process the events due at once concurrently
+	stepping bool // whether the replicas are processing concurrently
+}
+
+// newVirtualNet creates a network of len(latency) replicas, configure may
+// adjust the configuration of each replica
+func newVirtualNet(t *testing.T, latency [][]time.Duration, configure func(id uint64, config *viper.Viper)) *virtualNet {
+	net := &virtualNet{t: t, latency: latency}
+	N := len(latency)
+	epoch := time.Unix(0, 0)
+	for id := uint64(0); id < uint64(N); id++ {
+		config := loadConfig()
+		config.Set("general.N", N)
+		config.Set("general.f", (N-1)/3)
+		if configure != nil {
+			configure(id, config)
+		}
+		vr := &virtualReplica{id: id, net: net}
+		vr.pbft = newPbftCore(id, config, vr, &virtualTimerFactory{net: net, replica: id})
+		vr.pbft.now = func() time.Time { return epoch.Add(net.now) }
+		net.replicas = append(net.replicas, vr)
+	}
+	return net
+}
+
+func (net *virtualNet) stop() {
+	for _, vr := range net.replicas {
+		vr.pbft.Close()
+	}
+}
+
+func (net *virtualNet) schedule(ev *virtualEvent) {
+	net.seq++
+	ev.seq = net.seq
+	heap.Push(&net.queue, ev)
+}
+
+// scheduleFrom queues an event a replica caused, holding it back while the
+// replicas step concurrently so that the queue order does not depend on
+// their timing
+func (net *virtualNet) scheduleFrom(origin uint64, ev *virtualEvent) {
+	if net.stepping {
+		vr := net.replicas[origin]
+		vr.pending = append(vr.pending, ev)
+		return
+	}
+	net.schedule(ev)
+}
+
+// submitAt hands a request batch to a replica at a point in virtual time
+func (net *virtualNet) submitAt(at time.Duration, id uint64, reqBatch *RequestBatch) {
+	net.schedule(&virtualEvent{at: at, receiver: id, event: reqBatch})
+}
+
+// runUntil delivers every event due up to and including the deadline, and
+// leaves the clock at the deadline
+func (net *virtualNet) runUntil(deadline time.Duration) {
+	for len(net.queue) > 0 && net.queue[0].at <= deadline {
+		if net.parallel {
+			net.step()
+			continue
+		}
+		ev := heap.Pop(&net.queue).(*virtualEvent)
+		if ev.timer != nil {
+			if ev.gen != ev.timer.gen {
+				continue
+			}
+			ev.timer.armed = false
+		}
+		net.now = ev.at
+		events.SendEvent(net.replicas[ev.receiver].pbft, ev.event)
+	}
+	net.now = deadline
+}
+
+// step delivers the events due at the next point in virtual time, the
+// replicas processing them concurrently, each its own in order.  The events
+// and sent hook calls they cause are applied in replica order afterwards, so
+// runs stay deterministic.
+func (net *virtualNet) step() {
+	at := net.queue[0].at
+	due := make([][]*virtualEvent, len(net.replicas))
+	for len(net.queue) > 0 && net.queue[0].at == at {
+		ev := heap.Pop(&net.queue).(*virtualEvent)
+		due[ev.receiver] = append(due[ev.receiver], ev)
+	}
+	net.now = at
+
+	net.stepping = true
+	var wg sync.WaitGroup
+	for id, evs := range due {
+		if len(evs) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(vr *virtualReplica, evs []*virtualEvent) {
+			defer wg.Done()
+			for _, ev := range evs {
+				// Only the replica itself touches its timers
+				if ev.timer != nil {
+					if ev.gen != ev.timer.gen {
+						continue
+					}
+					ev.timer.armed = false
+				}
+				events.SendEvent(vr.pbft, ev.event)
+			}
+		}(net.replicas[id], evs)
+	}
+	wg.Wait()
+	net.stepping = false
+
+	for _, vr := range net.replicas {
+		for _, sent := range vr.pendingSent {
+			sent()
+		}
+		for _, ev := range vr.pending {
+			net.schedule(ev)
+		}
+		vr.pending, vr.pendingSent = nil, nil
+	}
+}
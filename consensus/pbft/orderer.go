@@ -0,0 +1,170 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/consensus/util/events"
+	"github.com/spf13/viper"
+)
+
+// Orderer is an engine which totally orders request batches on behalf of a
+// consumer, which the conformance suite checks an engine against.  pbftCore
+// and memoryOrderer implement it; noops orders transactions rather than
+// request batches and remains a plain consensus.Consenter.  Batches are
+// handed in through Submit and delivered back, in order and exactly once,
+// through the consumer's execute; the engine expects an execDoneEvent once
+// each execution completes.  All methods must be invoked from the event
+// thread.
+type Orderer interface {
+	events.Receiver
+
+	// Submit hands a request batch to the engine for ordering
+	Submit(reqBatch *RequestBatch) events.Event
+
+	// Reconfigure changes the replica count and tolerated faults, an engine
+	// which cannot do so at runtime returns an error
+	Reconfigure(N, f int) error
+
+	// Close releases any resources held by the engine
+	Close()
+}
+
+// batchExecutor is the consumer an engine delivers the ordered batches to
+type batchExecutor interface {
+	execute(seqNo uint64, reqBatch *RequestBatch)
+}
+
+// =============================================================================
+// pbftCore as an Orderer
+// =============================================================================
+
+// Submit passes a request batch to the three-phase protocol
+func (instance *pbftCore) Submit(reqBatch *RequestBatch) events.Event {
+	return instance.ProcessEvent(reqBatch)
+}
+
+// Reconfigure does not support changing N or f at runtime, as the PBFT
+// certificates in flight depend on them; it only accepts the current values
+func (instance *pbftCore) Reconfigure(N, f int) error {
+	if f*3+1 > N {
+		return fmt.Errorf("need at least %d replicas to tolerate %d byzantine faults, but only %d requested", f*3+1, f, N)
+	}
+	if N != instance.N || f != instance.f {
+		return fmt.Errorf("cannot change from N=%d f=%d to N=%d f=%d while running", instance.N, instance.f, N, f)
+	}
+	return nil
+}
+
+// Close halts the pbftCore timers
+func (instance *pbftCore) Close() {
+	instance.close()
+}
+
+// =============================================================================
+// In-memory orderer
+// =============================================================================
+
+// memoryOrdererWindow is how many of the latest submitted batches the memory
+// orderer remembers to drop their duplicates
+const memoryOrdererWindow = 1024
+
+// memoryOrderer delivers batches in the order they are submitted, with no
+// replication and no fault tolerance; it backs the memory consenter of a lone
+// validator and is the reference engine of the conformance suite
+type memoryOrderer struct {
+	id          uint64
+	consumer    batchExecutor
+	digestBytes int // bytes batch digests are truncated to, as general.digestbytes
+
+	seqNo     uint64          // last sequence number delivered
+	executing bool            // whether the consumer is executing seqNo
+	pending   []*RequestBatch // batches waiting for delivery
+	submitted map[string]bool // digests of the last memoryOrdererWindow batches submitted
+	window    []string        // the digests in submitted, oldest first
+	N         int
+	f         int
+}
+
+func newMemoryOrderer(id uint64, config *viper.Viper, consumer batchExecutor) *memoryOrderer {
+	return &memoryOrderer{
+		id:          id,
+		consumer:    consumer,
+		digestBytes: config.GetInt("general.digestbytes"),
+		submitted:   make(map[string]bool),
+		N:           1,
+	}
+}
+
+// ProcessEvent handles execution completions
+func (mo *memoryOrderer) ProcessEvent(e events.Event) events.Event {
+	switch et := e.(type) {
+	case *RequestBatch:
+		return mo.Submit(et)
+	case execDoneEvent:
+		mo.executing = false
+		mo.deliver()
+	default:
+		logger.Debugf("Replica %d memory orderer ignoring event %T", mo.id, e)
+	}
+	return nil
+}
+
+// Submit queues a batch and delivers it if the consumer is idle, batches
+// which were among the last memoryOrdererWindow submitted are dropped
+func (mo *memoryOrderer) Submit(reqBatch *RequestBatch) events.Event {
+	digest := truncatedBatchDigest(reqBatch, mo.digestBytes)
+	if mo.submitted[digest] {
+		logger.Debugf("Replica %d memory orderer dropping duplicate batch %s", mo.id, digest)
+		return nil
+	}
+	mo.submitted[digest] = true
+	mo.window = append(mo.window, digest)
+	if len(mo.window) > memoryOrdererWindow {
+		delete(mo.submitted, mo.window[0])
+		mo.window = mo.window[1:]
+	}
+	mo.pending = append(mo.pending, reqBatch)
+	mo.deliver()
+	return nil
+}
+
+func (mo *memoryOrderer) deliver() {
+	if mo.executing || len(mo.pending) == 0 {
+		return
+	}
+	reqBatch := mo.pending[0]
+	mo.pending = mo.pending[1:]
+	mo.seqNo++
+	mo.executing = true
+	logger.Debugf("Replica %d memory orderer delivering batch as seqNo %d", mo.id, mo.seqNo)
+	mo.consumer.execute(mo.seqNo, reqBatch)
+}
+
+// Reconfigure records the new membership, which has no effect on ordering
+func (mo *memoryOrderer) Reconfigure(N, f int) error {
+	if N < 1 || f < 0 || f >= N {
+		return fmt.Errorf("invalid configuration N=%d f=%d", N, f)
+	}
+	mo.N = N
+	mo.f = f
+	return nil
+}
+
+// Close is a no-op, the memory orderer holds no resources
+func (mo *memoryOrderer) Close() {}
@@ -0,0 +1,369 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/hyperledger/fabric/consensus/util/events"
+	pb "github.com/hyperledger/fabric/protos"
+)
+
+// ordererEngine describes an Orderer implementation to the conformance suite
+type ordererEngine struct {
+	name       string
+	byzantine  bool  // tolerates byzantine faults, otherwise crash faults only
+	replicated bool  // orders across replicas, otherwise only N=1 is exercised
+	sizes      []int // network sizes to run the suite against
+	newOrderer func(id uint64, N, f int, consumer innerStack) Orderer
+}
+
+// faults returns the number of faults the engine tolerates with N replicas
+func (e *ordererEngine) faults(N int) int {
+	if e.byzantine {
+		return (N - 1) / 3
+	}
+	return (N - 1) / 2
+}
+
+var ordererEngines = []*ordererEngine{
+	{
+		name:       "pbft",
+		byzantine:  true,
+		replicated: true,
+		sizes:      []int{1, 4, 7},
+		newOrderer: func(id uint64, N, f int, consumer innerStack) Orderer {
+			config := loadConfig()
+			config.Set("general.N", N)
+			config.Set("general.f", f)
+			return newPbftCore(id, config, consumer, &inertTimerFactory{})
+		},
+	},
+	{
+		name:  "memory",
+		sizes: []int{1},
+		newOrderer: func(id uint64, N, f int, consumer innerStack) Orderer {
+			return newMemoryOrderer(id, loadConfig(), consumer)
+		},
+	},
+}
+
+// conformanceReplica is the consumer of one Orderer in a conformanceNet
+type conformanceReplica struct {
+	id          uint64
+	net         *conformanceNet
+	orderer     Orderer
+	crashed     bool
+	partitioned bool // running, but cut off from the other replicas
+	executing   bool
+	seqNos      []uint64
+	digests     []string
+	mockPersist
+}
+
+func (cr *conformanceReplica) broadcast(msgPayload []byte) {
+	for _, r := range cr.net.replicas {
+		if r.id != cr.id {
+			cr.unicast(msgPayload, r.id)
+		}
+	}
+}
+
+func (cr *conformanceReplica) unicast(msgPayload []byte, receiverID uint64) error {
+	cr.net.msgs = append(cr.net.msgs, conformanceMsg{sender: cr.id, receiver: receiverID, payload: msgPayload})
+	return nil
+}
+
+func (cr *conformanceReplica) execute(seqNo uint64, reqBatch *RequestBatch) {
+	if cr.executing {
+		cr.net.t.Errorf("Replica %d delivered seqNo %d before previous execution completed", cr.id, seqNo)
+	}
+	cr.executing = true
+	cr.seqNos = append(cr.seqNos, seqNo)
+	cr.digests = append(cr.digests, hash(reqBatch))
+}
+
+func (cr *conformanceReplica) getState() []byte {
+	return []byte(fmt.Sprintf("%d", len(cr.digests)))
+}
+
+func (cr *conformanceReplica) getLastSeqNo() (uint64, error) {
+	if len(cr.seqNos) == 0 {
+		return 0, fmt.Errorf("no execution yet")
+	}
+	return cr.seqNos[len(cr.seqNos)-1], nil
+}
+
+func (cr *conformanceReplica) skipTo(seqNo uint64, snapshotID []byte, peers []uint64) {
+	cr.net.t.Errorf("Replica %d unexpectedly initiated state transfer to %d", cr.id, seqNo)
+}
+
+func (cr *conformanceReplica) sign(msg []byte) ([]byte, error) { return msg, nil }
+func (cr *conformanceReplica) verify(senderID uint64, signature []byte, message []byte) error {
+	return nil
+}
+func (cr *conformanceReplica) invalidateState() {}
+func (cr *conformanceReplica) validateState()   {}
+
+type conformanceMsg struct {
+	sender   uint64
+	receiver uint64
+	payload  []byte
+}
+
+// conformanceNet delivers messages and execution completions between
+// replicas synchronously, so runs are deterministic
+type conformanceNet struct {
+	t        *testing.T
+	replicas []*conformanceReplica
+	msgs     []conformanceMsg
+}
+
+func newConformanceNet(t *testing.T, engine *ordererEngine, N int) *conformanceNet {
+	net := &conformanceNet{t: t}
+	f := engine.faults(N)
+	for id := 0; id < N; id++ {
+		cr := &conformanceReplica{id: uint64(id), net: net}
+		net.replicas = append(net.replicas, cr)
+		cr.orderer = engine.newOrderer(cr.id, N, f, cr)
+	}
+	return net
+}
+
+func (net *conformanceNet) stop() {
+	for _, cr := range net.replicas {
+		cr.orderer.Close()
+	}
+}
+
+func (net *conformanceNet) submit(id uint64, reqBatch *RequestBatch) {
+	if r := net.replicas[id]; !r.crashed {
+		events.SendEvent(r.orderer, r.orderer.Submit(reqBatch))
+	}
+	net.process()
+}
+
+// process runs the network until no messages or executions remain
+func (net *conformanceNet) process() {
+	for {
+		if len(net.msgs) > 0 {
+			m := net.msgs[0]
+			net.msgs = net.msgs[1:]
+			sender, receiver := net.replicas[m.sender], net.replicas[m.receiver]
+			if sender.crashed || receiver.crashed || sender.partitioned != receiver.partitioned {
+				continue
+			}
+			msg := &Message{}
+			if err := proto.Unmarshal(m.payload, msg); err != nil {
+				net.t.Fatalf("Replica %d sent a message which did not unmarshal: %s", m.sender, err)
+			}
+			events.SendEvent(receiver.orderer, &pbftMessage{msg: msg, sender: m.sender})
+			continue
+		}
+		done := true
+		for _, cr := range net.replicas {
+			if cr.executing && !cr.crashed {
+				cr.executing = false
+				done = false
+				events.SendEvent(cr.orderer, execDoneEvent{})
+			}
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// checkDelivered verifies every live replica delivered exactly the expected
+// batches, in order, with consecutive sequence numbers
+func (net *conformanceNet) checkDelivered(expected []*RequestBatch) {
+	for _, cr := range net.replicas {
+		if cr.crashed {
+			continue
+		}
+		if len(cr.digests) != len(expected) {
+			net.t.Errorf("Replica %d delivered %d batches, expected %d", cr.id, len(cr.digests), len(expected))
+			continue
+		}
+		for i, reqBatch := range expected {
+			if cr.seqNos[i] != uint64(i+1) {
+				net.t.Errorf("Replica %d delivered batch %d as seqNo %d", cr.id, i+1, cr.seqNos[i])
+			}
+			if cr.digests[i] != hash(reqBatch) {
+				net.t.Errorf("Replica %d delivered batch %d out of order", cr.id, i+1)
+			}
+		}
+	}
+}
+
+// conformanceTotalOrder checks that every replica delivers the submitted
+// batches in submission order, across more than one checkpoint interval
+func conformanceTotalOrder(t *testing.T, engine *ordererEngine, N int) {
+	net := newConformanceNet(t, engine, N)
+	defer net.stop()
+
+	var submitted []*RequestBatch
+	for i := int64(1); i <= 12; i++ {
+		reqBatch := createPbftReqBatch(i, 0)
+		submitted = append(submitted, reqBatch)
+		net.submit(0, reqBatch)
+	}
+	net.checkDelivered(submitted)
+}
+
+// conformanceDuplicates checks that a batch submitted more than once, either
+// while it is in flight or after it was delivered, is delivered once
+func conformanceDuplicates(t *testing.T, engine *ordererEngine, N int) {
+	net := newConformanceNet(t, engine, N)
+	defer net.stop()
+
+	first, second := createPbftReqBatch(1, 0), createPbftReqBatch(2, 0)
+	r := net.replicas[0]
+	events.SendEvent(r.orderer, r.orderer.Submit(first))
+	events.SendEvent(r.orderer, r.orderer.Submit(first))
+	net.process()
+	net.submit(0, first)
+	net.submit(0, second)
+	net.checkDelivered([]*RequestBatch{first, second})
+}
+
+// conformanceCrash checks that ordering continues with f replicas crashed
+func conformanceCrash(t *testing.T, engine *ordererEngine, N int) {
+	f := engine.faults(N)
+	if f == 0 {
+		t.Skipf("N=%d tolerates no faults", N)
+	}
+	net := newConformanceNet(t, engine, N)
+	defer net.stop()
+
+	// Crash the highest numbered replicas, leaving the initial leader running
+	for i := 0; i < f; i++ {
+		net.replicas[N-1-i].crashed = true
+	}
+	var submitted []*RequestBatch
+	for i := int64(1); i <= 3; i++ {
+		reqBatch := createPbftReqBatch(i, 0)
+		submitted = append(submitted, reqBatch)
+		net.submit(0, reqBatch)
+	}
+	net.checkDelivered(submitted)
+}
+
+// conformanceByzantineReconfig checks that a BFT engine refuses a membership
+// which cannot tolerate the requested byzantine faults
+func conformanceByzantineReconfig(t *testing.T, engine *ordererEngine, N int) {
+	if !engine.byzantine {
+		t.Skipf("%s does not tolerate byzantine faults", engine.name)
+	}
+	net := newConformanceNet(t, engine, N)
+	defer net.stop()
+
+	f := engine.faults(N) + 1
+	if err := net.replicas[0].orderer.Reconfigure(3*f, f); err == nil {
+		t.Errorf("Expected N=%d f=%d to be rejected", 3*f, f)
+	}
+}
+
+var ordererConformanceSuite = []struct {
+	name string
+	test func(t *testing.T, engine *ordererEngine, N int)
+}{
+	{"TotalOrder", conformanceTotalOrder},
+	{"Duplicates", conformanceDuplicates},
+	{"Crash", conformanceCrash},
+	{"ByzantineReconfig", conformanceByzantineReconfig},
+}
+
+// TestOrdererConformance runs the conformance suite against every engine,
+// at each of the network sizes it supports
+func TestOrdererConformance(t *testing.T) {
+	for _, engine := range ordererEngines {
+		for _, N := range engine.sizes {
+			if N > 1 && !engine.replicated {
+				t.Fatalf("Engine %s is not replicated but lists N=%d", engine.name, N)
+			}
+			for _, c := range ordererConformanceSuite {
+				t.Run(fmt.Sprintf("%s/N=%d/%s", engine.name, N, c.name), func(t *testing.T) {
+					c.test(t, engine, N)
+				})
+			}
+		}
+	}
+}
+
+func TestMemoryOrdererBoundsDuplicateSuppression(t *testing.T) {
+	mo := newMemoryOrderer(0, loadConfig(), &omniProto{})
+	mo.executing = true // hold every batch pending
+	for i := int64(0); i <= memoryOrdererWindow; i++ {
+		mo.Submit(createPbftReqBatch(i, 0))
+	}
+	if len(mo.submitted) != memoryOrdererWindow || len(mo.window) != memoryOrdererWindow {
+		t.Errorf("Expected the memory orderer to remember %d digests, it remembers %d", memoryOrdererWindow, len(mo.submitted))
+	}
+	if mo.Submit(createPbftReqBatch(0, 0)); len(mo.pending) != memoryOrdererWindow+2 {
+		t.Errorf("Expected a batch older than the window to be accepted again")
+	}
+}
+
+func TestMemoryConsenter(t *testing.T) {
+	committed := make(chan uint64, 3)
+	var op *obcMemory
+	op = newObcMemory(loadConfig(), &omniProto{
+		GetBlockHeadMetadataImpl: func() ([]byte, error) {
+			return proto.Marshal(&Metadata{SeqNo: 5})
+		},
+		ExecuteImpl: func(tag interface{}, txs []*pb.Transaction) {
+			meta := &Metadata{}
+			proto.Unmarshal(tag.([]byte), meta)
+			if len(txs) != 1 {
+				t.Errorf("Expected seqNo=%d to execute one transaction, got %d", meta.SeqNo, len(txs))
+			}
+			if meta.SeqNo == 7 {
+				go op.ExecutionFailed(tag, fmt.Errorf("transaction failed"))
+				return
+			}
+			go op.Executed(tag)
+		},
+		CommitImpl: func(tag interface{}, meta []byte) {
+			m := &Metadata{}
+			proto.Unmarshal(meta, m)
+			committed <- m.SeqNo
+			go op.Committed(tag, nil)
+		},
+	})
+	defer op.Close()
+
+	for i := int64(1); i <= 3; i++ {
+		op.RecvMsg(createTxMsg(i), &pb.PeerID{Name: "vp0"})
+	}
+
+	// The failed execution is skipped, the next transaction is ordered after it
+	for _, expected := range []uint64{6, 8} {
+		select {
+		case seqNo := <-committed:
+			if seqNo != expected {
+				t.Errorf("Expected seqNo=%d to commit, got %d", expected, seqNo)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected seqNo=%d to commit", expected)
+		}
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"math/rand"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -57,8 +58,11 @@ const (
 // workEvent is a temporary type, to inject work
 type workEvent func()
 
-// viewChangeTimerEvent is sent when the view change timer expires
-type viewChangeTimerEvent struct{}
+// viewChangeTimerEvent is sent when the view change timer expires, reason
+// being set for a deferred view change
+type viewChangeTimerEvent struct {
+	reason ViewChange_Reason
+}
 
 // execDoneEvent is sent when an execution completes
 type execDoneEvent struct{}
@@ -78,6 +82,20 @@ type returnRequestBatchEvent *RequestBatch
 // nullRequestEvent provides "keep-alive" null requests
 type nullRequestEvent struct{}
 
+// execTimerEvent is sent when an execution has not completed within its deadline
+type execTimerEvent struct {
+	seqNo uint64
+}
+
+// execIntervalTimerEvent is sent when the minimum interval since the last execution elapsed
+type execIntervalTimerEvent struct{}
+
+// prewarmTimerEvent is sent when the oldest outstanding pre-warm fetch may have timed out
+type prewarmTimerEvent struct{}
+
+// bootstrapTimerEvent is sent when bootstrapping did not complete in time
+type bootstrapTimerEvent struct{}
+
 // Unless otherwise noted, all methods consume the PBFT thread, and should therefore
 // not rely on PBFT accomplishing any work while that thread is being held
 type innerStack interface {
@@ -124,45 +142,180 @@ type pbftCore struct {
 	consumer innerStack
 
 	// PBFT data
-	activeView    bool              // view change happening
-	byzantine     bool              // whether this node is intentionally acting as Byzantine; useful for debugging on the testnet
-	f             int               // max. number of faults we can tolerate
-	N             int               // max.number of validators in the network
-	h             uint64            // low watermark
-	id            uint64            // replica ID; PBFT `i`
-	K             uint64            // checkpoint period
-	logMultiplier uint64            // use this value to calculate log size : k*logMultiplier
-	L             uint64            // log size
-	lastExec      uint64            // last request we executed
-	replicaCount  int               // number of replicas; PBFT `|R|`
-	seqNo         uint64            // PBFT "n", strictly monotonic increasing sequence number
-	view          uint64            // current view
-	chkpts        map[uint64]string // state checkpoints; map lastExec to global hash
-	pset          map[uint64]*ViewChange_PQ
-	qset          map[qidx]*ViewChange_PQ
+	activeView         bool              // view change happening
+	byzantine          bool              // whether this node is intentionally acting as Byzantine; useful for debugging on the testnet
+	f                  int               // max. number of faults we can tolerate
+	N                  int               // max.number of validators in the network
+	h                  uint64            // low watermark
+	id                 uint64            // replica ID; PBFT `i`
+	K                  uint64            // checkpoint period
+	logMultiplier      uint64            // use this value to calculate log size : k*logMultiplier
+	L                  uint64            // log size
+	lastExec           uint64            // last request we executed
+	replicaCount       int               // number of replicas; PBFT `|R|`
+	primaries          []uint64          // order in which replicas become primary, nil for round robin
+	primaryBeacon      bool              // whether each new view draws the following primaries from a random beacon
+	beacons            []beaconEpoch     // primary orders from the last beacons, oldest first
+	seqNo              uint64            // PBFT "n", strictly monotonic increasing sequence number
+	view               uint64            // current view
+	viewLock           sync.Mutex        // guards publishedView and publishedPrimary, which View and PrimaryID read from any goroutine
+	publishedView      uint64            // view, as last published by publishView
+	publishedPrimary   uint64            // primary of publishedView
+	highActiveView     uint64            // highest view we have been active in, persisted to reject replayed view-changes
+	persistView        bool              // persist the view we move to, so that a restart resumes in it rather than in view 0
+	damagedStatePolicy string            // what a restart does with damaged persisted state: skip, refuse or discard
+	damagedKeys        []string          // persisted state found damaged while restoring
+	startErr           error             // why the replica refuses to start, nil if it may
+	maxFutureViews     int               // views above ours whose view-changes we buffer at most, 0 for no bound
+	digestBytes        int               // bytes batch digests are truncated to, 0 for the full hash
+	chkpts             map[uint64]string // state checkpoints; map lastExec to global hash
+	pset               map[uint64]*ViewChange_PQ
+	qset               map[qidx]*ViewChange_PQ
 
 	skipInProgress    bool               // Set when we have detected a fall behind scenario until we pick a new starting point
 	stateTransferring bool               // Set when state transfer is executing
+	transferTarget    *stateUpdateTarget // Target of the executing state transfer
 	highStateTarget   *stateUpdateTarget // Set to the highest weak checkpoint cert we have observed
 	hChkpts           map[uint64]uint64  // highest checkpoint sequence number observed for each replica
 
-	currentExec           *uint64                  // currently executing request
-	timerActive           bool                     // is the timer running?
-	vcResendTimer         events.Timer             // timer triggering resend of a view change
-	newViewTimer          events.Timer             // timeout triggering a view change
-	requestTimeout        time.Duration            // progress timeout for requests
-	vcResendTimeout       time.Duration            // timeout before resending view change
-	newViewTimeout        time.Duration            // progress timeout for new views
-	newViewTimerReason    string                   // what triggered the timer
-	lastNewViewTimeout    time.Duration            // last timeout we used during this view change
-	outstandingReqBatches map[string]*RequestBatch // track whether we are waiting for request batches to execute
-
-	nullRequestTimer   events.Timer  // timeout triggering a null request
-	nullRequestTimeout time.Duration // duration for this timeout
-	viewChangePeriod   uint64        // period between automatic view changes
-	viewChangeSeqNo    uint64        // next seqNo to perform view change
-
-	missingReqBatches map[string]bool // for all the assigned, non-checkpointed request batches we might be missing during view-change
+	currentExec           *uint64                      // currently executing request
+	timerActive           bool                         // is the timer running?
+	vcResendTimer         events.Timer                 // timer triggering resend of a view change
+	newViewTimer          events.Timer                 // timeout triggering a view change
+	requestTimeout        time.Duration                // progress timeout for requests
+	adaptiveFactor        float64                      // request timeout as a multiple of the commit latency, 0 keeps requestTimeout fixed
+	adaptiveMin           time.Duration                // lower bound of the adaptive request timeout
+	adaptiveMax           time.Duration                // upper bound of the adaptive request timeout
+	commitLatency         time.Duration                // moving average of the time from pre-prepare to commit, 0 until observed
+	commitLatencies       latencyHistogram             // every observed time from pre-prepare to commit
+	viewChanges           uint64                       // view changes we initiated
+	viewChangeReason      ViewChange_Reason            // why we initiated our latest view change
+	viewChangeReasons     map[ViewChange_Reason]uint64 // view changes we initiated, by reason
+	msgsReceived          map[string]uint64            // consensus messages received, by type
+	vcResendTimeout       time.Duration                // timeout before resending view change
+	newViewTimeout        time.Duration                // progress timeout for new views
+	newViewTimerReason    string                       // what triggered the timer
+	lastNewViewTimeout    time.Duration                // last timeout we used during this view change
+	viewChangeInterval    time.Duration                // minimum time between view changes we initiate from an active view, 0 disables it
+	lastViewChangeSent    time.Time                    // when we last sent a view-change for a new view
+	outstandingReqBatches map[string]*RequestBatch     // track whether we are waiting for request batches to execute
+
+	nullRequestTimer   events.Timer      // timeout triggering a null request
+	nullRequestTimeout time.Duration     // duration for this timeout
+	execTimer          events.Timer      // timeout abandoning an execution which takes too long
+	execTimeout        time.Duration     // duration for this timeout, 0 disables it
+	failedExecs        map[uint64]string // sequence numbers whose execution was abandoned, mapped to their batch digest
+	execBatch          *RequestBatch     // request batch last handed to the consumer, kept to retry its execution
+	execAttempts       int               // failed attempts at the current execution
+	execMaxAttempts    int               // attempts at an execution failing transiently before it is abandoned
+	execRetryBackoff   time.Duration     // wait before the first retry of a failed execution, doubled for every further one
+	execRetryTimer     events.Timer      // timeout retrying a failed execution
+	execIntervalTimer  events.Timer      // timeout releasing an execution held back by minExecInterval
+	minExecInterval    time.Duration     // minimum time between handing request batches to the consumer, 0 disables it
+	lastExecStart      time.Time         // when we last handed a request batch to the consumer
+	execView           uint64            // view of the commit certificate of the request batch we last handed to the consumer
+	leaseTimeout       time.Duration     // how long a pre-prepare may go without a prepare quorum before the primary's lease lapses, 0 disables it
+	leaseRenewedAt     time.Time         // when the backups last acknowledged the primary of the current view, zero before they did
+	now                func() time.Time  // clock for the leader lease, the request lifetime, quotas and read-only leases, replaceable in tests
+	traceSink          func(traceEvent)  // receives the stages of consensus traced requests reach
+	viewChangePeriod   uint64            // period between automatic view changes
+	viewChangeSeqNo    uint64            // next seqNo to perform view change
+
+	auditTimer    events.Timer       // timer triggering the next integrity audit
+	auditInterval time.Duration      // time between integrity audits, 0 disables them
+	auditSink     func(auditFinding) // receives the executed sequence numbers an audit finds unjustified
+	transferredTo uint64             // sequence number state transfer last brought us to, which needs no certificate
+
+	quorumCheckTimer    events.Timer       // timer triggering the next quorum check
+	quorumCheckInterval time.Duration      // time between quorum checks, 0 disables them
+	quorumSink          func(quorumStatus) // receives the losses and recoveries of a commit quorum
+	heardFrom           map[uint64]bool    // replicas we received a message from since the last quorum check
+	quorumLost          bool               // set while we hear from fewer replicas than a commit quorum needs
+
+	probeTimer events.Timer      // timeout completing a consistency probe which not every replica answered
+	probeNonce uint64            // nonce of the last consistency probe we initiated
+	probe      *consistencyProbe // the consistency probe we are collecting replies for, nil if none
+
+	bootstrapping    bool                       // set while we wait on the replies to our bootstrap request
+	bootstrapPeer    uint64                     // trusted peer we bootstrap from
+	bootstrapReplies map[uint64]*BootstrapReply // latest bootstrap reply of each replica
+	bootstrapTimer   events.Timer               // timeout giving up on bootstrapping
+	bootstrapTimeout time.Duration
+
+	gossipTimer    events.Timer                 // timer triggering the next gossip of our stable checkpoint
+	gossipInterval time.Duration                // time between gossips of our stable checkpoint, 0 disables them
+	stableCert     []*Checkpoint                // checkpoint messages of the quorum which made our last checkpoint stable
+	gossipChkpts   map[uint64]*CheckpointGossip // stable checkpoints gossiped above our high watermark, by replica
+
+	faultInjection        bool      // whether InjectFault may make us suffer faults, for chaos testing
+	debugInvariants       bool      // whether to check our internal consistency after every event, for testing
+	invariantExec         uint64    // last execution whose commit certificate the invariant checker verified
+	faultDropCommits      int       // commits from other replicas still to be dropped by an injected fault
+	faultExecDelayedUntil time.Time // until when an injected fault holds back execution
+
+	missingReqBatches map[string]bool                  // for all the assigned, non-checkpointed request batches we might be missing during view-change
+	rangeFetch        bool                             // whether a replica which missed a committed pre-prepare fetches the committed batches
+	rangeFetchHigh    uint64                           // highest sequence number we fetched committed batches up to
+	rangeReturns      map[msgID]map[string]*rangeVouch // committed batches returned by range fetches, by digest
+
+	prewarm            bool                     // whether the next primary fetches view-change referenced request batches ahead of its election
+	prewarmReqBatches  map[string]*RequestBatch // request batches fetched ahead of a view change we would lead, nil until returned, at most N*L
+	prewarmConcurrency int                      // pre-warm fetches outstanding at once at most, 0 for no bound
+	prewarmTimeout     time.Duration            // how long a pre-warm fetch may go unanswered before the batch is given up on, 0 waits forever
+	prewarmTimer       events.Timer             // timeout giving up on the oldest outstanding pre-warm fetch
+	prewarmQueue       []string                 // referenced request batches waiting for a pre-warm fetch slot
+	prewarmInFlight    map[string]time.Time     // outstanding pre-warm fetches, with when they were sent
+	prewarmFailed      map[string]bool          // request batches no replica returned before the pre-warm timeout
+	newViewDeferred    bool                     // set while our new-view waits on pre-warm fetches it references
+
+	execOnCheckpoint   bool            // defer execution of committed request batches until the next checkpoint
+	deferredReqBatches []*RequestBatch // committed request batches of the current checkpoint interval, in order
+	deferredThrough    uint64          // last sequence number deferred to the next checkpoint, lastExec only moves once the interval is applied
+
+	inclusionProof  bool // whether pre-prepares carry, and backups check, the digests of the batched requests
+	checkpointHints bool // whether the primary piggybacks its stable checkpoint on pre-prepares
+
+	checkpointLookahead uint64 // checkpoint intervals beyond our execution for which checkpoints are kept, 0 for the whole log
+
+	chkptFanout int                        // to how many replicas we send our checkpoints, 0 broadcasts them
+	chkptSentTo map[uint64]map[uint64]bool // replicas we sent our checkpoint to, by sequence number
+
+	coalesceMaxK uint64         // longest checkpoint period under load, a power of two multiple of K, 0 disables coalescing
+	coalesceLoad int            // average requests per batch over a checkpoint interval at which the period first doubles
+	execLoad     map[uint64]int // requests of the batches we executed in the last checkpoint interval, by seqNo
+
+	weakCheckpoint bool   // whether the primary paces its pre-prepares from weak checkpoints, f+1 matching ones
+	weakChkptHigh  uint64 // highest seqNo with a weak checkpoint, a liveness hint which never moves the low watermark
+
+	divergenceLimit int  // consecutive checkpoints our state may diverge from the network's before we halt, 0 never halts
+	divergences     int  // consecutive stable checkpoints our state diverged from
+	halted          bool // set once divergenceLimit is reached, we no longer order requests
+	divergenceQuiet bool // withhold our votes after our state diverged, until state transfer reconciles us
+	silenced        bool // set while divergenceQuiet withholds our votes
+	catchUpBarrier  bool // withhold our votes after a restart, until we caught up with the network
+	catchingUp      bool // set while catchUpBarrier withholds our votes
+	verifyOffloaded bool // whether received signatures were verified before reaching the event thread
+
+	voteBatching bool       // broadcast the prepares and commits of one event as a single vote batch
+	voteBuffer   []*Message // prepares and commits held back until the event is processed
+	eventDepth   int        // nesting of ProcessEvent, held back votes are flushed once the outermost call returns
+
+	verifyNewViewCheckpoint bool // whether a new view's base checkpoint needs 2f+1 distinct view-changes vouching for it
+	compactViewChange       bool // whether our view-changes encode their P and Q sets relative to our stable checkpoint
+
+	replicaSetCheck     bool              // whether we withhold participation until 2f+1 replicas announced our replica set
+	replicaSetDigest    string            // hash of our configured replica set
+	replicaSets         map[uint64]string // replica set digest announced by each replica
+	replicaSetConfirmed bool              // set once 2f+1 replicas announced our replica set
+	replicaSetMismatch  bool              // set once too many replicas announced another replica set for ours to be confirmed
+	withheldMsgs        []events.Event    // consensus messages received before our replica set was confirmed
+
+	protocolVersion    uint32            // version of the consensus messages we speak and announce, 0 disables negotiation
+	minProtocolVersion uint32            // oldest version of the consensus messages we understand
+	peerHellos         map[uint64]*Hello // protocol versions announced by each replica
+
+	quarantineThreshold int            // misbehavior score from which a replica is quarantined, 0 disables quarantine
+	misbehavior         map[uint64]int // faults each replica provably committed
 
 	// implementation of PBFT `in`
 	reqBatchStore   map[string]*RequestBatch // track request batches
@@ -183,12 +336,15 @@ type msgID struct { // our index through certStore
 }
 
 type msgCert struct {
-	digest      string
-	prePrepare  *PrePrepare
-	sentPrepare bool
-	prepare     []*Prepare
-	sentCommit  bool
-	commit      []*Commit
+	digest        string
+	prePrepare    *PrePrepare
+	prePreparedAt time.Time // when the pre-prepare was sent or accepted
+	committedAt   time.Time // when the commit quorum was first observed
+	sentPrepare   bool
+	prepare       []*Prepare
+	sentCommit    bool
+	commit        []*Commit
+	certified     bool // commit certificate returned by f+1 replicas in a range fetch
 }
 
 type vcidx struct {
@@ -221,6 +377,15 @@ func newPbftCore(id uint64, config *viper.Viper, consumer innerStack, etf events
 	instance.newViewTimer = etf.CreateTimer()
 	instance.vcResendTimer = etf.CreateTimer()
 	instance.nullRequestTimer = etf.CreateTimer()
+	instance.execTimer = etf.CreateTimer()
+	instance.execIntervalTimer = etf.CreateTimer()
+	instance.execRetryTimer = etf.CreateTimer()
+	instance.auditTimer = etf.CreateTimer()
+	instance.quorumCheckTimer = etf.CreateTimer()
+	instance.probeTimer = etf.CreateTimer()
+	instance.gossipTimer = etf.CreateTimer()
+	instance.prewarmTimer = etf.CreateTimer()
+	instance.bootstrapTimer = etf.CreateTimer()
 
 	instance.N = config.GetInt("general.N")
 	instance.f = config.GetInt("general.f")
@@ -238,6 +403,62 @@ func newPbftCore(id uint64, config *viper.Viper, consumer innerStack, etf events
 	instance.viewChangePeriod = uint64(config.GetInt("general.viewchangeperiod"))
 
 	instance.byzantine = config.GetBool("general.byzantine")
+	instance.faultInjection = config.GetBool("general.faultinjection")
+	instance.debugInvariants = config.GetBool("general.debug.invariants")
+	instance.prewarm = config.GetBool("general.prewarm")
+	instance.prewarmConcurrency = config.GetInt("general.prewarmconcurrency")
+	instance.inclusionProof = config.GetBool("general.inclusionproof")
+	instance.checkpointHints = config.GetBool("general.checkpointhints")
+	instance.rangeFetch = config.GetBool("general.rangefetch")
+	instance.checkpointLookahead = uint64(config.GetInt("general.checkpointlookahead"))
+	instance.chkptFanout = config.GetInt("general.checkpointfanout")
+	if instance.chkptFanout > 0 && instance.chkptFanout < instance.f {
+		logger.Warningf("PBFT checkpoint fanout of %d is too small for a quorum, using %d", instance.chkptFanout, instance.f)
+		instance.chkptFanout = instance.f
+	}
+	instance.coalesceMaxK = uint64(config.GetInt("general.coalesce.maxk"))
+	instance.coalesceLoad = config.GetInt("general.coalesce.load")
+	if instance.coalesceMaxK > 0 {
+		if periods := instance.coalesceMaxK / instance.K; instance.coalesceMaxK%instance.K != 0 || periods&(periods-1) != 0 {
+			panic("Coalesced checkpoint period must be a power of two multiple of K")
+		}
+		if 2*instance.coalesceMaxK > instance.L {
+			panic("Coalesced checkpoint period must be at most half the log size")
+		}
+	}
+	instance.weakCheckpoint = config.GetBool("general.weakcheckpoint")
+	instance.divergenceLimit = config.GetInt("general.divergencelimit")
+	instance.divergenceQuiet = config.GetBool("general.divergencequiet")
+	instance.catchUpBarrier = config.GetBool("general.catchupbarrier")
+	instance.voteBatching = config.GetBool("general.votebatching")
+	instance.persistView = config.GetBool("general.persistview")
+	instance.damagedStatePolicy = config.GetString("general.damagedstate")
+	switch instance.damagedStatePolicy {
+	case "", "skip", "refuse", "discard":
+	default:
+		panic(fmt.Errorf("Unknown damaged state policy %q, expected skip, refuse or discard", instance.damagedStatePolicy))
+	}
+	instance.maxFutureViews = config.GetInt("general.maxfutureviews")
+	instance.digestBytes = config.GetInt("general.digestbytes")
+	if instance.digestBytes != 0 && (instance.digestBytes < minDigestBytes || instance.digestBytes > fullDigestBytes()) {
+		panic(fmt.Errorf("Digest length of %d bytes is outside the supported range of %d to %d", instance.digestBytes, minDigestBytes, fullDigestBytes()))
+	}
+	instance.verifyNewViewCheckpoint = config.GetBool("general.verifynewviewcheckpoint")
+	instance.compactViewChange = config.GetBool("general.compactviewchange")
+	instance.replicaSetCheck = config.GetBool("general.replicaset.check")
+	instance.replicaSetDigest = replicaSetDigest(instance.N, instance.f, config.GetStringSlice("general.replicaset.identities"))
+	instance.protocolVersion = uint32(config.GetInt("general.protocol.version"))
+	instance.minProtocolVersion = uint32(config.GetInt("general.protocol.minversion"))
+	instance.quarantineThreshold = config.GetInt("general.quarantinethreshold")
+
+	switch strings.ToLower(config.GetString("general.executeon")) {
+	case "", "commit":
+		instance.execOnCheckpoint = false
+	case "checkpoint":
+		instance.execOnCheckpoint = true
+	default:
+		panic(fmt.Errorf("Invalid PBFT execution mode: %s", config.GetString("general.executeon")))
+	}
 
 	instance.requestTimeout, err = time.ParseDuration(config.GetString("general.timeout.request"))
 	if err != nil {
@@ -251,19 +472,112 @@ func newPbftCore(id uint64, config *viper.Viper, consumer innerStack, etf events
 	if err != nil {
 		panic(fmt.Errorf("Cannot parse new view timeout: %s", err))
 	}
+	instance.bootstrapTimeout, err = time.ParseDuration(config.GetString("general.timeout.bootstrap"))
+	if err != nil {
+		panic(fmt.Errorf("Cannot parse bootstrap timeout: %s", err))
+	}
+	instance.viewChangeInterval, err = time.ParseDuration(config.GetString("general.timeout.viewchangeinterval"))
+	if err != nil {
+		instance.viewChangeInterval = 0
+	}
 	instance.nullRequestTimeout, err = time.ParseDuration(config.GetString("general.timeout.nullrequest"))
 	if err != nil {
 		instance.nullRequestTimeout = 0
 	}
+	instance.execTimeout, err = time.ParseDuration(config.GetString("general.timeout.execution"))
+	if err != nil {
+		instance.execTimeout = 0
+	}
+	instance.execMaxAttempts = config.GetInt("general.execretry.maxattempts")
+	if instance.execMaxAttempts < 1 {
+		instance.execMaxAttempts = 1
+	}
+	instance.execRetryBackoff, err = time.ParseDuration(config.GetString("general.execretry.backoff"))
+	if err != nil && instance.execMaxAttempts > 1 {
+		panic(fmt.Errorf("Cannot parse execution retry backoff: %s", err))
+	}
+	instance.leaseTimeout, err = time.ParseDuration(config.GetString("general.timeout.lease"))
+	if err != nil {
+		instance.leaseTimeout = 0
+	}
+	instance.minExecInterval, err = time.ParseDuration(config.GetString("general.minexecinterval"))
+	if err != nil {
+		instance.minExecInterval = 0
+	}
+	instance.auditInterval, err = time.ParseDuration(config.GetString("general.timeout.audit"))
+	if err != nil {
+		instance.auditInterval = 0
+	}
+	instance.quorumCheckInterval, err = time.ParseDuration(config.GetString("general.timeout.quorumcheck"))
+	if err != nil {
+		instance.quorumCheckInterval = 0
+	}
+	instance.gossipInterval, err = time.ParseDuration(config.GetString("general.timeout.checkpointgossip"))
+	if err != nil {
+		instance.gossipInterval = 0
+	}
+	instance.prewarmTimeout, err = time.ParseDuration(config.GetString("general.timeout.prewarm"))
+	if err != nil {
+		instance.prewarmTimeout = 0
+	}
+	instance.adaptiveFactor = config.GetFloat64("general.timeout.adaptive.factor")
+	if instance.adaptiveFactor > 0 {
+		instance.adaptiveMin, err = time.ParseDuration(config.GetString("general.timeout.adaptive.min"))
+		if err != nil {
+			panic(fmt.Errorf("Cannot parse adaptive request timeout minimum: %s", err))
+		}
+		instance.adaptiveMax, err = time.ParseDuration(config.GetString("general.timeout.adaptive.max"))
+		if err != nil {
+			panic(fmt.Errorf("Cannot parse adaptive request timeout maximum: %s", err))
+		}
+		if instance.adaptiveMax < instance.adaptiveMin {
+			panic(fmt.Errorf("Adaptive request timeout maximum %v is below its minimum %v", instance.adaptiveMax, instance.adaptiveMin))
+		}
+	}
+	instance.now = time.Now
+	instance.traceSink = logTrace
+	instance.auditSink = logAuditFinding
+	instance.quorumSink = logQuorumStatus
 
 	instance.activeView = true
 	instance.replicaCount = instance.N
+	instance.primaries = newPrimaryOrder(config.GetStringSlice("general.domains"), instance.N)
+	instance.primaryBeacon = config.GetBool("general.primarybeacon")
+	if instance.primaryBeacon && instance.primaries != nil {
+		panic(fmt.Errorf("general.primarybeacon and general.domains are mutually exclusive"))
+	}
 
 	logger.Infof("PBFT type = %T", instance.consumer)
 	logger.Infof("PBFT Max number of validating peers (N) = %v", instance.N)
 	logger.Infof("PBFT Max number of failing peers (f) = %v", instance.f)
 	logger.Infof("PBFT byzantine flag = %v", instance.byzantine)
+	if instance.faultInjection {
+		logger.Warningf("PBFT fault injection enabled, this replica may be made to misbehave")
+	}
+	logger.Infof("PBFT new-view pre-warming = %v", instance.prewarm)
+	if instance.prewarm {
+		logger.Infof("PBFT pre-warm fetch concurrency = %d, timeout = %v", instance.prewarmConcurrency, instance.prewarmTimeout)
+	}
+	logger.Infof("PBFT execute on checkpoint = %v", instance.execOnCheckpoint)
+	logger.Infof("PBFT request inclusion proofs = %v", instance.inclusionProof)
+	logger.Infof("PBFT checkpoint hints = %v", instance.checkpointHints)
+	logger.Infof("PBFT weak checkpoint pacing = %v", instance.weakCheckpoint)
+	logger.Infof("PBFT range fetch = %v", instance.rangeFetch)
+	if instance.checkpointLookahead > 0 {
+		logger.Infof("PBFT checkpoint lookahead = %d intervals", instance.checkpointLookahead)
+	}
+	logger.Infof("PBFT new-view checkpoint certificates = %v", instance.verifyNewViewCheckpoint)
+	logger.Infof("PBFT compact view-changes = %v", instance.compactViewChange)
+	if instance.replicaSetCheck {
+		logger.Infof("PBFT replica set consistency check = %s", instance.replicaSetDigest)
+	}
+	if instance.protocolVersion > 0 {
+		logger.Infof("PBFT protocol version = %d, understanding versions from %d", instance.protocolVersion, instance.minProtocolVersion)
+	}
 	logger.Infof("PBFT request timeout = %v", instance.requestTimeout)
+	if instance.adaptiveFactor > 0 {
+		logger.Infof("PBFT adaptive request timeout = %v x commit latency, within [%v, %v]", instance.adaptiveFactor, instance.adaptiveMin, instance.adaptiveMax)
+	}
 	logger.Infof("PBFT view change timeout = %v", instance.newViewTimeout)
 	logger.Infof("PBFT Checkpoint period (K) = %v", instance.K)
 	logger.Infof("PBFT Log multiplier = %v", instance.logMultiplier)
@@ -273,6 +587,36 @@ func newPbftCore(id uint64, config *viper.Viper, consumer innerStack, etf events
 	} else {
 		logger.Infof("PBFT null requests disabled")
 	}
+	if instance.execTimeout > 0 {
+		logger.Infof("PBFT execution timeout = %v", instance.execTimeout)
+	} else {
+		logger.Infof("PBFT execution timeout disabled")
+	}
+	if instance.execMaxAttempts > 1 {
+		logger.Infof("PBFT execution attempts = %d, retry backoff = %v", instance.execMaxAttempts, instance.execRetryBackoff)
+	}
+	if instance.auditInterval > 0 {
+		logger.Infof("PBFT integrity audit interval = %v", instance.auditInterval)
+	} else {
+		logger.Infof("PBFT integrity audit disabled")
+	}
+	if instance.quorumCheckInterval > 0 {
+		logger.Infof("PBFT quorum check interval = %v", instance.quorumCheckInterval)
+	}
+	if instance.gossipInterval > 0 {
+		logger.Infof("PBFT checkpoint gossip interval = %v", instance.gossipInterval)
+	}
+	if instance.minExecInterval > 0 {
+		logger.Infof("PBFT minimum execution interval = %v", instance.minExecInterval)
+	}
+	if instance.viewChangeInterval > 0 {
+		logger.Infof("PBFT minimum view change interval = %v", instance.viewChangeInterval)
+	}
+	if instance.leaseTimeout > 0 {
+		logger.Infof("PBFT leader lease = %v", instance.leaseTimeout)
+	} else {
+		logger.Infof("PBFT leader lease disabled")
+	}
 	if instance.viewChangePeriod > 0 {
 		logger.Infof("PBFT view change period = %v", instance.viewChangePeriod)
 	} else {
@@ -283,6 +627,7 @@ func newPbftCore(id uint64, config *viper.Viper, consumer innerStack, etf events
 	instance.certStore = make(map[msgID]*msgCert)
 	instance.reqBatchStore = make(map[string]*RequestBatch)
 	instance.checkpointStore = make(map[Checkpoint]bool)
+	instance.chkptSentTo = make(map[uint64]map[uint64]bool)
 	instance.chkpts = make(map[uint64]string)
 	instance.viewChangeStore = make(map[vcidx]*ViewChange)
 	instance.pset = make(map[uint64]*ViewChange_PQ)
@@ -297,12 +642,37 @@ func newPbftCore(id uint64, config *viper.Viper, consumer innerStack, etf events
 	instance.lastNewViewTimeout = instance.newViewTimeout
 	instance.outstandingReqBatches = make(map[string]*RequestBatch)
 	instance.missingReqBatches = make(map[string]bool)
+	instance.rangeReturns = make(map[msgID]map[string]*rangeVouch)
+	instance.prewarmReqBatches = make(map[string]*RequestBatch)
+	instance.prewarmInFlight = make(map[string]time.Time)
+	instance.prewarmFailed = make(map[string]bool)
+	instance.failedExecs = make(map[uint64]string)
+	instance.replicaSets = make(map[uint64]string)
+	instance.peerHellos = make(map[uint64]*Hello)
+	instance.gossipChkpts = make(map[uint64]*CheckpointGossip)
+	instance.execLoad = make(map[uint64]int)
+	instance.misbehavior = make(map[uint64]int)
+	instance.msgsReceived = make(map[string]uint64)
+	instance.viewChangeReasons = make(map[ViewChange_Reason]uint64)
+	instance.heardFrom = make(map[uint64]bool)
+	instance.replicaSetConfirmed = !instance.replicaSetCheck || instance.intersectionQuorum() <= 1
 
 	instance.restoreState()
+	instance.publishView()
 
 	instance.viewChangeSeqNo = ^uint64(0) // infinity
 	instance.updateViewChangeSeqNo()
 
+	if instance.auditInterval > 0 {
+		instance.auditTimer.Reset(instance.auditInterval, auditTimerEvent{})
+	}
+	if instance.quorumCheckInterval > 0 {
+		instance.quorumCheckTimer.Reset(instance.quorumCheckInterval, quorumCheckTimerEvent{})
+	}
+	if instance.gossipInterval > 0 {
+		instance.gossipTimer.Reset(instance.gossipInterval, gossipTimerEvent{})
+	}
+
 	return instance
 }
 
@@ -310,26 +680,65 @@ func newPbftCore(id uint64, config *viper.Viper, consumer innerStack, etf events
 func (instance *pbftCore) close() {
 	instance.newViewTimer.Halt()
 	instance.nullRequestTimer.Halt()
+	instance.execTimer.Halt()
+	instance.execIntervalTimer.Halt()
+	instance.execRetryTimer.Halt()
+	instance.auditTimer.Halt()
+	instance.quorumCheckTimer.Halt()
+	instance.probeTimer.Halt()
+	instance.prewarmTimer.Halt()
+	instance.gossipTimer.Halt()
+	instance.bootstrapTimer.Halt()
 }
 
 // allow the view-change protocol to kick-off when the timer expires
 func (instance *pbftCore) ProcessEvent(e events.Event) events.Event {
 	var err error
 	logger.Debugf("Replica %d processing event", instance.id)
+	instance.eventDepth++
+	defer func() {
+		if instance.eventDepth--; instance.eventDepth == 0 {
+			instance.flushVotes()
+			if instance.debugInvariants {
+				instance.checkInvariants()
+			}
+		}
+	}()
 	switch et := e.(type) {
 	case viewChangeTimerEvent:
 		logger.Infof("Replica %d view change timer expired, sending view change: %s", instance.id, instance.newViewTimerReason)
+		reason := et.reason
+		if reason == ViewChange_UNSPECIFIED {
+			reason = ViewChange_REQUEST_TIMEOUT
+			if !instance.activeView {
+				reason = ViewChange_NEW_VIEW_TIMEOUT
+			}
+		}
 		instance.timerActive = false
-		instance.sendViewChange()
+		instance.sendViewChange(reason)
 	case *pbftMessage:
 		return pbftMessageEvent(*et)
 	case pbftMessageEvent:
 		msg := et
 		logger.Debugf("Replica %d received incoming message from %v", instance.id, msg.sender)
+		instance.msgsReceived[messageType(msg.msg)]++
+		instance.heardFrom[msg.sender] = true
+		if instance.quarantined(msg.sender) && !safetyMessage(msg.msg) {
+			logger.Debugf("Replica %d ignoring %s from quarantined replica %d", instance.id, messageType(msg.msg), msg.sender)
+			return nil
+		}
+		if instance.incompatible(msg.sender) && msg.msg.GetHello() == nil {
+			logger.Debugf("Replica %d refusing %s from replica %d, which speaks an incompatible protocol version", instance.id, messageType(msg.msg), msg.sender)
+			return nil
+		}
 		next, err := instance.recvMsg(msg.msg, msg.sender)
 		if err != nil {
 			break
 		}
+		if _, ok := next.(*ReplicaSet); !ok && !instance.replicaSetConfirmed {
+			instance.withhold(next)
+			return nil
+		}
 		return next
 	case *RequestBatch:
 		err = instance.recvRequestBatch(et)
@@ -349,9 +758,47 @@ func (instance *pbftCore) ProcessEvent(e events.Event) events.Event {
 		err = instance.recvFetchRequestBatch(et)
 	case returnRequestBatchEvent:
 		return instance.recvReturnRequestBatch(et)
+	case *RangeFetch:
+		err = instance.recvRangeFetch(et)
+	case *RangeReturn:
+		err = instance.recvRangeReturn(et)
+	case *ConsistencyProbe:
+		err = instance.recvConsistencyProbe(et)
+	case *ProbeReply:
+		instance.recvProbeReply(et)
+	case *VoteBatch:
+		err = instance.recvVoteBatch(et)
+	case *Hello:
+		instance.recvHello(et)
+	case *CheckpointGossip:
+		instance.recvCheckpointGossip(et)
+	case *BootstrapRequest:
+		err = instance.recvBootstrapRequest(et)
+	case *BootstrapReply:
+		instance.recvBootstrapReply(et)
+	case gossipTimerEvent:
+		instance.gossipCheckpoint()
+		if instance.gossipInterval > 0 {
+			instance.gossipTimer.Reset(instance.gossipInterval, gossipTimerEvent{})
+		}
+	case prewarmTimerEvent:
+		return instance.prewarmTimedOut()
+	case bootstrapTimerEvent:
+		instance.bootstrapTimedOut()
+	case probeTimerEvent:
+		if instance.probe != nil && instance.probe.nonce == et.nonce {
+			instance.finishProbe()
+		}
+	case *ReplicaSet:
+		return instance.recvReplicaSet(et)
+	case replicaSetConfirmedEvent:
+		for _, withheld := range et.withheld {
+			events.SendEvent(instance, withheld)
+		}
 	case stateUpdatedEvent:
 		update := et.chkpt
 		instance.stateTransferring = false
+		instance.transferTarget = nil
 		// If state transfer did not complete successfully, or if it did not reach our low watermark, do it again
 		if et.target == nil || update.seqNo < instance.h {
 			if et.target == nil {
@@ -372,8 +819,21 @@ func (instance *pbftCore) ProcessEvent(e events.Event) events.Event {
 		logger.Infof("Replica %d application caught up via state transfer, lastExec now %d", instance.id, update.seqNo)
 		// XXX create checkpoint
 		instance.lastExec = update.seqNo
+		instance.transferredTo = update.seqNo
+		// The transferred state includes anything we had deferred
+		instance.deferredReqBatches = nil
+		instance.deferredThrough = 0
 		instance.moveWatermarks(instance.lastExec) // The watermark movement handles moving this to a checkpoint boundary
+		if instance.seqNo < instance.h {
+			// A new view may have been accepted from a base checkpoint the transfer went beyond
+			instance.seqNo = instance.h
+		}
 		instance.skipInProgress = false
+		if instance.silenced {
+			logger.Infof("Replica %d reconciled with the network through state transfer to seqNo=%d, resuming voting", instance.id, update.seqNo)
+			instance.silenced = false
+		}
+		instance.liftCatchUpBarrier("state transfer")
 		instance.consumer.validateState()
 		instance.executeOutstanding()
 	case execDoneEvent:
@@ -385,6 +845,22 @@ func (instance *pbftCore) ProcessEvent(e events.Event) events.Event {
 		return instance.processNewView()
 	case nullRequestEvent:
 		instance.nullRequestHandler()
+	case execTimerEvent:
+		instance.execTimeoutHandler(et.seqNo)
+	case execFailedEvent:
+		instance.execFailedHandler(et.seqNo, et.err)
+	case execRetryTimerEvent:
+		instance.retryExecution(et.seqNo)
+	case execIntervalTimerEvent:
+		instance.executeOutstanding()
+	case auditTimerEvent:
+		instance.audit()
+		instance.auditTimer.Reset(instance.auditInterval, auditTimerEvent{})
+	case quorumCheckTimerEvent:
+		instance.checkQuorum()
+		if instance.quorumCheckInterval > 0 {
+			instance.quorumCheckTimer.Reset(instance.quorumCheckInterval, quorumCheckTimerEvent{})
+		}
 	case workEvent:
 		et() // Used to allow the caller to steal use of the main thread, to be removed
 	case viewChangeQuorumEvent:
@@ -402,7 +878,7 @@ func (instance *pbftCore) ProcessEvent(e events.Event) events.Event {
 		}
 		logger.Debugf("Replica %d view change resend timer expired before view change quorum was reached, resending", instance.id)
 		instance.view-- // sending the view change increments this
-		return instance.sendViewChange()
+		return instance.sendViewChange(instance.viewChangeReason)
 	default:
 		logger.Warningf("Replica %d received an unknown message type %T", instance.id, et)
 	}
@@ -420,9 +896,41 @@ func (instance *pbftCore) ProcessEvent(e events.Event) events.Event {
 
 // Given a certain view n, what is the expected primary?
 func (instance *pbftCore) primary(n uint64) uint64 {
+	if instance.primaryBeacon {
+		if id, ok := instance.beaconPrimary(n); ok {
+			return id
+		}
+	}
+	if instance.primaries != nil {
+		return instance.primaries[n%uint64(instance.replicaCount)]
+	}
 	return n % uint64(instance.replicaCount)
 }
 
+// publishView makes the current view and its primary visible to View and PrimaryID
+func (instance *pbftCore) publishView() {
+	instance.viewLock.Lock()
+	defer instance.viewLock.Unlock()
+	instance.publishedView = instance.view
+	instance.publishedPrimary = instance.primary(instance.view)
+}
+
+// View returns the current view of the replica, which may be in the middle of
+// changing to it.  It is safe to call from any goroutine.
+func (instance *pbftCore) View() uint64 {
+	instance.viewLock.Lock()
+	defer instance.viewLock.Unlock()
+	return instance.publishedView
+}
+
+// PrimaryID returns the replica id of the primary of the current view.  It is
+// safe to call from any goroutine.
+func (instance *pbftCore) PrimaryID() uint64 {
+	instance.viewLock.Lock()
+	defer instance.viewLock.Unlock()
+	return instance.publishedPrimary
+}
+
 // Is the sequence number between watermarks?
 func (instance *pbftCore) inW(n uint64) bool {
 	return n-instance.h > 0 && n-instance.h <= instance.L
@@ -447,6 +955,71 @@ func (instance *pbftCore) getCert(v uint64, n uint64) (cert *msgCert) {
 	return
 }
 
+// CertVote is a prepare or commit recorded in a certificate
+type CertVote struct {
+	ReplicaId   uint64 `json:"replica_id"`
+	BatchDigest string `json:"batch_digest"`
+}
+
+// CertSnapshot is a JSON-serializable copy of one certificate of the certStore
+type CertSnapshot struct {
+	View           uint64     `json:"view"`
+	SequenceNumber uint64     `json:"sequence_number"`
+	Digest         string     `json:"digest"`
+	PrePrepared    bool       `json:"pre_prepared"`
+	SentPrepare    bool       `json:"sent_prepare"`
+	Prepares       []CertVote `json:"prepares"`
+	Prepared       bool       `json:"prepared"`
+	SentCommit     bool       `json:"sent_commit"`
+	Commits        []CertVote `json:"commits"`
+	Committed      bool       `json:"committed"`
+}
+
+type sortableCertSnapshots []CertSnapshot
+
+func (a sortableCertSnapshots) Len() int {
+	return len(a)
+}
+func (a sortableCertSnapshots) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a sortableCertSnapshots) Less(i, j int) bool {
+	if a[i].View != a[j].View {
+		return a[i].View < a[j].View
+	}
+	return a[i].SequenceNumber < a[j].SequenceNumber
+}
+
+// DumpCertStore returns a copy of the certStore ordered by view and sequence
+// number.  It must run on the event thread, which makes the copy consistent
+// with respect to message processing.
+func (instance *pbftCore) DumpCertStore() []CertSnapshot {
+	dump := make([]CertSnapshot, 0, len(instance.certStore))
+	for idx, cert := range instance.certStore {
+		snap := CertSnapshot{
+			View:           idx.v,
+			SequenceNumber: idx.n,
+			Digest:         cert.digest,
+			PrePrepared:    cert.prePrepare != nil,
+			SentPrepare:    cert.sentPrepare,
+			Prepares:       make([]CertVote, 0, len(cert.prepare)),
+			Prepared:       instance.prepared(cert.digest, idx.v, idx.n),
+			SentCommit:     cert.sentCommit,
+			Commits:        make([]CertVote, 0, len(cert.commit)),
+			Committed:      instance.committed(cert.digest, idx.v, idx.n),
+		}
+		for _, p := range cert.prepare {
+			snap.Prepares = append(snap.Prepares, CertVote{ReplicaId: p.ReplicaId, BatchDigest: p.BatchDigest})
+		}
+		for _, c := range cert.commit {
+			snap.Commits = append(snap.Commits, CertVote{ReplicaId: c.ReplicaId, BatchDigest: c.BatchDigest})
+		}
+		dump = append(dump, snap)
+	}
+	sort.Sort(sortableCertSnapshots(dump))
+	return dump
+}
+
 // =============================================================================
 // preprepare/prepare/commit quorum checks
 // =============================================================================
@@ -514,6 +1087,10 @@ func (instance *pbftCore) prepared(digest string, v uint64, n uint64) bool {
 }
 
 func (instance *pbftCore) committed(digest string, v uint64, n uint64) bool {
+	if cert := instance.certStore[msgID{v, n}]; cert != nil && cert.certified && cert.digest == digest {
+		return true
+	}
+
 	if !instance.prepared(digest, v, n) {
 		return false
 	}
@@ -548,7 +1125,7 @@ func (instance *pbftCore) nullRequestHandler() {
 	if instance.primary(instance.view) != instance.id {
 		// backup expected a null request, but primary never sent one
 		logger.Info("Replica %d null request timer expired, sending view change", instance.id)
-		instance.sendViewChange()
+		instance.sendViewChange(ViewChange_NULL_REQUEST_TIMEOUT)
 	} else {
 		// time for the primary to send a null request
 		// pre-prepare with null digest
@@ -598,19 +1175,74 @@ func (instance *pbftCore) recvMsg(msg *Message, senderID uint64) (interface{}, e
 	} else if reqBatch := msg.GetReturnRequestBatch(); reqBatch != nil {
 		// it's ok for sender ID and replica ID to differ; we're sending the original request message
 		return returnRequestBatchEvent(reqBatch), nil
+	} else if rs := msg.GetReplicaSet(); rs != nil {
+		if senderID != rs.ReplicaId {
+			return nil, fmt.Errorf("Sender ID included in replica-set message (%v) doesn't match ID corresponding to the receiving stream (%v)", rs.ReplicaId, senderID)
+		}
+		return rs, nil
+	} else if rf := msg.GetRangeFetch(); rf != nil {
+		if senderID != rf.ReplicaId {
+			return nil, fmt.Errorf("Sender ID included in range-fetch message (%v) doesn't match ID corresponding to the receiving stream (%v)", rf.ReplicaId, senderID)
+		}
+		return rf, nil
+	} else if rr := msg.GetRangeReturn(); rr != nil {
+		if senderID != rr.ReplicaId {
+			return nil, fmt.Errorf("Sender ID included in range-return message (%v) doesn't match ID corresponding to the receiving stream (%v)", rr.ReplicaId, senderID)
+		}
+		return rr, nil
+	} else if cp := msg.GetConsistencyProbe(); cp != nil {
+		if senderID != cp.ReplicaId {
+			return nil, fmt.Errorf("Sender ID included in consistency-probe message (%v) doesn't match ID corresponding to the receiving stream (%v)", cp.ReplicaId, senderID)
+		}
+		return cp, nil
+	} else if pr := msg.GetProbeReply(); pr != nil {
+		if senderID != pr.ReplicaId {
+			return nil, fmt.Errorf("Sender ID included in probe-reply message (%v) doesn't match ID corresponding to the receiving stream (%v)", pr.ReplicaId, senderID)
+		}
+		return pr, nil
+	} else if vb := msg.GetVoteBatch(); vb != nil {
+		if senderID != vb.ReplicaId {
+			return nil, fmt.Errorf("Sender ID included in vote-batch message (%v) doesn't match ID corresponding to the receiving stream (%v)", vb.ReplicaId, senderID)
+		}
+		return vb, nil
+	} else if h := msg.GetHello(); h != nil {
+		if senderID != h.ReplicaId {
+			return nil, fmt.Errorf("Sender ID included in hello message (%v) doesn't match ID corresponding to the receiving stream (%v)", h.ReplicaId, senderID)
+		}
+		return h, nil
+	} else if g := msg.GetCheckpointGossip(); g != nil {
+		if senderID != g.ReplicaId {
+			return nil, fmt.Errorf("Sender ID included in checkpoint-gossip message (%v) doesn't match ID corresponding to the receiving stream (%v)", g.ReplicaId, senderID)
+		}
+		return g, nil
+	} else if br := msg.GetBootstrapRequest(); br != nil {
+		if senderID != br.ReplicaId {
+			return nil, fmt.Errorf("Sender ID included in bootstrap-request message (%v) doesn't match ID corresponding to the receiving stream (%v)", br.ReplicaId, senderID)
+		}
+		return br, nil
+	} else if br := msg.GetBootstrapReply(); br != nil {
+		if senderID != br.ReplicaId {
+			return nil, fmt.Errorf("Sender ID included in bootstrap-reply message (%v) doesn't match ID corresponding to the receiving stream (%v)", br.ReplicaId, senderID)
+		}
+		return br, nil
 	}
 	return nil, fmt.Errorf("Invalid message: %v", msg)
 }
 
 func (instance *pbftCore) recvRequestBatch(reqBatch *RequestBatch) error {
-	digest := hash(reqBatch)
+	digest := instance.batchDigest(reqBatch)
 	logger.Debugf("Replica %d received request batch %s", instance.id, digest)
 
+	if len(reqBatch.GetBatch()) == 0 {
+		logger.Warningf("Replica %d ignoring empty request batch %s, which would waste a sequence number", instance.id, digest)
+		return nil
+	}
+
 	instance.reqBatchStore[digest] = reqBatch
 	instance.outstandingReqBatches[digest] = reqBatch
 	instance.persistRequestBatch(digest)
 	if instance.activeView {
-		instance.softStartTimer(instance.requestTimeout, fmt.Sprintf("new request batch %s", digest))
+		instance.softStartTimer(instance.effectiveRequestTimeout(), fmt.Sprintf("new request batch %s", digest))
 	}
 	if instance.primary(instance.view) == instance.id && instance.activeView {
 		instance.nullRequestTimer.Stop()
@@ -624,6 +1256,26 @@ func (instance *pbftCore) recvRequestBatch(reqBatch *RequestBatch) error {
 func (instance *pbftCore) sendPrePrepare(reqBatch *RequestBatch, digest string) {
 	logger.Debugf("Replica %d is primary, issuing pre-prepare for request batch %s", instance.id, digest)
 
+	if instance.halted {
+		logger.Warningf("Primary %d has halted after its state diverged, withholding pre-prepare for request batch %s", instance.id, digest)
+		return
+	}
+
+	if instance.withholdingVotes() {
+		logger.Warningf("Primary %d is reconciling its state with the network, withholding pre-prepare for request batch %s", instance.id, digest)
+		return
+	}
+
+	if !instance.replicaSetConfirmed {
+		logger.Warningf("Primary %d has not confirmed its replica set, withholding pre-prepare for request batch %s", instance.id, digest)
+		return
+	}
+
+	if instance.leaseExpired() {
+		logger.Warningf("Primary %d lease has expired, withholding pre-prepare for request batch %s", instance.id, digest)
+		return
+	}
+
 	n := instance.seqNo + 1
 	for _, cert := range instance.certStore { // check for other PRE-PREPARE for same digest, but different seqNo
 		if p := cert.prePrepare; p != nil {
@@ -634,7 +1286,7 @@ func (instance *pbftCore) sendPrePrepare(reqBatch *RequestBatch, digest string)
 		}
 	}
 
-	if !instance.inWV(instance.view, n) || n > instance.h+instance.L/2 {
+	if !instance.inWV(instance.view, n) || n > instance.paceLimit() {
 		logger.Debugf("Replica %d is primary, not sending pre-prepare for request batch %s because it is out of sequence numbers", instance.id, digest)
 		return
 	}
@@ -653,14 +1305,86 @@ func (instance *pbftCore) sendPrePrepare(reqBatch *RequestBatch, digest string)
 		RequestBatch:   reqBatch,
 		ReplicaId:      instance.id,
 	}
+	if instance.inclusionProof {
+		for _, req := range reqBatch.GetBatch() {
+			preprep.RequestDigests = append(preprep.RequestDigests, hash(req))
+		}
+	}
+	if id, ok := instance.chkpts[instance.h]; instance.checkpointHints && ok && instance.h > 0 {
+		preprep.CheckpointSequenceNumber = instance.h
+		preprep.CheckpointId = id
+	}
 	cert := instance.getCert(instance.view, n)
 	cert.prePrepare = preprep
+	cert.prePreparedAt = instance.now()
 	cert.digest = digest
 	instance.persistQSet()
 	instance.innerBroadcast(&Message{Payload: &Message_PrePrepare{PrePrepare: preprep}})
+	instance.traceBatch(reqBatch, tracePrePrepared, instance.view, n)
 	instance.maybeSendCommit(digest, instance.view, n)
 }
 
+// renewLease records that the backups acknowledged the primary of the current view
+func (instance *pbftCore) renewLease() {
+	if instance.leaseTimeout > 0 {
+		instance.leaseRenewedAt = instance.now()
+	}
+}
+
+// leaseExpired reports whether the primary's lease in the current view has
+// lapsed, that is whether the backups have not acknowledged it for longer
+// than the lease while a pre-prepare waited on them.  Each prepare or commit
+// quorum of the view renews the lease, as does the new-view, so a pre-prepare
+// from before the last renewal no longer counts, however slow it is; an
+// expired lease only withholds pre-prepares, so a skewed clock may delay
+// progress but does not affect safety
+func (instance *pbftCore) leaseExpired() bool {
+	if instance.leaseTimeout == 0 {
+		return false
+	}
+	deadline := instance.now().Add(-instance.leaseTimeout)
+	for idx, cert := range instance.certStore {
+		if idx.v != instance.view || cert.prePrepare == nil || !cert.prePreparedAt.Before(deadline) {
+			continue
+		}
+		if !cert.prePreparedAt.After(instance.leaseRenewedAt) {
+			continue
+		}
+		if idx.n <= instance.lastExec || instance.committed(cert.digest, idx.v, idx.n) {
+			continue
+		}
+		if !instance.prepared(cert.digest, idx.v, idx.n) {
+			return true
+		}
+	}
+	return false
+}
+
+// validInclusionProof checks that the request digests of a pre-prepare list the requests of its batch, in order
+func (instance *pbftCore) validInclusionProof(preprep *PrePrepare) bool {
+	batch := preprep.RequestBatch.GetBatch()
+	if len(batch) != len(preprep.RequestDigests) {
+		return false
+	}
+	for i, req := range batch {
+		if hash(req) != preprep.RequestDigests[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// outstandingDigests returns the digests of the outstanding request batches
+// sorted, so they are resubmitted in the same order for the same input
+func (instance *pbftCore) outstandingDigests() []string {
+	digests := make([]string, 0, len(instance.outstandingReqBatches))
+	for d := range instance.outstandingReqBatches {
+		digests = append(digests, d)
+	}
+	sort.Strings(digests)
+	return digests
+}
+
 func (instance *pbftCore) resubmitRequestBatches() {
 	if instance.primary(instance.view) != instance.id {
 		return
@@ -669,7 +1393,8 @@ func (instance *pbftCore) resubmitRequestBatches() {
 	var submissionOrder []*RequestBatch
 
 outer:
-	for d, reqBatch := range instance.outstandingReqBatches {
+	for _, d := range instance.outstandingDigests() {
+		reqBatch := instance.outstandingReqBatches[d]
 		for _, cert := range instance.certStore {
 			if cert.digest == d {
 				logger.Debugf("Replica %d already has certificate for request batch %s - not going to resubmit", instance.id, d)
@@ -705,6 +1430,10 @@ func (instance *pbftCore) recvPrePrepare(preprep *PrePrepare) error {
 		return nil
 	}
 
+	if instance.checkpointHints && preprep.CheckpointSequenceNumber > instance.h {
+		instance.recvCheckpointHint(preprep)
+	}
+
 	if !instance.inWV(preprep.View, preprep.SequenceNumber) {
 		if preprep.SequenceNumber != instance.h && !instance.skipInProgress {
 			logger.Warningf("Replica %d pre-prepare view different, or sequence number outside watermarks: preprep.View %d, expected.View %d, seqNo %d, low-mark %d", instance.id, preprep.View, instance.primary(instance.view), preprep.SequenceNumber, instance.h)
@@ -718,36 +1447,77 @@ func (instance *pbftCore) recvPrePrepare(preprep *PrePrepare) error {
 
 	if preprep.SequenceNumber > instance.viewChangeSeqNo {
 		logger.Info("Replica %d received pre-prepare for %d, which should be from the next primary", instance.id, preprep.SequenceNumber)
-		instance.sendViewChange()
+		instance.sendViewChange(ViewChange_VIEW_CYCLE)
+		return nil
+	}
+
+	if instance.halted {
+		logger.Warningf("Replica %d has halted after its state diverged, not accepting pre-prepare for view=%d/seqNo=%d",
+			instance.id, preprep.View, preprep.SequenceNumber)
+		return nil
+	}
+
+	if !instance.validDigestLength(preprep.BatchDigest) {
+		logger.Warningf("Replica %d ignoring pre-prepare for view=%d/seqNo=%d from replica %d: digest %s does not have the configured length",
+			instance.id, preprep.View, preprep.SequenceNumber, preprep.ReplicaId, preprep.BatchDigest)
+		return nil
+	}
+
+	if instance.leaseExpired() {
+		logger.Warningf("Replica %d believes the lease of primary %d has expired, not accepting pre-prepare for view=%d/seqNo=%d",
+			instance.id, preprep.ReplicaId, preprep.View, preprep.SequenceNumber)
+		return nil
+	}
+
+	if instance.inclusionProof && preprep.BatchDigest != "" && preprep.RequestBatch != nil && !instance.validInclusionProof(preprep) {
+		logger.Warningf("Replica %d received pre-prepare for view=%d/seqNo=%d whose request digests do not match its request batch", instance.id, preprep.View, preprep.SequenceNumber)
 		return nil
 	}
 
 	cert := instance.getCert(preprep.View, preprep.SequenceNumber)
-	if cert.digest != "" && cert.digest != preprep.BatchDigest {
+	if cert.prePrepare != nil && cert.digest != preprep.BatchDigest {
 		logger.Warningf("Pre-prepare found for same view/seqNo but different digest: received %s, stored %s", preprep.BatchDigest, cert.digest)
-		instance.sendViewChange()
+		instance.reportFault(preprep.ReplicaId, "equivocating pre-prepare")
+		instance.sendViewChange(ViewChange_EQUIVOCATION)
+		return nil
+	}
+	if cert.prePrepare != nil {
+		// A retransmission must neither restart the request timer nor move the certificate's lease
+		logger.Debugf("Replica %d ignoring duplicate pre-prepare for view=%d/seqNo=%d", instance.id, preprep.View, preprep.SequenceNumber)
 		return nil
 	}
-
-	cert.prePrepare = preprep
-	cert.digest = preprep.BatchDigest
 
 	// Store the request batch if, for whatever reason, we haven't received it from an earlier broadcast
-	if _, ok := instance.reqBatchStore[preprep.BatchDigest]; !ok && preprep.BatchDigest != "" {
-		digest := hash(preprep.GetRequestBatch())
-		if digest != preprep.BatchDigest {
+	_, stored := instance.reqBatchStore[preprep.BatchDigest]
+	if !stored && preprep.BatchDigest != "" {
+		if digest := instance.batchDigest(preprep.GetRequestBatch()); digest != preprep.BatchDigest {
 			logger.Warningf("Pre-prepare and request digest do not match: request %s, digest %s", digest, preprep.BatchDigest)
 			return nil
 		}
+	}
+
+	cert.prePrepare = preprep
+	cert.prePreparedAt = instance.now()
+	cert.digest = preprep.BatchDigest
+
+	if !stored && preprep.BatchDigest != "" {
+		digest := preprep.BatchDigest
 		instance.reqBatchStore[digest] = preprep.GetRequestBatch()
 		logger.Debugf("Replica %d storing request batch %s in outstanding request batch store", instance.id, digest)
 		instance.outstandingReqBatches[digest] = preprep.GetRequestBatch()
 		instance.persistRequestBatch(digest)
 	}
 
-	instance.softStartTimer(instance.requestTimeout, fmt.Sprintf("new pre-prepare for request batch %s", preprep.BatchDigest))
+	instance.traceBatch(instance.reqBatchStore[preprep.BatchDigest], tracePrePrepared, preprep.View, preprep.SequenceNumber)
+
+	instance.softStartTimer(instance.effectiveRequestTimeout(), fmt.Sprintf("new pre-prepare for request batch %s", preprep.BatchDigest))
 	instance.nullRequestTimer.Stop()
 
+	if instance.withholdingVotes() {
+		logger.Debugf("Backup %d is reconciling its state with the network, not sending prepare for view=%d/seqNo=%d", instance.id, preprep.View, preprep.SequenceNumber)
+		return nil
+	}
+
 	if instance.primary(instance.view) != instance.id && instance.prePrepared(preprep.BatchDigest, preprep.View, preprep.SequenceNumber) && !cert.sentPrepare {
 		logger.Debugf("Backup %d broadcasting prepare for view=%d/seqNo=%d", instance.id, preprep.View, preprep.SequenceNumber)
 		prep := &Prepare{
@@ -784,11 +1554,23 @@ func (instance *pbftCore) recvPrepare(prep *Prepare) error {
 		return nil
 	}
 
+	if !instance.validDigestLength(prep.BatchDigest) {
+		logger.Warningf("Replica %d ignoring prepare for view=%d/seqNo=%d from replica %d: digest %s does not have the configured length",
+			instance.id, prep.View, prep.SequenceNumber, prep.ReplicaId, prep.BatchDigest)
+		return nil
+	}
+
 	cert := instance.getCert(prep.View, prep.SequenceNumber)
 
+	// At most one prepare counts per sender, so retransmissions, our own included, can not inflate the quorum
 	for _, prevPrep := range cert.prepare {
 		if prevPrep.ReplicaId == prep.ReplicaId {
-			logger.Warningf("Ignoring duplicate prepare from %d", prep.ReplicaId)
+			if prevPrep.BatchDigest != prep.BatchDigest {
+				logger.Warningf("Replica %d ignoring prepare from %d for view=%d/seqNo=%d, which conflicts with its previous prepare", instance.id, prep.ReplicaId, prep.View, prep.SequenceNumber)
+				instance.reportFault(prep.ReplicaId, "equivocating prepare")
+			} else {
+				logger.Debugf("Replica %d ignoring duplicate prepare from %d", instance.id, prep.ReplicaId)
+			}
 			return nil
 		}
 	}
@@ -801,6 +1583,12 @@ func (instance *pbftCore) recvPrepare(prep *Prepare) error {
 //
 func (instance *pbftCore) maybeSendCommit(digest string, v uint64, n uint64) error {
 	cert := instance.getCert(v, n)
+	if v == instance.view && instance.prepared(digest, v, n) {
+		instance.renewLease()
+	}
+	if instance.withholdingVotes() {
+		return nil
+	}
 	if instance.prepared(digest, v, n) && !cert.sentCommit {
 		logger.Debugf("Replica %d broadcasting commit for view=%d/seqNo=%d",
 			instance.id, v, n)
@@ -811,6 +1599,7 @@ func (instance *pbftCore) maybeSendCommit(digest string, v uint64, n uint64) err
 			ReplicaId:      instance.id,
 		}
 		cert.sentCommit = true
+		instance.traceBatch(instance.reqBatchStore[digest], tracePrepared, v, n)
 		instance.recvCommit(commit)
 		return instance.innerBroadcast(&Message{&Message_Commit{commit}})
 	}
@@ -831,16 +1620,43 @@ func (instance *pbftCore) recvCommit(commit *Commit) error {
 		return nil
 	}
 
+	if !instance.validDigestLength(commit.BatchDigest) {
+		logger.Warningf("Replica %d ignoring commit for view=%d/seqNo=%d from replica %d: digest %s does not have the configured length",
+			instance.id, commit.View, commit.SequenceNumber, commit.ReplicaId, commit.BatchDigest)
+		return nil
+	}
+
+	if instance.faultDropCommits > 0 && commit.ReplicaId != instance.id {
+		instance.faultDropCommits--
+		logger.Warningf("Replica %d dropping commit from %d for view=%d/seqNo=%d, injected fault", instance.id, commit.ReplicaId, commit.View, commit.SequenceNumber)
+		return nil
+	}
+
 	cert := instance.getCert(commit.View, commit.SequenceNumber)
 	for _, prevCommit := range cert.commit {
 		if prevCommit.ReplicaId == commit.ReplicaId {
-			logger.Warningf("Ignoring duplicate commit from %d", commit.ReplicaId)
+			if prevCommit.BatchDigest != commit.BatchDigest {
+				logger.Warningf("Replica %d ignoring commit from %d for view=%d/seqNo=%d, which conflicts with its previous commit", instance.id, commit.ReplicaId, commit.View, commit.SequenceNumber)
+				instance.reportFault(commit.ReplicaId, "equivocating commit")
+			} else {
+				logger.Debugf("Replica %d ignoring duplicate commit from %d", instance.id, commit.ReplicaId)
+			}
 			return nil
 		}
 	}
 	cert.commit = append(cert.commit, commit)
+	instance.maybeFetchRange(commit.View, commit.SequenceNumber, commit.BatchDigest)
 
 	if instance.committed(commit.BatchDigest, commit.View, commit.SequenceNumber) {
+		if commit.View == instance.view {
+			instance.renewLease()
+		}
+		if cert.committedAt.IsZero() {
+			cert.committedAt = instance.now()
+			if !cert.prePreparedAt.IsZero() {
+				instance.recordCommitLatency(cert.committedAt.Sub(cert.prePreparedAt))
+			}
+		}
 		instance.stopTimer()
 		instance.lastNewViewTimeout = instance.newViewTimeout
 		delete(instance.outstandingReqBatches, commit.BatchDigest)
@@ -849,7 +1665,7 @@ func (instance *pbftCore) recvCommit(commit *Commit) error {
 
 		if commit.SequenceNumber == instance.viewChangeSeqNo {
 			logger.Infof("Replica %d cycling view for seqNo=%d", instance.id, commit.SequenceNumber)
-			instance.sendViewChange()
+			instance.sendViewChange(ViewChange_VIEW_CYCLE)
 		}
 	}
 
@@ -896,6 +1712,7 @@ func (instance *pbftCore) retryStateTransfer(optional *stateUpdateTarget) {
 	}
 
 	instance.stateTransferring = true
+	instance.transferTarget = target
 
 	logger.Debugf("Replica %d is initiating state transfer to seqNo %d", instance.id, target.seqNo)
 	instance.consumer.skipTo(target.seqNo, target.id, target.replicas)
@@ -923,7 +1740,7 @@ func (instance *pbftCore) executeOutstanding() {
 func (instance *pbftCore) executeOne(idx msgID) bool {
 	cert := instance.certStore[idx]
 
-	if idx.n != instance.lastExec+1 || cert == nil || cert.prePrepare == nil {
+	if idx.n != instance.nextExec() || cert == nil || cert.prePrepare == nil {
 		return false
 	}
 
@@ -941,10 +1758,61 @@ func (instance *pbftCore) executeOne(idx msgID) bool {
 		return false
 	}
 
+	if wait := instance.faultExecDelayedUntil.Sub(instance.now()); wait > 0 {
+		logger.Warningf("Replica %d holding back execution of seqNo=%d for %v, injected fault", instance.id, idx.n, wait)
+		instance.execIntervalTimer.Reset(wait, execIntervalTimerEvent{})
+		return true
+	}
+
+	handsOff := (digest != "" || len(instance.deferredReqBatches) > 0) && !(instance.execOnCheckpoint && idx.n%instance.K != 0)
+	if handsOff && instance.minExecInterval > 0 && !instance.lastExecStart.IsZero() {
+		if wait := instance.lastExecStart.Add(instance.minExecInterval).Sub(instance.now()); wait > 0 {
+			logger.Debugf("Replica %d holding back execution of seqNo=%d for %v to respect the minimum execution interval", instance.id, idx.n, wait)
+			instance.execIntervalTimer.Reset(wait, execIntervalTimerEvent{})
+			return true
+		}
+	}
+
 	// we have a commit certificate for this request batch
+	instance.recordExecLoad(idx.n, reqBatch)
+	instance.traceBatch(reqBatch, traceCommitted, idx.v, idx.n)
+
+	if instance.execOnCheckpoint && idx.n%instance.K != 0 {
+		// lastExec stays put until the interval is applied, so a crash meanwhile
+		// leaves these batches to be executed again rather than lost
+		if digest != "" {
+			instance.deferredReqBatches = append(instance.deferredReqBatches, reqBatch)
+		}
+		instance.deferredThrough = idx.n
+		logger.Infof("Replica %d deferring execution for view=%d/seqNo=%d until the next checkpoint",
+			instance.id, idx.v, idx.n)
+		if instance.primary(instance.view) == instance.id && instance.activeView && instance.seqNo == idx.n {
+			// Nothing else is being ordered, fill the checkpoint interval so the deferred batches do not wait indefinitely
+			logger.Debugf("Primary %d padding checkpoint interval after seqNo=%d with a null request", instance.id, idx.n)
+			instance.sendPrePrepare(nil, "")
+		}
+		instance.executeOutstanding()
+		return true
+	}
+
 	currentExec := idx.n
 	instance.currentExec = &currentExec
 
+	if len(instance.deferredReqBatches) > 0 {
+		if digest != "" {
+			instance.deferredReqBatches = append(instance.deferredReqBatches, reqBatch)
+		}
+		interval := &RequestBatch{}
+		for _, deferred := range instance.deferredReqBatches {
+			interval.Batch = append(interval.Batch, deferred.Batch...)
+		}
+		instance.deferredReqBatches = nil
+		logger.Infof("Replica %d executing/committing checkpoint interval ending at view=%d/seqNo=%d with %d requests",
+			instance.id, idx.v, idx.n, len(interval.Batch))
+		instance.startExecution(idx.n, interval)
+		return true
+	}
+
 	// null request
 	if digest == "" {
 		logger.Infof("Replica %d executing/committing null request for view=%d/seqNo=%d",
@@ -954,17 +1822,95 @@ func (instance *pbftCore) executeOne(idx msgID) bool {
 		logger.Infof("Replica %d executing/committing request batch for view=%d/seqNo=%d and digest %s",
 			instance.id, idx.v, idx.n, digest)
 		// synchronously execute, it is the other side's responsibility to execute in the background if needed
-		instance.consumer.execute(idx.n, reqBatch)
+		instance.execView = idx.v
+		instance.startExecution(idx.n, reqBatch)
 	}
 	return true
 }
 
+// nextExec returns the sequence number to execute, or defer, next
+func (instance *pbftCore) nextExec() uint64 {
+	if instance.deferredThrough > instance.lastExec {
+		return instance.deferredThrough + 1
+	}
+	return instance.lastExec + 1
+}
+
+// startExecution hands a request batch to the consumer, bounded by the execution timeout if configured
+func (instance *pbftCore) startExecution(seqNo uint64, reqBatch *RequestBatch) {
+	instance.lastExecStart = instance.now()
+	instance.execBatch = reqBatch
+	if instance.execTimeout > 0 {
+		instance.execTimer.Reset(instance.execTimeout, execTimerEvent{seqNo})
+	}
+	instance.traceBatch(reqBatch, traceExecuting, instance.view, seqNo)
+	instance.consumer.execute(seqNo, reqBatch)
+}
+
+// execAbandoner is implemented by the consumers whose executions may be
+// abandoned while still running, they must roll the execution back once it
+// returns and never report it as done
+type execAbandoner interface {
+	abandonExecution(seqNo uint64)
+}
+
+// execTimeoutHandler abandons an execution which missed its deadline, the
+// consumer rolls it back so that it leaves no trace on the state
+func (instance *pbftCore) execTimeoutHandler(seqNo uint64) {
+	if instance.currentExec == nil || *instance.currentExec != seqNo {
+		return
+	}
+	if abandoner, ok := instance.consumer.(execAbandoner); ok {
+		abandoner.abandonExecution(seqNo)
+	}
+	instance.abandonExecution(seqNo, fmt.Sprintf("did not complete within %v", instance.execTimeout))
+}
+
+// abandonExecution marks the execution of seqNo failed and moves on to the
+// next sequence number.  The failed batch has no effect on the state, as if
+// it had been a null request, so one stuck execution does not wedge us.
+// Should the other replicas have executed it, our next checkpoint reveals
+// the divergence like any other
+func (instance *pbftCore) abandonExecution(seqNo uint64, reason string) {
+	digest := ""
+	for idx, cert := range instance.certStore {
+		if idx.n == seqNo && cert.prePrepare != nil {
+			digest = cert.digest
+		}
+	}
+	logger.Errorf("Replica %d execution of seqNo=%d (request batch %s) %s, abandoning it without effect on the state",
+		instance.id, seqNo, digest, reason)
+	instance.failedExecs[seqNo] = digest
+	instance.execDoneSync()
+}
+
 func (instance *pbftCore) Checkpoint(seqNo uint64, id []byte) {
 	if seqNo%instance.K != 0 {
 		logger.Errorf("Attempted to checkpoint a sequence number (%d) which is not a multiple of the checkpoint interval (%d)", seqNo, instance.K)
 		return
 	}
+	instance.checkpoint(seqNo, id)
+}
+
+// ForceCheckpoint checkpoints the last executed sequence number, even off the
+// checkpoint interval.  Like any other, the checkpoint only becomes stable once
+// 2f+1 replicas agree on it, so it must be forced at the same sequence number
+// on a quorum of replicas.  It is meant for tests and operational snapshots,
+// and must be called from the PBFT thread.
+func (instance *pbftCore) ForceCheckpoint() {
+	if instance.currentExec != nil || instance.skipInProgress {
+		logger.Warningf("Replica %d cannot force a checkpoint while executing or out of date", instance.id)
+		return
+	}
+	if _, ok := instance.chkpts[instance.lastExec]; ok || instance.lastExec == instance.h {
+		logger.Debugf("Replica %d already has a checkpoint for seqNo=%d", instance.id, instance.lastExec)
+		return
+	}
+	logger.Infof("Replica %d forcing a checkpoint for seqNo=%d", instance.id, instance.lastExec)
+	instance.checkpoint(instance.lastExec, instance.consumer.getState())
+}
 
+func (instance *pbftCore) checkpoint(seqNo uint64, id []byte) {
 	idAsString := base64.StdEncoding.EncodeToString(id)
 
 	logger.Debugf("Replica %d preparing checkpoint for view=%d/seqNo=%d and b64 id of %s",
@@ -979,14 +1925,36 @@ func (instance *pbftCore) Checkpoint(seqNo uint64, id []byte) {
 
 	instance.persistCheckpoint(seqNo, id)
 	instance.recvCheckpoint(chkpt)
-	instance.innerBroadcast(&Message{Payload: &Message_Checkpoint{Checkpoint: chkpt}})
+	instance.sendCheckpoint(chkpt)
+}
+
+// recvCheckpointHint counts the stable checkpoint piggybacked on a pre-prepare
+// as the primary's checkpoint message, but only if it matches the checkpoint we
+// computed ourselves; the watermarks still only move on a quorum
+func (instance *pbftCore) recvCheckpointHint(preprep *PrePrepare) {
+	n, id := preprep.CheckpointSequenceNumber, preprep.CheckpointId
+	if chkptID, ok := instance.chkpts[n]; !ok || chkptID != id {
+		logger.Debugf("Replica %d cannot verify checkpoint hint from primary %d for seqNo %d, digest %s",
+			instance.id, preprep.ReplicaId, n, id)
+		return
+	}
+	logger.Debugf("Replica %d verified checkpoint hint from primary %d for seqNo %d, digest %s",
+		instance.id, preprep.ReplicaId, n, id)
+	instance.recvCheckpoint(&Checkpoint{
+		SequenceNumber: n,
+		ReplicaId:      preprep.ReplicaId,
+		Id:             id,
+	})
 }
 
 func (instance *pbftCore) execDoneSync() {
+	instance.execTimer.Stop()
+	instance.execBatch = nil
+	instance.execAttempts = 0
 	if instance.currentExec != nil {
 		logger.Infof("Replica %d finished execution %d, trying next", instance.id, *instance.currentExec)
 		instance.lastExec = *instance.currentExec
-		if instance.lastExec%instance.K == 0 {
+		if instance.lastExec%instance.K == 0 && instance.checkpointDue(instance.lastExec) {
 			instance.Checkpoint(instance.lastExec, instance.consumer.getState())
 		}
 
@@ -1001,9 +1969,13 @@ func (instance *pbftCore) execDoneSync() {
 }
 
 func (instance *pbftCore) moveWatermarks(n uint64) {
-	// round down n to previous low watermark
+	// round down n to previous low watermark, unless it is a checkpoint forced off the interval
 	h := n / instance.K * instance.K
+	if _, ok := instance.chkpts[n]; ok {
+		h = n
+	}
 
+	purged := 0
 	for idx, cert := range instance.certStore {
 		if idx.n <= h {
 			logger.Debugf("Replica %d cleaning quorum certificate for view=%d/seqNo=%d",
@@ -1011,6 +1983,21 @@ func (instance *pbftCore) moveWatermarks(n uint64) {
 			instance.persistDelRequestBatch(cert.digest)
 			delete(instance.reqBatchStore, cert.digest)
 			delete(instance.certStore, idx)
+			// The stable checkpoint covers this batch, whether or not we saw it commit
+			if _, ok := instance.outstandingReqBatches[cert.digest]; ok {
+				delete(instance.outstandingReqBatches, cert.digest)
+				purged++
+			}
+			delete(instance.missingReqBatches, cert.digest)
+		}
+	}
+
+	if purged > 0 {
+		logger.Debugf("Replica %d purged %d outstanding request batches below the new low watermark %d",
+			instance.id, purged, h)
+		if len(instance.outstandingReqBatches) == 0 && instance.timerActive {
+			// Nothing is left for the timer to wait on
+			instance.stopTimer()
 		}
 	}
 
@@ -1022,6 +2009,12 @@ func (instance *pbftCore) moveWatermarks(n uint64) {
 		}
 	}
 
+	for n := range instance.chkptSentTo {
+		if n < h {
+			delete(instance.chkptSentTo, n)
+		}
+	}
+
 	for n := range instance.pset {
 		if n <= h {
 			delete(instance.pset, n)
@@ -1034,6 +2027,18 @@ func (instance *pbftCore) moveWatermarks(n uint64) {
 		}
 	}
 
+	for n := range instance.failedExecs {
+		if n <= h {
+			delete(instance.failedExecs, n)
+		}
+	}
+
+	for idx := range instance.rangeReturns {
+		if idx.n <= h {
+			delete(instance.rangeReturns, idx)
+		}
+	}
+
 	for n := range instance.chkpts {
 		if n < h {
 			delete(instance.chkpts, n)
@@ -1080,13 +2085,7 @@ func (instance *pbftCore) weakCheckpointSetOutOfRange(chkpt *Checkpoint) bool {
 			// (This is because all_replicas - missed - me = 3f+1 - f - 1 = 2f)
 			if m := chkptSeqNumArray[len(chkptSeqNumArray)-(instance.f+1)]; m > H {
 				logger.Warningf("Replica %d is out of date, f+1 nodes agree checkpoint with seqNo %d exists but our high water mark is %d", instance.id, chkpt.SequenceNumber, H)
-				instance.reqBatchStore = make(map[string]*RequestBatch) // Discard all our requests, as we will never know which were executed, to be addressed in #394
-				instance.persistDelAllRequestBatches()
-				instance.moveWatermarks(m)
-				instance.outstandingReqBatches = make(map[string]*RequestBatch)
-				instance.skipInProgress = true
-				instance.consumer.invalidateState()
-				instance.stopTimer()
+				instance.skipAhead(m)
 
 				// TODO, reprocess the already gathered checkpoints, this will make recovery faster, though it is presently correct
 
@@ -1098,6 +2097,44 @@ func (instance *pbftCore) weakCheckpointSetOutOfRange(chkpt *Checkpoint) bool {
 	return false
 }
 
+// skipAhead moves our watermarks to seqNo n, which the network moved on to
+// without us, abandoning our log pending state transfer
+func (instance *pbftCore) skipAhead(n uint64) {
+	instance.reqBatchStore = make(map[string]*RequestBatch) // Discard all our requests, as we will never know which were executed, to be addressed in #394
+	instance.persistDelAllRequestBatches()
+	instance.moveWatermarks(n)
+	instance.outstandingReqBatches = make(map[string]*RequestBatch)
+	instance.skipInProgress = true
+	instance.consumer.invalidateState()
+	instance.stopTimer()
+}
+
+// paceLimit is the highest seqNo the primary pre-prepares, leaving half the
+// log for backups whose low watermark lags ours.  A weak checkpoint shows a
+// replica which is not faulty reached it, so with weak checkpoint pacing the
+// half log counts from there, up to our high watermark.
+func (instance *pbftCore) paceLimit() uint64 {
+	base := instance.h
+	if instance.weakCheckpoint && instance.weakChkptHigh > base {
+		base = instance.weakChkptHigh
+	}
+	if limit := base + instance.L/2; limit < instance.h+instance.L {
+		return limit
+	}
+	return instance.h + instance.L
+}
+
+// recordWeakCheckpoint raises the weak checkpoint pacing the primary, which
+// resumes pre-preparing the request batches it held back
+func (instance *pbftCore) recordWeakCheckpoint(n uint64) {
+	if !instance.weakCheckpoint || n <= instance.weakChkptHigh {
+		return
+	}
+	logger.Debugf("Replica %d witnessed weak checkpoint for seqNo %d, low watermark stays at %d", instance.id, n, instance.h)
+	instance.weakChkptHigh = n
+	instance.resubmitRequestBatches()
+}
+
 func (instance *pbftCore) witnessCheckpointWeakCert(chkpt *Checkpoint) {
 	checkpointMembers := make([]uint64, instance.f+1) // Only ever invoked for the first weak cert, so guaranteed to be f+1
 	i := 0
@@ -1137,6 +2174,8 @@ func (instance *pbftCore) recvCheckpoint(chkpt *Checkpoint) events.Event {
 	logger.Debugf("Replica %d received checkpoint from replica %d, seqNo %d, digest %s",
 		instance.id, chkpt.ReplicaId, chkpt.SequenceNumber, chkpt.Id)
 
+	instance.answerCheckpoint(chkpt)
+
 	if instance.weakCheckpointSetOutOfRange(chkpt) {
 		return nil
 	}
@@ -1151,6 +2190,13 @@ func (instance *pbftCore) recvCheckpoint(chkpt *Checkpoint) events.Event {
 		return nil
 	}
 
+	// Checkpoints ahead of our execution are kept, and count once we reach them ourselves
+	if instance.checkpointLookahead > 0 && chkpt.SequenceNumber > instance.lastExec+instance.checkpointLookahead*instance.K {
+		logger.Debugf("Replica %d discarding checkpoint for seqNo %d, more than %d checkpoint intervals ahead of our execution at %d",
+			instance.id, chkpt.SequenceNumber, instance.checkpointLookahead, instance.lastExec)
+		return nil
+	}
+
 	instance.checkpointStore[*chkpt] = true
 
 	matching := 0
@@ -1165,6 +2211,7 @@ func (instance *pbftCore) recvCheckpoint(chkpt *Checkpoint) events.Event {
 	if matching == instance.f+1 {
 		// We do have a weak cert
 		instance.witnessCheckpointWeakCert(chkpt)
+		instance.recordWeakCheckpoint(chkpt.SequenceNumber)
 	}
 
 	if matching < instance.intersectionQuorum() {
@@ -1202,7 +2249,23 @@ func (instance *pbftCore) recvCheckpoint(chkpt *Checkpoint) events.Event {
 	if chkptID != chkpt.Id {
 		logger.Criticalf("Replica %d generated a checkpoint of %s, but a quorum of the network agrees on %s. This is almost definitely non-deterministic chaincode.",
 			instance.id, chkptID, chkpt.Id)
-		instance.stateTransfer(nil)
+		instance.divergences++
+		if instance.divergenceLimit > 0 && instance.divergences >= instance.divergenceLimit {
+			// Transferring state again would only diverge again
+			logger.Criticalf("Replica %d diverged from the network at %d consecutive checkpoints, halting ordering until an operator intervenes",
+				instance.id, instance.divergences)
+			instance.halted = true
+		} else {
+			if instance.divergenceQuiet && !instance.silenced {
+				logger.Warningf("Replica %d withholding its votes until state transfer reconciles it with the network", instance.id)
+				instance.silenced = true
+			}
+			instance.stateTransfer(nil)
+		}
+	} else {
+		instance.divergences = 0
+		instance.recordStableCert(chkpt)
+		instance.liftCatchUpBarrier("a stable checkpoint")
 	}
 
 	instance.moveWatermarks(chkpt.SequenceNumber)
@@ -1244,7 +2307,17 @@ func (instance *pbftCore) recvFetchRequestBatch(fr *FetchRequestBatch) (err erro
 }
 
 func (instance *pbftCore) recvReturnRequestBatch(reqBatch *RequestBatch) events.Event {
-	digest := hash(reqBatch)
+	digest := instance.batchDigest(reqBatch)
+	if b, ok := instance.prewarmReqBatches[digest]; ok && b == nil {
+		logger.Debugf("Replica %d received pre-warmed request batch %s", instance.id, digest)
+		instance.prewarmReqBatches[digest] = reqBatch
+		delete(instance.prewarmInFlight, digest)
+		delete(instance.prewarmFailed, digest)
+		instance.prewarmFetch()
+		if instance.newViewDeferred {
+			return instance.sendNewView()
+		}
+	}
 	if _, ok := instance.missingReqBatches[digest]; !ok {
 		return nil // either the wrong digest, or we got it already from someone else
 	}
@@ -1261,6 +2334,18 @@ func (instance *pbftCore) recvReturnRequestBatch(reqBatch *RequestBatch) events.
 // Marshals a Message and hands it to the Stack. If toSelf is true,
 // the message is also dispatched to the local instance's RecvMsgSync.
 func (instance *pbftCore) innerBroadcast(msg *Message) error {
+	if instance.voteBatching {
+		if msg.GetPrepare() != nil || msg.GetCommit() != nil {
+			instance.voteBuffer = append(instance.voteBuffer, msg)
+			return nil
+		}
+		// Keep our messages in the order we sent them
+		instance.flushVotes()
+	}
+	return instance.broadcastMessage(msg)
+}
+
+func (instance *pbftCore) broadcastMessage(msg *Message) error {
 	msgRaw, err := proto.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("Cannot marshal message %s", err)
@@ -1315,18 +2400,51 @@ func (instance *pbftCore) startTimerIfOutstandingRequests() {
 			}
 			return digests
 		}()
-		instance.softStartTimer(instance.requestTimeout, fmt.Sprintf("outstanding request batches %v", getOutstandingDigests))
+		instance.softStartTimer(instance.effectiveRequestTimeout(), fmt.Sprintf("outstanding request batches %v", getOutstandingDigests))
 	} else if instance.nullRequestTimeout > 0 {
 		timeout := instance.nullRequestTimeout
 		if instance.primary(instance.view) != instance.id {
 			// we're waiting for the primary to deliver a null request - give it a bit more time
-			timeout += instance.requestTimeout
+			timeout += instance.effectiveRequestTimeout()
 		}
 		instance.nullRequestTimer.Reset(timeout, nullRequestEvent{})
 	}
 }
 
+// recordCommitLatency folds an observed commit latency into the moving
+// average, weighting the newest sample by 1/8 as TCP does round-trip times
+func (instance *pbftCore) recordCommitLatency(latency time.Duration) {
+	if instance.commitLatency == 0 {
+		instance.commitLatency = latency
+	} else {
+		instance.commitLatency = (7*instance.commitLatency + latency) / 8
+	}
+	instance.commitLatencies.observe(latency)
+	logger.Debugf("Replica %d observed commit latency %v, average now %v", instance.id, latency, instance.commitLatency)
+}
+
+// effectiveRequestTimeout is the configured request timeout, or when adaptive
+// timeouts are enabled and a commit latency was observed, that latency scaled
+// by the adaptive factor and bounded by the adaptive minimum and maximum
+func (instance *pbftCore) effectiveRequestTimeout() time.Duration {
+	if instance.adaptiveFactor <= 0 || instance.commitLatency == 0 {
+		return instance.requestTimeout
+	}
+	timeout := time.Duration(instance.adaptiveFactor * float64(instance.commitLatency))
+	if timeout < instance.adaptiveMin {
+		return instance.adaptiveMin
+	}
+	if timeout > instance.adaptiveMax {
+		return instance.adaptiveMax
+	}
+	return timeout
+}
+
 func (instance *pbftCore) softStartTimer(timeout time.Duration, reason string) {
+	if !instance.replicaSetConfirmed {
+		logger.Debugf("Replica %d has not confirmed its replica set, not watching progress of %s", instance.id, reason)
+		return
+	}
 	logger.Debugf("Replica %d soft starting new view timer for %s: %s", instance.id, timeout, reason)
 	instance.newViewTimerReason = reason
 	instance.timerActive = true
@@ -1335,6 +2453,7 @@ func (instance *pbftCore) softStartTimer(timeout time.Duration, reason string) {
 
 func (instance *pbftCore) startTimer(timeout time.Duration, reason string) {
 	logger.Debugf("Replica %d starting new view timer for %s: %s", instance.id, timeout, reason)
+	instance.newViewTimerReason = reason
 	instance.timerActive = true
 	instance.newViewTimer.Reset(timeout, viewChangeTimerEvent{})
 }
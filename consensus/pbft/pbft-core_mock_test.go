@@ -18,6 +18,7 @@ package pbft
 
 import (
 	"fmt"
+	"testing"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/spf13/viper"
@@ -79,6 +80,10 @@ type simpleConsumer struct {
 	lastSeqNo     uint64
 	skipOccurred  bool
 	lastExecution string
+	execHang      bool
+	abandoned     []uint64       // sequence numbers whose execution pbft-core abandoned
+	executed      chan<- uint64  // if set, receives the sequence number of each executed batch
+	commitQuorums map[uint64]int // size of the commit certificate which justified each executed seqNo
 	mockPersist
 }
 
@@ -127,14 +132,51 @@ func (sc *simpleConsumer) skipTo(seqNo uint64, id []byte, replicas []uint64) {
 	sc.pbftNet.debugMsg("TEST: skipping to %d\n", seqNo)
 }
 
+func (sc *simpleConsumer) abandonExecution(seqNo uint64) {
+	sc.abandoned = append(sc.abandoned, seqNo)
+}
+
 func (sc *simpleConsumer) execute(seqNo uint64, reqBatch *RequestBatch) {
+	if sc.execHang {
+		// Simulate a stuck executor, which never reports back
+		sc.execHang = false
+		return
+	}
+	if sc.commitQuorums == nil {
+		sc.commitQuorums = make(map[uint64]int)
+	}
+	sc.commitQuorums[seqNo] = sc.pe.pbft.commitQuorum(seqNo)
 	for _, req := range reqBatch.GetBatch() {
 		sc.pbftNet.debugMsg("TEST: executing request\n")
 		sc.lastExecution = hash(req)
 		sc.executions++
 		sc.lastSeqNo = seqNo
-		go func() { sc.pe.manager.Queue() <- execDoneEvent{} }()
 	}
+	if sc.executed != nil {
+		sc.executed <- seqNo
+	}
+	go func() { sc.pe.manager.Queue() <- execDoneEvent{} }()
+}
+
+// commitQuorum returns the most distinct replicas which committed seqNo in
+// any view, with the digest of its pre-prepare
+func (instance *pbftCore) commitQuorum(seqNo uint64) int {
+	quorum := 0
+	for idx, cert := range instance.certStore {
+		if idx.n != seqNo || cert.prePrepare == nil {
+			continue
+		}
+		committers := make(map[uint64]bool)
+		for _, c := range cert.commit {
+			if c.View == idx.v && c.BatchDigest == cert.digest {
+				committers[c.ReplicaId] = true
+			}
+		}
+		if len(committers) > quorum {
+			quorum = len(committers)
+		}
+	}
+	return quorum
 }
 
 func (sc *simpleConsumer) getState() []byte {
@@ -183,3 +225,15 @@ func makePBFTNetwork(N int, config *viper.Viper) *pbftNetwork {
 	}
 	return pn
 }
+
+// assertNoPrematureExecution fails the test if any replica executed a
+// sequence number on fewer than 2f+1 commits
+func (net *pbftNetwork) assertNoPrematureExecution(t *testing.T, f int) {
+	for _, pep := range net.pbftEndpoints {
+		for seqNo, quorum := range pep.sc.commitQuorums {
+			if quorum < 2*f+1 {
+				t.Errorf("Replica %d executed seqNo=%d on %d commits, expected at least %d", pep.id, seqNo, quorum, 2*f+1)
+			}
+		}
+	}
+}
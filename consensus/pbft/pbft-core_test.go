@@ -17,8 +17,11 @@ limitations under the License.
 package pbft
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"google/protobuf"
 	"os"
 	"reflect"
 	"strings"
@@ -28,8 +31,10 @@ import (
 
 	"github.com/golang/protobuf/proto"
 	"github.com/op/go-logging"
+	"github.com/spf13/viper"
 
 	"github.com/hyperledger/fabric/consensus/util/events"
+	pb "github.com/hyperledger/fabric/protos"
 )
 
 func init() {
@@ -157,6 +162,7 @@ func TestNetwork(t *testing.T) {
 				pep.id, pep.sc.lastExecution, hash(reqBatch.GetBatch()[0]))
 		}
 	}
+	net.assertNoPrematureExecution(t, (validatorCount-1)/3)
 }
 
 type checkpointConsumer struct {
@@ -236,6 +242,7 @@ func TestCheckpoint(t *testing.T) {
 			t.Errorf("Should have executed %d, got %d instead for replica %d", expectedExecutions, pep.sc.executions, pep.id)
 		}
 	}
+	net.assertNoPrematureExecution(t, 1)
 }
 
 func TestLostPrePrepare(t *testing.T) {
@@ -274,6 +281,7 @@ func TestLostPrePrepare(t *testing.T) {
 			continue
 		}
 	}
+	net.assertNoPrematureExecution(t, 1)
 }
 
 func TestInconsistentPrePrepare(t *testing.T) {
@@ -311,6 +319,7 @@ func TestInconsistentPrePrepare(t *testing.T) {
 			continue
 		}
 	}
+	net.assertNoPrematureExecution(t, 1)
 }
 
 // This test is designed to detect a conflation of S and S' from the paper in the view change
@@ -436,6 +445,84 @@ func TestViewChangeCheckpointSelection(t *testing.T) {
 	}
 }
 
+// TestNewViewBogusCheckpoint checks that, with new-view checkpoint
+// verification enabled, a primary cannot substantiate a base checkpoint by
+// repeating its own view-change in the new-view
+func TestNewViewBogusCheckpoint(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.verifynewviewcheckpoint", true)
+	instance := newPbftCore(0, config, &omniProto{
+		viewChangeImpl: func(v uint64) {},
+		skipToImpl: func(s uint64, id []byte, replicas []uint64) {
+			t.Fatalf("Should not have attempted to initiate state transfer")
+		},
+		broadcastImpl: func(b []byte) {},
+		signImpl:      func(msg []byte) ([]byte, error) { return msg, nil },
+		verifyImpl:    func(senderID uint64, signature []byte, message []byte) error { return nil },
+	}, &inertTimerFactory{})
+	instance.activeView = false
+	instance.view = 1
+	instance.lastExec = 10
+
+	bogus := &ViewChange{
+		H:         5,
+		Cset:      []*ViewChange_C{{SequenceNumber: 20, Id: "bogus"}},
+		ReplicaId: 1,
+	}
+	honest := &ViewChange{
+		H:         5,
+		Cset:      []*ViewChange_C{{SequenceNumber: 10, Id: "ten"}},
+		ReplicaId: 2,
+	}
+
+	instance.newViewStore[1] = &NewView{
+		View:      1,
+		Vset:      []*ViewChange{bogus, bogus, honest},
+		Xset:      make(map[uint64]string),
+		ReplicaId: 1,
+	}
+
+	if _, ok := instance.processNewView().(viewChangedEvent); ok {
+		t.Fatalf("Should have rejected new view with an uncertified checkpoint")
+	}
+	if instance.view != 2 {
+		t.Errorf("Expected to move on to view 2, but in view %d", instance.view)
+	}
+	if instance.h != 0 {
+		t.Errorf("Expected low watermark to stay at 0, but moved to %d", instance.h)
+	}
+}
+
+// TestNewViewCertifiedCheckpointSelection checks that, with new-view checkpoint
+// verification enabled, only a checkpoint backed by 2f+1 replicas is selected
+func TestNewViewCertifiedCheckpointSelection(t *testing.T) {
+	instance := &pbftCore{
+		f:                       1,
+		N:                       4,
+		id:                      0,
+		verifyNewViewCheckpoint: true,
+	}
+
+	ten := &ViewChange_C{SequenceNumber: 10, Id: "ten"}
+	twenty := &ViewChange_C{SequenceNumber: 20, Id: "twenty"}
+	vset := []*ViewChange{
+		{H: 5, Cset: []*ViewChange_C{ten, twenty}, ReplicaId: 0},
+		{H: 5, Cset: []*ViewChange_C{ten, twenty}, ReplicaId: 1},
+		{H: 10, Cset: []*ViewChange_C{ten}, ReplicaId: 2},
+	}
+
+	checkpoint, ok, replicas := instance.selectInitialCheckpoint(vset)
+	if !ok {
+		t.Fatalf("Failed to pick a checkpoint for view change")
+	}
+	if checkpoint.SequenceNumber != 10 {
+		t.Fatalf("Expected to pick checkpoint 10, but picked %d", checkpoint.SequenceNumber)
+	}
+	if len(replicas) != 3 || replicas[0] != 0 || replicas[2] != 2 {
+		t.Errorf("Expected replicas 0, 1 and 2 to vouch for the checkpoint, got %v", replicas)
+	}
+}
+
 func TestViewChange(t *testing.T) {
 	validatorCount := 4
 	config := loadConfig()
@@ -454,7 +541,7 @@ func TestViewChange(t *testing.T) {
 	execReqBatch(3)
 
 	for i := 2; i < len(net.pbftEndpoints); i++ {
-		net.pbftEndpoints[i].pbft.sendViewChange()
+		net.pbftEndpoints[i].pbft.sendViewChange(ViewChange_MANUAL)
 	}
 
 	err := net.process()
@@ -566,8 +653,8 @@ func TestViewChangeWithStateTransfer(t *testing.T) {
 	fmt.Println("Done with stage 1")
 
 	// Add to replica 3's complaint, cause a view change
-	net.pbftEndpoints[1].pbft.sendViewChange()
-	net.pbftEndpoints[2].pbft.sendViewChange()
+	net.pbftEndpoints[1].pbft.sendViewChange(ViewChange_MANUAL)
+	net.pbftEndpoints[2].pbft.sendViewChange(ViewChange_MANUAL)
 	err = net.process()
 	if err != nil {
 		t.Fatalf("Processing failed: %s", err)
@@ -648,6 +735,50 @@ func TestNewViewTimeout(t *testing.T) {
 	}
 }
 
+// TestSilentNewPrimary checks that backups which voted for a view change arm
+// the new-view timer, and when the elected primary stays silent, move on to
+// the following view, whose primary brings the network back
+func TestSilentNewPrimary(t *testing.T) {
+	validatorCount := 4
+	config := loadConfig()
+	config.Set("general.timeout.viewchange", "400ms")
+	net := makePBFTNetwork(validatorCount, config)
+	defer net.stop()
+
+	// Replica 1, the primary of view 1, is silent
+	net.filterFn = func(src int, dst int, msg []byte) []byte {
+		if src == 1 {
+			return nil
+		}
+		return msg
+	}
+
+	for _, id := range []int{0, 2, 3} {
+		pep := net.pbftEndpoints[id]
+		pep.manager.Queue() <- workEvent(func() {
+			pep.pbft.sendViewChange(ViewChange_MANUAL)
+		})
+	}
+	// Processing only completes once the new-view timers have expired
+	if err := net.process(); err != nil {
+		t.Fatalf("Processing failed: %s", err)
+	}
+
+	for _, id := range []int{0, 2, 3} {
+		if pep := net.pbftEndpoints[id]; pep.pbft.view != 2 || !pep.pbft.activeView {
+			t.Fatalf("Replica %d should be active in view 2, in view %d, active %v", id, pep.pbft.view, pep.pbft.activeView)
+		}
+	}
+
+	net.pbftEndpoints[2].manager.Queue() <- createPbftReqBatch(1, uint64(generateBroadcaster(validatorCount)))
+	net.process()
+	for _, id := range []int{0, 2, 3} {
+		if pep := net.pbftEndpoints[id]; pep.sc.executions != 1 {
+			t.Errorf("Replica %d should have executed the request in view 2, got %d executions", id, pep.sc.executions)
+		}
+	}
+}
+
 func TestViewChangeUpdateSeqNo(t *testing.T) {
 	millisUntilTimeout := 400 * time.Millisecond
 	validatorCount := 4
@@ -671,8 +802,8 @@ func TestViewChangeUpdateSeqNo(t *testing.T) {
 	// view change, the new primary should pick up right after
 	// that.
 
-	net.pbftEndpoints[0].pbft.sendViewChange()
-	net.pbftEndpoints[1].pbft.sendViewChange()
+	net.pbftEndpoints[0].pbft.sendViewChange(ViewChange_MANUAL)
+	net.pbftEndpoints[1].pbft.sendViewChange(ViewChange_MANUAL)
 	time.Sleep(5 * millisUntilTimeout)
 
 	reqBatch = createPbftReqBatch(2, broadcaster)
@@ -717,6 +848,140 @@ func TestSendQueueThrottling(t *testing.T) {
 	}
 }
 
+// activeTimer tracks whether it is running, and for how long it was last set
+type activeTimer struct {
+	active   bool
+	duration time.Duration
+}
+
+func (at *activeTimer) Halt() { at.active = false }
+func (at *activeTimer) Reset(duration time.Duration, event events.Event) {
+	at.active, at.duration = true, duration
+}
+func (at *activeTimer) SoftReset(duration time.Duration, event events.Event) {
+	at.active, at.duration = true, duration
+}
+func (at *activeTimer) Stop() { at.active = false }
+
+type activeTimerFactory struct {
+	timers []*activeTimer
+}
+
+func (atf *activeTimerFactory) CreateTimer() events.Timer {
+	at := &activeTimer{}
+	atf.timers = append(atf.timers, at)
+	return at
+}
+
+// TestMoveWatermarksPurgesOutstanding checks that truncating the log at a
+// stable checkpoint drops the pre-prepared batches below the new low
+// watermark, and stops the view change timer once nothing is left to wait on
+func TestMoveWatermarksPurgesOutstanding(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.K", 2)
+	config.Set("general.logmultiplier", 4)
+	timers := &activeTimerFactory{}
+	instance := newPbftCore(1, config, &omniProto{
+		broadcastImpl: func(b []byte) {},
+	}, timers)
+	defer instance.close()
+
+	var digests []string
+	for n := uint64(1); n <= 3; n++ {
+		reqBatch := createPbftReqBatch(int64(n), 0)
+		digests = append(digests, hash(reqBatch))
+		events.SendEvent(instance, &PrePrepare{
+			View:           0,
+			SequenceNumber: n,
+			BatchDigest:    hash(reqBatch),
+			RequestBatch:   reqBatch,
+			ReplicaId:      0,
+		})
+	}
+	if len(instance.outstandingReqBatches) != 3 || !instance.timerActive {
+		t.Fatalf("Expected 3 outstanding batches and a running timer, got %d and %v",
+			len(instance.outstandingReqBatches), instance.timerActive)
+	}
+
+	instance.moveWatermarks(2)
+	if _, ok := instance.outstandingReqBatches[digests[2]]; !ok || len(instance.outstandingReqBatches) != 1 {
+		t.Fatalf("Expected only the batch above the low watermark to remain outstanding, got %v", instance.outstandingReqBatches)
+	}
+	if !instance.timerActive {
+		t.Errorf("Expected the timer to keep running for the batch still outstanding")
+	}
+
+	instance.moveWatermarks(4)
+	if len(instance.outstandingReqBatches) != 0 || len(instance.certStore) != 0 || len(instance.reqBatchStore) != 0 {
+		t.Errorf("Expected every batch below the low watermark to be dropped, got %d outstanding, %d certificates and %d stored",
+			len(instance.outstandingReqBatches), len(instance.certStore), len(instance.reqBatchStore))
+	}
+	if instance.timerActive {
+		t.Errorf("Expected the view change timer to be stopped")
+	}
+	for i, timer := range timers.timers {
+		if timer.active {
+			t.Errorf("Timer %d still running after truncation", i)
+		}
+	}
+}
+
+// TestForceCheckpoint forces a checkpoint off the checkpoint interval and
+// checks it only becomes stable, moving the watermarks, once 2f+1 replicas
+// forced it
+func TestForceCheckpoint(t *testing.T) {
+	validatorCount := 4
+	config := loadConfig()
+	config.Set("general.K", 4)
+	config.Set("general.logmultiplier", 2)
+	net := makePBFTNetwork(validatorCount, config)
+	defer net.stop()
+
+	for tag := int64(1); tag <= 3; tag++ {
+		net.pbftEndpoints[0].manager.Queue() <- createPbftReqBatch(tag, uint64(generateBroadcaster(validatorCount)))
+		net.process()
+	}
+
+	force := func(id int) {
+		pep := net.pbftEndpoints[id]
+		pep.manager.Queue() <- workEvent(func() {
+			pep.pbft.ForceCheckpoint()
+		})
+		net.process()
+	}
+
+	force(0)
+	force(1)
+	for _, pep := range net.pbftEndpoints {
+		if pep.pbft.h != 0 {
+			t.Fatalf("Replica %d moved its low watermark to %d without a quorum of forced checkpoints", pep.id, pep.pbft.h)
+		}
+	}
+
+	// Replica 3 sees the quorum, but only moves once its own checkpoint matches
+	force(2)
+	force(3)
+	for _, pep := range net.pbftEndpoints {
+		if pep.pbft.h != 3 {
+			t.Errorf("Replica %d expected the forced checkpoint to move its low watermark to 3, got %d", pep.id, pep.pbft.h)
+		}
+		if len(pep.pbft.certStore) != 0 {
+			t.Errorf("Replica %d kept %d certificates below the low watermark", pep.id, len(pep.pbft.certStore))
+		}
+	}
+
+	// A log of 8 from the forced checkpoint now admits sequence number 11
+	for tag := int64(4); tag <= 11; tag++ {
+		net.pbftEndpoints[0].manager.Queue() <- createPbftReqBatch(tag, uint64(generateBroadcaster(validatorCount)))
+		net.process()
+	}
+	for _, pep := range net.pbftEndpoints {
+		if pep.sc.executions != 11 {
+			t.Errorf("Replica %d expected 11 executions, got %d", pep.id, pep.sc.executions)
+		}
+	}
+}
+
 // From issue #687
 func TestWitnessCheckpointOutOfBounds(t *testing.T) {
 	mock := &omniProto{}
@@ -1563,6 +1828,114 @@ func TestStateNetworkMovesOnDuringSlowStateTransfer(t *testing.T) {
 	}
 }
 
+// TestRangeFetch checks that a replica which missed a few pre-prepares
+// catches up by fetching the committed batches rather than by state transfer
+func TestRangeFetch(t *testing.T) {
+	validatorCount := 4
+	config := loadConfig()
+	config.Set("general.rangefetch", true)
+	net := makePBFTNetwork(validatorCount, config)
+	defer net.stop()
+
+	fetches := 0
+	net.filterFn = func(src int, dst int, payload []byte) []byte {
+		msg := &Message{}
+		if err := proto.Unmarshal(payload, msg); err != nil {
+			t.Fatalf("Could not unmarshal message: %s", err)
+		}
+		if dst == 3 && msg.GetPrePrepare() != nil {
+			return nil
+		}
+		if src == 3 && msg.GetRangeFetch() != nil {
+			fetches++
+		}
+		return payload
+	}
+
+	for tag := int64(1); tag <= 3; tag++ {
+		net.pbftEndpoints[0].manager.Queue() <- createPbftReqBatch(tag, 1)
+		if err := net.process(); err != nil {
+			t.Fatalf("Processing failed: %s", err)
+		}
+	}
+
+	lagging := net.pbftEndpoints[3]
+	if lagging.sc.executions != 3 || lagging.pbft.lastExec != 3 {
+		t.Errorf("Expected replica 3 to catch up through seqNo 3, executed %d, lastExec %d", lagging.sc.executions, lagging.pbft.lastExec)
+	}
+	if lagging.sc.skipOccurred {
+		t.Errorf("Replica 3 should have caught up without state transfer")
+	}
+	if fetches == 0 {
+		t.Errorf("Expected replica 3 to fetch the batches it missed")
+	}
+}
+
+// TestViewChangeDuringStateTransfer checks that a new view arriving while
+// state transfer executes keeps the more advanced of the transfer target and
+// the new-view base checkpoint
+func TestViewChangeDuringStateTransfer(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		inFlight uint64
+		targets  []uint64
+		final    uint64
+	}{
+		{"superseded", 10, []uint64{10, 20}, 20},
+		{"completed", 30, []uint64{30}, 30},
+	} {
+		var targets []uint64
+		instance := newPbftCore(2, loadConfig(), &omniProto{
+			skipToImpl: func(s uint64, id []byte, replicas []uint64) {
+				targets = append(targets, s)
+			},
+			invalidateStateImpl: func() {},
+			validateStateImpl:   func() {},
+			viewChangeImpl:      func(v uint64) {},
+			broadcastImpl:       func(b []byte) {},
+			signImpl:            func(msg []byte) ([]byte, error) { return msg, nil },
+			verifyImpl:          func(senderID uint64, signature []byte, message []byte) error { return nil },
+		}, &inertTimerFactory{})
+		instance.stateTransfer(&stateUpdateTarget{
+			checkpointMessage: checkpointMessage{seqNo: tc.inFlight, id: []byte("inflight")},
+		})
+
+		twenty := []*ViewChange_C{{SequenceNumber: 20, Id: base64.StdEncoding.EncodeToString([]byte("twenty"))}}
+		instance.activeView = false
+		instance.view = 1
+		instance.newViewStore[1] = &NewView{
+			View: 1,
+			Vset: []*ViewChange{
+				{H: 20, Cset: twenty, ReplicaId: 0},
+				{H: 20, Cset: twenty, ReplicaId: 1},
+				{H: 20, Cset: twenty, ReplicaId: 3},
+			},
+			Xset:      map[uint64]string{21: ""},
+			ReplicaId: 1,
+		}
+		if _, ok := instance.processNewView().(viewChangedEvent); !ok {
+			t.Fatalf("%s: expected to accept the new view", tc.name)
+		}
+
+		// Complete each transfer the replica initiates
+		for i := 0; i < len(targets); i++ {
+			events.SendEvent(instance, stateUpdatedEvent{
+				chkpt:  &checkpointMessage{seqNo: targets[i]},
+				target: &pb.BlockchainInfo{},
+			})
+		}
+
+		if !reflect.DeepEqual(targets, tc.targets) {
+			t.Errorf("%s: expected state transfers to %v, got %v", tc.name, tc.targets, targets)
+		}
+		if instance.skipInProgress || instance.lastExec != tc.final || instance.h != tc.final || instance.seqNo < instance.h {
+			t.Errorf("%s: expected to be caught up at %d, skipInProgress %v, lastExec %d, h %d, seqNo %d",
+				tc.name, tc.final, instance.skipInProgress, instance.lastExec, instance.h, instance.seqNo)
+		}
+		instance.Close()
+	}
+}
+
 // This test is designed to ensure state transfer occurs if our checkpoint does not match a quorum cert
 func TestCheckpointDiffersFromQuorum(t *testing.T) {
 	invalidated := false
@@ -1602,3 +1975,2716 @@ func TestCheckpointDiffersFromQuorum(t *testing.T) {
 		t.Fatalf("Replica should have invalidated its state and skipped")
 	}
 }
+
+// TestPrewarmNewView measures how long the primary of the next view takes to
+// accept its own new-view once the view-change quorum forms, when it is
+// missing a request batch referenced by the view-changes and fetching it
+// takes a network round trip
+func TestPrewarmNewView(t *testing.T) {
+	for _, prewarm := range []bool{false, true} {
+		config := loadConfig()
+		config.Set("general.prewarm", prewarm)
+
+		reqBatch := createPbftReqBatch(1, 0)
+		digest := hash(reqBatch)
+
+		fetched := false
+		instance := newPbftCore(1, config, &omniProto{
+			signImpl:   func(msg []byte) ([]byte, error) { return msg, nil },
+			verifyImpl: func(senderID uint64, signature []byte, message []byte) error { return nil },
+			broadcastImpl: func(msgPayload []byte) {
+				msg := &Message{}
+				if err := proto.Unmarshal(msgPayload, msg); err != nil {
+					t.Fatalf("Could not unmarshal broadcast message: %s", err)
+				}
+				if fr := msg.GetFetchRequestBatch(); fr != nil && fr.BatchDigest == digest {
+					fetched = true
+				}
+			},
+		}, &inertTimerFactory{})
+		defer instance.close()
+
+		// Replica 1 never saw the pre-prepare, the others prepared it in view 0
+		makeVC := func(id uint64) *ViewChange {
+			return &ViewChange{
+				View:      1,
+				H:         0,
+				Cset:      []*ViewChange_C{{SequenceNumber: 0, Id: instance.chkpts[0]}},
+				Pset:      []*ViewChange_PQ{{SequenceNumber: 1, BatchDigest: digest, View: 0}},
+				Qset:      []*ViewChange_PQ{{SequenceNumber: 1, BatchDigest: digest, View: 0}},
+				ReplicaId: id,
+			}
+		}
+
+		events.SendEvent(instance, makeVC(2))
+		if !instance.activeView {
+			t.Fatalf("A single view-change should not have moved replica out of view 0")
+		}
+		if fetched != prewarm {
+			t.Fatalf("Expected the request batch to be fetched ahead of the view change only when pre-warming (prewarm=%v)", prewarm)
+		}
+		if fetched {
+			// The fetch is answered before the remaining view-changes trickle in
+			events.SendEvent(instance, returnRequestBatchEvent(reqBatch))
+		}
+
+		events.SendEvent(instance, makeVC(3))
+		if prewarm {
+			if !instance.activeView || instance.view != 1 {
+				t.Fatalf("Expected the pre-warmed replica to accept the new-view for view 1 without waiting on a fetch")
+			}
+			continue
+		}
+		if instance.activeView {
+			t.Fatalf("Expected the new-view without pre-warming to wait for the fetch")
+		}
+		if !fetched {
+			t.Fatalf("Expected the new-view to fetch the missing request batch")
+		}
+		events.SendEvent(instance, returnRequestBatchEvent(reqBatch))
+		if !instance.activeView || instance.view != 1 {
+			t.Fatalf("Replica never accepted the new-view for view 1 once the request batch was fetched")
+		}
+	}
+}
+
+// TestPrewarmBound checks that view-changes referencing more request batches
+// than fit the watermarks of every replica grow the pre-warmed batches no further
+func TestPrewarmBound(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.K", 2)
+	config.Set("general.logmultiplier", 2)
+	config.Set("general.prewarm", true)
+	instance := newPbftCore(1, config, &omniProto{
+		broadcastImpl: func(msgPayload []byte) {},
+		signImpl:      func(msg []byte) ([]byte, error) { return msg, nil },
+		verifyImpl:    func(senderID uint64, signature []byte, message []byte) error { return nil },
+	}, &inertTimerFactory{})
+	defer instance.close()
+
+	// A faulty replica claims a different batch in each of many old views
+	var qset []*ViewChange_PQ
+	for v := uint64(0); v < 49; v++ {
+		for n := uint64(1); n <= instance.L; n++ {
+			qset = append(qset, &ViewChange_PQ{SequenceNumber: n, BatchDigest: hash(createPbftReqBatch(int64(v*instance.L+n), 0)), View: v})
+		}
+	}
+	events.SendEvent(instance, &ViewChange{
+		View:      49,
+		Cset:      []*ViewChange_C{{SequenceNumber: 0, Id: instance.chkpts[0]}},
+		Qset:      qset,
+		ReplicaId: 0,
+	})
+
+	if limit := uint64(instance.N) * instance.L; uint64(len(instance.prewarmReqBatches)) != limit {
+		t.Errorf("Expected %d request batches pre-warmed at most, got %d", limit, len(instance.prewarmReqBatches))
+	}
+}
+
+// TestSingleReplica feeds every message type into a lone replica (N=1, f=0)
+func TestSingleReplica(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.N", 1)
+	config.Set("general.f", 0)
+	config.Set("general.K", 2)
+	config.Set("general.logmultiplier", 2)
+
+	var executed []uint64
+	executedDigests := make(map[string]bool)
+	var unicasts int
+	mock := &omniProto{
+		broadcastImpl: func(msgPayload []byte) {
+			msg := &Message{}
+			if err := proto.Unmarshal(msgPayload, msg); err != nil {
+				t.Fatalf("Could not unmarshal broadcast message: %s", err)
+			}
+			if msg.GetViewChange() != nil || msg.GetNewView() != nil {
+				t.Errorf("A single replica should never broadcast view change messages: %v", msg)
+			}
+		},
+		unicastImpl: func(msgPayload []byte, receiverID uint64) error {
+			unicasts++
+			return nil
+		},
+		signImpl:   func(msg []byte) ([]byte, error) { return msg, nil },
+		verifyImpl: func(senderID uint64, signature []byte, message []byte) error { return nil },
+		executeImpl: func(seqNo uint64, reqBatch *RequestBatch) {
+			if executedDigests[hash(reqBatch)] {
+				t.Errorf("Request batch executed twice, at seqNo %d", seqNo)
+			}
+			executedDigests[hash(reqBatch)] = true
+			executed = append(executed, seqNo)
+		},
+		getStateImpl: func() []byte { return []byte(fmt.Sprintf("%d", len(executed))) },
+	}
+	instance := newPbftCore(0, config, mock, &inertTimerFactory{})
+	defer instance.close()
+
+	send := func(msg *Message) {
+		events.SendEvent(instance, pbftMessageEvent{msg: msg, sender: 0})
+	}
+
+	for i := int64(1); i <= 3; i++ {
+		reqBatch := createPbftReqBatch(i, 0)
+		send(&Message{Payload: &Message_RequestBatch{RequestBatch: reqBatch}})
+		if len(executed) != int(i) || executed[i-1] != uint64(i) {
+			t.Fatalf("Expected request batch %d to execute without waiting for a quorum, executions: %v", i, executed)
+		}
+		events.SendEvent(instance, execDoneEvent{})
+	}
+	if instance.lastExec != 3 {
+		t.Fatalf("Expected lastExec 3, got %d", instance.lastExec)
+	}
+	if instance.h != 2 {
+		t.Fatalf("Expected the checkpoint at 2 to be stable by itself, low watermark is %d", instance.h)
+	}
+
+	reqBatch := createPbftReqBatch(4, 0)
+	digest := hash(reqBatch)
+	send(&Message{Payload: &Message_PrePrepare{PrePrepare: &PrePrepare{View: 0, SequenceNumber: 4, BatchDigest: digest, RequestBatch: reqBatch, ReplicaId: 0}}})
+	send(&Message{Payload: &Message_Prepare{Prepare: &Prepare{View: 0, SequenceNumber: 4, BatchDigest: digest, ReplicaId: 0}}})
+	send(&Message{Payload: &Message_Commit{Commit: &Commit{View: 0, SequenceNumber: 3, BatchDigest: digest, ReplicaId: 0}}})
+	send(&Message{Payload: &Message_Checkpoint{Checkpoint: &Checkpoint{SequenceNumber: 2, Id: instance.chkpts[2], ReplicaId: 0}}})
+	send(&Message{Payload: &Message_ViewChange{ViewChange: &ViewChange{View: 1, H: 2, ReplicaId: 0}}})
+	send(&Message{Payload: &Message_NewView{NewView: &NewView{View: 1, Xset: map[uint64]string{3: ""}, ReplicaId: 0}}})
+	send(&Message{Payload: &Message_FetchRequestBatch{FetchRequestBatch: &FetchRequestBatch{BatchDigest: digest, ReplicaId: 0}}})
+	send(&Message{Payload: &Message_ReturnRequestBatch{ReturnRequestBatch: reqBatch}})
+	events.SendEvent(instance, viewChangeTimerEvent{})
+	events.SendEvent(instance, viewChangeResendTimerEvent{})
+	events.SendEvent(instance, nullRequestEvent{})
+
+	if instance.view != 0 || !instance.activeView {
+		t.Fatalf("Expected a single replica to stay active in view 0, in view %d (active %v)", instance.view, instance.activeView)
+	}
+	if unicasts != 1 {
+		t.Errorf("Expected fetch-request-batch to be answered once, got %d unicasts", unicasts)
+	}
+	for i := 1; i < len(executed); i++ {
+		if executed[i] <= executed[i-1] {
+			t.Errorf("Expected executions in sequence number order, got %v", executed)
+		}
+	}
+}
+
+// TestExecuteOnCheckpoint verifies deferring execution to checkpoint boundaries
+// leaves replicas in the same state as executing on every commit
+func TestExecuteOnCheckpoint(t *testing.T) {
+	validatorCount := 4
+
+	run := func(mode string) *pbftNetwork {
+		config := loadConfig()
+		config.Set("general.K", 2)
+		config.Set("general.logmultiplier", 2)
+		config.Set("general.executeon", mode)
+		net := makePBFTNetwork(validatorCount, config)
+
+		// The last request batch does not fill the checkpoint interval
+		for i := int64(1); i <= 3; i++ {
+			net.pbftEndpoints[0].manager.Queue() <- createPbftReqBatch(i, 1)
+			net.process()
+		}
+		return net
+	}
+
+	onCommit := run("commit")
+	defer onCommit.stop()
+	onCheckpoint := run("checkpoint")
+	defer onCheckpoint.stop()
+
+	for i := range onCommit.pbftEndpoints {
+		expected := onCommit.pbftEndpoints[i]
+		pep := onCheckpoint.pbftEndpoints[i]
+
+		if !pep.pbft.execOnCheckpoint || expected.pbft.execOnCheckpoint {
+			t.Fatalf("Replica %d does not have the configured execution mode", pep.id)
+		}
+		if pep.sc.executions != 3 || pep.sc.executions != expected.sc.executions {
+			t.Errorf("Replica %d executed %d requests, expected %d", pep.id, pep.sc.executions, expected.sc.executions)
+		}
+		if pep.sc.lastExecution != expected.sc.lastExecution {
+			t.Errorf("Replica %d last executed %s, expected %s", pep.id, pep.sc.lastExecution, expected.sc.lastExecution)
+		}
+		if !reflect.DeepEqual(pep.sc.getState(), expected.sc.getState()) {
+			t.Errorf("Replica %d has state %s, expected %s", pep.id, pep.sc.getState(), expected.sc.getState())
+		}
+		if len(pep.pbft.deferredReqBatches) != 0 {
+			t.Errorf("Replica %d still has %d deferred request batches", pep.id, len(pep.pbft.deferredReqBatches))
+		}
+		if pep.pbft.lastExec%pep.pbft.K != 0 {
+			t.Errorf("Replica %d should only ever execute to checkpoint boundaries, lastExec is %d", pep.id, pep.pbft.lastExec)
+		}
+	}
+}
+
+// TestExecuteOnCheckpointDefersLastExec checks that lastExec, and with it
+// the state the replica vouches for, only moves once the deferred interval is
+// applied, so that a crash partway through the interval loses no batch
+func TestExecuteOnCheckpointDefersLastExec(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.K", 2)
+	config.Set("general.logmultiplier", 2)
+	config.Set("general.executeon", "checkpoint")
+	var executed []uint64
+	var requests int
+	instance := newPbftCore(1, config, &omniProto{
+		broadcastImpl: func(b []byte) {},
+		getStateImpl:  func() []byte { return []byte(fmt.Sprintf("%d", requests)) },
+		executeImpl: func(seqNo uint64, reqBatch *RequestBatch) {
+			executed = append(executed, seqNo)
+			requests += len(reqBatch.GetBatch())
+		},
+	}, &inertTimerFactory{})
+	defer instance.close()
+
+	commit := func(n uint64) {
+		reqBatch := createPbftReqBatch(int64(n), 0)
+		digest := hash(reqBatch)
+		events.SendEvent(instance, &PrePrepare{View: 0, SequenceNumber: n, BatchDigest: digest, RequestBatch: reqBatch, ReplicaId: 0})
+		for _, id := range []uint64{2, 3} {
+			events.SendEvent(instance, &Prepare{View: 0, SequenceNumber: n, BatchDigest: digest, ReplicaId: id})
+		}
+		for _, id := range []uint64{0, 2, 3} {
+			events.SendEvent(instance, &Commit{View: 0, SequenceNumber: n, BatchDigest: digest, ReplicaId: id})
+		}
+	}
+
+	commit(1)
+	if len(executed) != 0 || instance.lastExec != 0 || instance.deferredThrough != 1 {
+		t.Fatalf("Expected seqNo 1 to be deferred without moving lastExec, executed %v, lastExec %d", executed, instance.lastExec)
+	}
+	instance.ForceCheckpoint()
+	if _, ok := instance.chkpts[1]; ok {
+		t.Errorf("Expected no checkpoint of the state before the deferred interval is applied")
+	}
+
+	commit(2)
+	if len(executed) != 1 || executed[0] != 2 || requests != 2 {
+		t.Fatalf("Expected the interval to be applied as one execution at seqNo 2, executed %v with %d requests", executed, requests)
+	}
+	events.SendEvent(instance, execDoneEvent{})
+	if instance.lastExec != 2 {
+		t.Errorf("Expected lastExec to move to the checkpoint once the interval was applied, is %d", instance.lastExec)
+	}
+	if id, ok := instance.chkpts[2]; !ok || id != base64.StdEncoding.EncodeToString([]byte("2")) {
+		t.Errorf("Expected the checkpoint at seqNo 2 to cover the whole interval, got %q", id)
+	}
+}
+
+// TestReplayedViewChangeAfterRestart ensures that view-change messages for a view
+// the replica has already been active in are rejected, even after a restart which
+// restores a lower view from the persisted pset/qset.
+func TestReplayedViewChangeAfterRestart(t *testing.T) {
+	persist := &mockPersist{}
+	stack := &omniProto{
+		broadcastImpl:    func(msg []byte) {},
+		signImpl:         func(msg []byte) ([]byte, error) { return msg, nil },
+		verifyImpl:       func(senderID uint64, signature []byte, message []byte) error { return nil },
+		StoreStateImpl:   persist.StoreState,
+		DelStateImpl:     persist.DelState,
+		ReadStateImpl:    persist.ReadState,
+		ReadStateSetImpl: persist.ReadStateSet,
+	}
+	p := newPbftCore(0, loadConfig(), stack, &inertTimerFactory{})
+	p.view = 1
+	p.processNewView2(&NewView{View: 1, ReplicaId: 1})
+	p.close()
+
+	p = newPbftCore(0, loadConfig(), stack, &inertTimerFactory{})
+	defer p.close()
+	if p.highActiveView != 1 {
+		t.Fatalf("Expected highest active view 1 to be restored, got %d", p.highActiveView)
+	}
+
+	for _, id := range []uint64{2, 3} {
+		vc := &ViewChange{View: 1, ReplicaId: id}
+		vc.Signature, _ = vc.serialize()
+		events.SendEvent(p, vc)
+	}
+	if !p.activeView {
+		t.Errorf("Replayed view-change messages for view 1 moved replica out of its active view")
+	}
+	if len(p.viewChangeStore) != 0 {
+		t.Errorf("Expected replayed view-change messages to be rejected, %d were stored", len(p.viewChangeStore))
+	}
+
+	vc := &ViewChange{View: 2, ReplicaId: 2}
+	vc.Signature, _ = vc.serialize()
+	events.SendEvent(p, vc)
+	if _, ok := p.viewChangeStore[vcidx{2, 2}]; !ok {
+		t.Errorf("Expected view-change message for view 2 to be accepted")
+	}
+}
+
+func TestPersistView(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		persist := &mockPersist{}
+		stack := &omniProto{
+			broadcastImpl:    func(msg []byte) {},
+			signImpl:         func(msg []byte) ([]byte, error) { return msg, nil },
+			verifyImpl:       func(senderID uint64, signature []byte, message []byte) error { return nil },
+			StoreStateImpl:   persist.StoreState,
+			DelStateImpl:     persist.DelState,
+			ReadStateImpl:    persist.ReadState,
+			ReadStateSetImpl: persist.ReadStateSet,
+		}
+		config := loadConfig()
+		config.Set("general.persistview", enabled)
+		restart := func(p *pbftCore) *pbftCore {
+			p.close()
+			return newPbftCore(0, config, stack, &inertTimerFactory{})
+		}
+
+		p := newPbftCore(0, config, stack, &inertTimerFactory{})
+		p.sendViewChange(ViewChange_MANUAL)
+		p.processNewView2(&NewView{View: 1, ReplicaId: 1})
+		p = restart(p)
+		if enabled && (p.view != 1 || !p.activeView) {
+			t.Errorf("Expected the replica to resume active in view 1, got view %d, active %v", p.view, p.activeView)
+		}
+		if !enabled && p.view != 0 {
+			t.Errorf("Expected the replica to restart in view 0 without persisting its view, got view %d", p.view)
+		}
+
+		// Restarting in the middle of a view change resumes it
+		p.view = 1
+		p.sendViewChange(ViewChange_MANUAL)
+		p = restart(p)
+		if enabled && (p.view != 2 || p.activeView) {
+			t.Errorf("Expected the replica to resume its view change to view 2, got view %d, active %v", p.view, p.activeView)
+		}
+		p.close()
+	}
+}
+
+func TestDumpCertStore(t *testing.T) {
+	persist := &mockPersist{}
+	stack := &omniProto{
+		broadcastImpl:    func(msg []byte) {},
+		executeImpl:      func(seqNo uint64, reqBatch *RequestBatch) {},
+		StoreStateImpl:   persist.StoreState,
+		DelStateImpl:     persist.DelState,
+		ReadStateImpl:    persist.ReadState,
+		ReadStateSetImpl: persist.ReadStateSet,
+	}
+	p := newPbftCore(1, loadConfig(), stack, &inertTimerFactory{})
+	defer p.close()
+
+	digests := make([]string, 4)
+	for n := uint64(1); n <= 3; n++ {
+		reqBatch := createPbftReqBatch(int64(n), 0)
+		digests[n] = hash(reqBatch)
+		if n == 3 {
+			// only a prepare, no pre-prepare yet
+			break
+		}
+		events.SendEvent(p, &PrePrepare{
+			View:           0,
+			SequenceNumber: n,
+			BatchDigest:    digests[n],
+			RequestBatch:   reqBatch,
+			ReplicaId:      0,
+		})
+	}
+
+	// seqNo 1 commits, seqNo 2 only prepares, seqNo 3 only has a prepare
+	for _, id := range []uint64{2, 3} {
+		events.SendEvent(p, &Prepare{View: 0, SequenceNumber: 1, BatchDigest: digests[1], ReplicaId: id})
+		events.SendEvent(p, &Prepare{View: 0, SequenceNumber: 2, BatchDigest: digests[2], ReplicaId: id})
+	}
+	for _, id := range []uint64{0, 2} {
+		events.SendEvent(p, &Commit{View: 0, SequenceNumber: 1, BatchDigest: digests[1], ReplicaId: id})
+	}
+	events.SendEvent(p, &Prepare{View: 0, SequenceNumber: 3, BatchDigest: digests[3], ReplicaId: 2})
+
+	dump := p.DumpCertStore()
+	if len(dump) != 3 {
+		t.Fatalf("Expected 3 certificates in dump, got %d: %+v", len(dump), dump)
+	}
+
+	expected := []struct {
+		prePrepared, prepared, committed bool
+		prepares, commits                int
+	}{
+		{true, true, true, 3, 3},
+		{true, true, false, 3, 1},
+		{false, false, false, 1, 0},
+	}
+	for i, snap := range dump {
+		n := uint64(i + 1)
+		exp := expected[i]
+		if snap.View != 0 || snap.SequenceNumber != n || (exp.prePrepared && snap.Digest != digests[n]) {
+			t.Errorf("Certificate %d has unexpected view=%d/seqNo=%d/digest=%s", i, snap.View, snap.SequenceNumber, snap.Digest)
+		}
+		if snap.PrePrepared != exp.prePrepared || snap.Prepared != exp.prepared || snap.Committed != exp.committed {
+			t.Errorf("Certificate for seqNo %d: expected pre-prepared/prepared/committed %v/%v/%v, got %v/%v/%v",
+				n, exp.prePrepared, exp.prepared, exp.committed, snap.PrePrepared, snap.Prepared, snap.Committed)
+		}
+		if len(snap.Prepares) != exp.prepares || len(snap.Commits) != exp.commits {
+			t.Errorf("Certificate for seqNo %d: expected %d prepares and %d commits, got %d and %d",
+				n, exp.prepares, exp.commits, len(snap.Prepares), len(snap.Commits))
+		}
+		for _, vote := range append(snap.Prepares, snap.Commits...) {
+			if vote.BatchDigest != digests[n] {
+				t.Errorf("Certificate for seqNo %d holds vote from %d for digest %s", n, vote.ReplicaId, vote.BatchDigest)
+			}
+		}
+	}
+
+	// The dump is a copy, later messages must not alter it
+	events.SendEvent(p, &Commit{View: 0, SequenceNumber: 2, BatchDigest: digests[2], ReplicaId: 0})
+	if len(dump[1].Commits) != 1 {
+		t.Errorf("Dump changed after a later commit was received")
+	}
+
+	if _, err := json.Marshal(dump); err != nil {
+		t.Errorf("Could not serialize the dump: %s", err)
+	}
+}
+
+func TestDigestStability(t *testing.T) {
+	req := createPbftReq(1, 2)
+
+	// The same request, built with empty rather than absent fields, and after a round trip
+	reqEmpty := &Request{
+		Timestamp: &google_protobuf.Timestamp{Seconds: req.Timestamp.Seconds, Nanos: req.Timestamp.Nanos},
+		Payload:   append([]byte{}, req.Payload...),
+		ReplicaId: req.ReplicaId,
+		Signature: []byte{},
+	}
+	reqTrip := &Request{}
+	raw, _ := proto.Marshal(req)
+	proto.Unmarshal(raw, reqTrip)
+
+	for i, other := range []*Request{reqEmpty, reqTrip} {
+		if hash(req) != hash(other) {
+			t.Errorf("Equivalent request %d hashed to %s, expected %s", i, hash(other), hash(req))
+		}
+	}
+
+	if hash(&Request{ReplicaId: 1}) != hash(&Request{ReplicaId: 1, Timestamp: &google_protobuf.Timestamp{}, Payload: []byte{}}) {
+		t.Errorf("Requests with nil and empty fields hashed differently")
+	}
+
+	batch := &RequestBatch{Batch: []*Request{req}}
+	for i, other := range []*RequestBatch{
+		{Batch: []*Request{reqEmpty}},
+		{Batch: []*Request{reqTrip}},
+	} {
+		if hash(batch) != hash(other) {
+			t.Errorf("Equivalent request batch %d hashed to %s, expected %s", i, hash(other), hash(batch))
+		}
+	}
+
+	if hash(&RequestBatch{}) != hash(&RequestBatch{Batch: []*Request{}}) {
+		t.Errorf("Request batches with nil and empty batch hashed differently")
+	}
+
+	if hash(batch) == hash(&RequestBatch{Batch: []*Request{createPbftReq(2, 2)}}) {
+		t.Errorf("Different request batches hashed to the same digest")
+	}
+}
+
+func TestExecutionTimeout(t *testing.T) {
+	validatorCount := 4
+	config := loadConfig()
+	config.Set("general.timeout.execution", "100ms")
+	net := makePBFTNetwork(validatorCount, config)
+	defer net.stop()
+
+	stuck := net.pbftEndpoints[3]
+	stuck.sc.execHang = true
+
+	execute := func(tag int64) {
+		net.pbftEndpoints[0].manager.Queue() <- createPbftReqBatch(tag, 1)
+		if err := net.process(); err != nil {
+			t.Fatalf("Processing failed: %s", err)
+		}
+	}
+
+	execute(1)
+	time.Sleep(300 * time.Millisecond)
+
+	failed := false
+	var lastExec uint64
+	stuck.manager.Queue() <- workEvent(func() {
+		_, failed = stuck.pbft.failedExecs[1]
+		lastExec = stuck.pbft.lastExec
+	})
+	stuck.manager.Queue() <- nil
+	if !failed || lastExec != 1 {
+		t.Fatalf("Replica 3 should have marked its stuck execution of seqNo 1 as failed and moved past it, lastExec %d", lastExec)
+	}
+	if len(stuck.sc.abandoned) != 1 || stuck.sc.abandoned[0] != 1 {
+		t.Errorf("Replica 3 should have had its consumer roll back seqNo 1, abandoned %v", stuck.sc.abandoned)
+	}
+
+	// The stuck replica executes the later sequence numbers as usual
+	execute(2)
+	execute(3)
+
+	for _, pep := range net.pbftEndpoints {
+		if pep.pbft.lastExec != 3 {
+			t.Errorf("Replica %d should have executed through seqNo 3, has lastExec %d", pep.id, pep.pbft.lastExec)
+		}
+	}
+	if stuck.sc.lastSeqNo != 3 || stuck.sc.executions != 2 {
+		t.Errorf("Replica 3 should have executed seqNo 2 and 3 itself, executed %d requests through seqNo %d", stuck.sc.executions, stuck.sc.lastSeqNo)
+	}
+	if stuck.sc.skipOccurred {
+		t.Errorf("Replica 3 should have moved on without state transfer")
+	}
+}
+
+// TestStaleViewPrePrepare checks that certificates are keyed by view as well as
+// sequence number, so a pre-prepare from an old view cannot collide with the
+// assignment the new view makes for the same sequence number.
+func TestStaleViewPrePrepare(t *testing.T) {
+	persist := &mockPersist{}
+	stack := &omniProto{
+		broadcastImpl:    func(msg []byte) {},
+		StoreStateImpl:   persist.StoreState,
+		DelStateImpl:     persist.DelState,
+		ReadStateImpl:    persist.ReadState,
+		ReadStateSetImpl: persist.ReadStateSet,
+	}
+	p := newPbftCore(2, loadConfig(), stack, &inertTimerFactory{})
+	defer p.close()
+	p.view = 1 // replica 1 is primary
+
+	stale := createPbftReqBatch(1, 0)
+	events.SendEvent(p, &PrePrepare{
+		View:           0,
+		SequenceNumber: 1,
+		BatchDigest:    hash(stale),
+		RequestBatch:   stale,
+		ReplicaId:      1,
+	})
+	if len(p.certStore) != 0 {
+		t.Fatalf("Stale-view pre-prepare should have been ignored, found certificates %v", p.certStore)
+	}
+
+	current := createPbftReqBatch(2, 0)
+	events.SendEvent(p, &PrePrepare{
+		View:           1,
+		SequenceNumber: 1,
+		BatchDigest:    hash(current),
+		RequestBatch:   current,
+		ReplicaId:      1,
+	})
+	if !p.prePrepared(hash(current), 1, 1) {
+		t.Errorf("Pre-prepare of the current view for seqNo 1 should have been accepted")
+	}
+	if p.prePrepared(hash(stale), 0, 1) || p.prePrepared(hash(stale), 1, 1) {
+		t.Errorf("Stale-view request batch should not be pre-prepared")
+	}
+	if !p.activeView {
+		t.Errorf("Replica should not have suspected the primary")
+	}
+}
+
+// TestCheckpointHint checks that a backup which missed checkpoint messages
+// stabilizes the checkpoint from the primary's piggybacked hint, but only once
+// the hint matches the checkpoint it computed itself
+func TestCheckpointHint(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.checkpointhints", true)
+	instance := newPbftCore(1, config, &omniProto{
+		broadcastImpl: func(msg []byte) {},
+	}, &inertTimerFactory{})
+	defer instance.close()
+
+	// We executed to 10, and only received the checkpoint from replica 2
+	instance.lastExec = 10
+	instance.chkpts[10] = "ten"
+	instance.recvCheckpoint(&Checkpoint{SequenceNumber: 10, ReplicaId: 1, Id: "ten"})
+	instance.recvCheckpoint(&Checkpoint{SequenceNumber: 10, ReplicaId: 2, Id: "ten"})
+
+	preprep := func(n uint64, id string) *PrePrepare {
+		reqBatch := createPbftReqBatch(int64(n), 0)
+		return &PrePrepare{
+			View:                     0,
+			SequenceNumber:           n,
+			BatchDigest:              hash(reqBatch),
+			RequestBatch:             reqBatch,
+			ReplicaId:                0,
+			CheckpointSequenceNumber: 10,
+			CheckpointId:             id,
+		}
+	}
+
+	events.SendEvent(instance, preprep(1, "bogus"))
+	if instance.h != 0 {
+		t.Fatalf("Unverifiable checkpoint hint moved low watermark to %d", instance.h)
+	}
+
+	events.SendEvent(instance, preprep(2, "ten"))
+	if instance.h != 10 {
+		t.Fatalf("Expected checkpoint hint to move low watermark to 10, got %d", instance.h)
+	}
+}
+
+// TestFutureCheckpoint delivers a checkpoint quorum ahead of our execution,
+// which stabilizes the checkpoint once we reach it, unless it lies beyond the
+// configured lookahead
+func TestFutureCheckpoint(t *testing.T) {
+	four := base64.StdEncoding.EncodeToString([]byte("four"))
+	for _, lookahead := range []int{0, 1} {
+		config := loadConfig()
+		config.Set("general.K", 2)
+		config.Set("general.logmultiplier", 4)
+		config.Set("general.checkpointlookahead", lookahead)
+		persist := &mockPersist{}
+		instance := newPbftCore(1, config, &omniProto{
+			broadcastImpl:  func(msg []byte) {},
+			StoreStateImpl: persist.StoreState,
+			DelStateImpl:   persist.DelState,
+		}, &inertTimerFactory{})
+
+		for _, id := range []uint64{0, 2, 3} {
+			instance.recvCheckpoint(&Checkpoint{SequenceNumber: 4, ReplicaId: id, Id: four})
+		}
+		instance.recvCheckpoint(&Checkpoint{SequenceNumber: 10, ReplicaId: 0, Id: "ten"})
+		if instance.h != 0 {
+			t.Fatalf("Lookahead %d: moved low watermark to %d before reaching the checkpoint", lookahead, instance.h)
+		}
+		for chkpt := range instance.checkpointStore {
+			if chkpt.SequenceNumber == 10 {
+				t.Errorf("Lookahead %d: kept checkpoint %d beyond the high watermark", lookahead, chkpt.SequenceNumber)
+			}
+		}
+
+		// Catch up to the checkpoint
+		instance.lastExec = 4
+		instance.Checkpoint(4, []byte("four"))
+		expected := uint64(4)
+		if lookahead == 1 {
+			expected = 0
+		}
+		if instance.h != expected {
+			t.Errorf("Lookahead %d: expected low watermark %d once caught up, got %d", lookahead, expected, instance.h)
+		}
+		instance.close()
+	}
+}
+
+// TestDivergenceCircuitBreaker diverges from the network at consecutive
+// checkpoints, and checks the replica stops transferring state and halts
+// ordering once the divergence limit is reached
+func TestDivergenceCircuitBreaker(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.K", 2)
+	config.Set("general.divergencelimit", 2)
+	var invalidations, prePrepares int
+	instance := newPbftCore(0, config, &omniProto{
+		broadcastImpl: func(msgPayload []byte) {
+			msg := &Message{}
+			proto.Unmarshal(msgPayload, msg)
+			if msg.GetPrePrepare() != nil {
+				prePrepares++
+			}
+		},
+		invalidateStateImpl: func() { invalidations++ },
+	}, &inertTimerFactory{})
+	defer instance.close()
+
+	diverge := func(n uint64) {
+		// We computed a checkpoint which a quorum of the network disagrees with
+		instance.lastExec = n
+		instance.chkpts[n] = "ours"
+		for _, id := range []uint64{1, 2, 3} {
+			instance.recvCheckpoint(&Checkpoint{SequenceNumber: n, ReplicaId: id, Id: "theirs"})
+		}
+	}
+
+	diverge(2)
+	if invalidations != 1 || instance.halted {
+		t.Fatalf("Expected the first divergence to trigger state transfer, %d invalidations, halted %v", invalidations, instance.halted)
+	}
+	instance.skipInProgress = false // as if state transfer completed
+
+	diverge(4)
+	if !instance.halted {
+		t.Fatalf("Expected the circuit breaker to trip on the second consecutive divergence")
+	}
+	if invalidations != 1 {
+		t.Errorf("Expected no further state transfer once halted, got %d invalidations", invalidations)
+	}
+
+	instance.seqNo = instance.h
+	events.SendEvent(instance, createPbftReqBatch(1, 1))
+	if prePrepares != 0 {
+		t.Errorf("Expected a halted primary to withhold pre-prepares, sent %d", prePrepares)
+	}
+}
+
+// TestLeaderLeasePartitionHeal partitions the primary, lets the others move to
+// the next view, and heals the partition; the old primary must not keep
+// issuing pre-prepares once its lease lapsed, so only the new primary orders
+func TestLeaderLeasePartitionHeal(t *testing.T) {
+	clock := time.Unix(0, 0)
+	engine := &ordererEngine{
+		name:      "pbft",
+		byzantine: true,
+		newOrderer: func(id uint64, N, f int, consumer innerStack) Orderer {
+			config := loadConfig()
+			config.Set("general.N", N)
+			config.Set("general.f", f)
+			config.Set("general.timeout.lease", "1s")
+			instance := newPbftCore(id, config, consumer, &inertTimerFactory{})
+			instance.now = func() time.Time { return clock }
+			return instance
+		},
+	}
+	net := newConformanceNet(t, engine, 4)
+	defer net.stop()
+	old := net.replicas[0].orderer.(*pbftCore)
+
+	net.replicas[0].partitioned = true
+	net.submit(0, createPbftReqBatch(1, 0))
+	if old.seqNo != 1 {
+		t.Fatalf("Expected partitioned primary to pre-prepare while holding its lease")
+	}
+	clock = clock.Add(2 * time.Second)
+	net.submit(0, createPbftReqBatch(2, 0))
+	if old.seqNo != 1 {
+		t.Fatalf("Partitioned primary issued a pre-prepare after its lease expired")
+	}
+
+	// The backups time out on the silent primary and elect replica 1
+	for _, r := range net.replicas[1:] {
+		p := r.orderer.(*pbftCore)
+		events.SendEvent(p, p.sendViewChange(ViewChange_MANUAL))
+	}
+	net.process()
+	for _, r := range net.replicas[1:] {
+		if p := r.orderer.(*pbftCore); p.view != 1 || !p.activeView {
+			t.Fatalf("Replica %d did not move to view 1", r.id)
+		}
+	}
+
+	// Once healed, both primaries are offered batches, the old one, whose lease
+	// lapsed, keeps quiet, and the new one keeps making progress
+	net.replicas[0].partitioned = false
+	var expected []string
+	for i := int64(3); i <= 8; i += 2 {
+		next := createPbftReqBatch(i+1, 0)
+		expected = append(expected, hash(next))
+		net.submit(0, createPbftReqBatch(i, 0))
+		net.submit(1, next)
+		clock = clock.Add(2 * time.Second)
+	}
+	if old.seqNo != 1 {
+		t.Errorf("Old primary issued a pre-prepare after the partition healed")
+	}
+	for _, r := range net.replicas[1:] {
+		if len(r.digests) != len(expected) {
+			t.Errorf("Replica %d did not execute every batch of the new primary, executed %v", r.id, r.digests)
+			continue
+		}
+		for i, digest := range expected {
+			if r.digests[i] != digest {
+				t.Errorf("Replica %d executed %s at position %d, expected the new primary's %s", r.id, r.digests[i], i, digest)
+			}
+		}
+	}
+}
+
+// TestLeaderLeaseSlowCertificate checks that a pre-prepare which never
+// prepares at this replica does not hold the lease expired once the backups
+// acknowledged a later pre-prepare, so the replica keeps accepting them
+func TestLeaderLeaseSlowCertificate(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.timeout.lease", "1s")
+	instance := newPbftCore(1, config, &omniProto{
+		broadcastImpl: func(b []byte) {},
+		executeImpl:   func(seqNo uint64, reqBatch *RequestBatch) {},
+	}, &inertTimerFactory{})
+	defer instance.close()
+	clock := time.Unix(0, 0)
+	instance.now = func() time.Time { return clock }
+
+	prePrepare := func(n uint64) string {
+		reqBatch := createPbftReqBatch(int64(n), 0)
+		digest := hash(reqBatch)
+		events.SendEvent(instance, &PrePrepare{View: 0, SequenceNumber: n, BatchDigest: digest, RequestBatch: reqBatch, ReplicaId: 0})
+		return digest
+	}
+
+	// The prepares for seqNo 1 are lost, those for seqNo 2 arrive
+	prePrepare(1)
+	clock = clock.Add(500 * time.Millisecond)
+	digest := prePrepare(2)
+	for _, id := range []uint64{2, 3} {
+		events.SendEvent(instance, &Prepare{View: 0, SequenceNumber: 2, BatchDigest: digest, ReplicaId: id})
+	}
+
+	clock = clock.Add(5 * time.Second)
+	if instance.leaseExpired() {
+		t.Fatalf("Expected the prepare quorum of seqNo 2 to renew the lease despite the slow seqNo 1")
+	}
+	prePrepare(3)
+	if cert := instance.certStore[msgID{v: 0, n: 3}]; cert == nil || cert.prePrepare == nil {
+		t.Errorf("Expected the pre-prepare for seqNo 3 to be accepted")
+	}
+
+	// Without any acknowledgment for seqNo 3 either, the primary is stale
+	clock = clock.Add(2 * time.Second)
+	if !instance.leaseExpired() {
+		t.Errorf("Expected the lease to expire once a pre-prepare after the last renewal went unacknowledged")
+	}
+}
+
+// TestLeaderLeaseRenewedByExecution checks that a pre-prepare this replica
+// never saw prepared stops holding the lease expired once its batch executes
+func TestLeaderLeaseRenewedByExecution(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.timeout.lease", "1s")
+	instance := newPbftCore(1, config, &omniProto{
+		broadcastImpl: func(b []byte) {},
+		executeImpl:   func(seqNo uint64, reqBatch *RequestBatch) {},
+	}, &inertTimerFactory{})
+	defer instance.close()
+	clock := time.Unix(0, 0)
+	instance.now = func() time.Time { return clock }
+
+	reqBatch := createPbftReqBatch(1, 0)
+	events.SendEvent(instance, &PrePrepare{View: 0, SequenceNumber: 1, BatchDigest: hash(reqBatch), RequestBatch: reqBatch, ReplicaId: 0})
+	clock = clock.Add(2 * time.Second)
+	if !instance.leaseExpired() {
+		t.Fatalf("Expected the lease to expire on a pre-prepare without prepares")
+	}
+
+	// The replica catches up past the batch, as it would by state transfer
+	instance.lastExec = 1
+	if instance.leaseExpired() {
+		t.Errorf("Expected the lease to be re-armed once the unprepared batch executed")
+	}
+}
+
+// TestAdaptiveRequestTimeout checks that as commits slow down past the
+// configured request timeout, the adaptive timeout grows ahead of them, so
+// the backup never times out on a request which is making progress
+func TestAdaptiveRequestTimeout(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.timeout.request", "2s")
+	config.Set("general.timeout.adaptive.factor", 3)
+	config.Set("general.timeout.adaptive.min", "1s")
+	config.Set("general.timeout.adaptive.max", "30s")
+	timers := &activeTimerFactory{}
+	instance := newPbftCore(1, config, &omniProto{
+		broadcastImpl: func(b []byte) {},
+		executeImpl:   func(seqNo uint64, reqBatch *RequestBatch) {},
+	}, timers)
+	defer instance.close()
+	newViewTimer := timers.timers[0]
+	clock := time.Unix(0, 0)
+	instance.now = func() time.Time { return clock }
+
+	for n := uint64(1); n <= 8; n++ {
+		latency := time.Duration(n) * 500 * time.Millisecond
+		reqBatch := createPbftReqBatch(int64(n), 0)
+		digest := hash(reqBatch)
+		events.SendEvent(instance, &PrePrepare{View: 0, SequenceNumber: n, BatchDigest: digest, RequestBatch: reqBatch, ReplicaId: 0})
+		if !newViewTimer.active || newViewTimer.duration <= latency {
+			t.Fatalf("Request timeout for seqNo %d is %v, but it will take %v to commit", n, newViewTimer.duration, latency)
+		}
+
+		clock = clock.Add(latency)
+		for _, id := range []uint64{2, 3} {
+			events.SendEvent(instance, &Prepare{View: 0, SequenceNumber: n, BatchDigest: digest, ReplicaId: id})
+		}
+		for _, id := range []uint64{0, 2, 3} {
+			events.SendEvent(instance, &Commit{View: 0, SequenceNumber: n, BatchDigest: digest, ReplicaId: id})
+		}
+		if instance.currentExec == nil || *instance.currentExec != n {
+			t.Fatalf("Expected seqNo %d to execute", n)
+		}
+		events.SendEvent(instance, execDoneEvent{})
+	}
+
+	if timeout := instance.effectiveRequestTimeout(); timeout <= instance.requestTimeout {
+		t.Errorf("Expected the request timeout to grow beyond %v, is %v", instance.requestTimeout, timeout)
+	}
+}
+
+// TestMinExecInterval checks that batches committing in quick succession
+// are handed to the consumer no closer together than the minimum interval
+func TestMinExecInterval(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.minexecinterval", "100ms")
+	clock := time.Unix(0, 0)
+	var execs []time.Time
+	timers := &activeTimerFactory{}
+	instance := newPbftCore(1, config, &omniProto{
+		broadcastImpl: func(b []byte) {},
+		executeImpl: func(seqNo uint64, reqBatch *RequestBatch) {
+			execs = append(execs, clock)
+		},
+	}, timers)
+	defer instance.close()
+	instance.now = func() time.Time { return clock }
+	intervalTimer := timers.timers[4]
+
+	for n := uint64(1); n <= 3; n++ {
+		reqBatch := createPbftReqBatch(int64(n), 0)
+		digest := hash(reqBatch)
+		events.SendEvent(instance, &PrePrepare{View: 0, SequenceNumber: n, BatchDigest: digest, RequestBatch: reqBatch, ReplicaId: 0})
+		for _, id := range []uint64{2, 3} {
+			events.SendEvent(instance, &Prepare{View: 0, SequenceNumber: n, BatchDigest: digest, ReplicaId: id})
+		}
+		for _, id := range []uint64{0, 2, 3} {
+			events.SendEvent(instance, &Commit{View: 0, SequenceNumber: n, BatchDigest: digest, ReplicaId: id})
+		}
+	}
+
+	for len(execs) < 3 {
+		clock = clock.Add(10 * time.Millisecond)
+		if instance.currentExec != nil {
+			events.SendEvent(instance, execDoneEvent{})
+		} else if intervalTimer.active {
+			if intervalTimer.duration > 100*time.Millisecond {
+				t.Fatalf("Execution held back for %v, longer than the interval", intervalTimer.duration)
+			}
+			intervalTimer.active = false
+			events.SendEvent(instance, execIntervalTimerEvent{})
+		} else {
+			t.Fatalf("Stalled after %d executions", len(execs))
+		}
+	}
+
+	for i := 1; i < len(execs); i++ {
+		if gap := execs[i].Sub(execs[i-1]); gap < 100*time.Millisecond {
+			t.Errorf("Executions %d and %d only %v apart", i, i+1, gap)
+		}
+	}
+}
+
+// TestCompactViewChange checks that a view-change for a deep pipeline
+// encodes smaller relative to its checkpoint, and that it still means the
+// same to the new-view computation
+func TestCompactViewChange(t *testing.T) {
+	instance := newPbftCore(1, loadConfig(), &omniProto{}, &inertTimerFactory{})
+	defer instance.close()
+
+	h := uint64(1) << 40
+	newVC := func(id uint64) *ViewChange {
+		vc := &ViewChange{View: 7, H: h, ReplicaId: id, Cset: []*ViewChange_C{{SequenceNumber: h, Id: "chkpt"}}}
+		for n := h + 1; n <= h+instance.L; n++ {
+			digest := hash(createPbftReqBatch(int64(n-h), 0))
+			vc.Pset = append(vc.Pset, &ViewChange_PQ{SequenceNumber: n, BatchDigest: digest, View: 6})
+			vc.Qset = append(vc.Qset, &ViewChange_PQ{SequenceNumber: n, BatchDigest: digest, View: 6})
+		}
+		return vc
+	}
+
+	var plain, compact []*ViewChange
+	for id := uint64(0); id < 3; id++ {
+		plain = append(plain, newVC(id))
+		vc := newVC(id)
+		compactViewChange(vc)
+		raw, _ := proto.Marshal(vc)
+		received := &ViewChange{}
+		proto.Unmarshal(raw, received)
+		compact = append(compact, received)
+	}
+
+	plainSize, compactSize := proto.Size(plain[0]), proto.Size(compact[0])
+	t.Logf("View-change with %d prepared requests encodes in %d bytes, %d compact", instance.L, plainSize, compactSize)
+	if compactSize >= plainSize {
+		t.Errorf("Compact view-change is %d bytes, expected fewer than %d", compactSize, plainSize)
+	}
+
+	pset, qset := compact[0].expandedSets()
+	if !reflect.DeepEqual(pset, plain[0].Pset) || !reflect.DeepEqual(qset, plain[0].Qset) {
+		t.Errorf("Compact view-change sets expand to %v and %v, expected %v and %v", pset, qset, plain[0].Pset, plain[0].Qset)
+	}
+	if !instance.correctViewChange(plain[0]) || !instance.correctViewChange(compact[0]) {
+		t.Fatalf("Expected both encodings to be correct view-changes")
+	}
+	plainList, compactList := instance.assignSequenceNumbers(plain, h), instance.assignSequenceNumbers(compact, h)
+	if len(plainList) != int(instance.L) || !reflect.DeepEqual(plainList, compactList) {
+		t.Errorf("Compact view-changes assign %v, expected %v", compactList, plainList)
+	}
+}
+
+// TestVirtualTimeViewChange checks, with asymmetric link latencies and a
+// silent primary, that each backup asks for a view change exactly when its
+// request timer expires or when f+1 view-changes reached it, whichever is first
+func TestVirtualTimeViewChange(t *testing.T) {
+	ms := time.Millisecond
+	latency := [][]time.Duration{
+		{0, unreachable, unreachable, unreachable},
+		{5 * ms, 0, 30 * ms, 100 * ms},
+		{5 * ms, 10 * ms, 0, 10 * ms},
+		{5 * ms, 10 * ms, 10 * ms, 0},
+	}
+	net := newVirtualNet(t, latency, func(id uint64, config *viper.Viper) {
+		config.Set("general.timeout.request", "2s")
+	})
+	defer net.stop()
+
+	viewChangeAt := make(map[uint64]time.Duration)
+	var newViewAt []time.Duration
+	net.sent = func(sender, receiver uint64, msg *Message) {
+		if vc := msg.GetViewChange(); vc != nil {
+			if _, ok := viewChangeAt[sender]; !ok {
+				viewChangeAt[sender] = net.now
+			}
+		}
+		if msg.GetNewView() != nil && receiver == 2 {
+			newViewAt = append(newViewAt, net.now)
+		}
+	}
+
+	reqBatch := createPbftReqBatch(1, 1)
+	net.submitAt(0, 1, reqBatch)
+	net.submitAt(30*ms, 2, reqBatch)
+	net.submitAt(500*ms, 3, reqBatch)
+	net.runUntil(10 * time.Second)
+
+	expected := map[uint64]time.Duration{
+		1: 2000 * ms, // its own request timer
+		2: 2030 * ms, // its own request timer
+		3: 2100 * ms, // the view-changes of 2 and 1 arrived at 2040ms and 2100ms, before its timer at 2500ms
+	}
+	for id, at := range expected {
+		if viewChangeAt[id] != at {
+			t.Errorf("Replica %d sent its view-change at %v, expected %v", id, viewChangeAt[id], at)
+		}
+	}
+	if _, ok := viewChangeAt[0]; ok {
+		t.Errorf("Silent replica 0 should not have reached anybody")
+	}
+	// replica 1 collects 2f+1 view-changes once replica 3's arrives at 2110ms
+	if len(newViewAt) != 1 || newViewAt[0] != 2110*ms {
+		t.Errorf("New primary sent new-views at %v, expected once at 2.11s", newViewAt)
+	}
+
+	for _, vr := range net.replicas[1:] {
+		if vr.pbft.view != 1 || !vr.pbft.activeView {
+			t.Errorf("Replica %d is in view %d (active %v), expected active view 1", vr.id, vr.pbft.view, vr.pbft.activeView)
+		}
+		if len(vr.executed) != 1 {
+			t.Errorf("Replica %d executed %v, expected the submitted batch once", vr.id, vr.executed)
+		}
+		if vr.pbft.viewChanges != 1 {
+			t.Errorf("Replica %d initiated %d view changes, expected 1", vr.id, vr.pbft.viewChanges)
+		}
+	}
+}
+
+func TestVirtualNetParallel(t *testing.T) {
+	ms := time.Millisecond
+	run := func(parallel bool) ([][]uint64, []uint64) {
+		latency := [][]time.Duration{
+			{0, 5 * ms, 10 * ms, 5 * ms},
+			{5 * ms, 0, 30 * ms, 100 * ms},
+			{5 * ms, 10 * ms, 0, 10 * ms},
+			{unreachable, 10 * ms, 10 * ms, 0},
+		}
+		net := newVirtualNet(t, latency, func(id uint64, config *viper.Viper) {
+			config.Set("general.K", 2)
+			config.Set("general.timeout.request", "2s")
+		})
+		defer net.stop()
+		net.parallel = parallel
+
+		for i := 0; i < 8; i++ {
+			net.submitAt(time.Duration(i)*20*ms, uint64(i%4), createPbftReqBatch(int64(i+1), uint64(i%4)))
+		}
+		net.runUntil(10 * time.Second)
+
+		var executed [][]uint64
+		var views []uint64
+		for _, vr := range net.replicas {
+			executed = append(executed, vr.executed)
+			views = append(views, vr.pbft.view)
+		}
+		return executed, views
+	}
+
+	serial, serialViews := run(false)
+	for _, log := range serial {
+		if len(log) == 0 {
+			t.Fatalf("Expected the scenario to execute on every replica, got %v", serial)
+		}
+	}
+	concurrent, concurrentViews := run(true)
+	if !reflect.DeepEqual(serial, concurrent) || !reflect.DeepEqual(serialViews, concurrentViews) {
+		t.Errorf("Concurrent processing executed %v in views %v, serial processing %v in views %v", concurrent, concurrentViews, serial, serialViews)
+	}
+}
+
+func TestRetransmittedPrepareAndCommit(t *testing.T) {
+	mock := &omniProto{
+		broadcastImpl: func(msgPayload []byte) {},
+	}
+	instance := newPbftCore(1, loadConfig(), mock, &inertTimerFactory{})
+	defer instance.close()
+
+	reqBatch := createPbftReqBatch(1, 0)
+	digest := hash(reqBatch)
+	events.SendEvent(instance, &PrePrepare{
+		View:           0,
+		SequenceNumber: 1,
+		BatchDigest:    digest,
+		RequestBatch:   reqBatch,
+		ReplicaId:      0,
+	})
+	cert := instance.certStore[msgID{v: 0, n: 1}]
+	if !cert.sentPrepare {
+		t.Fatalf("Expected replica to prepare the pre-prepared batch")
+	}
+
+	// Our own prepare, retransmitted, counts once
+	prep := &Prepare{View: 0, SequenceNumber: 1, BatchDigest: digest, ReplicaId: 1}
+	for i := 0; i < 3; i++ {
+		events.SendEvent(instance, prep)
+	}
+	if len(cert.prepare) != 1 || instance.prepared(digest, 0, 1) || cert.sentCommit {
+		t.Fatalf("Retransmissions of our own prepare inflated the quorum: %d prepares", len(cert.prepare))
+	}
+
+	events.SendEvent(instance, &Prepare{View: 0, SequenceNumber: 1, BatchDigest: digest, ReplicaId: 2})
+	if !instance.prepared(digest, 0, 1) || !cert.sentCommit {
+		t.Fatalf("Expected a prepare quorum once a second replica prepared")
+	}
+
+	// The same holds for our own commit
+	commit := &Commit{View: 0, SequenceNumber: 1, BatchDigest: digest, ReplicaId: 1}
+	for i := 0; i < 3; i++ {
+		events.SendEvent(instance, commit)
+	}
+	events.SendEvent(instance, &Commit{View: 0, SequenceNumber: 1, BatchDigest: digest, ReplicaId: 2})
+	if len(cert.commit) != 2 || instance.committed(digest, 0, 1) {
+		t.Fatalf("Retransmissions of our own commit inflated the quorum: %d commits", len(cert.commit))
+	}
+}
+
+func TestDuplicatePrePrepare(t *testing.T) {
+	broadcasts := 0
+	mock := &omniProto{
+		broadcastImpl: func(msgPayload []byte) { broadcasts++ },
+		signImpl:      func(msg []byte) ([]byte, error) { return msg, nil },
+		verifyImpl:    func(senderID uint64, signature []byte, message []byte) error { return nil },
+	}
+	instance := newPbftCore(1, loadConfig(), mock, &inertTimerFactory{})
+	defer instance.close()
+	clock := time.Unix(0, 0)
+	instance.now = func() time.Time { return clock }
+
+	reqBatch := createPbftReqBatch(1, 0)
+	preprep := &PrePrepare{
+		View:           0,
+		SequenceNumber: 1,
+		BatchDigest:    hash(reqBatch),
+		RequestBatch:   reqBatch,
+		ReplicaId:      0,
+	}
+	events.SendEvent(instance, preprep)
+	cert := instance.certStore[msgID{v: 0, n: 1}]
+	if cert == nil || !cert.sentPrepare || broadcasts != 1 {
+		t.Fatalf("Expected replica to prepare the pre-prepared batch")
+	}
+
+	// The primary retransmits once our request timer was stopped
+	instance.stopTimer()
+	clock = clock.Add(time.Second)
+	retransmitted := *preprep
+	events.SendEvent(instance, &retransmitted)
+	if cert.prePrepare != preprep || !cert.prePreparedAt.Equal(time.Unix(0, 0)) || instance.timerActive || broadcasts != 1 {
+		t.Errorf("Duplicate pre-prepare changed the replica's state")
+	}
+
+	conflicting := createPbftReqBatch(2, 0)
+	events.SendEvent(instance, &PrePrepare{
+		View:           0,
+		SequenceNumber: 1,
+		BatchDigest:    hash(conflicting),
+		RequestBatch:   conflicting,
+		ReplicaId:      0,
+	})
+	if instance.misbehavior[0] != 1 || instance.view != 1 || instance.activeView {
+		t.Errorf("Expected a conflicting pre-prepare to count as an equivocation and trigger a view change")
+	}
+}
+
+func TestViewAndPrimaryID(t *testing.T) {
+	mock := &omniProto{
+		broadcastImpl: func(msgPayload []byte) {},
+		signImpl:      func(msg []byte) ([]byte, error) { return msg, nil },
+		verifyImpl:    func(senderID uint64, signature []byte, message []byte) error { return nil },
+	}
+	instance := newPbftCore(2, loadConfig(), mock, &inertTimerFactory{})
+	defer instance.close()
+
+	if instance.View() != 0 || instance.PrimaryID() != 0 {
+		t.Fatalf("Expected view 0 with primary 0, got view %d with primary %d", instance.View(), instance.PrimaryID())
+	}
+
+	events.SendEvent(instance, viewChangeTimerEvent{})
+
+	// The accessors may be called off the event thread
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if instance.View() != 1 || instance.PrimaryID() != 1 {
+			t.Errorf("Expected view 1 with primary 1 after the view change, got view %d with primary %d", instance.View(), instance.PrimaryID())
+		}
+	}()
+	<-done
+}
+
+func TestQuarantine(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.quarantinethreshold", 3)
+	mock := &omniProto{
+		broadcastImpl: func(msgPayload []byte) {},
+		signImpl:      func(msg []byte) ([]byte, error) { return msg, nil },
+		verifyImpl: func(senderID uint64, signature []byte, message []byte) error {
+			if senderID == 3 {
+				return fmt.Errorf("bad signature")
+			}
+			return nil
+		},
+	}
+	instance := newPbftCore(1, config, mock, &inertTimerFactory{})
+	defer instance.close()
+
+	sendBatch := func(tag int64) string {
+		reqBatch := createPbftReqBatch(tag, 3)
+		events.SendEvent(instance, &pbftMessage{msg: &Message{Payload: &Message_RequestBatch{RequestBatch: reqBatch}}, sender: 3})
+		return hash(reqBatch)
+	}
+
+	for v := uint64(1); v <= 3; v++ {
+		if digest := sendBatch(int64(v)); instance.reqBatchStore[digest] == nil {
+			t.Fatalf("Request batch from replica 3 ignored before it was quarantined, score %d", instance.misbehavior[3])
+		}
+		vc := &ViewChange{View: v, ReplicaId: 3}
+		events.SendEvent(instance, &pbftMessage{msg: &Message{Payload: &Message_ViewChange{ViewChange: vc}}, sender: 3})
+	}
+	if !instance.quarantined(3) || instance.quarantined(2) {
+		t.Fatalf("Expected only replica 3 to be quarantined, scores %v", instance.misbehavior)
+	}
+
+	if digest := sendBatch(4); instance.reqBatchStore[digest] != nil {
+		t.Errorf("Request batch from quarantined replica 3 was processed")
+	}
+	instance.protocolVersion = 1
+	events.SendEvent(instance, &pbftMessage{msg: &Message{Payload: &Message_Hello{Hello: &Hello{ReplicaId: 3, ProtocolVersion: 1}}}, sender: 3})
+	if instance.peerHellos[3] != nil {
+		t.Errorf("Hello from quarantined replica 3 was processed")
+	}
+
+	// Its agreement messages still count
+	reqBatch := createPbftReqBatch(5, 0)
+	digest := hash(reqBatch)
+	events.SendEvent(instance, &PrePrepare{View: 0, SequenceNumber: 1, BatchDigest: digest, RequestBatch: reqBatch, ReplicaId: 0})
+	events.SendEvent(instance, &pbftMessage{msg: &Message{Payload: &Message_Prepare{Prepare: &Prepare{View: 0, SequenceNumber: 1, BatchDigest: digest, ReplicaId: 3}}}, sender: 3})
+	if !instance.prepared(digest, 0, 1) {
+		t.Errorf("Prepare from quarantined replica 3 should still count towards the quorum")
+	}
+}
+
+// benchmarkConsensusThroughput orders request batches of batchSize requests
+// through a network of N replicas whose executor only counts them, one batch
+// at a time, and reports requests ordered per second
+func benchmarkConsensusThroughput(b *testing.B, N int, batchSize int) {
+	// Quiet the debug logging for the benchmark only, the tests keep it
+	defer logging.SetLevel(logging.GetLevel(""), "")
+	logging.SetLevel(logging.ERROR, "")
+
+	net := makePBFTNetwork(N, nil)
+	defer func() {
+		net.stop()
+		for _, pep := range net.pbftEndpoints {
+			pep.manager.Halt()
+		}
+	}()
+	go net.processContinually()
+
+	executed := make(chan uint64, N)
+	for _, pep := range net.pbftEndpoints {
+		pep.sc.executed = executed
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reqBatch := &RequestBatch{}
+		for j := 0; j < batchSize; j++ {
+			reqBatch.Batch = append(reqBatch.Batch, createPbftReq(int64(i*batchSize+j), 0))
+		}
+		net.pbftEndpoints[0].manager.Queue() <- reqBatch
+		for r := 0; r < N; r++ {
+			<-executed
+		}
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "req/s")
+}
+
+func BenchmarkConsensusThroughputN1(b *testing.B) {
+	benchmarkConsensusThroughput(b, 1, 1)
+}
+
+func BenchmarkConsensusThroughputN1Batched(b *testing.B) {
+	benchmarkConsensusThroughput(b, 1, 100)
+}
+
+func BenchmarkConsensusThroughputN4(b *testing.B) {
+	benchmarkConsensusThroughput(b, 4, 1)
+}
+
+func BenchmarkConsensusThroughputN4Batched(b *testing.B) {
+	benchmarkConsensusThroughput(b, 4, 100)
+}
+
+// TestIntegrityAudit checks that the periodic audit finds nothing on a healthy
+// replica, and flags a sequence number executed without a commit certificate
+func TestIntegrityAudit(t *testing.T) {
+	ms := time.Millisecond
+	latency := [][]time.Duration{
+		{0, 5 * ms, 5 * ms, 5 * ms},
+		{5 * ms, 0, 5 * ms, 5 * ms},
+		{5 * ms, 5 * ms, 0, 5 * ms},
+		{5 * ms, 5 * ms, 5 * ms, 0},
+	}
+	net := newVirtualNet(t, latency, func(id uint64, config *viper.Viper) {
+		config.Set("general.timeout.audit", "1s")
+	})
+	defer net.stop()
+
+	findings := make(map[uint64][]auditFinding)
+	for _, vr := range net.replicas {
+		id := vr.id
+		vr.pbft.auditSink = func(f auditFinding) { findings[id] = append(findings[id], f) }
+	}
+
+	net.submitAt(0, 0, createPbftReqBatch(1, 0))
+	net.submitAt(100*ms, 0, createPbftReqBatch(2, 0))
+	net.runUntil(1500 * ms)
+
+	for _, vr := range net.replicas {
+		if vr.pbft.lastExec != 2 {
+			t.Fatalf("Replica %d expected to execute through seqNo 2, lastExec %d", vr.id, vr.pbft.lastExec)
+		}
+	}
+	if len(findings) != 0 {
+		t.Fatalf("Audit of healthy replicas flagged %v", findings)
+	}
+
+	// Replica 2 claims an execution no certificate justifies
+	net.replicas[2].pbft.lastExec = 3
+	net.runUntil(2500 * ms)
+
+	if len(findings) != 1 || len(findings[2]) != 1 || findings[2][0].seqNo != 3 {
+		t.Errorf("Expected the audit to flag seqNo 3 on replica 2 alone, got %v", findings)
+	}
+}
+
+func TestInjectFault(t *testing.T) {
+	instance := newPbftCore(0, loadConfig(), &omniProto{}, &inertTimerFactory{})
+	if _, err := instance.InjectFault(ForceViewChange{}); err != errFaultInjectionDisabled {
+		t.Errorf("Expected fault injection to be disabled by default, got %v", err)
+	}
+	instance.close()
+
+	ms := time.Millisecond
+	latency := [][]time.Duration{
+		{0, 5 * ms, 5 * ms, 5 * ms},
+		{5 * ms, 0, 5 * ms, 5 * ms},
+		{5 * ms, 5 * ms, 0, 5 * ms},
+		{5 * ms, 5 * ms, 5 * ms, 0},
+	}
+	newNet := func() *virtualNet {
+		net := newVirtualNet(t, latency, func(id uint64, config *viper.Viper) {
+			config.Set("general.faultinjection", true)
+			config.Set("general.K", 2)
+			config.Set("general.logmultiplier", 2)
+		})
+		net.stateTransfer = true
+		return net
+	}
+	inject := func(vr *virtualReplica, fault FaultKind) {
+		e, err := vr.pbft.InjectFault(fault)
+		if err != nil {
+			t.Fatalf("Replica %d refused fault %T: %s", vr.id, fault, err)
+		}
+		if e != nil {
+			events.SendEvent(vr.pbft, e)
+		}
+	}
+	expectExecuted := func(net *virtualNet, n int, fault string) {
+		for _, vr := range net.replicas {
+			if len(vr.executed) != n {
+				t.Errorf("Replica %d executed %v after %s, expected %d batches", vr.id, vr.executed, fault, n)
+			}
+		}
+	}
+
+	// Replica 3 misses the commit quorum of the first batch, and catches up through
+	// state transfer once the others move past its high watermark
+	net := newNet()
+	inject(net.replicas[3], DropCommits{N: 3})
+	for i := 0; i < 8; i++ {
+		net.submitAt(time.Duration(i)*100*ms, 0, createPbftReqBatch(int64(i+1), 0))
+	}
+	net.runUntil(350 * ms)
+	if len(net.replicas[3].executed) != 0 || len(net.replicas[0].executed) != 4 {
+		t.Errorf("Expected only replica 3 to stall on the dropped commits, it executed %v, replica 0 %v", net.replicas[3].executed, net.replicas[0].executed)
+	}
+	net.runUntil(2 * time.Second)
+	expectExecuted(net, 8, "dropping commits")
+	net.stop()
+
+	// Replica 1 holds back execution, which resumes once the delay elapses
+	net = newNet()
+	inject(net.replicas[1], DelayExecution{Delay: time.Second})
+	net.submitAt(0, 0, createPbftReqBatch(1, 0))
+	net.submitAt(100*ms, 0, createPbftReqBatch(2, 0))
+	net.runUntil(500 * ms)
+	if len(net.replicas[1].executed) != 0 || len(net.replicas[0].executed) != 2 {
+		t.Errorf("Expected only replica 1 to delay execution, it executed %v, replica 0 %v", net.replicas[1].executed, net.replicas[0].executed)
+	}
+	net.runUntil(1500 * ms)
+	expectExecuted(net, 2, "delaying execution")
+	net.stop()
+
+	// Two forced view changes bring the others along, and the new primary takes requests
+	net = newNet()
+	net.submitAt(0, 0, createPbftReqBatch(1, 0))
+	net.runUntil(100 * ms)
+	inject(net.replicas[0], ForceViewChange{})
+	inject(net.replicas[1], ForceViewChange{})
+	net.runUntil(200 * ms)
+	for _, vr := range net.replicas {
+		if vr.pbft.view != 1 || !vr.pbft.activeView {
+			t.Errorf("Replica %d is in view %d (active %v) after forced view changes, expected active view 1", vr.id, vr.pbft.view, vr.pbft.activeView)
+		}
+	}
+	net.submitAt(200*ms, 1, createPbftReqBatch(2, 1))
+	net.runUntil(500 * ms)
+	expectExecuted(net, 2, "forcing a view change")
+	net.stop()
+}
+
+func TestViewChangeRateLimit(t *testing.T) {
+	ms := time.Millisecond
+	latency := [][]time.Duration{
+		{0, 5 * ms, 5 * ms, 5 * ms},
+		{5 * ms, 0, 5 * ms, 5 * ms},
+		{5 * ms, 5 * ms, 0, 5 * ms},
+		{5 * ms, 5 * ms, 5 * ms, 0},
+	}
+	net := newVirtualNet(t, latency, func(id uint64, config *viper.Viper) {
+		config.Set("general.timeout.viewchangeinterval", "10s")
+	})
+	defer net.stop()
+
+	trigger := func(ids ...uint64) {
+		for _, id := range ids {
+			if e := net.replicas[id].pbft.sendViewChange(ViewChange_MANUAL); e != nil {
+				events.SendEvent(net.replicas[id].pbft, e)
+			}
+		}
+	}
+	expectView := func(view uint64, when string) {
+		for _, vr := range net.replicas {
+			if vr.pbft.view != view || !vr.pbft.activeView {
+				t.Errorf("Replica %d is in view %d (active %v) %s, expected active view %d", vr.id, vr.pbft.view, vr.pbft.activeView, when, view)
+			}
+		}
+	}
+
+	trigger(2, 3)
+	net.runUntil(100 * ms)
+	expectView(1, "after the first view change")
+
+	// Triggered again right away, replicas 2 and 3 defer their view changes
+	net.runUntil(200 * ms)
+	trigger(2, 3)
+	net.runUntil(9 * time.Second)
+	expectView(1, "within the view change interval")
+
+	// Once deferred, they move on, and 0 and 1 join within their own interval
+	net.runUntil(10500 * ms)
+	expectView(2, "after the view change interval")
+
+	net.submitAt(10500*ms, 2, createPbftReqBatch(1, 2))
+	net.runUntil(11 * time.Second)
+	for _, vr := range net.replicas {
+		if len(vr.executed) != 1 {
+			t.Errorf("Replica %d executed %v in the new view, expected the submitted batch", vr.id, vr.executed)
+		}
+	}
+}
+
+func TestDeterministicResubmission(t *testing.T) {
+	var first map[uint64]string
+	for run := 0; run < 5; run++ {
+		instance := newPbftCore(0, loadConfig(), &omniProto{
+			broadcastImpl: func(msgPayload []byte) {},
+		}, &inertTimerFactory{})
+
+		// The request batches arrive during a view change, and are pre-prepared once it ends
+		instance.activeView = false
+		for i := int64(1); i <= 5; i++ {
+			instance.recvRequestBatch(createPbftReqBatch(i, 1))
+		}
+		instance.activeView = true
+		instance.resubmitRequestBatches()
+
+		assigned := make(map[uint64]string)
+		for idx, cert := range instance.certStore {
+			assigned[idx.n] = cert.digest
+		}
+		instance.close()
+
+		if len(assigned) != 5 {
+			t.Fatalf("Run %d expected the 5 request batches to be pre-prepared, got %v", run, assigned)
+		}
+		if first == nil {
+			first = assigned
+		} else if !reflect.DeepEqual(assigned, first) {
+			t.Fatalf("Run %d assigned the request batches %v, the first run %v", run, assigned, first)
+		}
+	}
+}
+
+// TestConsistencyProbe checks that a probe reports a replica whose state
+// diverged, without sending anything beyond the probe itself
+func TestConsistencyProbe(t *testing.T) {
+	ms := time.Millisecond
+	latency := [][]time.Duration{
+		{0, 5 * ms, 5 * ms, 5 * ms},
+		{5 * ms, 0, 5 * ms, 5 * ms},
+		{5 * ms, 5 * ms, 0, 5 * ms},
+		{5 * ms, 5 * ms, 5 * ms, 0},
+	}
+	net := newVirtualNet(t, latency, func(id uint64, config *viper.Viper) {
+		config.Set("general.K", 2)
+	})
+	defer net.stop()
+
+	net.submitAt(0, 0, createPbftReqBatch(1, 0))
+	net.submitAt(100*ms, 0, createPbftReqBatch(2, 0))
+	net.runUntil(500 * ms)
+	for _, vr := range net.replicas {
+		if vr.pbft.h != 2 {
+			t.Fatalf("Replica %d expected a stable checkpoint at seqNo 2, got %d", vr.id, vr.pbft.h)
+		}
+	}
+
+	done := net.replicas[0].pbft.ConsistencyProbe()
+	net.runUntil(600 * ms)
+	report := <-done
+	if !report.Agreed() || len(report.Checkpoints) != 4 || len(report.Unanswered) != 0 {
+		t.Fatalf("Expected all replicas to agree, got %+v", report)
+	}
+
+	// Replica 3 diverged
+	net.replicas[3].pbft.chkpts[2] = "diverged"
+	net.sent = func(sender, receiver uint64, msg *Message) {
+		if msg.GetConsistencyProbe() == nil && msg.GetProbeReply() == nil {
+			t.Errorf("Replica %d sent %s during the probe", sender, messageType(msg))
+		}
+	}
+	done = net.replicas[0].pbft.ConsistencyProbe()
+	net.runUntil(700 * ms)
+
+	select {
+	case report = <-done:
+	default:
+		t.Fatalf("Probe did not complete once every replica answered")
+	}
+	if report.SequenceNumber != 2 || len(report.Divergent) != 1 || report.Divergent[0] != 3 {
+		t.Errorf("Expected the probe to find replica 3 diverging at seqNo 2, got %+v", report)
+	}
+}
+
+// TestPrewarmConcurrency checks that the next primary, missing many request
+// batches, accepts its new-view sooner when fetching them in parallel
+func TestPrewarmConcurrency(t *testing.T) {
+	ms := time.Millisecond
+	timeToNewView := func(concurrency int) time.Duration {
+		// Replica 1 never receives the pre-prepares of replica 0
+		latency := [][]time.Duration{
+			{0, unreachable, 20 * ms, 20 * ms},
+			{20 * ms, 0, 20 * ms, 20 * ms},
+			{20 * ms, 20 * ms, 0, 20 * ms},
+			{20 * ms, 20 * ms, 20 * ms, 0},
+		}
+		net := newVirtualNet(t, latency, func(id uint64, config *viper.Viper) {
+			config.Set("general.prewarm", true)
+			config.Set("general.prewarmconcurrency", concurrency)
+		})
+		defer net.stop()
+
+		for i := int64(1); i <= 8; i++ {
+			net.submitAt(0, 0, createPbftReqBatch(i, 0))
+		}
+		net.runUntil(500 * ms)
+		if len(net.replicas[1].pbft.reqBatchStore) != 0 {
+			t.Fatalf("Replica 1 should be missing every request batch")
+		}
+
+		trigger := func(ids ...uint64) {
+			for _, id := range ids {
+				if e := net.replicas[id].pbft.sendViewChange(ViewChange_MANUAL); e != nil {
+					events.SendEvent(net.replicas[id].pbft, e)
+				}
+			}
+		}
+		trigger(2)
+		net.runUntil(600 * ms)
+		trigger(0, 3)
+
+		primary := net.replicas[1].pbft
+		for now := 600 * ms; now < 2*time.Second; now += ms {
+			net.runUntil(now)
+			if primary.view == 1 && primary.activeView {
+				return now - 600*ms
+			}
+		}
+		t.Fatalf("Replica 1 never accepted its new-view (concurrency %d)", concurrency)
+		return 0
+	}
+
+	serial := timeToNewView(1)
+	parallel := timeToNewView(4)
+	if parallel >= serial {
+		t.Errorf("Expected parallel pre-warming to shorten the time to new-view, took %v in parallel and %v serially", parallel, serial)
+	}
+}
+
+// TestPrewarmAlternativeAssignment checks that the next primary, unable to
+// fetch a request batch only the old primary's view-change claims prepared,
+// gives up on it and builds the new-view from the other view-changes
+func TestPrewarmAlternativeAssignment(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.prewarm", true)
+	config.Set("general.timeout.prewarm", "100ms")
+
+	digest := hash(createPbftReqBatch(1, 0))
+	newViews := make(chan *NewView, 1)
+	mock := &omniProto{
+		signImpl:   func(msg []byte) ([]byte, error) { return msg, nil },
+		verifyImpl: func(senderID uint64, signature []byte, message []byte) error { return nil },
+		broadcastImpl: func(msgPayload []byte) {
+			msg := &Message{}
+			proto.Unmarshal(msgPayload, msg)
+			if nv := msg.GetNewView(); nv != nil {
+				newViews <- nv
+			}
+		},
+	}
+	instance, manager := createRunningPbftWithManager(1, config, mock)
+	defer manager.Halt()
+	defer instance.close()
+
+	makeVC := func(id uint64, pset, qset []*ViewChange_PQ) *ViewChange {
+		return &ViewChange{
+			View:      1,
+			Cset:      []*ViewChange_C{{SequenceNumber: 0, Id: instance.chkpts[0]}},
+			Pset:      pset,
+			Qset:      qset,
+			ReplicaId: id,
+		}
+	}
+	pq := []*ViewChange_PQ{{SequenceNumber: 1, BatchDigest: digest, View: 0}}
+	manager.Queue() <- makeVC(0, pq, pq)
+	manager.Queue() <- makeVC(2, nil, pq)
+	manager.Queue() <- makeVC(3, nil, nil)
+
+	select {
+	case nv := <-newViews:
+		if d, ok := nv.Xset[1]; ok && d != "" {
+			t.Errorf("Expected the new-view to avoid the unobtainable request batch, assigned %s", d)
+		}
+		for _, vc := range nv.Vset {
+			if vc.ReplicaId == 0 {
+				t.Errorf("Expected the new-view to leave out the view-change of replica 0")
+			}
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Replica never sent its new-view")
+	}
+}
+
+// TestWeakCheckpointPacing checks that f+1 matching checkpoints let the
+// primary pre-prepare further ahead, but never move its low watermark
+func TestWeakCheckpointPacing(t *testing.T) {
+	for _, weak := range []bool{false, true} {
+		config := loadConfig()
+		config.Set("general.K", 2)
+		config.Set("general.weakcheckpoint", weak)
+		var sent []uint64
+		instance := newPbftCore(0, config, &omniProto{
+			broadcastImpl: func(msgPayload []byte) {
+				msg := &Message{}
+				proto.Unmarshal(msgPayload, msg)
+				if preprep := msg.GetPrePrepare(); preprep != nil {
+					sent = append(sent, preprep.SequenceNumber)
+				}
+			},
+		}, &inertTimerFactory{})
+
+		// The primary pre-prepares up to half its log of 8 ahead of its low watermark
+		for i := int64(1); i <= 5; i++ {
+			instance.recvRequestBatch(createPbftReqBatch(i, 0))
+		}
+		if len(sent) != 4 {
+			t.Fatalf("Expected the primary to pace its pre-prepares to seqNo 4, sent %v", sent)
+		}
+
+		instance.recvCheckpoint(&Checkpoint{SequenceNumber: 2, ReplicaId: 1, Id: "state"})
+		instance.recvCheckpoint(&Checkpoint{SequenceNumber: 2, ReplicaId: 2, Id: "state"})
+		if weak && len(sent) != 5 {
+			t.Errorf("Expected the weak checkpoint to let the primary pre-prepare seqNo 5, sent %v", sent)
+		}
+		if !weak && len(sent) != 4 {
+			t.Errorf("Expected the primary to keep pacing from its low watermark without weak checkpoints, sent %v", sent)
+		}
+		if instance.h != 0 || instance.certStore[msgID{0, 1}] == nil {
+			t.Errorf("Weak checkpoint moved the low watermark to %d, or truncated the log (weak=%v)", instance.h, weak)
+		}
+
+		// A stable checkpoint still moves the watermarks
+		instance.chkpts[2] = "state"
+		instance.recvCheckpoint(&Checkpoint{SequenceNumber: 2, ReplicaId: 3, Id: "state"})
+		if instance.h != 2 || instance.certStore[msgID{0, 1}] != nil {
+			t.Errorf("Expected the stable checkpoint to move the low watermark to 2, got %d (weak=%v)", instance.h, weak)
+		}
+		instance.close()
+	}
+}
+
+// TestNewViewOrder checks that the primary marshals the view-changes of its
+// new-view by replica id, and that backups verify any order alike, although
+// the view-changes here support two assignments depending on their order
+func TestNewViewOrder(t *testing.T) {
+	reqBatch1, reqBatch2 := createPbftReqBatch(1, 0), createPbftReqBatch(2, 0)
+	d1, d2 := hash(reqBatch1), hash(reqBatch2)
+	makeVCs := func(genesis string) []*ViewChange {
+		makeVC := func(id uint64, pset, qset []*ViewChange_PQ) *ViewChange {
+			return &ViewChange{View: 1, Cset: []*ViewChange_C{{SequenceNumber: 0, Id: genesis}}, Pset: pset, Qset: qset, ReplicaId: id}
+		}
+		pq1 := []*ViewChange_PQ{{SequenceNumber: 1, BatchDigest: d1, View: 0}}
+		pq2 := []*ViewChange_PQ{{SequenceNumber: 1, BatchDigest: d2, View: 0}}
+		return []*ViewChange{makeVC(0, pq1, pq1), makeVC(1, pq2, pq2), makeVC(2, nil, pq1), makeVC(3, nil, pq2)}
+	}
+	newReplica := func(id uint64, broadcast func(msgPayload []byte)) *pbftCore {
+		instance := newPbftCore(id, loadConfig(), &omniProto{
+			broadcastImpl: broadcast,
+			signImpl:      func(msg []byte) ([]byte, error) { return msg, nil },
+			verifyImpl:    func(senderID uint64, signature []byte, message []byte) error { return nil },
+		}, &inertTimerFactory{})
+		instance.view = 1
+		instance.activeView = false
+		instance.reqBatchStore[d1] = reqBatch1
+		instance.reqBatchStore[d2] = reqBatch2
+		return instance
+	}
+
+	var nvRaw []byte
+	for run := 0; run < 5; run++ {
+		var sent []byte
+		primary := newReplica(1, func(msgPayload []byte) {
+			msg := &Message{}
+			proto.Unmarshal(msgPayload, msg)
+			if nv := msg.GetNewView(); nv != nil {
+				sent, _ = proto.Marshal(nv)
+			}
+		})
+		for _, vc := range makeVCs(primary.chkpts[0]) {
+			primary.viewChangeStore[vcidx{vc.View, vc.ReplicaId}] = vc
+		}
+		primary.sendNewView()
+		primary.close()
+		if nvRaw != nil && !bytes.Equal(sent, nvRaw) {
+			t.Fatalf("Primary marshaled its new-view differently from one run to the next")
+		}
+		nvRaw = sent
+	}
+	nv := &NewView{}
+	proto.Unmarshal(nvRaw, nv)
+	if nv.Xset[1] != d1 {
+		t.Fatalf("Expected the new-view to assign seqNo 1 from the view-change of replica 0, got %v", nv.Xset)
+	}
+
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 1, 2, 0}, {1, 3, 0, 2}} {
+		backup := newReplica(2, func(msgPayload []byte) {})
+		shuffled := &NewView{View: nv.View, Xset: nv.Xset, ReplicaId: nv.ReplicaId}
+		for _, i := range order {
+			shuffled.Vset = append(shuffled.Vset, nv.Vset[i])
+		}
+		backup.recvNewView(shuffled)
+		if !backup.activeView || backup.view != 1 {
+			t.Errorf("Backup rejected the new-view with view-changes ordered %v", order)
+		}
+		backup.close()
+	}
+}
+
+func TestExecutionRetry(t *testing.T) {
+	ms := time.Millisecond
+	latency := [][]time.Duration{
+		{0, 5 * ms, 5 * ms, 5 * ms},
+		{5 * ms, 0, 5 * ms, 5 * ms},
+		{5 * ms, 5 * ms, 0, 5 * ms},
+		{5 * ms, 5 * ms, 5 * ms, 0},
+	}
+	net := newVirtualNet(t, latency, func(id uint64, config *viper.Viper) {
+		config.Set("general.execretry.maxattempts", 3)
+		config.Set("general.execretry.backoff", "100ms")
+	})
+	defer net.stop()
+
+	// Replica 2 fails to execute seqNo 1 twice, then succeeds, and fails seqNo 2 for good
+	var attempts []time.Duration
+	net.execError = func(replica, seqNo uint64) error {
+		if replica != 2 {
+			return nil
+		}
+		if seqNo == 2 {
+			return &PermanentExecError{Err: fmt.Errorf("poison request")}
+		}
+		attempts = append(attempts, net.now)
+		if len(attempts) <= 2 {
+			return fmt.Errorf("resource temporarily locked")
+		}
+		return nil
+	}
+
+	net.submitAt(0, 0, createPbftReqBatch(1, 0))
+	net.runUntil(time.Second)
+	if len(attempts) != 3 || attempts[1]-attempts[0] != 100*ms || attempts[2]-attempts[1] != 200*ms {
+		t.Fatalf("Expected 3 attempts backing off 100ms then 200ms, attempted at %v", attempts)
+	}
+	if vr := net.replicas[2]; len(vr.executed) != 1 || vr.pbft.lastExec != 1 {
+		t.Fatalf("Expected replica 2 to execute seqNo 1 once it succeeded, executed %v", vr.executed)
+	}
+
+	net.submitAt(time.Second, 0, createPbftReqBatch(2, 0))
+	net.runUntil(2 * time.Second)
+	if len(attempts) != 3 {
+		t.Errorf("Expected no retry of a permanently failed execution, attempted at %v", attempts)
+	}
+	if _, ok := net.replicas[2].pbft.failedExecs[2]; !ok || net.replicas[2].pbft.lastExec != 2 {
+		t.Errorf("Expected replica 2 to mark seqNo 2 failed and move past it")
+	}
+}
+
+// TestDivergenceQuiet diverges replica 3 from the network's checkpoint, it must
+// withhold its votes while state transfer reconciles it, then resume voting
+func TestDivergenceQuiet(t *testing.T) {
+	ms := time.Millisecond
+	latency := [][]time.Duration{
+		{0, ms, ms, ms},
+		{ms, 0, ms, ms},
+		{ms, ms, 0, ms},
+		{ms, ms, ms, 0},
+	}
+	net := newVirtualNet(t, latency, func(id uint64, config *viper.Viper) {
+		config.Set("general.K", 2)
+		config.Set("general.divergencequiet", true)
+	})
+	defer net.stop()
+	net.stateTransfer = true
+	net.transferLatency = 100 * ms
+
+	// An extra execution puts the state of replica 3 off from the others
+	diverged := net.replicas[3]
+	diverged.executed = []uint64{0}
+
+	var votes []uint64
+	net.sent = func(sender, receiver uint64, msg *Message) {
+		if sender != 3 {
+			return
+		}
+		if p := msg.GetPrepare(); p != nil && diverged.pbft.silenced {
+			t.Errorf("Replica 3 sent a prepare for seqNo=%d while reconciling", p.SequenceNumber)
+		}
+		if c := msg.GetCommit(); c != nil {
+			if diverged.pbft.silenced {
+				t.Errorf("Replica 3 sent a commit for seqNo=%d while reconciling", c.SequenceNumber)
+			} else if receiver == 0 {
+				votes = append(votes, c.SequenceNumber)
+			}
+		}
+	}
+
+	net.submitAt(0, 0, createPbftReqBatch(1, 0))
+	net.submitAt(10*ms, 0, createPbftReqBatch(2, 0))
+	// Ordered while replica 3 transfers state
+	net.submitAt(30*ms, 0, createPbftReqBatch(3, 0))
+	net.runUntil(50 * ms)
+	if !diverged.pbft.silenced {
+		t.Fatalf("Expected replica 3 to withhold its votes once its checkpoint diverged")
+	}
+
+	net.runUntil(200 * ms)
+	if diverged.pbft.silenced {
+		t.Fatalf("Expected replica 3 to resume voting once reconciled")
+	}
+	if !reflect.DeepEqual(votes, []uint64{1, 2}) {
+		t.Fatalf("Expected replica 3 to vote for seqNo 1 and 2 only before reconciling, voted for %v", votes)
+	}
+
+	net.submitAt(300*ms, 0, createPbftReqBatch(4, 0))
+	net.runUntil(time.Second)
+	if !reflect.DeepEqual(votes, []uint64{1, 2, 4}) {
+		t.Errorf("Expected replica 3 to vote again once reconciled, voted for %v", votes)
+	}
+	if diverged.pbft.lastExec != 4 || string(diverged.getState()) != string(net.replicas[0].getState()) {
+		t.Errorf("Expected replica 3 to execute up to seqNo 4 in the network's state, at seqNo=%d with state %s", diverged.pbft.lastExec, diverged.getState())
+	}
+}
+
+// TestVoteBatching feeds a burst of prepares to two backups, individually and
+// as vote batches, and expects both to end up with the same certificates and
+// to send the same commits, the batching backup as a single vote batch
+func TestVoteBatching(t *testing.T) {
+	type backup struct {
+		instance *pbftCore
+		sent     []*Message
+	}
+	newBackup := func(batching bool) *backup {
+		b := &backup{}
+		config := loadConfig()
+		config.Set("general.votebatching", batching)
+		b.instance = newPbftCore(1, config, &omniProto{
+			broadcastImpl: func(msgPayload []byte) {
+				msg := &Message{}
+				proto.Unmarshal(msgPayload, msg)
+				b.sent = append(b.sent, msg)
+			},
+		}, &inertTimerFactory{})
+		return b
+	}
+	individual, batched := newBackup(false), newBackup(true)
+	defer individual.instance.close()
+	defer batched.instance.close()
+
+	deliver := func(b *backup, sender uint64, msg *Message) {
+		events.SendEvent(b.instance, pbftMessageEvent{msg: msg, sender: sender})
+	}
+	var digests []string
+	for n := uint64(1); n <= 5; n++ {
+		reqBatch := createPbftReqBatch(int64(n), 1)
+		digests = append(digests, hash(reqBatch))
+		preprep := &PrePrepare{View: 0, SequenceNumber: n, BatchDigest: hash(reqBatch), RequestBatch: reqBatch, ReplicaId: 0}
+		for _, b := range []*backup{individual, batched} {
+			deliver(b, 0, &Message{Payload: &Message_PrePrepare{PrePrepare: preprep}})
+		}
+	}
+
+	for _, sender := range []uint64{2, 3} {
+		vb := &VoteBatch{ReplicaId: sender}
+		for n := uint64(1); n <= 5; n++ {
+			vb.Prepares = append(vb.Prepares, &Prepare{View: 0, SequenceNumber: n, BatchDigest: digests[n-1], ReplicaId: sender})
+		}
+		// A vote claiming another sender is refused either way
+		vb.Prepares = append(vb.Prepares, &Prepare{View: 0, SequenceNumber: 1, BatchDigest: digests[0], ReplicaId: 4})
+		for _, prep := range vb.Prepares {
+			deliver(individual, sender, &Message{Payload: &Message_Prepare{Prepare: prep}})
+		}
+		deliver(batched, sender, &Message{Payload: &Message_VoteBatch{VoteBatch: vb}})
+	}
+
+	for n := uint64(1); n <= 5; n++ {
+		ic, bc := individual.instance.certStore[msgID{0, n}], batched.instance.certStore[msgID{0, n}]
+		if !reflect.DeepEqual(ic.prepare, bc.prepare) || !reflect.DeepEqual(ic.commit, bc.commit) {
+			t.Errorf("Certificates of seqNo=%d differ, individually %v/%v, batched %v/%v", n, ic.prepare, ic.commit, bc.prepare, bc.commit)
+		}
+		if len(bc.prepare) != 3 {
+			t.Errorf("Expected the prepares of replicas 1, 2 and 3 for seqNo=%d, got %v", n, bc.prepare)
+		}
+	}
+
+	var individualCommits []*Commit
+	for _, msg := range individual.sent {
+		if commit := msg.GetCommit(); commit != nil {
+			individualCommits = append(individualCommits, commit)
+		}
+	}
+	last := batched.sent[len(batched.sent)-1].GetVoteBatch()
+	if len(individualCommits) != 5 || last == nil || !reflect.DeepEqual(last.Commits, individualCommits) {
+		t.Errorf("Expected the 5 commits sent individually, %v, to be sent as one vote batch, got %v", individualCommits, batched.sent[len(batched.sent)-1])
+	}
+}
+
+func TestFutureViewChangeBound(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.maxfutureviews", 3)
+	p := newPbftCore(0, config, &omniProto{
+		broadcastImpl: func(msg []byte) {},
+		signImpl:      func(msg []byte) ([]byte, error) { return msg, nil },
+		verifyImpl:    func(senderID uint64, signature []byte, message []byte) error { return nil },
+	}, &inertTimerFactory{})
+	defer p.close()
+
+	for v := uint64(100); v >= 2; v-- {
+		vc := &ViewChange{View: v, ReplicaId: 3}
+		vc.Signature, _ = vc.serialize()
+		events.SendEvent(p, vc)
+	}
+	if len(p.viewChangeStore) != 3 {
+		t.Fatalf("Expected view-changes of 3 future views to be buffered, got %d", len(p.viewChangeStore))
+	}
+	for v := uint64(2); v <= 4; v++ {
+		if _, ok := p.viewChangeStore[vcidx{v, 3}]; !ok {
+			t.Errorf("Expected view-change for low view %d to be kept", v)
+		}
+	}
+
+	vc := &ViewChange{View: 1, ReplicaId: 1}
+	vc.Signature, _ = vc.serialize()
+	events.SendEvent(p, vc)
+	if p.view != 1 {
+		t.Errorf("Expected f+1 view-changes to move replica to view 1, it is in view %d", p.view)
+	}
+}
+
+func TestCheckpointGossip(t *testing.T) {
+	validatorCount := 4
+	config := loadConfig()
+	config.Set("general.K", 2)
+	config.Set("general.logmultiplier", 2)
+	config.Set("general.timeout.checkpointgossip", "1h")
+	net := makePBFTNetwork(validatorCount, config)
+	defer net.stop()
+
+	pep := net.pbftEndpoints[3]
+	pbft := pep.pbft
+
+	// Replica 3 misses every message until the network is stable past its high watermark
+	net.filterFn = func(src, replica int, msg []byte) []byte {
+		if src != -1 && replica == 3 {
+			return nil
+		}
+		return msg
+	}
+	for i := int64(1); uint64(i) <= pbft.L+pbft.K; i++ {
+		net.pbftEndpoints[0].manager.Queue() <- createPbftReqBatch(i, uint64(generateBroadcaster(validatorCount)))
+		if err := net.process(); err != nil {
+			t.Fatalf("Processing failed: %s", err)
+		}
+	}
+	net.filterFn = nil
+	if pbft.skipInProgress {
+		t.Fatalf("Replica 3 should not know it fell behind before any gossip")
+	}
+
+	for _, id := range []int{0, 1, 2} {
+		net.pbftEndpoints[id].manager.Queue() <- gossipTimerEvent{}
+	}
+	if err := net.process(); err != nil {
+		t.Fatalf("Processing failed: %s", err)
+	}
+
+	if !pep.sc.skipOccurred {
+		t.Fatalf("Replica 3 did not state transfer on learning of the stable checkpoint through gossip")
+	}
+	if pep.sc.executions != pbft.L+pbft.K {
+		t.Errorf("Expected replica 3 to catch up to the gossiped checkpoint %d, got to %d", pbft.L+pbft.K, pep.sc.executions)
+	}
+}
+
+func TestCheckpointCoalescing(t *testing.T) {
+	validatorCount := 4
+	config := loadConfig()
+	config.Set("general.K", 2)
+	config.Set("general.logmultiplier", 4)
+	config.Set("general.coalesce.maxk", 4)
+	config.Set("general.coalesce.load", 2)
+	net := makePBFTNetwork(validatorCount, config)
+	defer net.stop()
+
+	var checkpointed []uint64
+	net.filterFn = func(src, replica int, payload []byte) []byte {
+		msg := &Message{}
+		if src == 0 && replica == 1 && proto.Unmarshal(payload, msg) == nil && msg.GetCheckpoint() != nil {
+			checkpointed = append(checkpointed, msg.GetCheckpoint().SequenceNumber)
+		}
+		return payload
+	}
+
+	tag := int64(0)
+	execReqBatches := func(batches, requests int) {
+		for i := 0; i < batches; i++ {
+			reqBatch := &RequestBatch{}
+			for j := 0; j < requests; j++ {
+				tag++
+				reqBatch.Batch = append(reqBatch.Batch, createPbftReq(tag, uint64(generateBroadcaster(validatorCount))))
+			}
+			net.pbftEndpoints[0].manager.Queue() <- reqBatch
+			if err := net.process(); err != nil {
+				t.Fatalf("Processing failed: %s", err)
+			}
+			for _, pep := range net.pbftEndpoints {
+				if pep.pbft.h%pep.pbft.K != 0 || pep.pbft.lastExec < pep.pbft.h || pep.pbft.lastExec-pep.pbft.h > pep.pbft.L-pep.pbft.K {
+					t.Fatalf("Replica %d broke the watermark invariants, h=%d, lastExec=%d, L=%d", pep.id, pep.pbft.h, pep.pbft.lastExec, pep.pbft.L)
+				}
+			}
+		}
+	}
+
+	// Under load the checkpoint period doubles, but no further than maxk
+	execReqBatches(8, 8)
+	// Once the load drops, it is back to K
+	execReqBatches(4, 1)
+
+	if expected := []uint64{4, 8, 10, 12}; !reflect.DeepEqual(checkpointed, expected) {
+		t.Errorf("Expected checkpoints at %v, got %v", expected, checkpointed)
+	}
+	for _, pep := range net.pbftEndpoints {
+		if pep.pbft.h != 12 {
+			t.Errorf("Replica %d expected its low watermark at 12, got %d", pep.id, pep.pbft.h)
+		}
+	}
+}
+
+func TestTrustedBootstrap(t *testing.T) {
+	validatorCount := 4
+	config := loadConfig()
+	config.Set("general.K", 2)
+	config.Set("general.logmultiplier", 2)
+	net := makePBFTNetwork(validatorCount, config)
+	defer net.stop()
+
+	execReqBatch := func(tag int64) {
+		net.pbftEndpoints[0].manager.Queue() <- createPbftReqBatch(tag, uint64(generateBroadcaster(validatorCount)))
+		if err := net.process(); err != nil {
+			t.Fatalf("Processing failed: %s", err)
+		}
+	}
+
+	// Replica 3 is yet to join, while the network commits past a stable checkpoint
+	net.filterFn = func(src, replica int, msg []byte) []byte {
+		if src == 3 || replica == 3 {
+			return nil
+		}
+		return msg
+	}
+	for tag := int64(1); tag <= 5; tag++ {
+		execReqBatch(tag)
+	}
+	net.filterFn = nil
+
+	newcomer := net.pbftEndpoints[3]
+	newcomer.manager.Queue() <- workEvent(func() {
+		if err := newcomer.pbft.Bootstrap(0); err != nil {
+			t.Errorf("Could not bootstrap: %s", err)
+		}
+	})
+	if err := net.process(); err != nil {
+		t.Fatalf("Processing failed: %s", err)
+	}
+
+	if !newcomer.sc.skipOccurred {
+		t.Fatalf("Replica 3 did not state transfer to the trusted peer's checkpoint")
+	}
+	if newcomer.pbft.lastExec != 5 || newcomer.sc.executions != 5 {
+		t.Fatalf("Expected replica 3 to execute the batch committed above the checkpoint, lastExec=%d, executions=%d", newcomer.pbft.lastExec, newcomer.sc.executions)
+	}
+
+	execReqBatch(6)
+	for _, pep := range net.pbftEndpoints {
+		if pep.pbft.lastExec != 6 {
+			t.Errorf("Replica %d expected to execute seqNo=6 once bootstrapped, lastExec=%d", pep.id, pep.pbft.lastExec)
+		}
+	}
+}
+
+// A trusted peer alone can not make a bootstrapping replica adopt its
+// checkpoint, and bootstrapping is given up when no f+1 replicas reply
+func TestBootstrapNeedsMatchingReplies(t *testing.T) {
+	validatorCount := 4
+	config := loadConfig()
+	config.Set("general.K", 2)
+	config.Set("general.logmultiplier", 2)
+	net := makePBFTNetwork(validatorCount, config)
+	defer net.stop()
+
+	net.filterFn = func(src, replica int, msg []byte) []byte {
+		if src == 3 || replica == 3 {
+			return nil
+		}
+		return msg
+	}
+	for tag := int64(1); tag <= 5; tag++ {
+		net.pbftEndpoints[0].manager.Queue() <- createPbftReqBatch(tag, uint64(generateBroadcaster(validatorCount)))
+		net.process()
+	}
+
+	// only the trusted peer replies
+	net.filterFn = func(src, replica int, payload []byte) []byte {
+		msg := &Message{}
+		if replica == 3 && src != 0 && proto.Unmarshal(payload, msg) == nil && msg.GetBootstrapReply() != nil {
+			return nil
+		}
+		return payload
+	}
+	newcomer := net.pbftEndpoints[3]
+	newcomer.manager.Queue() <- workEvent(func() {
+		if err := newcomer.pbft.Bootstrap(0); err != nil {
+			t.Errorf("Could not bootstrap: %s", err)
+		}
+	})
+	net.process()
+
+	if newcomer.sc.skipOccurred || newcomer.pbft.lastExec != 0 {
+		t.Fatalf("Expected replica 3 not to catch up from the trusted peer's reply alone, lastExec=%d", newcomer.pbft.lastExec)
+	}
+	newcomer.manager.Queue() <- workEvent(func() {
+		if !newcomer.pbft.bootstrapping {
+			t.Errorf("Expected replica 3 to still await matching bootstrap replies")
+		}
+		events.SendEvent(newcomer.pbft, bootstrapTimerEvent{})
+		if newcomer.pbft.bootstrapping {
+			t.Errorf("Expected replica 3 to give up bootstrapping once it timed out")
+		}
+	})
+	net.process()
+}
+
+func TestTruncatedDigest(t *testing.T) {
+	validatorCount := 4
+	config := loadConfig()
+	config.Set("general.digestbytes", 16)
+	net := makePBFTNetwork(validatorCount, config)
+	defer net.stop()
+
+	// Replica 3 is misconfigured with another digest length
+	net.pbftEndpoints[3].pbft.digestBytes = 32
+
+	var digests []string
+	net.filterFn = func(src, replica int, payload []byte) []byte {
+		msg := &Message{}
+		if src == 0 && replica == 1 && proto.Unmarshal(payload, msg) == nil && msg.GetPrePrepare() != nil {
+			digests = append(digests, msg.GetPrePrepare().BatchDigest)
+		}
+		return payload
+	}
+
+	reqBatch := &RequestBatch{Batch: []*Request{createPbftReq(1, uint64(generateBroadcaster(validatorCount)))}}
+	net.pbftEndpoints[0].manager.Queue() <- reqBatch
+	if err := net.process(); err != nil {
+		t.Fatalf("Processing failed: %s", err)
+	}
+
+	if len(digests) != 1 {
+		t.Fatalf("Expected one pre-prepare, got %d", len(digests))
+	}
+	if raw, _ := base64.StdEncoding.DecodeString(digests[0]); len(raw) != 16 {
+		t.Errorf("Expected a digest truncated to 16 bytes, got %d", len(raw))
+	}
+	for _, pep := range net.pbftEndpoints[:3] {
+		if pep.pbft.lastExec != 1 {
+			t.Errorf("Replica %d expected to execute the batch with truncated digests, lastExec=%d", pep.id, pep.pbft.lastExec)
+		}
+	}
+	if pbft := net.pbftEndpoints[3].pbft; pbft.lastExec != 0 || pbft.getCert(0, 1).prePrepare != nil {
+		t.Errorf("Replica 3 expected to refuse digests of another length, lastExec=%d", pbft.lastExec)
+	}
+}
+
+func TestViewChangeReason(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.faultinjection", true)
+
+	var sent []ViewChange_Reason
+	newReplica := func() *pbftCore {
+		sent = nil
+		return newPbftCore(1, config, &omniProto{
+			broadcastImpl: func(payload []byte) {
+				msg := &Message{}
+				if proto.Unmarshal(payload, msg) == nil && msg.GetViewChange() != nil {
+					sent = append(sent, msg.GetViewChange().Reason)
+				}
+			},
+			signImpl:   func(msg []byte) ([]byte, error) { return msg, nil },
+			verifyImpl: func(senderID uint64, signature []byte, message []byte) error { return nil },
+		}, &inertTimerFactory{})
+	}
+	check := func(p *pbftCore, cause string, expected ...ViewChange_Reason) {
+		if !reflect.DeepEqual(sent, expected) {
+			t.Errorf("Expected %s to send view-changes with reasons %v, got %v", cause, expected, sent)
+		}
+		if last := expected[len(expected)-1]; p.viewChangeReason != last || p.Metrics().ViewChangeCauses[last.String()] == 0 {
+			t.Errorf("Expected %s to be recorded as reason %s, got %s", cause, last, p.viewChangeReason)
+		}
+	}
+
+	p := newReplica()
+	events.SendEvent(p, viewChangeTimerEvent{})
+	events.SendEvent(p, viewChangeTimerEvent{})
+	check(p, "request and new-view timeouts", ViewChange_REQUEST_TIMEOUT, ViewChange_NEW_VIEW_TIMEOUT)
+	p.close()
+
+	p = newReplica()
+	events.SendEvent(p, nullRequestEvent{})
+	check(p, "a missing null request", ViewChange_NULL_REQUEST_TIMEOUT)
+	p.close()
+
+	p = newReplica()
+	for i := int64(1); i <= 2; i++ {
+		reqBatch := createPbftReqBatch(i, 0)
+		events.SendEvent(p, &PrePrepare{View: 0, SequenceNumber: 1, BatchDigest: hash(reqBatch), RequestBatch: reqBatch, ReplicaId: 0})
+	}
+	check(p, "an equivocating primary", ViewChange_EQUIVOCATION)
+	p.close()
+
+	p = newReplica()
+	e, err := p.InjectFault(ForceViewChange{})
+	if err != nil {
+		t.Fatalf("Injecting fault failed: %s", err)
+	}
+	events.SendEvent(p, e)
+	check(p, "a manual trigger", ViewChange_MANUAL)
+	p.close()
+}
+
+func TestDamagedStatePolicy(t *testing.T) {
+	restart := func(policy string) (p *pbftCore, persist *mockPersist, invalidated bool, err interface{}) {
+		persist = &mockPersist{}
+		persist.StoreState("chkpt.10", []byte("checkpoint"))
+		persist.StoreState("pset", []byte("garbage"))
+		config := loadConfig()
+		config.Set("general.damagedstate", policy)
+		stack := &omniProto{
+			StoreStateImpl:      persist.StoreState,
+			DelStateImpl:        persist.DelState,
+			ReadStateImpl:       persist.ReadState,
+			ReadStateSetImpl:    persist.ReadStateSet,
+			invalidateStateImpl: func() { invalidated = true },
+		}
+		defer func() { err = recover() }()
+		p = newPbftCore(0, config, stack, &inertTimerFactory{})
+		return
+	}
+
+	p, _, _, err := restart("skip")
+	if err != nil {
+		t.Fatalf("Expected skip policy to start the replica, got %v", err)
+	}
+	if p.h != 10 || p.skipInProgress {
+		t.Errorf("Expected skip policy to restore the intact checkpoint, h=%d", p.h)
+	}
+	p.close()
+
+	p, _, _, err = restart("refuse")
+	if err != nil {
+		t.Fatalf("Expected refuse policy to report an error rather than panic, got %v", err)
+	}
+	if p.startErr == nil || !strings.Contains(p.startErr.Error(), "refusing to start") {
+		t.Errorf("Expected refuse policy not to start the replica, got %v", p.startErr)
+	}
+	p.close()
+
+	p, persist, invalidated, err := restart("discard")
+	if err != nil {
+		t.Fatalf("Expected discard policy to start the replica, got %v", err)
+	}
+	defer p.close()
+	if len(persist.store) != 0 || p.h != 0 || len(p.chkpts) != 0 {
+		t.Errorf("Expected discard policy to drop all persisted state, h=%d, persisted %d keys", p.h, len(persist.store))
+	}
+	if !p.skipInProgress || !invalidated {
+		t.Errorf("Expected discard policy to await state transfer")
+	}
+}
+
+func TestCatchUpBarrier(t *testing.T) {
+	validatorCount := 4
+	config := loadConfig()
+	config.Set("general.K", 2)
+	config.Set("general.logmultiplier", 2)
+	config.Set("general.catchupbarrier", true)
+	net := makePBFTNetwork(validatorCount, config)
+	defer net.stop()
+
+	tag := int64(0)
+	execReqBatch := func() {
+		tag++
+		net.pbftEndpoints[0].manager.Queue() <- createPbftReqBatch(tag, uint64(generateBroadcaster(validatorCount)))
+		if err := net.process(); err != nil {
+			t.Fatalf("Processing failed: %s", err)
+		}
+	}
+
+	execReqBatch()
+	if net.pbftEndpoints[0].pbft.catchingUp {
+		t.Fatalf("Expected a replica started without state to vote")
+	}
+
+	// Replica 3 falls behind, and then restarts
+	behind := true
+	var votes []uint64
+	net.filterFn = func(src, replica int, payload []byte) []byte {
+		if behind && replica == 3 {
+			return nil
+		}
+		msg := &Message{}
+		if src == 3 && proto.Unmarshal(payload, msg) == nil {
+			if p := msg.GetPrepare(); p != nil {
+				votes = append(votes, p.SequenceNumber)
+			} else if c := msg.GetCommit(); c != nil {
+				votes = append(votes, c.SequenceNumber)
+			}
+		}
+		return payload
+	}
+	execReqBatch()
+	execReqBatch()
+
+	pe := net.pbftEndpoints[3]
+	pe.pbft.close()
+	pe.pbft = newPbftCore(3, config, pe.sc, events.NewTimerFactoryImpl(pe.manager))
+	pe.manager.SetReceiver(pe.pbft)
+	if !pe.pbft.catchingUp {
+		t.Fatalf("Expected replica 3 to withhold its votes after restarting at seqNo=%d", pe.pbft.lastExec)
+	}
+	behind = false
+
+	for pe.pbft.catchingUp && tag < 20 {
+		execReqBatch()
+	}
+	if pe.pbft.catchingUp {
+		t.Fatalf("Expected replica 3 to catch up with the network")
+	}
+	caughtUp := pe.pbft.lastExec
+	if len(votes) != 0 {
+		t.Errorf("Expected replica 3 to withhold its votes until it caught up at seqNo=%d, it voted on %v", caughtUp, votes)
+	}
+
+	execReqBatch()
+	if len(votes) == 0 || votes[0] <= caughtUp {
+		t.Errorf("Expected replica 3 to vote on sequence numbers after seqNo=%d once caught up, it voted on %v", caughtUp, votes)
+	}
+	if pe.sc.lastSeqNo != net.pbftEndpoints[0].sc.lastSeqNo {
+		t.Errorf("Expected replica 3 to execute up to seqNo=%d, it is at %d", net.pbftEndpoints[0].sc.lastSeqNo, pe.sc.lastSeqNo)
+	}
+}
+
+func TestInvariantChecker(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.debug.invariants", true)
+	instance := newPbftCore(0, config, &omniProto{}, &inertTimerFactory{})
+	defer instance.close()
+
+	if err := instance.invariantViolation(); err != nil {
+		t.Fatalf("Expected a fresh replica to be consistent, got %v", err)
+	}
+
+	cert := instance.getCert(0, 1)
+	for i := 0; i <= instance.N; i++ {
+		cert.commit = append(cert.commit, &Commit{View: 0, SequenceNumber: 1, ReplicaId: uint64(i % instance.N)})
+	}
+	if err := instance.invariantViolation(); err == nil || !strings.Contains(err.Error(), "commits") {
+		t.Errorf("Expected more commits than replicas to violate an invariant, got %v", err)
+	}
+	cert.commit = nil
+
+	executing := uint64(1)
+	instance.currentExec = &executing
+	if err := instance.invariantViolation(); err == nil || !strings.Contains(err.Error(), "without a commit certificate") {
+		t.Errorf("Expected executing an uncommitted seqNo to violate an invariant, got %v", err)
+	}
+
+	var err interface{}
+	func() {
+		defer func() { err = recover() }()
+		instance.ProcessEvent(nil)
+	}()
+	if err == nil {
+		t.Errorf("Expected the checker to panic after processing an event")
+	}
+}
+
+func TestPrimaryDomains(t *testing.T) {
+	config := loadConfig()
+	config.Set("general.N", 7)
+	config.Set("general.f", 2)
+	config.Set("general.domains", []string{"rack1", "rack1", "rack1", "rack2", "rack2", "rack3", "rack3"})
+	instance := newPbftCore(0, config, &omniProto{}, &inertTimerFactory{})
+	defer instance.close()
+
+	domains := config.GetStringSlice("general.domains")
+	seen := make(map[uint64]bool)
+	for v := uint64(0); v < uint64(2*instance.N); v++ {
+		primary, next := instance.primary(v), instance.primary(v+1)
+		if domains[primary] == domains[next] {
+			t.Errorf("Expected primaries of views %d and %d in different domains, both %d and %d are in %s", v, v+1, primary, next, domains[primary])
+		}
+		seen[primary] = true
+	}
+	if len(seen) != instance.N {
+		t.Errorf("Expected every replica to become primary, only %d did", len(seen))
+	}
+
+	config.Set("general.domains", []string{})
+	plain := newPbftCore(0, config, &omniProto{}, &inertTimerFactory{})
+	defer plain.close()
+	if plain.primary(3) != 3 {
+		t.Errorf("Expected round robin primaries without domains, view 3 has primary %d", plain.primary(3))
+	}
+}
+
+func TestCheckpointFanout(t *testing.T) {
+	validatorCount := 16
+	config := loadConfig()
+	config.Set("general.N", validatorCount)
+	config.Set("general.f", 5)
+	config.Set("general.K", 2)
+	config.Set("general.logmultiplier", 4)
+	config.Set("general.checkpointfanout", 5)
+	net := makePBFTNetwork(validatorCount, config)
+	defer net.stop()
+
+	checkpointMsgs := 0
+	net.filterFn = func(src, replica int, payload []byte) []byte {
+		msg := &Message{}
+		if replica != -1 && proto.Unmarshal(payload, msg) == nil && msg.GetCheckpoint() != nil {
+			checkpointMsgs++
+		}
+		return payload
+	}
+
+	for i := int64(1); i <= 8; i++ {
+		net.pbftEndpoints[0].manager.Queue() <- createPbftReqBatch(i, uint64(generateBroadcaster(validatorCount)))
+		if err := net.process(); err != nil {
+			t.Fatalf("Processing failed: %s", err)
+		}
+	}
+
+	for _, pep := range net.pbftEndpoints {
+		if pep.pbft.lastExec != 8 || pep.pbft.h != 8 {
+			t.Errorf("Expected replica %d to execute and stabilize checkpoint seqNo=8, lastExec=%d, h=%d", pep.id, pep.pbft.lastExec, pep.pbft.h)
+		}
+	}
+	if broadcast := 4 * validatorCount * (validatorCount - 1); checkpointMsgs >= broadcast {
+		t.Errorf("Expected fewer than the %d checkpoint messages of broadcasting, got %d", broadcast, checkpointMsgs)
+	}
+}
+
+func TestPrimaryBeacon(t *testing.T) {
+	validatorCount := 7
+	config := loadConfig()
+	config.Set("general.N", validatorCount)
+	config.Set("general.f", 2)
+	config.Set("general.K", 2)
+	config.Set("general.logmultiplier", 2)
+	config.Set("general.primarybeacon", true)
+	net := makePBFTNetwork(validatorCount, config)
+	defer net.stop()
+
+	net.pbftEndpoints[0].manager.Queue() <- createPbftReqBatch(1, uint64(generateBroadcaster(validatorCount)))
+	net.process()
+	for _, pep := range net.pbftEndpoints {
+		pep.pbft.sendViewChange(ViewChange_MANUAL)
+	}
+	net.process()
+
+	first := net.pbftEndpoints[0].pbft
+	if first.view != 1 || !first.activeView {
+		t.Fatalf("Expected replica 0 active in view 1, got view %d (active %v)", first.view, first.activeView)
+	}
+	if first.primary(1) != 1 {
+		t.Errorf("Expected the primary of view 1 to stay round robin, got %d", first.primary(1))
+	}
+	roundRobin := true
+	for v := uint64(2); v < uint64(2+2*validatorCount); v++ {
+		for _, pep := range net.pbftEndpoints[1:] {
+			if pep.pbft.primary(v) != first.primary(v) {
+				t.Errorf("Replica %d derived primary %d for view %d, replica 0 derived %d", pep.id, pep.pbft.primary(v), v, first.primary(v))
+			}
+		}
+		if first.primary(v) != v%uint64(validatorCount) {
+			roundRobin = false
+		}
+	}
+	if roundRobin {
+		t.Errorf("Expected the beacon to draw primaries other than round robin")
+	}
+	if first.primary(2) == first.primary(1) {
+		t.Errorf("Expected view 2 to get a new primary, replica %d leads views 1 and 2", first.primary(1))
+	}
+
+	// the same new view draws the same primaries, also across a restart
+	persist := &mockPersist{}
+	stack := &omniProto{
+		StoreStateImpl:   persist.StoreState,
+		DelStateImpl:     persist.DelState,
+		ReadStateImpl:    persist.ReadState,
+		ReadStateSetImpl: persist.ReadStateSet,
+	}
+	p := newPbftCore(0, config, stack, &inertTimerFactory{})
+	p.installBeacon(first.newViewStore[1])
+	p.close()
+	p = newPbftCore(0, config, stack, &inertTimerFactory{})
+	defer p.close()
+	for v := uint64(1); v < uint64(2+2*validatorCount); v++ {
+		if p.primary(v) != first.primary(v) {
+			t.Errorf("Expected the beacon to reproduce primary %d for view %d, got %d", first.primary(v), v, p.primary(v))
+		}
+	}
+}
+
+func TestPrimaryBeaconLaggingReplica(t *testing.T) {
+	validatorCount := 4
+	config := loadConfig()
+	config.Set("general.N", validatorCount)
+	config.Set("general.f", 1)
+	config.Set("general.K", 2)
+	config.Set("general.logmultiplier", 2)
+	config.Set("general.primarybeacon", true)
+	net := makePBFTNetwork(validatorCount, config)
+	defer net.stop()
+
+	broadcaster := uint64(generateBroadcaster(validatorCount))
+	for i := int64(1); i <= 2; i++ {
+		net.pbftEndpoints[0].manager.Queue() <- createPbftReqBatch(i, broadcaster)
+		net.process()
+	}
+
+	// replica 3 misses the new view which draws the beacon
+	net.filterFn = func(src, dst int, msg []byte) []byte {
+		if src == 3 || dst == 3 {
+			return nil
+		}
+		return msg
+	}
+	for _, pep := range net.pbftEndpoints[:3] {
+		pep.pbft.sendViewChange(ViewChange_MANUAL)
+	}
+	net.process()
+	first := net.pbftEndpoints[0].pbft
+	lagging := net.pbftEndpoints[3].pbft
+	if first.view != 1 || !first.activeView || lagging.view != 0 {
+		t.Fatalf("Expected replica 0 active in view 1 and replica 3 left in view 0, got views %d and %d", first.view, lagging.view)
+	}
+	if lagging.latestBeacon() != nil {
+		t.Fatalf("Expected replica 3 to have no beacon")
+	}
+
+	net.filterFn = nil
+	for _, pep := range net.pbftEndpoints[:3] {
+		pep.pbft.sendViewChange(ViewChange_MANUAL)
+	}
+	net.process()
+
+	for _, pep := range net.pbftEndpoints {
+		if pep.pbft.view != 2 || !pep.pbft.activeView {
+			t.Errorf("Expected replica %d active in view 2, got view %d (active %v)", pep.id, pep.pbft.view, pep.pbft.activeView)
+		}
+	}
+	for v := uint64(2); v < uint64(2+2*validatorCount); v++ {
+		if lagging.primary(v) != first.primary(v) {
+			t.Errorf("Replica 3 derived primary %d for view %d, replica 0 derived %d", lagging.primary(v), v, first.primary(v))
+		}
+	}
+}
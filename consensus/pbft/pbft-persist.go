@@ -19,6 +19,7 @@ package pbft
 import (
 	"encoding/base64"
 	"fmt"
+	"strconv"
 
 	"github.com/golang/protobuf/proto"
 )
@@ -61,7 +62,7 @@ func (instance *pbftCore) restorePQSet(key string) []*ViewChange_PQ {
 	val := &PQset{}
 	err = proto.Unmarshal(raw, val)
 	if err != nil {
-		logger.Errorf("Replica %d could not unmarshal %s - local state is damaged: %s", instance.id, key, err)
+		instance.damagedState(key, err)
 		return nil
 	}
 	return val.GetSet()
@@ -100,6 +101,39 @@ func (instance *pbftCore) persistDelCheckpoint(seqNo uint64) {
 	instance.consumer.DelState(key)
 }
 
+func (instance *pbftCore) persistHighActiveView() {
+	instance.consumer.StoreState("highActiveView", []byte(strconv.FormatUint(instance.highActiveView, 10)))
+}
+
+func (instance *pbftCore) persistViewNumber() {
+	if instance.persistView {
+		instance.consumer.StoreState("view", []byte(strconv.FormatUint(instance.view, 10)))
+	}
+}
+
+// restoreView resumes in the view we last moved to.  Unless we had become
+// active in it, we were changing views, and time out of the view change if
+// its new-view never reaches us.
+func (instance *pbftCore) restoreView() {
+	raw, err := instance.consumer.ReadState("view")
+	if err != nil {
+		return
+	}
+	view, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil {
+		instance.damagedState("view", err)
+		return
+	}
+	if view > instance.view {
+		instance.view = view
+	}
+	if instance.view > instance.highActiveView {
+		logger.Infof("Replica %d resuming its view change to view %d", instance.id, instance.view)
+		instance.activeView = false
+		instance.startTimer(instance.lastNewViewTimeout, "resumed view change")
+	}
+}
+
 func (instance *pbftCore) restoreState() {
 	updateSeqView := func(set []*ViewChange_PQ) {
 		for _, e := range set {
@@ -130,9 +164,11 @@ func (instance *pbftCore) restoreState() {
 			reqBatch := &RequestBatch{}
 			err = proto.Unmarshal(v, reqBatch)
 			if err != nil {
-				logger.Warningf("Replica %d could not restore request batch %s", instance.id, k)
+				instance.damagedState(k, err)
+			} else if digest := instance.batchDigest(reqBatch); "reqBatch."+digest != k {
+				instance.damagedState(k, fmt.Errorf("request batch has digest %s", digest))
 			} else {
-				instance.reqBatchStore[hash(reqBatch)] = reqBatch
+				instance.reqBatchStore[digest] = reqBatch
 			}
 		}
 	} else {
@@ -145,7 +181,7 @@ func (instance *pbftCore) restoreState() {
 		for key, id := range chkpts {
 			var seqNo uint64
 			if _, err = fmt.Sscanf(key, "chkpt.%d", &seqNo); err != nil {
-				logger.Warningf("Replica %d could not restore checkpoint key %s", instance.id, key)
+				instance.damagedState(key, err)
 			} else {
 				idAsString := base64.StdEncoding.EncodeToString(id)
 				logger.Debugf("Replica %d found checkpoint %s for seqNo %d", instance.id, idAsString, seqNo)
@@ -160,10 +196,73 @@ func (instance *pbftCore) restoreState() {
 		logger.Warningf("Replica %d could not restore checkpoints: %s", instance.id, err)
 	}
 
+	if raw, err := instance.consumer.ReadState("highActiveView"); err == nil {
+		if instance.highActiveView, err = strconv.ParseUint(string(raw), 10, 64); err != nil {
+			instance.damagedState("highActiveView", err)
+		}
+	}
+
+	if instance.persistView {
+		instance.restoreView()
+	}
+
+	if instance.primaryBeacon {
+		instance.restoreBeacons()
+	}
+
+	if len(instance.damagedKeys) > 0 {
+		instance.recoverDamagedState()
+		if instance.startErr != nil {
+			return
+		}
+	}
+
 	instance.restoreLastSeqNo()
+	instance.raiseCatchUpBarrier()
 
-	logger.Infof("Replica %d restored state: view: %d, seqNo: %d, pset: %d, qset: %d, reqBatches: %d, chkpts: %d",
-		instance.id, instance.view, instance.seqNo, len(instance.pset), len(instance.qset), len(instance.reqBatchStore), len(instance.chkpts))
+	logger.Infof("Replica %d restored state: view: %d, highest active view: %d, seqNo: %d, pset: %d, qset: %d, reqBatches: %d, chkpts: %d",
+		instance.id, instance.view, instance.highActiveView, instance.seqNo, len(instance.pset), len(instance.qset), len(instance.reqBatchStore), len(instance.chkpts))
+}
+
+// damagedState notes that the persisted state under key failed to restore
+func (instance *pbftCore) damagedState(key string, err error) {
+	logger.Errorf("Replica %d could not restore %s - local state is damaged: %s", instance.id, key, err)
+	instance.damagedKeys = append(instance.damagedKeys, key)
+}
+
+// recoverDamagedState applies the configured policy to persisted state found
+// damaged on restart: skip restores what it can, refuse stops the replica
+// from starting, and discard drops the persisted state altogether, so the
+// replica catches up with the network through state transfer
+func (instance *pbftCore) recoverDamagedState() {
+	switch instance.damagedStatePolicy {
+	case "refuse":
+		instance.startErr = fmt.Errorf("Replica %d found its persisted consensus state damaged in %v, refusing to start; repair or remove the state, or set general.damagedstate to discard", instance.id, instance.damagedKeys)
+		logger.Error(instance.startErr)
+	case "discard":
+		logger.Warningf("Replica %d discarding its persisted consensus state, damaged in %v, and awaiting state transfer", instance.id, instance.damagedKeys)
+		for _, key := range []string{"pset", "qset", "highActiveView", "view", "beacon"} {
+			instance.consumer.DelState(key)
+		}
+		instance.persistDelAllRequestBatches()
+		if chkpts, err := instance.consumer.ReadStateSet("chkpt."); err == nil {
+			for key := range chkpts {
+				instance.consumer.DelState(key)
+			}
+		}
+		instance.pset = make(map[uint64]*ViewChange_PQ)
+		instance.qset = make(map[qidx]*ViewChange_PQ)
+		instance.reqBatchStore = make(map[string]*RequestBatch)
+		instance.chkpts = make(map[uint64]string)
+		instance.beacons = nil
+		instance.view, instance.highActiveView, instance.seqNo, instance.h = 0, 0, 0, 0
+		instance.activeView = true
+		instance.stopTimer()
+		instance.skipInProgress = true
+		instance.consumer.invalidateState()
+	default:
+		logger.Warningf("Replica %d skipped its persisted consensus state damaged in %v", instance.id, instance.damagedKeys)
+	}
 }
 
 func (instance *pbftCore) restoreLastSeqNo() {
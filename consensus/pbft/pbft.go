@@ -40,22 +40,33 @@ func init() {
 }
 
 // GetPlugin returns the handle to the Consenter singleton
-func GetPlugin(c consensus.Stack) consensus.Consenter {
+func GetPlugin(c consensus.Stack) (consensus.Consenter, error) {
 	if pluginInstance == nil {
-		pluginInstance = New(c)
+		consenter, err := New(c)
+		if err != nil {
+			return nil, err
+		}
+		pluginInstance = consenter
 	}
-	return pluginInstance
+	return pluginInstance, nil
 }
 
 // New creates a new Obc* instance that provides the Consenter interface.
-// Internally, it uses an opaque pbft-core instance.
-func New(stack consensus.Stack) consensus.Consenter {
+// Internally, it uses an opaque pbft-core instance.  It returns an error if
+// the replica refuses to start, such as on damaged persisted state.
+func New(stack consensus.Stack) (consensus.Consenter, error) {
 	handle, _, _ := stack.GetNetworkHandles()
 	id, _ := getValidatorID(handle)
+	// the peer enables the system chaincodes that requests are tagged for priority by
+	config.SetDefault("chaincode.system", viper.GetStringMapString("chaincode.system"))
 
 	switch strings.ToLower(config.GetString("general.mode")) {
 	case "batch":
-		return newObcBatch(id, config, stack)
+		op := newObcBatch(id, config, stack)
+		if op.pbft.startErr != nil {
+			return nil, op.pbft.startErr
+		}
+		return op, nil
 	default:
 		panic(fmt.Errorf("Invalid PBFT mode: %s", config.GetString("general.mode")))
 	}
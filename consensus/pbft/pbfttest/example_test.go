@@ -0,0 +1,81 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbfttest_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/hyperledger/fabric/consensus"
+	"github.com/hyperledger/fabric/consensus/pbft"
+	"github.com/hyperledger/fabric/consensus/pbft/pbfttest"
+	pb "github.com/hyperledger/fabric/protos"
+)
+
+var _ consensus.Stack = &pbfttest.Stack{}
+
+// TestPBFTNetwork runs the PBFT plugin on four test stacks, one of which
+// fails every transaction, and checks every ledger records the transaction
+func TestPBFTNetwork(t *testing.T) {
+	os.Setenv("CORE_PBFT_GENERAL_BATCHSIZE", "1")
+	defer os.Unsetenv("CORE_PBFT_GENERAL_BATCHSIZE")
+
+	net := pbfttest.NewNetwork(4)
+	defer net.Stop()
+	net.Stack(3).ExecDelay = 50 * time.Millisecond
+	net.Stack(3).ExecError = func(tx *pb.Transaction) error {
+		return fmt.Errorf("chaincode failed")
+	}
+
+	var consenters []consensus.Consenter
+	for _, s := range net.Stacks() {
+		c, err := pbft.New(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Attach(c)
+		consenters = append(consenters, c)
+	}
+	defer func() {
+		for _, c := range consenters {
+			c.(interface {
+				Close()
+			}).Close()
+		}
+	}()
+
+	tx := &pb.Transaction{Type: pb.Transaction_CHAINCODE_INVOKE, Uuid: "example"}
+	raw, _ := proto.Marshal(tx)
+	consenters[0].RecvMsg(&pb.Message{Type: pb.Message_CHAIN_TRANSACTION, Payload: raw}, &pb.PeerID{Name: "vp0"})
+
+	if err := net.WaitForHeight(1, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range net.Stacks() {
+		block := s.Ledger()[0]
+		if len(block.Transactions) != 1 || block.Transactions[0].Uuid != "example" {
+			t.Errorf("Replica %d committed %v, expected the example transaction", i, block.Transactions)
+		}
+		if failed := block.Errors[0] != nil; failed != (i == 3) {
+			t.Errorf("Replica %d recorded execution error %v", i, block.Errors[0])
+		}
+	}
+}
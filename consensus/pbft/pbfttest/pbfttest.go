@@ -0,0 +1,485 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pbfttest provides an in-memory network of consensus stacks, so that
+// code embedding the PBFT plugin can test its integration from other packages.
+package pbfttest
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/hyperledger/fabric/consensus"
+	"github.com/hyperledger/fabric/core/util"
+	pb "github.com/hyperledger/fabric/protos"
+)
+
+// Block is a batch of transactions committed to the ledger of a Stack
+type Block struct {
+	Transactions []*pb.Transaction
+	Errors       []error // the forced execution error of each transaction, nil if it succeeded
+	Metadata     []byte  // consensus metadata committed with the block
+	Hash         []byte
+}
+
+// Network connects a set of Stacks, delivering the messages between any two
+// of them in the order they were sent
+type Network struct {
+	stacks []*Stack
+}
+
+// NewNetwork creates a network of n stacks, with handles vp0 to vp(n-1)
+func NewNetwork(n int) *Network {
+	net := &Network{}
+	for i := 0; i < n; i++ {
+		s := &Stack{
+			id:    uint64(i),
+			net:   net,
+			state: make(map[string][]byte),
+			valid: true,
+		}
+		s.inboxCond = sync.NewCond(&s.inboxLock)
+		net.stacks = append(net.stacks, s)
+	}
+	return net
+}
+
+// Stack returns the stack with the given replica id
+func (net *Network) Stack(id uint64) *Stack {
+	return net.stacks[id]
+}
+
+// Stacks returns every stack of the network
+func (net *Network) Stacks() []*Stack {
+	return net.stacks
+}
+
+// Stop stops delivering messages
+func (net *Network) Stop() {
+	for _, s := range net.stacks {
+		s.inboxLock.Lock()
+		s.closed = true
+		s.inboxLock.Unlock()
+		s.inboxCond.Broadcast()
+	}
+}
+
+// WaitForHeight waits until every stack's ledger holds at least height blocks
+func (net *Network) WaitForHeight(height uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		done := true
+		for _, s := range net.stacks {
+			if s.GetBlockchainSize() < height {
+				done = false
+			}
+		}
+		if done {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for height %d", height)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type delivery struct {
+	msg    *pb.Message
+	sender *pb.PeerID
+}
+
+// Stack implements consensus.Stack for one replica of a Network.  The knobs
+// must be set before the consenter is attached.
+type Stack struct {
+	// ExecDelay is how long each execution takes before it is reported back
+	ExecDelay time.Duration
+
+	// ExecError is consulted for every executed transaction, an error it
+	// returns is recorded against the transaction, as for a failing chaincode
+	ExecError func(tx *pb.Transaction) error
+
+	id        uint64
+	net       *Network
+	consenter consensus.Consenter
+
+	inboxLock sync.Mutex
+	inboxCond *sync.Cond
+	inbox     []delivery
+	closed    bool
+
+	lock    sync.Mutex
+	ledger  []*Block
+	pending *Block
+	state   map[string][]byte
+	valid   bool
+}
+
+func replicaHandle(id uint64) *pb.PeerID {
+	return &pb.PeerID{Name: "vp" + strconv.FormatUint(id, 10)}
+}
+
+func replicaID(handle *pb.PeerID) (uint64, error) {
+	if len(handle.Name) < 3 || handle.Name[0:2] != "vp" {
+		return 0, fmt.Errorf("invalid handle %s", handle.Name)
+	}
+	return strconv.ParseUint(handle.Name[2:], 10, 64)
+}
+
+// Attach starts delivering messages and execution callbacks to the consenter
+func (s *Stack) Attach(c consensus.Consenter) {
+	s.consenter = c
+	go s.deliverLoop()
+}
+
+func (s *Stack) deliverLoop() {
+	for {
+		s.inboxLock.Lock()
+		for len(s.inbox) == 0 && !s.closed {
+			s.inboxCond.Wait()
+		}
+		if s.closed {
+			s.inboxLock.Unlock()
+			return
+		}
+		d := s.inbox[0]
+		s.inbox = s.inbox[1:]
+		s.inboxLock.Unlock()
+		s.consenter.RecvMsg(d.msg, d.sender)
+	}
+}
+
+func (s *Stack) enqueue(msg *pb.Message, sender *pb.PeerID) {
+	s.inboxLock.Lock()
+	s.inbox = append(s.inbox, delivery{msg, sender})
+	s.inboxLock.Unlock()
+	s.inboxCond.Signal()
+}
+
+// Ledger returns a copy of the blocks committed so far
+func (s *Stack) Ledger() []*Block {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*Block(nil), s.ledger...)
+}
+
+// Valid reports whether the consenter considers the ledger up to date
+func (s *Stack) Valid() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.valid
+}
+
+// NetworkStack
+
+// Broadcast sends a message to every other stack of the network
+func (s *Stack) Broadcast(msg *pb.Message, peerType pb.PeerEndpoint_Type) error {
+	for _, r := range s.net.stacks {
+		if r.id != s.id {
+			r.enqueue(msg, replicaHandle(s.id))
+		}
+	}
+	return nil
+}
+
+// Unicast sends a message to a single stack
+func (s *Stack) Unicast(msg *pb.Message, receiverHandle *pb.PeerID) error {
+	rid, err := replicaID(receiverHandle)
+	if err != nil {
+		return err
+	}
+	if rid >= uint64(len(s.net.stacks)) {
+		return fmt.Errorf("no replica %d", rid)
+	}
+	s.net.stacks[rid].enqueue(msg, replicaHandle(s.id))
+	return nil
+}
+
+// GetNetworkInfo returns endpoints for this and every other stack
+func (s *Stack) GetNetworkInfo() (self *pb.PeerEndpoint, network []*pb.PeerEndpoint, err error) {
+	for _, r := range s.net.stacks {
+		ep := &pb.PeerEndpoint{ID: replicaHandle(r.id), Type: pb.PeerEndpoint_VALIDATOR}
+		network = append(network, ep)
+		if r.id == s.id {
+			self = ep
+		}
+	}
+	return
+}
+
+// GetNetworkHandles returns handles for this and every other stack
+func (s *Stack) GetNetworkHandles() (self *pb.PeerID, network []*pb.PeerID, err error) {
+	for _, r := range s.net.stacks {
+		network = append(network, replicaHandle(r.id))
+	}
+	return replicaHandle(s.id), network, nil
+}
+
+// SecurityUtils
+
+// Sign returns the message itself as its signature
+func (s *Stack) Sign(msg []byte) ([]byte, error) {
+	return msg, nil
+}
+
+// Verify accepts a signature equal to the message
+func (s *Stack) Verify(peerID *pb.PeerID, signature []byte, message []byte) error {
+	if !bytes.Equal(signature, message) {
+		return fmt.Errorf("bad signature from %s", peerID.Name)
+	}
+	return nil
+}
+
+// Executor
+
+// Start is a no-op
+func (s *Stack) Start() {}
+
+// Halt is a no-op
+func (s *Stack) Halt() {}
+
+// Execute runs the transactions into the pending block, after ExecDelay
+func (s *Stack) Execute(tag interface{}, txs []*pb.Transaction) {
+	go func() {
+		time.Sleep(s.ExecDelay)
+		s.lock.Lock()
+		if s.pending == nil {
+			s.pending = &Block{}
+		}
+		for _, tx := range txs {
+			var err error
+			if s.ExecError != nil {
+				err = s.ExecError(tx)
+			}
+			s.pending.Transactions = append(s.pending.Transactions, tx)
+			s.pending.Errors = append(s.pending.Errors, err)
+		}
+		s.lock.Unlock()
+		s.consenter.Executed(tag)
+	}()
+}
+
+// Commit appends the pending block to the ledger
+func (s *Stack) Commit(tag interface{}, metadata []byte) {
+	go func() {
+		s.lock.Lock()
+		block := s.pending
+		if block == nil {
+			block = &Block{}
+		}
+		s.pending = nil
+		block.Metadata = metadata
+		block.Hash = s.blockHash(block)
+		s.ledger = append(s.ledger, block)
+		info := s.info()
+		s.lock.Unlock()
+		s.consenter.Committed(tag, info)
+	}()
+}
+
+// Rollback discards the pending block
+func (s *Stack) Rollback(tag interface{}) {
+	go func() {
+		s.lock.Lock()
+		s.pending = nil
+		s.lock.Unlock()
+		s.consenter.RolledBack(tag)
+	}()
+}
+
+// UpdateState copies the ledger of a peer which holds the target block
+func (s *Stack) UpdateState(tag interface{}, target *pb.BlockchainInfo, peers []*pb.PeerID) {
+	go func() {
+		for _, peer := range peers {
+			pid, err := replicaID(peer)
+			if err != nil || pid == s.id || pid >= uint64(len(s.net.stacks)) {
+				continue
+			}
+			ledger := s.net.stacks[pid].Ledger()
+			if uint64(len(ledger)) < target.Height || target.Height == 0 ||
+				!bytes.Equal(ledger[target.Height-1].Hash, target.CurrentBlockHash) {
+				continue
+			}
+			s.lock.Lock()
+			s.ledger = ledger[:target.Height]
+			s.pending = nil
+			info := s.info()
+			s.lock.Unlock()
+			s.consenter.StateUpdated(tag, info)
+			return
+		}
+		s.consenter.StateUpdated(tag, nil)
+	}()
+}
+
+// blockHash chains the block to its predecessor, must be called with the lock held
+func (s *Stack) blockHash(block *Block) []byte {
+	var raw []byte
+	if len(s.ledger) > 0 {
+		raw = append(raw, s.ledger[len(s.ledger)-1].Hash...)
+	}
+	for _, tx := range block.Transactions {
+		b, _ := proto.Marshal(tx)
+		raw = append(raw, b...)
+	}
+	raw = append(raw, block.Metadata...)
+	return util.ComputeCryptoHash(raw)
+}
+
+// info describes the ledger, must be called with the lock held
+func (s *Stack) info() *pb.BlockchainInfo {
+	info := &pb.BlockchainInfo{Height: uint64(len(s.ledger))}
+	if n := len(s.ledger); n > 0 {
+		info.CurrentBlockHash = s.ledger[n-1].Hash
+		if n > 1 {
+			info.PreviousBlockHash = s.ledger[n-2].Hash
+		}
+	}
+	return info
+}
+
+// LegacyExecutor, which the PBFT plugin does not use
+
+// BeginTxBatch is a no-op
+func (s *Stack) BeginTxBatch(id interface{}) error { return nil }
+
+// ExecTxs is not supported
+func (s *Stack) ExecTxs(id interface{}, txs []*pb.Transaction) ([]byte, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+// CommitTxBatch is not supported
+func (s *Stack) CommitTxBatch(id interface{}, metadata []byte) (*pb.Block, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+// RollbackTxBatch is a no-op
+func (s *Stack) RollbackTxBatch(id interface{}) error { return nil }
+
+// PreviewCommitTxBatch is not supported
+func (s *Stack) PreviewCommitTxBatch(id interface{}, metadata []byte) ([]byte, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+// LedgerManager
+
+// InvalidateState marks the ledger out of date
+func (s *Stack) InvalidateState() {
+	s.lock.Lock()
+	s.valid = false
+	s.lock.Unlock()
+}
+
+// ValidateState marks the ledger up to date
+func (s *Stack) ValidateState() {
+	s.lock.Lock()
+	s.valid = true
+	s.lock.Unlock()
+}
+
+// ReadOnlyLedger
+
+// GetBlock returns a committed block
+func (s *Stack) GetBlock(id uint64) (*pb.Block, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if id >= uint64(len(s.ledger)) {
+		return nil, fmt.Errorf("no block %d", id)
+	}
+	block := &pb.Block{
+		Transactions:      s.ledger[id].Transactions,
+		ConsensusMetadata: s.ledger[id].Metadata,
+	}
+	if id > 0 {
+		block.PreviousBlockHash = s.ledger[id-1].Hash
+	}
+	return block, nil
+}
+
+// GetBlockchainSize returns the number of committed blocks
+func (s *Stack) GetBlockchainSize() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return uint64(len(s.ledger))
+}
+
+// GetBlockchainInfo describes the committed blocks
+func (s *Stack) GetBlockchainInfo() *pb.BlockchainInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.info()
+}
+
+// GetBlockchainInfoBlob returns the marshaled GetBlockchainInfo
+func (s *Stack) GetBlockchainInfoBlob() []byte {
+	raw, _ := proto.Marshal(s.GetBlockchainInfo())
+	return raw
+}
+
+// GetBlockHeadMetadata returns the consensus metadata of the last block
+func (s *Stack) GetBlockHeadMetadata() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.ledger) == 0 {
+		return nil, fmt.Errorf("no blocks committed")
+	}
+	return s.ledger[len(s.ledger)-1].Metadata, nil
+}
+
+// StatePersistor
+
+// StoreState stores a value in memory
+func (s *Stack) StoreState(key string, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state[key] = value
+	return nil
+}
+
+// ReadState returns a stored value
+func (s *Stack) ReadState(key string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if val, ok := s.state[key]; ok {
+		return val, nil
+	}
+	return nil, fmt.Errorf("no key %s", key)
+}
+
+// ReadStateSet returns every stored value whose key has the prefix
+func (s *Stack) ReadStateSet(prefix string) (map[string][]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := make(map[string][]byte)
+	for k, v := range s.state {
+		if len(k) >= len(prefix) && k[0:len(prefix)] == prefix {
+			ret[k] = v
+		}
+	}
+	return ret, nil
+}
+
+// DelState removes a stored value
+func (s *Stack) DelState(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.state, key)
+}
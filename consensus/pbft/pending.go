@@ -0,0 +1,119 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import "fmt"
+
+// requestQueue is implemented by the consumers which hold client requests
+// before handing them to consensus
+type requestQueue interface {
+	queued() []*Request     // the requests held, in the order they would be batched
+	forget(reqs []*Request) // drops held requests, they are no longer waited on
+	broadcastRequest(req *Request)
+	unicastRequest(req *Request, receiverID uint64)
+}
+
+// DrainRequests hands the client requests our consumer holds, but which are
+// not yet handed to consensus, to the primary (or to everyone, if we are the
+// primary or in a view change) and forgets them locally, so they survive this
+// replica being taken down for maintenance.  It must run on the event thread.
+func (instance *pbftCore) DrainRequests() {
+	queue, ok := instance.consumer.(requestQueue)
+	if !ok {
+		return
+	}
+	reqs := queue.queued()
+	primary := instance.primary(instance.view)
+	for _, req := range reqs {
+		if primary == instance.id || !instance.activeView {
+			logger.Infof("Replica %d draining request %s to all replicas", instance.id, hash(req))
+			queue.broadcastRequest(req)
+		} else {
+			logger.Infof("Replica %d draining request %s to primary %d", instance.id, hash(req), primary)
+			queue.unicastRequest(req, primary)
+		}
+	}
+	queue.forget(reqs)
+}
+
+// PendingRequest describes a client request we hold which is not yet ordered
+type PendingRequest struct {
+	Digest    string `json:"digest"`
+	ReplicaId uint64 `json:"replica"` // through which the client submitted it
+	Bytes     int    `json:"bytes"`
+}
+
+// PendingRequests lists the client requests our consumer holds which are not
+// yet handed to consensus, by digest, for display by debugging tools.  It must
+// run on the event thread.
+func (instance *pbftCore) PendingRequests() []PendingRequest {
+	queue, ok := instance.consumer.(requestQueue)
+	if !ok {
+		return nil
+	}
+	var pending []PendingRequest
+	for _, req := range queue.queued() {
+		pending = append(pending, PendingRequest{
+			Digest:    hash(req),
+			ReplicaId: req.ReplicaId,
+			Bytes:     len(req.Payload),
+		})
+	}
+	return pending
+}
+
+// CancelRequest drops a client request our consumer holds which is not yet
+// handed to consensus, so that it is neither batched nor waited on.
+// Cancellation is local, should the request reach us again it is handled
+// anew.  It must run on the event thread.
+func (instance *pbftCore) CancelRequest(digest string) error {
+	if queue, ok := instance.consumer.(requestQueue); ok {
+		for _, req := range queue.queued() {
+			if hash(req) == digest {
+				logger.Warningf("Replica %d cancelling pending request %s", instance.id, digest)
+				queue.forget([]*Request{req})
+				return nil
+			}
+		}
+	}
+	for _, reqBatch := range instance.reqBatchStore {
+		for _, req := range reqBatch.GetBatch() {
+			if hash(req) == digest {
+				return fmt.Errorf("request %s is already ordered", digest)
+			}
+		}
+	}
+	return fmt.Errorf("request %s is not pending", digest)
+}
+
+// PendingRequests runs pbftCore.PendingRequests on the event thread
+func (op *obcBatch) PendingRequests() []PendingRequest {
+	result := make(chan []PendingRequest)
+	op.manager.Queue() <- workEvent(func() {
+		result <- op.pbft.PendingRequests()
+	})
+	return <-result
+}
+
+// CancelRequest runs pbftCore.CancelRequest on the event thread
+func (op *obcBatch) CancelRequest(digest string) error {
+	result := make(chan error)
+	op.manager.Queue() <- workEvent(func() {
+		result <- op.pbft.CancelRequest(digest)
+	})
+	return <-result
+}
@@ -0,0 +1,70 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+	"sort"
+)
+
+// primaryOrder arranges the replicas, whose failure domains are given ordered
+// by replica id, so consecutive views avoid primaries in the same domain.
+// Every replica derives the same order from the same domains
+func primaryOrder(domains []string) []uint64 {
+	members := make(map[string][]uint64)
+	var names []string
+	for id, domain := range domains {
+		if _, ok := members[domain]; !ok {
+			names = append(names, domain)
+		}
+		members[domain] = append(members[domain], uint64(id))
+	}
+	sort.Strings(names)
+
+	order := make([]uint64, 0, len(domains))
+	last := -1
+	for len(order) < len(domains) {
+		// prefer the domain with most replicas left, unless it provided the previous primary
+		pick := -1
+		for i, name := range names {
+			if len(members[name]) == 0 || i == last {
+				continue
+			}
+			if pick < 0 || len(members[name]) > len(members[names[pick]]) {
+				pick = i
+			}
+		}
+		if pick < 0 {
+			pick = last // only the previous domain has replicas left
+		}
+		order = append(order, members[names[pick]][0])
+		members[names[pick]] = members[names[pick]][1:]
+		last = pick
+	}
+	return order
+}
+
+// newPrimaryOrder returns the primary order for the configured failure domains, nil for plain round robin
+func newPrimaryOrder(domains []string, N int) []uint64 {
+	if len(domains) == 0 {
+		return nil
+	}
+	if len(domains) != N {
+		panic(fmt.Errorf("Configured %d failure domains for %d replicas", len(domains), N))
+	}
+	return primaryOrder(domains)
+}
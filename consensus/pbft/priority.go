@@ -0,0 +1,127 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+	"strconv"
+
+	pb "github.com/hyperledger/fabric/protos"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+)
+
+// systemTag is the tag of requests invoking a system chaincode
+const systemTag = "system"
+
+// requestPriority assigns outstanding requests to priority queues by their
+// tag, and schedules between the queues
+type requestPriority struct {
+	levels  map[string]int // queue of each tag, highest priority first; other requests join the last queue
+	queues  int
+	weights []int                       // requests served from each queue per round, nil serves the queues in strict priority
+	tag     func(payload []byte) string // derives the tag of a request from its payload
+}
+
+// newRequestPriority reads the priority queues from general.priority, it
+// returns nil when no tags are configured
+func newRequestPriority(config *viper.Viper) *requestPriority {
+	tags := config.GetStringSlice("general.priority.tags")
+	if len(tags) == 0 {
+		return nil
+	}
+	p := &requestPriority{
+		levels: make(map[string]int),
+		queues: len(tags) + 1,
+	}
+	for l, tag := range tags {
+		p.levels[tag] = l
+	}
+
+	switch scheduling := config.GetString("general.priority.scheduling"); scheduling {
+	case "", "strict":
+	case "weighted":
+		weights := config.GetStringSlice("general.priority.weights")
+		if len(weights) != p.queues {
+			panic(fmt.Errorf("Weighted request scheduling needs %d weights, one per tag and one for the default queue, got %d", p.queues, len(weights)))
+		}
+		for _, w := range weights {
+			weight, err := strconv.Atoi(w)
+			if err != nil || weight < 1 {
+				panic(fmt.Errorf("Request queue weight must be a positive integer, got %q", w))
+			}
+			p.weights = append(p.weights, weight)
+		}
+	default:
+		panic(fmt.Errorf("Unknown request scheduling: %s", scheduling))
+	}
+	return p
+}
+
+// level returns the queue of a request.  The tag is derived from the
+// payload rather than taken from the request, which the replica forwarding
+// it could have tagged as it liked
+func (p *requestPriority) level(req *Request) int {
+	if l, ok := p.levels[p.tag(req.Payload)]; ok {
+		return l
+	}
+	return p.queues - 1
+}
+
+// enabledSystemChaincodes returns the system chaincodes the peer enables
+// through chaincode.system, which New carries over from the peer's
+// configuration
+func enabledSystemChaincodes(config *viper.Viper) map[string]bool {
+	enabled := make(map[string]bool)
+	for name, val := range config.GetStringMapString("chaincode.system") {
+		if val == "enable" || val == "true" || val == "yes" {
+			enabled[name] = true
+		}
+	}
+	return enabled
+}
+
+// requestTag tags a client transaction invoking a system chaincode
+func (op *obcBatch) requestTag(payload []byte) string {
+	if len(op.systemChaincodes) == 0 {
+		return ""
+	}
+	tx, err := op.codec.Decode(payload)
+	if err != nil {
+		return ""
+	}
+	cID := &pb.ChaincodeID{}
+	if err := proto.Unmarshal(tx.ChaincodeID, cID); err != nil {
+		return ""
+	}
+	if op.systemChaincodes[cID.Name] {
+		return systemTag
+	}
+	return ""
+}
+
+// newRequestStore creates a request store serving the configured priority
+// queues, and identifying requests as configured
+func (op *obcBatch) newRequestStore() *requestStore {
+	rs := newRequestStore()
+	rs.priority = op.priority
+	if op.dedupCopies {
+		rs.keyBy(clientDigest)
+	}
+	return rs
+}
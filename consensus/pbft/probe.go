@@ -0,0 +1,151 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// ProbeReport is the outcome of a consistency probe
+type ProbeReport struct {
+	SequenceNumber uint64            // stable checkpoint at which the state hashes are compared
+	Checkpoints    map[uint64]string // state hash reported by each replica, ourselves included
+	Divergent      []uint64          // replicas whose state hash differs from that of most replicas
+	Unanswered     []uint64          // replicas which reported no state hash at SequenceNumber before the probe timed out
+}
+
+// Agreed reports whether every replica which answered holds the same state
+func (r *ProbeReport) Agreed() bool {
+	return len(r.Divergent) == 0
+}
+
+// consistencyProbe collects the replies to a probe we initiated
+type consistencyProbe struct {
+	nonce  uint64
+	report *ProbeReport
+	done   chan *ProbeReport
+}
+
+// probeTimerEvent is sent when a consistency probe times out
+type probeTimerEvent struct {
+	nonce uint64
+}
+
+// ConsistencyProbe asks every replica for its state hash at our stable
+// checkpoint, and delivers the report on the returned channel once all
+// replied, or the request timeout expired.  The probe is read-only, and
+// leaves consensus undisturbed.  Like ProcessEvent, it must be called on the
+// event thread.
+func (instance *pbftCore) ConsistencyProbe() <-chan *ProbeReport {
+	if instance.probe != nil {
+		instance.finishProbe()
+	}
+	instance.probeNonce++
+	instance.probe = &consistencyProbe{
+		nonce: instance.probeNonce,
+		report: &ProbeReport{
+			SequenceNumber: instance.h,
+			Checkpoints:    map[uint64]string{instance.id: instance.chkpts[instance.h]},
+		},
+		done: make(chan *ProbeReport, 1),
+	}
+	done := instance.probe.done
+
+	logger.Infof("Replica %d probing the consistency of the replicas at seqNo=%d", instance.id, instance.h)
+	instance.innerBroadcast(&Message{Payload: &Message_ConsistencyProbe{ConsistencyProbe: &ConsistencyProbe{
+		Nonce:          instance.probeNonce,
+		SequenceNumber: instance.h,
+		ReplicaId:      instance.id,
+	}}})
+	if instance.N <= 1 {
+		instance.finishProbe()
+	} else {
+		instance.probeTimer.Reset(instance.requestTimeout, probeTimerEvent{nonce: instance.probeNonce})
+	}
+	return done
+}
+
+// recvConsistencyProbe returns our state hash at the probed checkpoint
+func (instance *pbftCore) recvConsistencyProbe(cp *ConsistencyProbe) error {
+	pr := &ProbeReply{
+		Nonce:          cp.Nonce,
+		SequenceNumber: cp.SequenceNumber,
+		Id:             instance.chkpts[cp.SequenceNumber],
+		ReplicaId:      instance.id,
+	}
+	msgPacked, err := proto.Marshal(&Message{Payload: &Message_ProbeReply{ProbeReply: pr}})
+	if err != nil {
+		return fmt.Errorf("Error marshalling probe-reply message: %v", err)
+	}
+	logger.Debugf("Replica %d answering consistency probe of replica %d at seqNo=%d", instance.id, cp.ReplicaId, cp.SequenceNumber)
+	return instance.consumer.unicast(msgPacked, cp.ReplicaId)
+}
+
+// recvProbeReply records the state hash a replica reported for our probe
+func (instance *pbftCore) recvProbeReply(pr *ProbeReply) {
+	probe := instance.probe
+	if probe == nil || pr.Nonce != probe.nonce || pr.SequenceNumber != probe.report.SequenceNumber {
+		logger.Debugf("Replica %d ignoring stale probe-reply from replica %d", instance.id, pr.ReplicaId)
+		return
+	}
+	if pr.Id == "" {
+		logger.Debugf("Replica %d does not hold a checkpoint at seqNo=%d", pr.ReplicaId, pr.SequenceNumber)
+		return
+	}
+	probe.report.Checkpoints[pr.ReplicaId] = pr.Id
+	if len(probe.report.Checkpoints) == instance.N {
+		instance.finishProbe()
+	}
+}
+
+// finishProbe compares the collected state hashes against the one most
+// replicas reported, preferring ours on a tie, and delivers the report
+func (instance *pbftCore) finishProbe() {
+	probe := instance.probe
+	instance.probe = nil
+	instance.probeTimer.Stop()
+	report := probe.report
+
+	votes := make(map[string]int)
+	for _, id := range report.Checkpoints {
+		votes[id]++
+	}
+	reference := report.Checkpoints[instance.id]
+	for id, n := range votes {
+		if n > votes[reference] {
+			reference = id
+		}
+	}
+
+	for replica := uint64(0); replica < uint64(instance.N); replica++ {
+		id, ok := report.Checkpoints[replica]
+		if !ok {
+			report.Unanswered = append(report.Unanswered, replica)
+		} else if id != reference {
+			report.Divergent = append(report.Divergent, replica)
+		}
+	}
+
+	if report.Agreed() {
+		logger.Infof("Replica %d consistency probe at seqNo=%d found %d replicas agreeing, %d unanswered", instance.id, report.SequenceNumber, len(report.Checkpoints), len(report.Unanswered))
+	} else {
+		logger.Warningf("Replica %d consistency probe at seqNo=%d found replicas %v diverging", instance.id, report.SequenceNumber, report.Divergent)
+	}
+	probe.done <- report
+}
@@ -0,0 +1,82 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+// hello announces the protocol versions we speak and understand
+func (instance *pbftCore) hello() *Message {
+	return &Message{Payload: &Message_Hello{Hello: &Hello{
+		ReplicaId:          instance.id,
+		ProtocolVersion:    instance.protocolVersion,
+		MinProtocolVersion: instance.minProtocolVersion,
+	}}}
+}
+
+// sendHello announces our protocol versions to every replica, ahead of any
+// other consensus message
+func (instance *pbftCore) sendHello() {
+	logger.Infof("Replica %d announcing protocol version %d, understanding versions from %d", instance.id, instance.protocolVersion, instance.minProtocolVersion)
+	instance.innerBroadcast(instance.hello())
+}
+
+// sendHelloTo announces our protocol versions to a replica we just connected to
+func (instance *pbftCore) sendHelloTo(replica uint64) {
+	logger.Debugf("Replica %d announcing protocol version %d to replica %d", instance.id, instance.protocolVersion, replica)
+	msgPacked, _ := proto.Marshal(instance.hello())
+	instance.consumer.unicast(msgPacked, replica)
+}
+
+// compatible reports whether we and a replica announcing h understand the
+// consensus messages of each other
+func (instance *pbftCore) compatible(h *Hello) bool {
+	return h.ProtocolVersion >= instance.minProtocolVersion && instance.protocolVersion >= h.MinProtocolVersion
+}
+
+// incompatible reports whether a replica announced protocol versions we
+// cannot interoperate with, so that we refuse its messages rather than
+// misinterpret them.  Replicas which announced no version are not refused.
+func (instance *pbftCore) incompatible(replica uint64) bool {
+	h, ok := instance.peerHellos[replica]
+	return ok && !instance.compatible(h)
+}
+
+func (instance *pbftCore) recvHello(h *Hello) {
+	if instance.protocolVersion == 0 {
+		logger.Debugf("Replica %d does not negotiate protocol versions, ignoring hello from replica %d", instance.id, h.ReplicaId)
+		return
+	}
+	_, known := instance.peerHellos[h.ReplicaId]
+	instance.peerHellos[h.ReplicaId] = h
+	if !known {
+		// The sender may have started after our announcement, answer it
+		instance.sendHelloTo(h.ReplicaId)
+	}
+
+	if !instance.compatible(h) {
+		logger.Errorf("Replica %d speaks protocol version %d and understands versions from %d, but replica %d speaks version %d and understands versions from %d; refusing its messages until one of them is upgraded",
+			instance.id, instance.protocolVersion, instance.minProtocolVersion, h.ReplicaId, h.ProtocolVersion, h.MinProtocolVersion)
+		return
+	}
+	version := instance.protocolVersion
+	if h.ProtocolVersion < version {
+		version = h.ProtocolVersion
+	}
+	logger.Infof("Replica %d interoperating with replica %d at protocol version %d", instance.id, h.ReplicaId, version)
+}
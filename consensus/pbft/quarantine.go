@@ -0,0 +1,50 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+// reportFault raises the misbehavior score of a replica which sent us a
+// message proving it faulty, quarantining it once the score reaches the
+// threshold
+func (instance *pbftCore) reportFault(replica uint64, reason string) {
+	if replica == instance.id {
+		return
+	}
+	instance.misbehavior[replica]++
+	score := instance.misbehavior[replica]
+	logger.Warningf("Replica %d observed fault of replica %d (%s), misbehavior score %d", instance.id, replica, reason, score)
+	if instance.quarantineThreshold > 0 && score == instance.quarantineThreshold {
+		logger.Errorf("Replica %d quarantining replica %d, only processing its pre-prepares, prepares, commits, checkpoints, view-changes and new-views from now on", instance.id, replica)
+	}
+}
+
+// quarantined reports whether we ignore the messages of a replica which
+// consensus does not need for safety
+func (instance *pbftCore) quarantined(replica uint64) bool {
+	return instance.quarantineThreshold > 0 && instance.misbehavior[replica] >= instance.quarantineThreshold
+}
+
+// safetyMessage reports whether a message takes part in agreement, and so is
+// processed even from a quarantined replica, whose valid messages still count
+// towards quorums.  Any other message, including those of message types added
+// later, is dropped
+func safetyMessage(msg *Message) bool {
+	switch msg.GetPayload().(type) {
+	case *Message_PrePrepare, *Message_Prepare, *Message_Commit, *Message_VoteBatch, *Message_Checkpoint, *Message_ViewChange, *Message_NewView:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+// quorumCheckTimerEvent is sent when the next quorum check is due
+type quorumCheckTimerEvent struct{}
+
+// quorumStatus reports that a replica lost, or regained, contact with enough
+// replicas for the network to commit
+type quorumStatus struct {
+	replica uint64
+	live    int // replicas heard from during the last check interval, including ourselves
+	needed  int // replicas needed for a commit quorum
+	lost    bool
+}
+
+// logQuorumStatus is the default quorum sink
+func logQuorumStatus(s quorumStatus) {
+	if s.lost {
+		logger.Errorf("Replica %d heard from only %d of the %d replicas needed for a quorum, entering degraded mode", s.replica, s.live, s.needed)
+	} else {
+		logger.Warningf("Replica %d hears from %d replicas again, leaving degraded mode", s.replica, s.live)
+	}
+}
+
+// checkQuorum counts the replicas heard from since the last check, and
+// reports when their number drops below, or returns to, a commit quorum.
+// On an idle network null requests keep the other replicas heard.
+func (instance *pbftCore) checkQuorum() {
+	live := 1
+	for replica := range instance.heardFrom {
+		if replica != instance.id {
+			live++
+		}
+	}
+	instance.heardFrom = make(map[uint64]bool)
+
+	lost := live < instance.intersectionQuorum()
+	if lost == instance.quorumLost {
+		logger.Debugf("Replica %d heard from %d replicas during the last quorum check interval", instance.id, live)
+		return
+	}
+	instance.quorumLost = lost
+	instance.quorumSink(quorumStatus{replica: instance.id, live: live, needed: instance.intersectionQuorum(), lost: lost})
+}
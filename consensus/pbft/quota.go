@@ -0,0 +1,218 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Quota is what an organization may submit per quota window
+type Quota struct {
+	Requests int // client transactions, 0 for no limit
+	Bytes    int // payload bytes of the client transactions, 0 for no limit
+}
+
+// QuotaManager attributes client transactions to the organizations which
+// submitted them, and tells the quota of each.  It is called concurrently
+// from RecvMsg.
+type QuotaManager interface {
+	Org(payload []byte) string
+	Quota(org string) Quota
+}
+
+var quotaManagers = map[string]QuotaManager{}
+
+// RegisterQuotaManager makes a quota manager selectable through
+// general.quota.manager, it must be called before the plugin is created
+func RegisterQuotaManager(name string, manager QuotaManager) {
+	quotaManagers[name] = manager
+}
+
+// quotaUsage is what an organization had ordered in a quota window
+type quotaUsage struct {
+	requests int
+	bytes    int
+}
+
+// quotaWindow is the usage of every organization in one quota window
+type quotaWindow struct {
+	index uint64
+	seqNo uint64 // of the last batch accounted
+	usage map[string]*quotaUsage
+}
+
+func (w *quotaWindow) copy() *quotaWindow {
+	c := &quotaWindow{index: w.index, seqNo: w.seqNo, usage: make(map[string]*quotaUsage, len(w.usage))}
+	for org, usage := range w.usage {
+		u := *usage
+		c.usage[org] = &u
+	}
+	return c
+}
+
+// quotas accounts the client transactions each organization had ordered in
+// the current window.  Every replica charges the requests of a batch as it
+// executes it, in the order the primary batched them, so all agree on the
+// usage and on which requests exceed it; the metadata of each batch records
+// the usage, for the replicas which restart or transfer state.  A window
+// lasts a configured time, by the timestamp each request was stamped with,
+// or otherwise a checkpoint interval of sequence numbers
+type quotas struct {
+	manager QuotaManager
+	window  time.Duration
+	K       uint64
+
+	lock      sync.Mutex   // guards committed, admission runs outside the event thread
+	committed *quotaWindow // usage as of the last batch committed
+	executing *quotaWindow // usage as of the batch in execution
+}
+
+// newQuotas returns the accounting for the quota manager selected by
+// general.quota.manager, or nil if no quotas are enforced
+func newQuotas(config *viper.Viper, K uint64) *quotas {
+	name := config.GetString("general.quota.manager")
+	if name == "" {
+		return nil
+	}
+	manager, ok := quotaManagers[name]
+	if !ok {
+		panic(fmt.Errorf("Unknown quota manager: %s", name))
+	}
+	return &quotas{
+		manager:   manager,
+		window:    config.GetDuration("general.quota.window"),
+		K:         K,
+		committed: &quotaWindow{usage: make(map[string]*quotaUsage)},
+	}
+}
+
+// timedWindow is the index of the timed window holding t
+func (q *quotas) timedWindow(t time.Time) uint64 {
+	return uint64(t.UnixNano() / int64(q.window))
+}
+
+// exceeds tells whether a transaction would take its organization's usage over its quota
+func (q *quotas) exceeds(org string, usage *quotaUsage, payload []byte) error {
+	quota := q.manager.Quota(org)
+	if (quota.Requests > 0 && usage.requests+1 > quota.Requests) || (quota.Bytes > 0 && usage.bytes+len(payload) > quota.Bytes) {
+		return fmt.Errorf("PBFT refuses to order a transaction of organization %q, which would exceed its quota of %d requests and %d bytes, having had %d requests and %d bytes ordered",
+			org, quota.Requests, quota.Bytes, usage.requests, usage.bytes)
+	}
+	return nil
+}
+
+// admit turns away a client transaction taken in at now whose organization
+// already had its quota ordered in the current window.  It charges nothing,
+// the transaction is charged once it executes
+func (q *quotas) admit(payload []byte, now time.Time) error {
+	org := q.manager.Org(payload)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.window > 0 && q.timedWindow(now) > q.committed.index {
+		return nil
+	}
+	if q.window == 0 && q.committed.seqNo%q.K == 0 {
+		// the next batch opens a new window
+		return nil
+	}
+	usage, ok := q.committed.usage[org]
+	if !ok {
+		return nil
+	}
+	return q.exceeds(org, usage, payload)
+}
+
+// charge accounts the requests of the batch ordered at seqNo, in order, to
+// the quotas of their organizations, from the usage as of the last batch
+// committed.  It returns the requests refused for exceeding their quota
+func (q *quotas) charge(seqNo uint64, reqs []*Request) map[*Request]error {
+	q.lock.Lock()
+	w := q.committed.copy()
+	q.lock.Unlock()
+	w.seqNo = seqNo
+
+	refused := make(map[*Request]error)
+	for _, req := range reqs {
+		index := (seqNo - 1) / q.K // windows end on checkpoints, where state transfer resumes
+		if q.window > 0 {
+			index = 0
+			if req.Timestamp != nil {
+				index = q.timedWindow(time.Unix(req.Timestamp.Seconds, int64(req.Timestamp.Nanos)))
+			}
+		}
+		if index > w.index {
+			// a request stamped in an earlier window is charged to the current one
+			w = &quotaWindow{index: index, seqNo: seqNo, usage: make(map[string]*quotaUsage)}
+		}
+		org := q.manager.Org(req.Payload)
+		usage, ok := w.usage[org]
+		if !ok {
+			usage = &quotaUsage{}
+			w.usage[org] = usage
+		}
+		if err := q.exceeds(org, usage, req.Payload); err != nil {
+			refused[req] = err
+			continue
+		}
+		usage.requests++
+		usage.bytes += len(req.Payload)
+	}
+	q.executing = w
+	return refused
+}
+
+// record notes the usage as of the batch in execution in its metadata
+func (q *quotas) record(meta *Metadata) {
+	w := q.executing
+	meta.QuotaWindow = w.index
+	var orgs []string
+	for org := range w.usage {
+		orgs = append(orgs, org)
+	}
+	sort.Strings(orgs)
+	for _, org := range orgs {
+		usage := w.usage[org]
+		meta.QuotaUsage = append(meta.QuotaUsage, &QuotaUsage{Org: org, Requests: uint64(usage.requests), Bytes: uint64(usage.bytes)})
+	}
+}
+
+// commit makes the usage as of the batch in execution the committed usage
+func (q *quotas) commit() {
+	if q.executing == nil {
+		return
+	}
+	q.lock.Lock()
+	q.committed, q.executing = q.executing, nil
+	q.lock.Unlock()
+}
+
+// restore takes the committed usage from the metadata of the ledger head
+func (q *quotas) restore(meta *Metadata) {
+	w := &quotaWindow{index: meta.QuotaWindow, seqNo: meta.SeqNo, usage: make(map[string]*quotaUsage)}
+	for _, usage := range meta.QuotaUsage {
+		w.usage[usage.Org] = &quotaUsage{requests: int(usage.Requests), bytes: int(usage.Bytes)}
+	}
+	q.lock.Lock()
+	q.committed, q.executing = w, nil
+	q.lock.Unlock()
+}
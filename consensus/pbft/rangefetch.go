@@ -0,0 +1,183 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// rangeVouch is a committed batch returned by a range fetch, with the
+// replicas which returned it
+type rangeVouch struct {
+	batch    *CommittedBatch
+	replicas map[uint64]bool
+}
+
+// maybeFetchRange asks the other replicas for the committed batches up to n
+// when a commit quorum shows the network committed n without us seeing its
+// pre-prepare
+func (instance *pbftCore) maybeFetchRange(v uint64, n uint64, digest string) {
+	if !instance.rangeFetch {
+		return
+	}
+	cert := instance.certStore[msgID{v, n}]
+	if cert == nil || cert.prePrepare != nil || instance.skipInProgress || n <= instance.rangeFetchHigh {
+		return
+	}
+
+	quorum := 0
+	for _, c := range cert.commit {
+		if c.BatchDigest == digest {
+			quorum++
+		}
+	}
+	if quorum < instance.intersectionQuorum() {
+		return
+	}
+
+	start := instance.lastExec + 1
+	if instance.rangeFetchHigh >= start {
+		start = instance.rangeFetchHigh + 1
+	}
+	instance.rangeFetchHigh = n
+	logger.Infof("Replica %d missed the pre-prepare of committed seqNo=%d, fetching committed batches %d to %d", instance.id, n, start, n)
+	instance.innerBroadcast(&Message{Payload: &Message_RangeFetch{RangeFetch: &RangeFetch{
+		Start:     start,
+		End:       n,
+		ReplicaId: instance.id,
+	}}})
+}
+
+// recvRangeFetch returns the committed batches of the range which we still
+// hold, with their commit certificates
+func (instance *pbftCore) recvRangeFetch(rf *RangeFetch) error {
+	rr := &RangeReturn{ReplicaId: instance.id}
+	for idx, cert := range instance.certStore {
+		if idx.n < rf.Start || idx.n > rf.End || cert.prePrepare == nil {
+			continue
+		}
+		if !instance.committed(cert.digest, idx.v, idx.n) {
+			continue
+		}
+		rr.Batches = append(rr.Batches, &CommittedBatch{
+			View:           idx.v,
+			SequenceNumber: idx.n,
+			RequestBatch:   instance.reqBatchStore[cert.digest],
+			Commits:        cert.commit,
+		})
+	}
+	if len(rr.Batches) == 0 {
+		logger.Debugf("Replica %d holds no committed batches from %d to %d requested by replica %d", instance.id, rf.Start, rf.End, rf.ReplicaId)
+		return nil
+	}
+
+	msgPacked, err := proto.Marshal(&Message{Payload: &Message_RangeReturn{RangeReturn: rr}})
+	if err != nil {
+		return fmt.Errorf("Error marshalling range-return message: %v", err)
+	}
+	logger.Debugf("Replica %d returning %d committed batches from %d to %d to replica %d", instance.id, len(rr.Batches), rf.Start, rf.End, rf.ReplicaId)
+	return instance.consumer.unicast(msgPacked, rf.ReplicaId)
+}
+
+// verifyCommittedBatch checks that a returned batch carries a commit quorum
+// of distinct replicas for its digest, and returns the digest
+func (instance *pbftCore) verifyCommittedBatch(cb *CommittedBatch) (string, error) {
+	if len(cb.Commits) == 0 {
+		return "", fmt.Errorf("no commit certificate")
+	}
+	digest := cb.Commits[0].BatchDigest
+	committers := make(map[uint64]bool)
+	for _, c := range cb.Commits {
+		if c.View != cb.View || c.SequenceNumber != cb.SequenceNumber || c.BatchDigest != digest {
+			return "", fmt.Errorf("commit from replica %d does not match the batch", c.ReplicaId)
+		}
+		committers[c.ReplicaId] = true
+	}
+	if len(committers) < instance.intersectionQuorum() {
+		return "", fmt.Errorf("commit certificate has %d of the %d replicas needed", len(committers), instance.intersectionQuorum())
+	}
+	if digest == "" {
+		if len(cb.GetRequestBatch().GetBatch()) != 0 {
+			return "", fmt.Errorf("null request carries requests")
+		}
+	} else if cb.RequestBatch == nil || instance.batchDigest(cb.RequestBatch) != digest {
+		return "", fmt.Errorf("request batch does not match digest %s", digest)
+	}
+	return digest, nil
+}
+
+// recvRangeReturn adopts a returned batch once f+1 replicas returned it with
+// a valid commit certificate, as the commits themselves are not signed
+func (instance *pbftCore) recvRangeReturn(rr *RangeReturn) error {
+	for _, cb := range rr.Batches {
+		n := cb.SequenceNumber
+		if n <= instance.lastExec || !instance.inW(n) {
+			continue
+		}
+		digest, err := instance.verifyCommittedBatch(cb)
+		if err != nil {
+			logger.Warningf("Replica %d ignoring committed batch for view=%d/seqNo=%d from replica %d: %s", instance.id, cb.View, n, rr.ReplicaId, err)
+			continue
+		}
+
+		idx := msgID{cb.View, n}
+		if instance.rangeReturns[idx] == nil {
+			instance.rangeReturns[idx] = make(map[string]*rangeVouch)
+		}
+		vouch := instance.rangeReturns[idx][digest]
+		if vouch == nil {
+			vouch = &rangeVouch{batch: cb, replicas: make(map[uint64]bool)}
+			instance.rangeReturns[idx][digest] = vouch
+		}
+		vouch.replicas[rr.ReplicaId] = true
+		if len(vouch.replicas) < instance.f+1 {
+			continue
+		}
+
+		if instance.getCert(cb.View, n).certified {
+			continue
+		}
+		logger.Infof("Replica %d adopting committed batch for view=%d/seqNo=%d returned by %d replicas", instance.id, cb.View, n, len(vouch.replicas))
+		instance.adoptCommittedBatch(vouch.batch, digest)
+		delete(instance.rangeReturns, idx)
+	}
+
+	instance.executeOutstanding()
+	return nil
+}
+
+// adoptCommittedBatch certifies a batch whose commit certificate we verified,
+// for us to execute it in turn
+func (instance *pbftCore) adoptCommittedBatch(cb *CommittedBatch, digest string) {
+	cert := instance.getCert(cb.View, cb.SequenceNumber)
+	cert.digest = digest
+	cert.certified = true
+	cert.prePrepare = &PrePrepare{
+		View:           cb.View,
+		SequenceNumber: cb.SequenceNumber,
+		BatchDigest:    digest,
+		RequestBatch:   cb.RequestBatch,
+		ReplicaId:      instance.primary(cb.View),
+	}
+	if digest != "" {
+		instance.reqBatchStore[digest] = cb.RequestBatch
+		instance.persistRequestBatch(digest)
+	}
+	delete(instance.outstandingReqBatches, digest)
+}
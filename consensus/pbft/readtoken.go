@@ -0,0 +1,107 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+	"time"
+)
+
+// ErrTokenTimeout is returned when a replica did not commit the write of a
+// consistency token in time to serve a read reflecting it
+var ErrTokenTimeout = fmt.Errorf("PBFT replica has not yet committed the write of the consistency token, retry or read from another replica")
+
+// readTimerEvent is sent when the earliest held read may have outwaited its timeout
+type readTimerEvent struct{}
+
+// readWaiter is a read waiting for the batch of its consistency token to commit
+type readWaiter struct {
+	token    uint64
+	deadline time.Time
+	done     chan error
+}
+
+// AwaitToken blocks until we committed the batch of a consistency token, so
+// that a read served afterwards reflects the client's write.  The token of a
+// write is the sequence number of its reply.  A lagging replica waits up to
+// the timeout, then gives up with ErrTokenTimeout.
+func (op *obcBatch) AwaitToken(token uint64, timeout time.Duration) error {
+	done := make(chan error, 1)
+	op.manager.Queue() <- workEvent(func() {
+		if op.headMetadata().SeqNo >= token {
+			done <- nil
+			return
+		}
+		logger.Debugf("Replica %d holding a read until it commits seqNo=%d", op.pbft.id, token)
+		op.readWaiters = append(op.readWaiters, &readWaiter{token: token, deadline: op.pbft.now().Add(timeout), done: done})
+		op.armReadTimer()
+	})
+	return <-done
+}
+
+// releaseReads lets the reads whose tokens we committed proceed
+func (op *obcBatch) releaseReads() {
+	if len(op.readWaiters) == 0 {
+		return
+	}
+	committed := op.headMetadata().SeqNo
+	waiting := op.readWaiters[:0]
+	for _, w := range op.readWaiters {
+		if w.token <= committed {
+			w.done <- nil
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+	op.readWaiters = waiting
+	op.armReadTimer()
+}
+
+// expireReads gives up on the held reads which outwaited their timeout
+func (op *obcBatch) expireReads() {
+	now := op.pbft.now()
+	waiting := op.readWaiters[:0]
+	for _, w := range op.readWaiters {
+		if !w.deadline.After(now) {
+			logger.Debugf("Replica %d gave up on a read waiting for seqNo=%d", op.pbft.id, w.token)
+			w.done <- ErrTokenTimeout
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+	op.readWaiters = waiting
+	op.armReadTimer()
+}
+
+// armReadTimer schedules the next timeout check for the earliest held read
+func (op *obcBatch) armReadTimer() {
+	if len(op.readWaiters) == 0 {
+		op.readTimer.Stop()
+		return
+	}
+	earliest := op.readWaiters[0].deadline
+	for _, w := range op.readWaiters[1:] {
+		if w.deadline.Before(earliest) {
+			earliest = w.deadline
+		}
+	}
+	wait := earliest.Sub(op.pbft.now())
+	if wait < 0 {
+		wait = 0
+	}
+	op.readTimer.Reset(wait, readTimerEvent{})
+}
@@ -0,0 +1,305 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const reconfigKey = "reconfig"
+
+// reconfigurationEvent is sent when a reconfiguration is submitted for ordering
+type reconfigurationEvent struct {
+	payload []byte
+}
+
+// pendingReconfiguration is a committed reconfiguration awaiting its checkpoint
+type pendingReconfiguration struct {
+	key      string // persisted state key
+	at       uint64 // checkpoint after which the replicas switch to the settings
+	settings []*ConfigSetting
+}
+
+// reconfigurable maps each setting a reconfiguration may change to a parser
+// of its value, which returns the function applying it
+var reconfigurable = map[string]func(value string) (func(op *obcBatch), error){
+	"general.batchsize": func(value string) (func(op *obcBatch), error) {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("batch size must be a positive integer, not %q", value)
+		}
+		return func(op *obcBatch) { op.batchSize = size }, nil
+	},
+	"general.timeout.batch":      durationSetting(func(op *obcBatch, d time.Duration) { op.batchTimeout = d }),
+	"general.timeout.request":    durationSetting(func(op *obcBatch, d time.Duration) { op.pbft.requestTimeout = d }),
+	"general.timeout.viewchange": durationSetting(func(op *obcBatch, d time.Duration) { op.pbft.newViewTimeout = d }),
+}
+
+func durationSetting(set func(op *obcBatch, d time.Duration)) func(value string) (func(op *obcBatch), error) {
+	return func(value string) (func(op *obcBatch), error) {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("timeout must be a positive duration, not %q", value)
+		}
+		return func(op *obcBatch) { set(op, d) }, nil
+	}
+}
+
+// parseReconfiguration unmarshals and checks a reconfiguration, which may
+// only change settings in reconfigurable, each at most once
+func parseReconfiguration(payload []byte) (*Reconfiguration, error) {
+	reconfig := &Reconfiguration{}
+	if err := proto.Unmarshal(payload, reconfig); err != nil {
+		return nil, err
+	}
+	if len(reconfig.Settings) == 0 {
+		return nil, fmt.Errorf("reconfiguration changes no settings")
+	}
+	seen := make(map[string]bool)
+	for _, setting := range reconfig.Settings {
+		parse, ok := reconfigurable[setting.Key]
+		if !ok {
+			return nil, fmt.Errorf("setting %s cannot be reconfigured", setting.Key)
+		}
+		if seen[setting.Key] {
+			return nil, fmt.Errorf("setting %s is reconfigured twice", setting.Key)
+		}
+		seen[setting.Key] = true
+		if _, err := parse(setting.Value); err != nil {
+			return nil, fmt.Errorf("setting %s: %s", setting.Key, err)
+		}
+	}
+	return reconfig, nil
+}
+
+// authorizeReconfiguration parses a reconfiguration and checks that an
+// administrator issued it, none are authorized without an authorizer
+func (op *obcBatch) authorizeReconfiguration(payload []byte) (*Reconfiguration, error) {
+	reconfig, err := parseReconfiguration(payload)
+	if err != nil {
+		return nil, err
+	}
+	if op.reconfigAuth == nil {
+		return nil, fmt.Errorf("reconfigurations are refused, general.reconfigauth is not set")
+	}
+	if err = op.reconfigAuth.Authorize(reconfig.Settings, reconfig.Credential); err != nil {
+		return nil, fmt.Errorf("unauthorized reconfiguration: %s", err)
+	}
+	return reconfig, nil
+}
+
+// SubmitReconfiguration orders a change of consensus settings like a client
+// transaction, once the ReconfigurationAuthorizer accepts the credential.
+// Once ordered, every replica switches to the new settings after executing
+// the first checkpoint at or after it, so all switch at the same sequence
+// number.  Only the batch size and the batch, request and view change
+// timeouts can be reconfigured
+func (op *obcBatch) SubmitReconfiguration(settings map[string]string, credential []byte) error {
+	var keys []string
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	reconfig := &Reconfiguration{Credential: credential}
+	for _, key := range keys {
+		reconfig.Settings = append(reconfig.Settings, &ConfigSetting{Key: key, Value: settings[key]})
+	}
+	payload, err := proto.Marshal(reconfig)
+	if err != nil {
+		return err
+	}
+	if _, err = op.authorizeReconfiguration(payload); err != nil {
+		return err
+	}
+	op.manager.Queue() <- reconfigurationEvent{payload: payload}
+	return nil
+}
+
+// reconfigCheckpoint is the checkpoint a reconfiguration ordered at seqNo takes effect at
+func (op *obcBatch) reconfigCheckpoint(seqNo uint64) uint64 {
+	return (seqNo + op.pbft.K - 1) / op.pbft.K * op.pbft.K
+}
+
+// recordReconfigurations notes in the metadata of the batch at seqNo the
+// settings reconfigured and scheduled once it commits, so that the
+// checkpointed state carries them to the replicas catching up by state
+// transfer
+func (op *obcBatch) recordReconfigurations(meta *Metadata, seqNo uint64, reconfigs []*Reconfiguration) {
+	if len(op.reconfigured) > 0 {
+		meta.Reconfigured = op.reconfiguredSettings()
+	}
+	for _, pending := range op.reconfigs {
+		meta.Scheduled = append(meta.Scheduled, &Reconfiguration{Settings: pending.settings, SequenceNumber: pending.at})
+	}
+	for _, reconfig := range reconfigs {
+		meta.Scheduled = append(meta.Scheduled, &Reconfiguration{Settings: reconfig.Settings, SequenceNumber: op.reconfigCheckpoint(seqNo)})
+	}
+}
+
+// scheduleReconfigurations defers the reconfigurations committed at seqNo to the next checkpoint
+func (op *obcBatch) scheduleReconfigurations(seqNo uint64, reconfigs []*Reconfiguration) {
+	for i, reconfig := range reconfigs {
+		at := op.reconfigCheckpoint(seqNo)
+		logger.Infof("Replica %d scheduling reconfiguration ordered at seqNo=%d for checkpoint seqNo=%d", op.pbft.id, seqNo, at)
+		op.scheduleReconfiguration(fmt.Sprintf("%s.%d.%d", reconfigKey, seqNo, i), at, reconfig.Settings)
+	}
+	op.applyReconfigurations()
+}
+
+func (op *obcBatch) scheduleReconfiguration(key string, at uint64, settings []*ConfigSetting) {
+	op.reconfigs = append(op.reconfigs, pendingReconfiguration{key: key, at: at, settings: settings})
+	raw, err := proto.Marshal(&Reconfiguration{Settings: settings, SequenceNumber: at})
+	if err != nil {
+		logger.Errorf("Replica %d could not marshal the reconfiguration for checkpoint seqNo=%d: %v", op.pbft.id, at, err)
+		return
+	}
+	op.StoreState(key, raw)
+}
+
+// adoptReconfigurations takes over the settings recorded in the ledger head
+// after a state transfer, which may have skipped the batches reconfiguring
+// them
+func (op *obcBatch) adoptReconfigurations(head *Metadata) {
+	if head.Reconfigured == nil && len(head.Scheduled) == 0 {
+		return
+	}
+	logger.Infof("Replica %d adopting the reconfigurations recorded at seqNo=%d", op.pbft.id, head.SeqNo)
+	for _, pending := range op.reconfigs {
+		op.DelState(pending.key)
+	}
+	op.reconfigs = nil
+	if head.Reconfigured != nil {
+		op.reconfigured = make(map[string]string)
+		op.applySettings(head.Reconfigured.Settings, head.Reconfigured.SequenceNumber)
+		op.persistReconfigured()
+	}
+	for i, reconfig := range head.Scheduled {
+		op.scheduleReconfiguration(fmt.Sprintf("%s.%d.%d", reconfigKey, head.SeqNo, i), reconfig.SequenceNumber, reconfig.Settings)
+	}
+}
+
+// applyReconfigurations switches to the settings of the pending reconfigurations whose checkpoint executed
+func (op *obcBatch) applyReconfigurations() {
+	applied := false
+	for len(op.reconfigs) > 0 && op.reconfigs[0].at <= op.pbft.lastExec {
+		pending := op.reconfigs[0]
+		op.reconfigs = op.reconfigs[1:]
+		op.applySettings(pending.settings, pending.at)
+		op.persistReconfigured()
+		op.DelState(pending.key)
+		applied = true
+	}
+	// a smaller batch size may leave the batch in assembly full already
+	if applied && op.pbft.primary(op.pbft.view) == op.pbft.id && op.pbft.activeView && len(op.batchStore) >= op.batchSize {
+		op.manager.Inject(op.sendBatch())
+	}
+}
+
+func (op *obcBatch) applySettings(settings []*ConfigSetting, at uint64) {
+	for _, setting := range settings {
+		apply, err := reconfigurable[setting.Key](setting.Value)
+		if err != nil {
+			continue // checked when scheduled
+		}
+		logger.Infof("Replica %d switching to %s=%s at checkpoint seqNo=%d", op.pbft.id, setting.Key, setting.Value, at)
+		apply(op)
+		op.reconfigured[setting.Key] = setting.Value
+	}
+	if op.batchTimeout >= op.pbft.requestTimeout {
+		op.pbft.requestTimeout = 3 * op.batchTimeout / 2
+		logger.Warningf("Replica %d reconfigured request timeout must be greater than batch timeout, setting to %v", op.pbft.id, op.pbft.requestTimeout)
+	}
+	op.reconfiguredAt = at
+}
+
+// reconfiguredSettings returns the reconfigured settings sorted by key, and the checkpoint the last took effect at
+func (op *obcBatch) reconfiguredSettings() *Reconfiguration {
+	var keys []string
+	for key := range op.reconfigured {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	reconfig := &Reconfiguration{SequenceNumber: op.reconfiguredAt}
+	for _, key := range keys {
+		reconfig.Settings = append(reconfig.Settings, &ConfigSetting{Key: key, Value: op.reconfigured[key]})
+	}
+	return reconfig
+}
+
+func (op *obcBatch) persistReconfigured() {
+	raw, err := proto.Marshal(op.reconfiguredSettings())
+	if err != nil {
+		logger.Errorf("Replica %d could not marshal its reconfigured settings: %v", op.pbft.id, err)
+		return
+	}
+	if err = op.StoreState(reconfigKey, raw); err != nil {
+		logger.Warningf("Replica %d could not persist its reconfigured settings: %v", op.pbft.id, err)
+	}
+}
+
+// restoreReconfigurations reapplies the reconfigured settings and reschedules
+// the reconfigurations still awaiting their checkpoint after a restart
+func (op *obcBatch) restoreReconfigurations() {
+	if raw, err := op.ReadState(reconfigKey); err == nil {
+		if reconfig, err := parseReconfiguration(raw); err != nil {
+			logger.Warningf("Replica %d could not restore its reconfigured settings: %v", op.pbft.id, err)
+		} else {
+			op.applySettings(reconfig.Settings, reconfig.SequenceNumber)
+		}
+	}
+	reconfigs, err := op.ReadStateSet(reconfigKey + ".")
+	if err != nil {
+		return
+	}
+	var seqNos []uint64
+	keys := make(map[uint64][]string)
+	for key := range reconfigs {
+		var seqNo uint64
+		var i int
+		if _, err := fmt.Sscanf(key, reconfigKey+".%d.%d", &seqNo, &i); err != nil {
+			logger.Warningf("Replica %d ignoring malformed reconfiguration key %s", op.pbft.id, key)
+			continue
+		}
+		if _, ok := keys[seqNo]; !ok {
+			seqNos = append(seqNos, seqNo)
+		}
+		for len(keys[seqNo]) <= i {
+			keys[seqNo] = append(keys[seqNo], "")
+		}
+		keys[seqNo][i] = key
+	}
+	sort.Sort(sortableUint64Slice(seqNos))
+	for _, seqNo := range seqNos {
+		for _, key := range keys[seqNo] {
+			if key == "" {
+				continue
+			}
+			reconfig, err := parseReconfiguration(reconfigs[key])
+			if err != nil {
+				logger.Warningf("Replica %d ignoring malformed reconfiguration %s: %v", op.pbft.id, key, err)
+				continue
+			}
+			op.reconfigs = append(op.reconfigs, pendingReconfiguration{key: key, at: reconfig.SequenceNumber, settings: reconfig.Settings})
+		}
+	}
+	op.applyReconfigurations()
+}
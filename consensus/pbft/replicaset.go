@@ -0,0 +1,113 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/consensus/util/events"
+	"github.com/hyperledger/fabric/core/util"
+)
+
+// replicaSetConfirmedEvent is sent once 2f+1 replicas announced our replica
+// set, carrying the consensus messages withheld until then
+type replicaSetConfirmedEvent struct {
+	withheld []events.Event
+}
+
+// replicaSetDigest identifies a replica set by its size, tolerated faults and
+// the identities of its members, ordered by replica id
+func replicaSetDigest(N, f int, identities []string) string {
+	raw := []byte(fmt.Sprintf("N=%d f=%d replicas=%s", N, f, strings.Join(identities, ",")))
+	return base64.StdEncoding.EncodeToString(util.ComputeCryptoHash(raw))
+}
+
+// sendReplicaSet announces our replica set to every replica
+func (instance *pbftCore) sendReplicaSet() {
+	logger.Infof("Replica %d announcing replica set %s", instance.id, instance.replicaSetDigest)
+	instance.innerBroadcast(&Message{Payload: &Message_ReplicaSet{ReplicaSet: &ReplicaSet{
+		ReplicaId: instance.id,
+		Digest:    instance.replicaSetDigest,
+	}}})
+}
+
+func (instance *pbftCore) recvReplicaSet(rs *ReplicaSet) events.Event {
+	_, known := instance.replicaSets[rs.ReplicaId]
+	instance.replicaSets[rs.ReplicaId] = rs.Digest
+	if !known {
+		// The sender may have started after our announcement, answer it
+		msgPacked, _ := proto.Marshal(&Message{Payload: &Message_ReplicaSet{ReplicaSet: &ReplicaSet{
+			ReplicaId: instance.id,
+			Digest:    instance.replicaSetDigest,
+		}}})
+		instance.consumer.unicast(msgPacked, rs.ReplicaId)
+	}
+
+	if rs.Digest != instance.replicaSetDigest {
+		logger.Errorf("Replica %d configured replica set %s, but replica %d announced %s; check N, f and the replica identities of both",
+			instance.id, instance.replicaSetDigest, rs.ReplicaId, rs.Digest)
+	}
+	if instance.replicaSetConfirmed || instance.replicaSetMismatch {
+		return nil
+	}
+	return instance.checkReplicaSet()
+}
+
+// checkReplicaSet confirms our replica set once 2f+1 replicas, counting
+// ourself, announced it, or gives up once too many announced another
+func (instance *pbftCore) checkReplicaSet() events.Event {
+	matches, mismatches := 1, 0
+	for id, digest := range instance.replicaSets {
+		if id == instance.id {
+			continue
+		}
+		if digest == instance.replicaSetDigest {
+			matches++
+		} else {
+			mismatches++
+		}
+	}
+
+	if matches >= instance.intersectionQuorum() {
+		logger.Infof("Replica %d confirmed replica set %s with %d replicas, participating in consensus", instance.id, instance.replicaSetDigest, matches)
+		instance.replicaSetConfirmed = true
+		withheld := instance.withheldMsgs
+		instance.withheldMsgs = nil
+		return replicaSetConfirmedEvent{withheld: withheld}
+	}
+	if mismatches > instance.N-instance.intersectionQuorum() {
+		logger.Criticalf("Replica %d replica set %s disagrees with %d replicas, it can never be confirmed; refusing to participate in consensus until reconfigured",
+			instance.id, instance.replicaSetDigest, mismatches)
+		instance.replicaSetMismatch = true
+		instance.withheldMsgs = nil
+	}
+	return nil
+}
+
+// withhold keeps a consensus message until our replica set is confirmed,
+// and drops it once the replica set can no longer be confirmed
+func (instance *pbftCore) withhold(e events.Event) {
+	if instance.replicaSetMismatch {
+		logger.Debugf("Replica %d replica set mismatch, dropping %T", instance.id, e)
+		return
+	}
+	logger.Debugf("Replica %d replica set not yet confirmed, withholding %T", instance.id, e)
+	instance.withheldMsgs = append(instance.withheldMsgs, e)
+}
@@ -0,0 +1,152 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"container/list"
+	"encoding/base64"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/consensus"
+	"github.com/hyperledger/fabric/core/util"
+)
+
+const replyKeyPrefix = "reply."
+
+type cachedReply struct {
+	digest string
+	reply  []byte // marshaled Reply sent to the client
+}
+
+// replyCache remembers the replies to recently executed requests, keyed by
+// the digest of the request payload, so retransmissions are answered rather
+// than ordered again.  It holds at most size replies, evicting the oldest, and
+// when persistence is enabled writes its changes out every persistInterval
+// executed batches.
+type replyCache struct {
+	size            int
+	persistInterval int
+	persistor       consensus.StatePersistor
+
+	replies    map[string]*list.Element
+	order      *list.List      // of *cachedReply, oldest first
+	dirty      map[string]bool // changes since the last flush, true if stored and false if evicted
+	sinceFlush int             // batches executed since the last flush
+}
+
+func newReplyCache(size int, persistInterval int, persistor consensus.StatePersistor) *replyCache {
+	rc := &replyCache{
+		size:            size,
+		persistInterval: persistInterval,
+		persistor:       persistor,
+		replies:         make(map[string]*list.Element),
+		order:           list.New(),
+		dirty:           make(map[string]bool),
+	}
+	if persistInterval > 0 {
+		rc.restore()
+	}
+	return rc
+}
+
+// replyDigest identifies a request by its payload, which a retransmission repeats
+func replyDigest(req *Request) string {
+	return base64.StdEncoding.EncodeToString(util.ComputeCryptoHash(req.Payload))
+}
+
+func (rc *replyCache) get(req *Request) ([]byte, bool) {
+	if el, ok := rc.replies[replyDigest(req)]; ok {
+		return el.Value.(*cachedReply).reply, true
+	}
+	return nil, false
+}
+
+func (rc *replyCache) add(req *Request, reply []byte) {
+	digest := replyDigest(req)
+	if _, ok := rc.replies[digest]; ok {
+		return
+	}
+	rc.insert(&cachedReply{digest: digest, reply: reply})
+	rc.dirty[digest] = true
+	for rc.order.Len() > rc.size {
+		oldest := rc.order.Remove(rc.order.Front()).(*cachedReply)
+		delete(rc.replies, oldest.digest)
+		rc.dirty[oldest.digest] = false
+	}
+}
+
+func (rc *replyCache) insert(cr *cachedReply) {
+	rc.replies[cr.digest] = rc.order.PushBack(cr)
+}
+
+// executed is called once per executed batch, and flushes the changes to the
+// cache when the persistence interval elapses
+func (rc *replyCache) executed() {
+	if rc.persistInterval <= 0 {
+		return
+	}
+	rc.sinceFlush++
+	if rc.sinceFlush < rc.persistInterval {
+		return
+	}
+	rc.sinceFlush = 0
+	for digest, stored := range rc.dirty {
+		key := replyKeyPrefix + digest
+		if !stored {
+			rc.persistor.DelState(key)
+		} else if err := rc.persistor.StoreState(key, rc.replies[digest].Value.(*cachedReply).reply); err != nil {
+			logger.Warningf("Could not persist reply for request %s: %s", digest, err)
+		}
+	}
+	rc.dirty = make(map[string]bool)
+}
+
+type sortableCachedReplies []*cachedReply
+
+func (a sortableCachedReplies) Len() int      { return len(a) }
+func (a sortableCachedReplies) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a sortableCachedReplies) Less(i, j int) bool {
+	mi, mj := &Reply{}, &Reply{}
+	proto.Unmarshal(a[i].reply, mi)
+	proto.Unmarshal(a[j].reply, mj)
+	return mi.SeqNo < mj.SeqNo
+}
+
+// restore reloads persisted replies, oldest execution first
+func (rc *replyCache) restore() {
+	stored, err := rc.persistor.ReadStateSet(replyKeyPrefix)
+	if err != nil {
+		logger.Debugf("No persisted replies to restore: %s", err)
+		return
+	}
+	var restored sortableCachedReplies
+	for key, reply := range stored {
+		restored = append(restored, &cachedReply{digest: key[len(replyKeyPrefix):], reply: reply})
+	}
+	sort.Sort(restored)
+	if len(restored) > rc.size {
+		for _, cr := range restored[:len(restored)-rc.size] {
+			rc.dirty[cr.digest] = false
+		}
+		restored = restored[len(restored)-rc.size:]
+	}
+	for _, cr := range restored {
+		rc.insert(cr)
+	}
+	logger.Infof("Restored %d cached replies", len(restored))
+}
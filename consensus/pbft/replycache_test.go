@@ -0,0 +1,46 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestReplyCacheEviction(t *testing.T) {
+	persist := &mockPersist{}
+	rc := newReplyCache(2, 2, persist)
+
+	for i := int64(1); i <= 3; i++ {
+		meta, _ := proto.Marshal(&Metadata{SeqNo: uint64(i)})
+		rc.add(createPbftReq(i, 0), meta)
+		rc.executed()
+	}
+	if _, ok := rc.get(createPbftReq(1, 0)); ok {
+		t.Errorf("Oldest reply should have been evicted")
+	}
+
+	// Only the first two batches were flushed, so the evicted reply is still stored
+	restored := newReplyCache(2, 2, persist)
+	if _, ok := restored.get(createPbftReq(3, 0)); ok {
+		t.Errorf("Reply added after the last flush should not have been persisted")
+	}
+	if _, ok := restored.get(createPbftReq(2, 0)); !ok {
+		t.Errorf("Expected flushed reply to be restored")
+	}
+}
@@ -26,15 +26,29 @@ type requestContainer struct {
 type orderedRequests struct {
 	order    list.List
 	presence map[string]*list.Element
+	bytes    int                   // total payload size of the requests held
+	key      func(*Request) string // identifies the requests held, hash when nil
 }
 
 func (a *orderedRequests) Len() int {
 	return a.order.Len()
 }
 
+// Bytes returns the total payload size of the requests held
+func (a *orderedRequests) Bytes() int {
+	return a.bytes
+}
+
+func (a *orderedRequests) keyOf(req *Request) string {
+	if a.key != nil {
+		return a.key(req)
+	}
+	return hash(req)
+}
+
 func (a *orderedRequests) wrapRequest(req *Request) requestContainer {
 	return requestContainer{
-		key: hash(req),
+		key: a.keyOf(req),
 		req: req,
 	}
 }
@@ -49,6 +63,7 @@ func (a *orderedRequests) add(request *Request) {
 	if !a.has(rc.key) {
 		e := a.order.PushBack(rc)
 		a.presence[rc.key] = e
+		a.bytes += len(request.Payload)
 	}
 }
 
@@ -66,6 +81,7 @@ func (a *orderedRequests) remove(request *Request) bool {
 	}
 	a.order.Remove(e)
 	delete(a.presence, rc.key)
+	a.bytes -= len(e.Value.(requestContainer).req.Payload)
 	return true
 }
 
@@ -83,11 +99,13 @@ func (a *orderedRequests) removes(requests []*Request) bool {
 func (a *orderedRequests) empty() {
 	a.order.Init()
 	a.presence = make(map[string]*list.Element)
+	a.bytes = 0
 }
 
 type requestStore struct {
 	outstandingRequests *orderedRequests
 	pendingRequests     *orderedRequests
+	priority            *requestPriority // nil serves the outstanding requests in arrival order
 }
 
 // newRequestStore creates a new requestStore.
@@ -103,6 +121,19 @@ func newRequestStore() *requestStore {
 	return rs
 }
 
+// keyBy identifies the requests held by key rather than by their digest, a
+// request matching one held under the same key is taken to be the same
+func (rs *requestStore) keyBy(key func(*Request) string) {
+	rs.outstandingRequests.key = key
+	rs.pendingRequests.key = key
+}
+
+// has returns whether the request is outstanding or pending
+func (rs *requestStore) has(request *Request) bool {
+	key := rs.outstandingRequests.keyOf(request)
+	return rs.outstandingRequests.has(key) || rs.pendingRequests.has(key)
+}
+
 // storeOutstanding adds a request to the outstanding request list
 func (rs *requestStore) storeOutstanding(request *Request) {
 	rs.outstandingRequests.add(request)
@@ -132,6 +163,9 @@ func (rs *requestStore) hasNonPending() bool {
 
 // getNextNonPending returns up to the next n outstanding, but not pending requests
 func (rs *requestStore) getNextNonPending(n int) (result []*Request) {
+	if rs.priority != nil {
+		return rs.getNextPrioritized(n)
+	}
 	for oreqc := rs.outstandingRequests.order.Front(); oreqc != nil; oreqc = oreqc.Next() {
 		oreq := oreqc.Value.(requestContainer)
 		if rs.pendingRequests.has(oreq.key) {
@@ -145,3 +179,44 @@ func (rs *requestStore) getNextNonPending(n int) (result []*Request) {
 
 	return result
 }
+
+// getNextPrioritized returns up to the next n outstanding, but not pending
+// requests, scheduled between the priority queues
+func (rs *requestStore) getNextPrioritized(n int) (result []*Request) {
+	queues := make([][]*Request, rs.priority.queues)
+	for oreqc := rs.outstandingRequests.order.Front(); oreqc != nil; oreqc = oreqc.Next() {
+		oreq := oreqc.Value.(requestContainer)
+		if rs.pendingRequests.has(oreq.key) {
+			continue
+		}
+		l := rs.priority.level(oreq.req)
+		queues[l] = append(queues[l], oreq.req)
+	}
+
+	for len(result) < n {
+		served := false
+		for l, queue := range queues {
+			take := len(queue)
+			if rs.priority.weights != nil && rs.priority.weights[l] < take {
+				take = rs.priority.weights[l]
+			}
+			if take > n-len(result) {
+				take = n - len(result)
+			}
+			if take == 0 {
+				continue
+			}
+			result = append(result, queue[:take]...)
+			queues[l] = queue[take:]
+			served = true
+			if rs.priority.weights == nil || len(result) == n {
+				break
+			}
+		}
+		if !served {
+			break
+		}
+	}
+
+	return result
+}
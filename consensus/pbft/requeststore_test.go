@@ -54,6 +54,40 @@ func TestOrderedRequests(t *testing.T) {
 	}
 }
 
+func TestPrioritizedRequests(t *testing.T) {
+	rs := newRequestStore()
+	tags := make(map[string]string)
+	rs.priority = &requestPriority{levels: map[string]int{"high": 0}, queues: 2, weights: []int{2, 1},
+		tag: func(payload []byte) string { return tags[string(payload)] }}
+	var high, low []*Request
+	for i := 0; i < 4; i++ {
+		low = append(low, createPbftReq(int64(i), 0))
+		rs.storeOutstanding(low[i])
+	}
+	for i := 0; i < 3; i++ {
+		req := createPbftReq(int64(10+i), 0)
+		tags[string(req.Payload)] = "high"
+		high = append(high, req)
+		rs.storeOutstanding(req)
+	}
+
+	expected := []*Request{high[0], high[1], low[0], high[2], low[1], low[2]}
+	for i, req := range rs.getNextNonPending(6) {
+		if req != expected[i] {
+			t.Errorf("Expected weighted scheduling to serve %v in position %d, got %v", expected[i], i, req)
+		}
+	}
+
+	rs.priority.weights = nil
+	rs.storePending(high[0])
+	expected = []*Request{high[1], high[2], low[0]}
+	for i, req := range rs.getNextNonPending(3) {
+		if req != expected[i] {
+			t.Errorf("Expected strict scheduling to serve %v in position %d, got %v", expected[i], i, req)
+		}
+	}
+}
+
 func BenchmarkOrderedRequests(b *testing.B) {
 	or := &orderedRequests{}
 	or.empty()
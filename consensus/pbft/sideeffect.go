@@ -0,0 +1,106 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+	"strconv"
+
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/viper"
+)
+
+// sideEffectFenceKey persists the sequence number of the last batch handed to
+// the side effect
+const sideEffectFenceKey = "sideEffectFence"
+
+// SideEffect performs the external side effects of a committed batch, such as
+// notifying another system.  The commit-order fence hands it every batch we
+// execute once the batch is committed, in sequence number order, and records
+// the sequence number it handed over, so that a batch executed again after a
+// restart is not handed over twice.  The sequence number doubles as an
+// idempotency token: a side effect which records it along with its effects,
+// skipping the batches up to the one it last recorded, is exactly-once even
+// should we crash between handing a batch over and recording the fence.
+// Batches we skip through state transfer are never handed over.
+type SideEffect interface {
+	Apply(seqNo uint64, txs []*pb.Transaction)
+}
+
+var sideEffects = map[string]SideEffect{}
+
+// RegisterSideEffect makes a side effect selectable through
+// general.sideeffect, it must be called before the plugin is created
+func RegisterSideEffect(name string, effect SideEffect) {
+	sideEffects[name] = effect
+}
+
+// newSideEffect returns the side effect selected by general.sideeffect, or
+// nil if batches have none
+func newSideEffect(config *viper.Viper) SideEffect {
+	name := config.GetString("general.sideeffect")
+	if name == "" {
+		return nil
+	}
+	effect, ok := sideEffects[name]
+	if !ok {
+		panic(fmt.Errorf("Unknown side effect: %s", name))
+	}
+	return effect
+}
+
+// restoreSideEffectFence resumes the fence where we last moved it
+func (op *obcBatch) restoreSideEffectFence() {
+	raw, err := op.stack.ReadState(sideEffectFenceKey)
+	if err != nil {
+		return
+	}
+	fence, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil {
+		logger.Warningf("Replica %d could not restore its side effect fence: %s", op.pbft.id, err)
+		return
+	}
+	op.effectFence = fence
+}
+
+// holdSideEffect keeps the transactions of the batch executing at seqNo
+// until it is committed
+func (op *obcBatch) holdSideEffect(seqNo uint64, txs []*pb.Transaction) {
+	if op.sideEffect == nil {
+		return
+	}
+	op.effectHeld, op.effectSeqNo, op.effectTxs = true, seqNo, txs
+}
+
+// releaseSideEffect hands the committed batch to the side effect, unless it
+// was handed over before, and moves the fence past it
+func (op *obcBatch) releaseSideEffect() {
+	if !op.effectHeld {
+		return
+	}
+	seqNo, txs := op.effectSeqNo, op.effectTxs
+	op.effectHeld, op.effectTxs = false, nil
+	if seqNo <= op.effectFence {
+		logger.Infof("Replica %d not repeating the side effects of seqNo=%d, its fence is at seqNo=%d", op.pbft.id, seqNo, op.effectFence)
+		return
+	}
+	op.sideEffect.Apply(seqNo, txs)
+	op.effectFence = seqNo
+	if err := op.stack.StoreState(sideEffectFenceKey, []byte(strconv.FormatUint(seqNo, 10))); err != nil {
+		logger.Errorf("Replica %d could not persist its side effect fence at seqNo=%d: %s", op.pbft.id, seqNo, err)
+	}
+}
@@ -16,7 +16,12 @@ limitations under the License.
 
 package pbft
 
-import pb "github.com/golang/protobuf/proto"
+import (
+	"bytes"
+	"fmt"
+
+	pb "github.com/golang/protobuf/proto"
+)
 
 type signable interface {
 	getSignature() []byte
@@ -42,6 +47,10 @@ func (instance *pbftCore) sign(s signable) error {
 }
 
 func (instance *pbftCore) verify(s signable) error {
+	return verifySignable(s, instance.consumer.verify)
+}
+
+func verifySignable(s signable, verify func(senderID uint64, signature []byte, message []byte) error) error {
 	origSig := s.getSignature()
 	s.setSignature(nil)
 	raw, err := s.serialize()
@@ -49,7 +58,7 @@ func (instance *pbftCore) verify(s signable) error {
 	if err != nil {
 		return err
 	}
-	return instance.consumer.verify(s.getID(), origSig, raw)
+	return verify(s.getID(), origSig, raw)
 }
 
 func (vc *ViewChange) getSignature() []byte {
@@ -71,3 +80,57 @@ func (vc *ViewChange) setID(id uint64) {
 func (vc *ViewChange) serialize() ([]byte, error) {
 	return pb.Marshal(vc)
 }
+
+func (r *Reply) getSignature() []byte {
+	return r.Signature
+}
+
+func (r *Reply) setSignature(sig []byte) {
+	r.Signature = sig
+}
+
+func (r *Reply) getID() uint64 {
+	return r.ReplicaId
+}
+
+func (r *Reply) setID(id uint64) {
+	r.ReplicaId = id
+}
+
+func (r *Reply) serialize() ([]byte, error) {
+	return pb.Marshal(r)
+}
+
+// VerifySignedReplies checks the proof a light client holds of a request's
+// result: f+1 signed replies of distinct replicas for the request digest,
+// agreeing on its sequence number, view and result.  verify checks the
+// signature of a replica over a message.  It returns one of the agreeing replies.
+func VerifySignedReplies(replies []*Reply, digest string, f int, verify func(replicaID uint64, signature []byte, message []byte) error) (*Reply, error) {
+	vouched := make(map[uint64]bool)
+	for _, candidate := range replies {
+		if candidate.RequestDigest != digest || vouched[candidate.ReplicaId] {
+			continue
+		}
+		var agreed *Reply
+		matching := make(map[uint64]bool)
+		for _, r := range replies {
+			if r.RequestDigest != digest || r.SeqNo != candidate.SeqNo || r.View != candidate.View ||
+				r.Executed != candidate.Executed || !bytes.Equal(r.Result, candidate.Result) || matching[r.ReplicaId] {
+				continue
+			}
+			if err := verifySignable(r, verify); err != nil {
+				logger.Warningf("Ignoring reply of replica %d for request %s with incorrect signature: %s", r.ReplicaId, digest, err)
+				continue
+			}
+			matching[r.ReplicaId] = true
+			vouched[r.ReplicaId] = true
+			if agreed == nil {
+				agreed = r
+			}
+		}
+		if len(matching) >= f+1 {
+			return agreed, nil
+		}
+	}
+	return nil, fmt.Errorf("Fewer than %d matching signed replies for request %s", f+1, digest)
+}
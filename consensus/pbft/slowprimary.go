@@ -0,0 +1,84 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"time"
+
+	"github.com/hyperledger/fabric/consensus/util/events"
+)
+
+// noteArrival remembers when we took in an outstanding request, to measure
+// how long the primary takes to pre-prepare it
+func (op *obcBatch) noteArrival(req *Request) {
+	if op.slowPrimaryFactor <= 0 {
+		return
+	}
+	key := op.reqStore.outstandingRequests.keyOf(req)
+	if _, ok := op.arrivals[key]; !ok {
+		op.arrivals[key] = op.pbft.now()
+	}
+}
+
+// checkOrderingDelay measures how long the primary took to pre-prepare the
+// requests of an accepted pre-prepare which we held, beyond the batch timeout
+// it may wait for a batch to fill.  A delay above slowPrimaryFactor times the
+// commit latency of the cluster counts the pre-prepare as slow, and once
+// slowPrimaryBatches pre-prepares in a row were slow we send a view change
+// although the primary is not faulty.
+func (op *obcBatch) checkOrderingDelay(preprep *PrePrepare) events.Event {
+	if op.slowPrimaryFactor <= 0 || preprep.BatchDigest == "" {
+		return nil
+	}
+	cert, ok := op.pbft.certStore[msgID{v: preprep.View, n: preprep.SequenceNumber}]
+	if !ok || cert.prePrepare != preprep {
+		// pbft-core rejected this pre-prepare
+		return nil
+	}
+
+	var first time.Time
+	for _, req := range preprep.RequestBatch.GetBatch() {
+		key := op.reqStore.outstandingRequests.keyOf(req)
+		if at, ok := op.arrivals[key]; ok {
+			if first.IsZero() || at.Before(first) {
+				first = at
+			}
+			delete(op.arrivals, key)
+		}
+	}
+	if first.IsZero() || op.pbft.commitLatency == 0 {
+		// Nothing to compare the primary against
+		return nil
+	}
+
+	delay := cert.prePreparedAt.Sub(first) - op.batchTimeout
+	allowed := time.Duration(op.slowPrimaryFactor * float64(op.pbft.commitLatency))
+	if delay <= allowed {
+		op.slowPrimaryCount = 0
+		return nil
+	}
+	op.slowPrimaryCount++
+	logger.Warningf("Replica %d found primary %d took %v beyond the batch timeout to pre-prepare seqNo=%d, %v allowed, slow for %d batches in a row",
+		op.pbft.id, preprep.ReplicaId, delay, preprep.SequenceNumber, allowed, op.slowPrimaryCount)
+	if op.slowPrimaryCount < op.slowPrimaryBatches {
+		return nil
+	}
+
+	logger.Warningf("Replica %d sending performance view change, primary %d is slow but not faulty", op.pbft.id, preprep.ReplicaId)
+	op.slowPrimaryCount = 0
+	return op.pbft.sendViewChange(ViewChange_SLOW_PRIMARY)
+}
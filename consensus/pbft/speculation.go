@@ -0,0 +1,115 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/viper"
+)
+
+// Speculator pre-executes request batches as they are pre-prepared, ahead of
+// their commit, on a speculative state of its own, such as to precompute their
+// results.  Each batch is speculated atop the batches speculated before it,
+// in the order their pre-prepares reached us, which need not be the order
+// they commit in.  The authoritative state only ever changes through the
+// execution of committed batches in sequence number order; committing pins
+// the speculations to that order, confirming a speculation which matches the
+// committed batch atop the committed prefix, and discarding the speculative
+// state from the first one which does not.  It is called on the event thread.
+type Speculator interface {
+	Speculate(seqNo uint64, txs []*pb.Transaction)
+	Confirm(seqNo uint64)
+	Discard(seqNo uint64)
+}
+
+var speculators = map[string]Speculator{}
+
+// RegisterSpeculator makes a speculator selectable through
+// general.speculator, it must be called before the plugin is created
+func RegisterSpeculator(name string, speculator Speculator) {
+	speculators[name] = speculator
+}
+
+// newSpeculator returns the speculator selected by general.speculator, or
+// nil if batches are not executed speculatively
+func newSpeculator(config *viper.Viper) Speculator {
+	name := config.GetString("general.speculator")
+	if name == "" {
+		return nil
+	}
+	speculator, ok := speculators[name]
+	if !ok {
+		panic(fmt.Errorf("Unknown speculator: %s", name))
+	}
+	return speculator
+}
+
+// speculation is a batch handed to the speculator, identified by the
+// sequence number and digest it was pre-prepared with
+type speculation struct {
+	seqNo  uint64
+	digest string
+}
+
+// speculate hands the batch of a pre-prepare pbft-core accepted to the
+// speculator
+func (op *obcBatch) speculate(preprep *PrePrepare) {
+	if op.speculator == nil || preprep.BatchDigest == "" {
+		return
+	}
+	cert, ok := op.pbft.certStore[msgID{v: preprep.View, n: preprep.SequenceNumber}]
+	if !ok || cert.prePrepare != preprep {
+		// pbft-core rejected this pre-prepare
+		return
+	}
+	spec := speculation{preprep.SequenceNumber, preprep.BatchDigest}
+	for _, speculated := range op.speculations {
+		if speculated == spec {
+			// A new view pre-prepared the batch again
+			return
+		}
+	}
+	var txs []*pb.Transaction
+	for _, req := range preprep.RequestBatch.GetBatch() {
+		if tx, err := op.codec.Decode(req.Payload); err == nil {
+			txs = append(txs, tx)
+		}
+	}
+	op.speculations = append(op.speculations, spec)
+	op.speculator.Speculate(preprep.SequenceNumber, txs)
+}
+
+// pinSpeculation confirms the speculation of the batch we execute at seqNo
+// when it is next in the committed order, and otherwise discards the
+// speculative state, which diverged from the committed order
+func (op *obcBatch) pinSpeculation(seqNo uint64, reqBatch *RequestBatch) {
+	if op.speculator == nil || len(op.speculations) == 0 {
+		return
+	}
+	committed := speculation{seqNo, op.pbft.batchDigest(reqBatch)}
+	if op.speculations[0] == committed {
+		op.speculations = op.speculations[1:]
+		op.speculator.Confirm(seqNo)
+		return
+	}
+	logger.Warningf("Replica %d discarding its speculative state from seqNo=%d, where it speculated batch %s of seqNo=%d but committed %s",
+		op.pbft.id, seqNo, op.speculations[0].digest, op.speculations[0].seqNo, committed.digest)
+	op.speculations = nil
+	op.speculator.Discard(seqNo)
+}
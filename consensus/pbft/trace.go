@@ -0,0 +1,61 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+// Stages of consensus at which traced requests are reported
+const (
+	traceSubmitted   = "submitted"
+	tracePrePrepared = "pre-prepared"
+	tracePrepared    = "prepared"
+	traceCommitted   = "committed"
+	traceExecuting   = "executing"
+)
+
+// traceEvent reports that a traced request reached a stage of consensus on a replica
+type traceEvent struct {
+	traceID string
+	replica uint64
+	stage   string
+	view    uint64
+	seqNo   uint64
+}
+
+// logTrace is the default trace sink, which emits one structured log line per event
+func logTrace(ev traceEvent) {
+	logger.Infof("trace=%s replica=%d stage=%s view=%d seqNo=%d", ev.traceID, ev.replica, ev.stage, ev.view, ev.seqNo)
+}
+
+// traceRequest reports the stage a request reached, if it carries a trace id
+func (instance *pbftCore) traceRequest(req *Request, stage string, v uint64, n uint64) {
+	if req == nil || req.TraceId == "" {
+		return
+	}
+	instance.traceSink(traceEvent{
+		traceID: req.TraceId,
+		replica: instance.id,
+		stage:   stage,
+		view:    v,
+		seqNo:   n,
+	})
+}
+
+// traceBatch reports the stage every traced request of a batch reached
+func (instance *pbftCore) traceBatch(reqBatch *RequestBatch, stage string, v uint64, n uint64) {
+	for _, req := range reqBatch.GetBatch() {
+		instance.traceRequest(req, stage, v, n)
+	}
+}
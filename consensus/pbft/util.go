@@ -21,6 +21,9 @@ package pbft
 
 import (
 	"encoding/base64"
+	"google/protobuf"
+	"sort"
+	"strings"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/util"
@@ -30,9 +33,9 @@ func hash(msg interface{}) string {
 	var raw []byte
 	switch converted := msg.(type) {
 	case *Request:
-		raw, _ = proto.Marshal(converted)
+		raw, _ = proto.Marshal(canonicalRequest(converted))
 	case *RequestBatch:
-		raw, _ = proto.Marshal(converted)
+		raw, _ = proto.Marshal(canonicalRequestBatch(converted))
 	default:
 		logger.Error("Asked to hash non-supported message type, ignoring")
 		return ""
@@ -40,3 +43,81 @@ func hash(msg interface{}) string {
 	return base64.StdEncoding.EncodeToString(util.ComputeCryptoHash(raw))
 
 }
+
+// canonicalRequest returns a copy of req in which fields that are present but
+// empty, which marshal differently from absent ones, are left unset, so that
+// every replica hashes equivalent requests to the same digest
+func canonicalRequest(req *Request) *Request {
+	canonical := &Request{ReplicaId: req.ReplicaId, Tag: req.Tag, Reconfiguration: req.Reconfiguration}
+	if ts := req.Timestamp; ts != nil && (ts.Seconds != 0 || ts.Nanos != 0) {
+		canonical.Timestamp = &google_protobuf.Timestamp{Seconds: ts.Seconds, Nanos: ts.Nanos}
+	}
+	if len(req.Payload) > 0 {
+		canonical.Payload = req.Payload
+	}
+	if len(req.Signature) > 0 {
+		canonical.Signature = req.Signature
+	}
+	return canonical
+}
+
+// clientDigest is the canonical digest of a request as its client submitted
+// it, leaving out the replica which stamped it and when, so every copy of a
+// client transaction submitted to several replicas shares it
+func clientDigest(req *Request) string {
+	return hash(&Request{Payload: req.Payload, Signature: req.Signature})
+}
+
+// canonicalRequestBatch canonicalizes every request of a batch; nil
+// requests cannot be marshaled, so cannot have been received, and are dropped
+func canonicalRequestBatch(reqBatch *RequestBatch) *RequestBatch {
+	canonical := &RequestBatch{}
+	if reqBatch != nil && len(reqBatch.Metadata) > 0 {
+		canonical.Metadata = reqBatch.Metadata
+	}
+	for _, req := range reqBatch.GetBatch() {
+		if req != nil {
+			canonical.Batch = append(canonical.Batch, canonicalRequest(req))
+		}
+	}
+	return canonical
+}
+
+type shuffledRequest struct {
+	key string
+	req *Request
+}
+
+type sortableShuffledRequests []shuffledRequest
+
+func (a sortableShuffledRequests) Len() int           { return len(a) }
+func (a sortableShuffledRequests) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a sortableShuffledRequests) Less(i, j int) bool { return a[i].key < a[j].key }
+
+// shuffleRequests deterministically reorders the requests of a batch by the
+// hash of each request's digest combined with a digest of the batch contents,
+// so the primary can not choose the order they execute in.  The batch digest
+// is taken over the sorted request digests, as reordering the batch must not
+// re-roll the shuffle
+func shuffleRequests(reqs []*Request) []*Request {
+	digests := make([]string, len(reqs))
+	for i, req := range reqs {
+		digests[i] = hash(req)
+	}
+	sorted := append([]string(nil), digests...)
+	sort.Strings(sorted)
+	seed := util.ComputeCryptoHash([]byte(strings.Join(sorted, ",")))
+
+	shuffled := make(sortableShuffledRequests, len(reqs))
+	for i, req := range reqs {
+		key := util.ComputeCryptoHash(append(append([]byte(nil), seed...), digests[i]...))
+		shuffled[i] = shuffledRequest{key: string(key), req: req}
+	}
+	sort.Stable(shuffled)
+
+	result := make([]*Request, len(reqs))
+	for i, sr := range shuffled {
+		result[i] = sr.req
+	}
+	return result
+}
@@ -0,0 +1,107 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"sync"
+
+	pb "github.com/hyperledger/fabric/protos"
+)
+
+type verifyJob struct {
+	msg  *batchMessage
+	done chan error
+}
+
+// verifier checks the signatures of received messages on a bounded pool of
+// workers, and forwards the messages which verify in the order they arrived,
+// reporting those which do not
+type verifier struct {
+	verify  func(ocMsg *pb.Message) error
+	forward func(msg *batchMessage)
+	failed  func(msg *batchMessage, err error)
+
+	lock    sync.Mutex      // serializes submissions, so jobs and ordered agree
+	closed  bool            // whether stop has been called
+	jobs    chan *verifyJob // consumed by the workers
+	ordered chan *verifyJob // consumed by the forwarder, in arrival order
+
+	stopped sync.WaitGroup
+}
+
+func newVerifier(workers int, verify func(ocMsg *pb.Message) error, forward func(msg *batchMessage), failed func(msg *batchMessage, err error)) *verifier {
+	v := &verifier{
+		verify:  verify,
+		forward: forward,
+		failed:  failed,
+		jobs:    make(chan *verifyJob, workers),
+		ordered: make(chan *verifyJob, workers),
+	}
+	for i := 0; i < workers; i++ {
+		go v.work()
+	}
+	v.stopped.Add(1)
+	go v.forwardInOrder()
+	return v
+}
+
+func (v *verifier) work() {
+	for job := range v.jobs {
+		job.done <- v.verify(job.msg.msg)
+	}
+}
+
+func (v *verifier) forwardInOrder() {
+	defer v.stopped.Done()
+	for job := range v.ordered {
+		if err := <-job.done; err != nil {
+			logger.Warningf("Dropping message from %v which failed verification: %s", job.msg.sender, err)
+			if v.failed != nil {
+				v.failed(job.msg, err)
+			}
+			continue
+		}
+		v.forward(job.msg)
+	}
+}
+
+// submit queues a message for verification, blocking while the pool is full
+func (v *verifier) submit(ocMsg *pb.Message, senderHandle *pb.PeerID) {
+	job := &verifyJob{
+		msg:  &batchMessage{msg: ocMsg, sender: senderHandle},
+		done: make(chan error, 1),
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.closed {
+		return
+	}
+	v.ordered <- job
+	v.jobs <- job
+}
+
+// stop waits for the messages already submitted to be forwarded
+func (v *verifier) stop() {
+	v.lock.Lock()
+	if !v.closed {
+		v.closed = true
+		close(v.jobs)
+		close(v.ordered)
+	}
+	v.lock.Unlock()
+	v.stopped.Wait()
+}
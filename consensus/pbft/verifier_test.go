@@ -0,0 +1,125 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/hyperledger/fabric/protos"
+)
+
+func TestVerifierOrder(t *testing.T) {
+	var forwarded, failed []byte
+	v := newVerifier(4, func(ocMsg *pb.Message) error {
+		// Later messages verify faster, so workers complete out of order
+		time.Sleep(time.Duration(10-ocMsg.Payload[0]) * time.Millisecond)
+		if ocMsg.Payload[0] == 3 {
+			return fmt.Errorf("bad signature")
+		}
+		return nil
+	}, func(msg *batchMessage) {
+		forwarded = append(forwarded, msg.msg.Payload[0])
+	}, func(msg *batchMessage, err error) {
+		failed = append(failed, msg.msg.Payload[0])
+	})
+
+	for i := byte(0); i < 10; i++ {
+		v.submit(&pb.Message{Payload: []byte{i}}, nil)
+	}
+	v.stop()
+
+	expected := []byte{0, 1, 2, 4, 5, 6, 7, 8, 9}
+	if string(forwarded) != string(expected) {
+		t.Errorf("Expected messages %v to be forwarded in order, got %v", expected, forwarded)
+	}
+	if string(failed) != string([]byte{3}) {
+		t.Errorf("Expected message 3 to be reported as failing verification, got %v", failed)
+	}
+
+	v.submit(&pb.Message{Payload: []byte{10}}, nil)
+	if len(forwarded) != len(expected) {
+		t.Errorf("Message submitted after stop was forwarded")
+	}
+}
+
+// benchmarkVerifyWorkers measures view-changes from their receipt by obcBatch
+// until the event thread processed them, with ECDSA signature verification
+func benchmarkVerifyWorkers(b *testing.B, workers int) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	config := loadConfig()
+	config.Set("general.verifyworkers", workers)
+	op := newObcBatch(1, config, &omniProto{
+		UnicastImpl: func(ocMsg *pb.Message, peer *pb.PeerID) error { return nil },
+		SignImpl: func(msg []byte) ([]byte, error) {
+			digest := sha256.Sum256(msg)
+			r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+			if err != nil {
+				return nil, err
+			}
+			return append(r.Bytes(), s.Bytes()...), nil
+		},
+		VerifyImpl: func(peerID *pb.PeerID, signature []byte, message []byte) error {
+			digest := sha256.Sum256(message)
+			if len(signature) != 64 || !ecdsa.Verify(&key.PublicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+				return fmt.Errorf("bad signature")
+			}
+			return nil
+		},
+	})
+	defer op.Close()
+
+	var msgs []*pb.Message
+	for i := 0; i < b.N; i++ {
+		vc := &ViewChange{View: uint64(i + 1), ReplicaId: 2}
+		for {
+			// r and s must both take 32 bytes for the simple encoding above
+			if err := op.pbft.sign(vc); err == nil && len(vc.Signature) == 64 {
+				break
+			}
+		}
+		pbftMsg, _ := proto.Marshal(&Message{Payload: &Message_ViewChange{ViewChange: vc}})
+		batchMsg, _ := proto.Marshal(&BatchMessage{Payload: &BatchMessage_PbftMessage{PbftMessage: pbftMsg}})
+		msgs = append(msgs, &pb.Message{Type: pb.Message_CONSENSUS, Payload: batchMsg})
+	}
+
+	b.ResetTimer()
+	for _, msg := range msgs {
+		op.RecvMsg(msg, &pb.PeerID{Name: "vp2"})
+	}
+	if op.verifier != nil {
+		op.verifier.stop() // waits for verified messages to be queued
+	}
+	op.manager.Queue() <- nil
+	b.StopTimer()
+}
+
+func BenchmarkVerifySerial(b *testing.B) {
+	benchmarkVerifyWorkers(b, 0)
+}
+
+func BenchmarkVerifyWorkers(b *testing.B) {
+	benchmarkVerifyWorkers(b, runtime.NumCPU())
+}
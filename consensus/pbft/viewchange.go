@@ -20,6 +20,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"reflect"
+	"sort"
+	"time"
 
 	"github.com/hyperledger/fabric/consensus/util/events"
 )
@@ -27,8 +29,49 @@ import (
 // viewChangeQuorumEvent is returned to the event loop when a new ViewChange message is received which is part of a quorum cert
 type viewChangeQuorumEvent struct{}
 
+// compactViewChange rewrites the P and Q sets of a view-change relative to
+// its stable checkpoint and view, dropping the entries at or below the
+// checkpoint, so the sequence numbers and views encode as small varints
+func compactViewChange(vc *ViewChange) {
+	compact := func(set []*ViewChange_PQ) (compacted []*ViewChange_PQ) {
+		for _, pq := range set {
+			if pq.SequenceNumber <= vc.H {
+				continue
+			}
+			compacted = append(compacted, &ViewChange_PQ{
+				SequenceNumber: pq.SequenceNumber - vc.H,
+				BatchDigest:    pq.BatchDigest,
+				View:           vc.View - pq.View,
+			})
+		}
+		return
+	}
+	vc.Pset, vc.Qset = compact(vc.Pset), compact(vc.Qset)
+	vc.Compact = true
+}
+
+// expandedSets returns the P and Q sets of a view-change with absolute
+// sequence numbers and views, however they were encoded
+func (vc *ViewChange) expandedSets() (pset, qset []*ViewChange_PQ) {
+	if !vc.Compact {
+		return vc.Pset, vc.Qset
+	}
+	expand := func(set []*ViewChange_PQ) (expanded []*ViewChange_PQ) {
+		for _, pq := range set {
+			expanded = append(expanded, &ViewChange_PQ{
+				SequenceNumber: vc.H + pq.SequenceNumber,
+				BatchDigest:    pq.BatchDigest,
+				View:           vc.View - pq.View,
+			})
+		}
+		return
+	}
+	return expand(vc.Pset), expand(vc.Qset)
+}
+
 func (instance *pbftCore) correctViewChange(vc *ViewChange) bool {
-	for _, p := range append(vc.Pset, vc.Qset...) {
+	pset, qset := vc.expandedSets()
+	for _, p := range append(pset, qset...) {
 		if !(p.View < vc.View && p.SequenceNumber > vc.H && p.SequenceNumber <= vc.H+instance.L) {
 			logger.Debugf("Replica %d invalid p entry in view-change: vc(v:%d h:%d) p(v:%d n:%d)",
 				instance.id, vc.View, vc.H, p.View, p.SequenceNumber)
@@ -122,12 +165,82 @@ func (instance *pbftCore) calcQSet() map[qidx]*ViewChange_PQ {
 	return qset
 }
 
-func (instance *pbftCore) sendViewChange() events.Event {
+// sendViewChange moves to the next view for reason, unless we initiated a
+// view change less than viewChangeInterval ago, in which case the view change
+// timer defers it until the interval elapses
+func (instance *pbftCore) sendViewChange(reason ViewChange_Reason) events.Event {
+	if instance.activeView && instance.viewChangeInterval > 0 && !instance.lastViewChangeSent.IsZero() {
+		if wait := instance.lastViewChangeSent.Add(instance.viewChangeInterval).Sub(instance.now()); wait > 0 {
+			logger.Warningf("Replica %d deferring view change by %v, it initiated one less than %v ago", instance.id, wait, instance.viewChangeInterval)
+			instance.newViewTimerReason = "deferred view change"
+			instance.timerActive = true
+			instance.newViewTimer.Reset(wait, viewChangeTimerEvent{reason: reason})
+			return nil
+		}
+	}
+	return instance.startViewChange(reason)
+}
+
+// boundFutureViewChanges evicts the view-changes of the highest buffered
+// views while they span more than maxFutureViews views above our own.  The
+// f+1 rule joins the smallest of the views, so keeping the lowest preserves
+// it for the views the network can reach next, while a flood of high views
+// only displaces high views.  It reports whether vc is still buffered.
+func (instance *pbftCore) boundFutureViewChanges(vc *ViewChange) bool {
+	if instance.maxFutureViews <= 0 {
+		return true
+	}
+	for {
+		views := make(map[uint64]bool)
+		highest := uint64(0)
+		for idx := range instance.viewChangeStore {
+			if idx.v <= instance.view {
+				continue
+			}
+			views[idx.v] = true
+			if idx.v > highest {
+				highest = idx.v
+			}
+		}
+		if len(views) <= instance.maxFutureViews {
+			break
+		}
+		logger.Warningf("Replica %d buffers view-changes for %d future views, evicting those for view %d", instance.id, len(views), highest)
+		for idx := range instance.viewChangeStore {
+			if idx.v == highest {
+				delete(instance.viewChangeStore, idx)
+			}
+		}
+	}
+	_, ok := instance.viewChangeStore[vcidx{vc.View, vc.ReplicaId}]
+	return ok
+}
+
+// startViewChange moves to the next view and sends our view-change, which
+// records reason for the operators of every replica
+func (instance *pbftCore) startViewChange(reason ViewChange_Reason) events.Event {
 	instance.stopTimer()
 
+	if instance.N == 1 {
+		// With f=0 every pre-prepare commits as soon as it is issued, and there
+		// is no other replica which could take over as primary
+		logger.Debugf("Replica %d is the only replica, view change is a no-op", instance.id)
+		return nil
+	}
+
+	if !instance.replicaSetConfirmed {
+		logger.Warningf("Replica %d has not confirmed its replica set, not sending view-change", instance.id)
+		return nil
+	}
+
 	delete(instance.newViewStore, instance.view)
 	instance.view++
 	instance.activeView = false
+	instance.viewChanges++
+	instance.viewChangeReason = reason
+	instance.viewChangeReasons[reason]++
+	instance.persistViewNumber()
+	instance.publishView()
 
 	instance.pset = instance.calcPSet()
 	instance.qset = instance.calcQSet()
@@ -148,6 +261,10 @@ func (instance *pbftCore) sendViewChange() events.Event {
 		View:      instance.view,
 		H:         instance.h,
 		ReplicaId: instance.id,
+		Reason:    reason,
+	}
+	if instance.primaryBeacon {
+		vc.Beacon = instance.latestBeacon()
 	}
 
 	for n, id := range instance.chkpts {
@@ -171,24 +288,43 @@ func (instance *pbftCore) sendViewChange() events.Event {
 		vc.Qset = append(vc.Qset, q)
 	}
 
+	if instance.compactViewChange {
+		compactViewChange(vc)
+	}
+
 	instance.sign(vc)
 
-	logger.Infof("Replica %d sending view-change, v:%d, h:%d, |C|:%d, |P|:%d, |Q|:%d",
-		instance.id, vc.View, vc.H, len(vc.Cset), len(vc.Pset), len(vc.Qset))
+	logger.Infof("Replica %d sending view-change, v:%d, h:%d, |C|:%d, |P|:%d, |Q|:%d, reason %s",
+		instance.id, vc.View, vc.H, len(vc.Cset), len(vc.Pset), len(vc.Qset), vc.Reason)
 
 	instance.innerBroadcast(&Message{Payload: &Message_ViewChange{ViewChange: vc}})
 
 	instance.vcResendTimer.Reset(instance.vcResendTimeout, viewChangeResendTimerEvent{})
+	instance.lastViewChangeSent = instance.now()
 
 	return instance.recvViewChange(vc)
 }
 
 func (instance *pbftCore) recvViewChange(vc *ViewChange) events.Event {
-	logger.Infof("Replica %d received view-change from replica %d, v:%d, h:%d, |C|:%d, |P|:%d, |Q|:%d",
-		instance.id, vc.ReplicaId, vc.View, vc.H, len(vc.Cset), len(vc.Pset), len(vc.Qset))
+	logger.Infof("Replica %d received view-change from replica %d, v:%d, h:%d, |C|:%d, |P|:%d, |Q|:%d, reason %s",
+		instance.id, vc.ReplicaId, vc.View, vc.H, len(vc.Cset), len(vc.Pset), len(vc.Qset), vc.Reason)
 
-	if err := instance.verify(vc); err != nil {
-		logger.Warningf("Replica %d found incorrect signature in view-change message: %s", instance.id, err)
+	if instance.N == 1 {
+		logger.Debugf("Replica %d is the only replica, ignoring view-change", instance.id)
+		return nil
+	}
+
+	// When verification is offloaded, the consumer checked the signature before queueing the message
+	if !instance.verifyOffloaded {
+		if err := instance.verify(vc); err != nil {
+			logger.Warningf("Replica %d found incorrect signature in view-change message: %s", instance.id, err)
+			instance.reportFault(vc.ReplicaId, "bad view-change signature")
+			return nil
+		}
+	}
+
+	if vc.View <= instance.highActiveView {
+		logger.Warningf("Replica %d found view-change message for view %d, but has already been active in view %d", instance.id, vc.View, instance.highActiveView)
 		return nil
 	}
 
@@ -199,6 +335,7 @@ func (instance *pbftCore) recvViewChange(vc *ViewChange) events.Event {
 
 	if !instance.correctViewChange(vc) {
 		logger.Warningf("Replica %d found view-change message incorrect", instance.id)
+		instance.reportFault(vc.ReplicaId, "incorrect view-change")
 		return nil
 	}
 
@@ -208,6 +345,16 @@ func (instance *pbftCore) recvViewChange(vc *ViewChange) events.Event {
 	}
 
 	instance.viewChangeStore[vcidx{vc.View, vc.ReplicaId}] = vc
+	if !instance.boundFutureViewChanges(vc) {
+		return nil
+	}
+	if instance.primaryBeacon {
+		instance.learnBeacon(vc.View)
+	}
+
+	if instance.prewarm && instance.primary(vc.View) == instance.id && (vc.View > instance.view || !instance.activeView) {
+		instance.prewarmViewChange(vc)
+	}
 
 	// PBFT TOCS 4.5.1 Liveness: "if a replica receives a set of
 	// f+1 valid VIEW-CHANGE messages from other replicas for
@@ -231,9 +378,9 @@ func (instance *pbftCore) recvViewChange(vc *ViewChange) events.Event {
 	if len(replicas) >= instance.f+1 {
 		logger.Infof("Replica %d received f+1 view-change messages, triggering view-change to view %d",
 			instance.id, minView)
-		// subtract one, because sendViewChange() increments
+		// subtract one, because startViewChange() increments; joining is never deferred, lest we get stuck
 		instance.view = minView - 1
-		return instance.sendViewChange()
+		return instance.startViewChange(ViewChange_JOINED)
 	}
 
 	quorum := 0
@@ -247,7 +394,8 @@ func (instance *pbftCore) recvViewChange(vc *ViewChange) events.Event {
 	if !instance.activeView && vc.View == instance.view && quorum >= instance.allCorrectReplicasQuorum() {
 		if quorum >= instance.allCorrectReplicasQuorum() {
 			instance.vcResendTimer.Stop()
-			instance.startTimer(instance.lastNewViewTimeout, "new view change")
+			// Should the new primary not send a valid new-view in time, the timer moves us on to the next view
+			instance.startTimer(instance.lastNewViewTimeout, fmt.Sprintf("new-view for view %d", instance.view))
 			instance.lastNewViewTimeout = 2 * instance.lastNewViewTimeout
 			return viewChangeQuorumEvent{}
 		}
@@ -257,6 +405,149 @@ func (instance *pbftCore) recvViewChange(vc *ViewChange) events.Event {
 	return nil
 }
 
+// prewarmViewChange is invoked when we would be the primary of the view a
+// view-change votes for.  It fetches the request batches referenced by the
+// view-change which we do not have, so that the new-view does not wait on
+// another round trip.  Fetched batches are kept aside and only enter the
+// reqBatchStore once a new-view assigns them, so if the current primary
+// recovers, nothing about our state has changed.  At most prewarmConcurrency
+// fetches are outstanding at once, the others are queued.  We pre-warm at most
+// N*L request batches, as many as honest view-changes reference within the
+// watermarks, so a faulty replica cannot grow them without bound.
+func (instance *pbftCore) prewarmViewChange(vc *ViewChange) {
+	pset, qset := vc.expandedSets()
+	for _, pq := range append(pset, qset...) {
+		digest := pq.BatchDigest
+		if digest == "" {
+			continue
+		}
+		if _, ok := instance.reqBatchStore[digest]; ok {
+			continue
+		}
+		if _, ok := instance.prewarmReqBatches[digest]; ok {
+			continue
+		}
+		if uint64(len(instance.prewarmReqBatches)) >= uint64(instance.N)*instance.L {
+			logger.Warningf("Replica %d pre-warming view %d, already holds %d request batches, not fetching more", instance.id, vc.View, len(instance.prewarmReqBatches))
+			break
+		}
+		logger.Debugf("Replica %d pre-warming view %d, queueing fetch of request batch %s", instance.id, vc.View, digest)
+		instance.prewarmReqBatches[digest] = nil
+		instance.prewarmQueue = append(instance.prewarmQueue, digest)
+	}
+	instance.prewarmFetch()
+}
+
+// prewarmFetch sends queued pre-warm fetches while fetch slots are free
+func (instance *pbftCore) prewarmFetch() {
+	for len(instance.prewarmQueue) > 0 && (instance.prewarmConcurrency <= 0 || len(instance.prewarmInFlight) < instance.prewarmConcurrency) {
+		digest := instance.prewarmQueue[0]
+		instance.prewarmQueue = instance.prewarmQueue[1:]
+		if instance.prewarmReqBatches[digest] != nil {
+			continue
+		}
+		logger.Debugf("Replica %d fetching pre-warm request batch %s", instance.id, digest)
+		instance.prewarmInFlight[digest] = instance.now()
+		instance.innerBroadcast(&Message{Payload: &Message_FetchRequestBatch{FetchRequestBatch: &FetchRequestBatch{
+			BatchDigest: digest,
+			ReplicaId:   instance.id,
+		}}})
+	}
+	instance.resetPrewarmTimer()
+}
+
+// resetPrewarmTimer arms the pre-warm timer for the oldest outstanding fetch
+func (instance *pbftCore) resetPrewarmTimer() {
+	if instance.prewarmTimeout <= 0 {
+		return
+	}
+	var oldest time.Time
+	for _, sent := range instance.prewarmInFlight {
+		if oldest.IsZero() || sent.Before(oldest) {
+			oldest = sent
+		}
+	}
+	if oldest.IsZero() {
+		instance.prewarmTimer.Stop()
+		return
+	}
+	instance.prewarmTimer.Reset(oldest.Add(instance.prewarmTimeout).Sub(instance.now()), prewarmTimerEvent{})
+}
+
+// prewarmTimedOut gives up on the pre-warm fetches no replica answered in
+// time, freeing their slots, and retries a new-view waiting on them
+func (instance *pbftCore) prewarmTimedOut() events.Event {
+	for digest, sent := range instance.prewarmInFlight {
+		if instance.now().Sub(sent) >= instance.prewarmTimeout {
+			logger.Warningf("Replica %d giving up on pre-warm fetch of request batch %s", instance.id, digest)
+			instance.prewarmFailed[digest] = true
+			delete(instance.prewarmInFlight, digest)
+		}
+	}
+	instance.prewarmFetch()
+	if instance.newViewDeferred {
+		return instance.sendNewView()
+	}
+	return nil
+}
+
+// awaitingPrewarm reports whether an assignment references a request batch
+// we lack, which a pre-warm fetch may still return
+func (instance *pbftCore) awaitingPrewarm(msgList map[uint64]string) bool {
+	for _, d := range msgList {
+		if _, ok := instance.reqBatchStore[d]; ok || d == "" {
+			continue
+		}
+		if b, ok := instance.prewarmReqBatches[d]; ok && b == nil && !instance.prewarmFailed[d] {
+			return true
+		}
+	}
+	return false
+}
+
+// unobtainable reports whether an assignment references a request batch no
+// replica returned to our pre-warm fetch
+func (instance *pbftCore) unobtainable(msgList map[uint64]string) bool {
+	for _, d := range msgList {
+		if instance.prewarmFailed[d] {
+			if _, ok := instance.reqBatchStore[d]; !ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// alternativeAssignment leaves out the view-changes whose P set references a
+// request batch we could not fetch.  Any 2f+1 view-changes yield a safe
+// new-view, so if enough remain and their assignment only references batches
+// we hold or can fetch, it is used instead.
+func (instance *pbftCore) alternativeAssignment(vset []*ViewChange) ([]*ViewChange, ViewChange_C, map[uint64]string) {
+	var filtered []*ViewChange
+vcLoop:
+	for _, vc := range vset {
+		pset, _ := vc.expandedSets()
+		for _, pq := range pset {
+			if instance.unobtainable(map[uint64]string{pq.SequenceNumber: pq.BatchDigest}) {
+				continue vcLoop
+			}
+		}
+		filtered = append(filtered, vc)
+	}
+	if len(filtered) == len(vset) || len(filtered) < instance.intersectionQuorum() {
+		return nil, ViewChange_C{}, nil
+	}
+	cp, ok, _ := instance.selectInitialCheckpoint(filtered)
+	if !ok {
+		return nil, ViewChange_C{}, nil
+	}
+	msgList := instance.assignSequenceNumbers(filtered, cp.SequenceNumber)
+	if msgList == nil || instance.unobtainable(msgList) {
+		return nil, ViewChange_C{}, nil
+	}
+	return filtered, cp, msgList
+}
+
 func (instance *pbftCore) sendNewView() events.Event {
 
 	if _, ok := instance.newViewStore[instance.view]; ok {
@@ -278,6 +569,21 @@ func (instance *pbftCore) sendNewView() events.Event {
 		return nil
 	}
 
+	instance.newViewDeferred = false
+	if instance.prewarm && instance.prewarmTimeout > 0 {
+		if instance.awaitingPrewarm(msgList) {
+			logger.Infof("Replica %d deferring new-view for view %d until its pre-warm fetches return or time out", instance.id, instance.view)
+			instance.newViewDeferred = true
+			return nil
+		}
+		if instance.unobtainable(msgList) {
+			if altVset, altCp, altList := instance.alternativeAssignment(vset); altList != nil {
+				logger.Infof("Replica %d assigning new-view for view %d from %d of %d view-changes, avoiding request batches it could not fetch", instance.id, instance.view, len(altVset), len(vset))
+				vset, cp, msgList = altVset, altCp, altList
+			}
+		}
+	}
+
 	nv := &NewView{
 		View:      instance.view,
 		Vset:      vset,
@@ -297,6 +603,14 @@ func (instance *pbftCore) recvNewView(nv *NewView) events.Event {
 	logger.Infof("Replica %d received new-view %d",
 		instance.id, nv.View)
 
+	if instance.N == 1 {
+		logger.Debugf("Replica %d is the only replica, ignoring new-view", instance.id)
+		return nil
+	}
+
+	if instance.primaryBeacon {
+		instance.learnBeacon(nv.View)
+	}
 	if !(nv.View > 0 && nv.View >= instance.view && instance.primary(nv.View) == nv.ReplicaId && instance.newViewStore[nv.View] == nil) {
 		logger.Infof("Replica %d rejecting invalid new-view from %d, v:%d",
 			instance.id, nv.ReplicaId, nv.View)
@@ -306,6 +620,7 @@ func (instance *pbftCore) recvNewView(nv *NewView) events.Event {
 	for _, vc := range nv.Vset {
 		if err := instance.verify(vc); err != nil {
 			logger.Warningf("Replica %d found incorrect view-change signature in new-view message: %s", instance.id, err)
+			instance.reportFault(nv.ReplicaId, "new-view with a bad view-change signature")
 			return nil
 		}
 	}
@@ -328,17 +643,25 @@ func (instance *pbftCore) processNewView() events.Event {
 		return nil
 	}
 
-	cp, ok, replicas := instance.selectInitialCheckpoint(nv.Vset)
+	vset := canonicalViewChanges(nv.Vset)
+	cp, ok, replicas := instance.selectInitialCheckpoint(vset)
 	if !ok {
 		logger.Warningf("Replica %d could not determine initial checkpoint: %+v",
 			instance.id, instance.viewChangeStore)
-		return instance.sendViewChange()
+		return instance.sendViewChange(ViewChange_INVALID_NEW_VIEW)
 	}
 
 	speculativeLastExec := instance.lastExec
 	if instance.currentExec != nil {
 		speculativeLastExec = *instance.currentExec
 	}
+	if instance.stateTransferring && instance.transferTarget.seqNo > speculativeLastExec {
+		// The executing state transfer takes us at least as far as its target
+		speculativeLastExec = instance.transferTarget.seqNo
+		if speculativeLastExec >= cp.SequenceNumber {
+			logger.Infof("Replica %d completing state transfer to seqNo %d, which reaches the new-view base checkpoint %d", instance.id, speculativeLastExec, cp.SequenceNumber)
+		}
+	}
 
 	// If we have not reached the sequence number, check to see if we can reach it without state transfer
 	// In general, executions are better than state transfer
@@ -385,17 +708,18 @@ func (instance *pbftCore) processNewView() events.Event {
 		logger.Infof("Replica %d cannot execute to the view change checkpoint with seqNo %d", instance.id, cp.SequenceNumber)
 	}
 
-	msgList := instance.assignSequenceNumbers(nv.Vset, cp.SequenceNumber)
+	msgList := instance.assignSequenceNumbers(vset, cp.SequenceNumber)
 	if msgList == nil {
 		logger.Warningf("Replica %d could not assign sequence numbers: %+v",
 			instance.id, instance.viewChangeStore)
-		return instance.sendViewChange()
+		return instance.sendViewChange(ViewChange_INVALID_NEW_VIEW)
 	}
 
 	if !(len(msgList) == 0 && len(nv.Xset) == 0) && !reflect.DeepEqual(msgList, nv.Xset) {
 		logger.Warningf("Replica %d failed to verify new-view Xset: computed %+v, received %+v",
 			instance.id, msgList, nv.Xset)
-		return instance.sendViewChange()
+		instance.reportFault(nv.ReplicaId, "invalid new-view")
+		return instance.sendViewChange(ViewChange_INVALID_NEW_VIEW)
 	}
 
 	if instance.h < cp.SequenceNumber {
@@ -404,6 +728,10 @@ func (instance *pbftCore) processNewView() events.Event {
 
 	if speculativeLastExec < cp.SequenceNumber {
 		logger.Warningf("Replica %d missing base checkpoint %d (%s), our most recent execution %d", instance.id, cp.SequenceNumber, cp.Id, speculativeLastExec)
+		if instance.stateTransferring {
+			// Its result falls below the new low watermark, so is discarded in favor of the base checkpoint
+			logger.Infof("Replica %d abandoning state transfer to seqNo %d, superseded by the new-view base checkpoint %d", instance.id, instance.transferTarget.seqNo, cp.SequenceNumber)
+		}
 
 		snapshotID, err := base64.StdEncoding.DecodeString(cp.Id)
 		if nil != err {
@@ -436,6 +764,12 @@ func (instance *pbftCore) processNewView() events.Event {
 			}
 
 			if _, ok := instance.reqBatchStore[d]; !ok {
+				if reqBatch := instance.prewarmReqBatches[d]; reqBatch != nil {
+					logger.Debugf("Replica %d using pre-warmed request batch %s", instance.id, d)
+					instance.reqBatchStore[d] = reqBatch
+					instance.persistRequestBatch(d)
+					continue
+				}
 				logger.Warningf("Replica %d missing assigned, non-checkpointed request batch %s",
 					instance.id, d)
 				if _, ok := instance.missingReqBatches[d]; !ok {
@@ -464,7 +798,21 @@ func (instance *pbftCore) processNewView2(nv *NewView) events.Event {
 	instance.nullRequestTimer.Stop()
 
 	instance.activeView = true
+	instance.renewLease()
 	delete(instance.newViewStore, instance.view-1)
+	if instance.view > instance.highActiveView {
+		instance.highActiveView = instance.view
+		instance.persistHighActiveView()
+	}
+	if instance.primaryBeacon {
+		instance.installBeacon(nv)
+	}
+	instance.prewarmReqBatches = make(map[string]*RequestBatch)
+	instance.prewarmQueue = nil
+	instance.prewarmInFlight = make(map[string]time.Time)
+	instance.prewarmFailed = make(map[string]bool)
+	instance.newViewDeferred = false
+	instance.prewarmTimer.Stop()
 
 	instance.seqNo = instance.h
 	for n, d := range nv.Xset {
@@ -485,6 +833,7 @@ func (instance *pbftCore) processNewView2(nv *NewView) events.Event {
 		}
 		cert := instance.getCert(instance.view, n)
 		cert.prePrepare = preprep
+		cert.prePreparedAt = instance.now()
 		cert.digest = d
 		if n > instance.seqNo {
 			instance.seqNo = n
@@ -494,8 +843,12 @@ func (instance *pbftCore) processNewView2(nv *NewView) events.Event {
 
 	instance.updateViewChangeSeqNo()
 
+	instance.liftCatchUpBarrier("a new view")
 	if instance.primary(instance.view) != instance.id {
 		for n, d := range nv.Xset {
+			if instance.withholdingVotes() {
+				break
+			}
 			prep := &Prepare{
 				View:           instance.view,
 				SequenceNumber: n,
@@ -526,10 +879,37 @@ func (instance *pbftCore) getViewChanges() (vset []*ViewChange) {
 		vset = append(vset, vc)
 	}
 
-	return
+	return canonicalViewChanges(vset)
+}
+
+type sortableViewChanges []*ViewChange
+
+func (a sortableViewChanges) Len() int {
+	return len(a)
+}
+func (a sortableViewChanges) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a sortableViewChanges) Less(i, j int) bool {
+	return a[i].ReplicaId < a[j].ReplicaId
+}
+
+// canonicalViewChanges returns a copy of vset ordered by replica id.  The
+// checkpoint selection and sequence number assignment may depend on the
+// order of the view-changes, so the primary marshals its new-view in this
+// order, and backups verify whichever order they receive in it.
+func canonicalViewChanges(vset []*ViewChange) []*ViewChange {
+	sorted := make([]*ViewChange, len(vset))
+	copy(sorted, vset)
+	sort.Sort(sortableViewChanges(sorted))
+	return sorted
 }
 
 func (instance *pbftCore) selectInitialCheckpoint(vset []*ViewChange) (checkpoint ViewChange_C, ok bool, replicas []uint64) {
+	if instance.verifyNewViewCheckpoint {
+		return instance.selectCertifiedCheckpoint(vset)
+	}
+
 	checkpoints := make(map[ViewChange_C][]*ViewChange)
 	for _, vc := range vset {
 		for _, c := range vc.Cset { // TODO, verify that we strip duplicate checkpoints from this set
@@ -581,18 +961,78 @@ func (instance *pbftCore) selectInitialCheckpoint(vset []*ViewChange) (checkpoin
 	return
 }
 
+// selectCertifiedCheckpoint selects the highest checkpoint which a full
+// checkpoint certificate backs: 2f+1 distinct replicas must list it in their
+// view-change, and as many have low watermarks at or below it.  Repeated
+// view-changes from one replica count once, so a primary cannot substantiate a
+// checkpoint by including its own view-change several times.
+func (instance *pbftCore) selectCertifiedCheckpoint(vset []*ViewChange) (checkpoint ViewChange_C, ok bool, replicas []uint64) {
+	lowWatermarks := make(map[uint64]uint64)
+	checkpoints := make(map[ViewChange_C]map[uint64]bool)
+	for _, vc := range vset {
+		if _, ok := lowWatermarks[vc.ReplicaId]; ok {
+			logger.Warningf("Replica %d found repeated view-change from replica %d, ignoring it", instance.id, vc.ReplicaId)
+			continue
+		}
+		lowWatermarks[vc.ReplicaId] = vc.H
+		for _, c := range vc.Cset {
+			if checkpoints[*c] == nil {
+				checkpoints[*c] = make(map[uint64]bool)
+			}
+			checkpoints[*c][vc.ReplicaId] = true
+		}
+	}
+
+	for idx, vouching := range checkpoints {
+		if len(vouching) < instance.intersectionQuorum() {
+			logger.Debugf("Replica %d has no checkpoint certificate for n:%d, only %d replicas vouch for it",
+				instance.id, idx.SequenceNumber, len(vouching))
+			continue
+		}
+
+		quorum := 0
+		for _, h := range lowWatermarks {
+			if h <= idx.SequenceNumber {
+				quorum++
+			}
+		}
+		if quorum < instance.intersectionQuorum() {
+			logger.Debugf("Replica %d has no quorum for n:%d", instance.id, idx.SequenceNumber)
+			continue
+		}
+
+		if !ok || checkpoint.SequenceNumber < idx.SequenceNumber {
+			checkpoint = idx
+			ok = true
+			replicas = make([]uint64, 0, len(vouching))
+			for id := range vouching {
+				replicas = append(replicas, id)
+			}
+			sort.Sort(sortableUint64Slice(replicas))
+		}
+	}
+
+	return
+}
+
 func (instance *pbftCore) assignSequenceNumbers(vset []*ViewChange, h uint64) (msgList map[uint64]string) {
 	msgList = make(map[uint64]string)
 
 	maxN := h + 1
 
+	psets := make(map[*ViewChange][]*ViewChange_PQ, len(vset))
+	qsets := make(map[*ViewChange][]*ViewChange_PQ, len(vset))
+	for _, m := range vset {
+		psets[m], qsets[m] = m.expandedSets()
+	}
+
 	// "for all n such that h < n <= h + L"
 nLoop:
 	for n := h + 1; n <= h+instance.L; n++ {
 		// "∃m ∈ S..."
 		for _, m := range vset {
 			// "...with <n,d,v> ∈ m.P"
-			for _, em := range m.Pset {
+			for _, em := range psets[m] {
 				quorum := 0
 				// "A1. ∃2f+1 messages m' ∈ S"
 			mpLoop:
@@ -601,7 +1041,7 @@ nLoop:
 						continue
 					}
 					// "∀<n,d',v'> ∈ m'.P"
-					for _, emp := range mp.Pset {
+					for _, emp := range psets[mp] {
 						if n == emp.SequenceNumber && !(emp.View < em.View || (emp.View == em.View && emp.BatchDigest == em.BatchDigest)) {
 							continue mpLoop
 						}
@@ -617,7 +1057,7 @@ nLoop:
 				// "A2. ∃f+1 messages m' ∈ S"
 				for _, mp := range vset {
 					// "∃<n,d',v'> ∈ m'.Q"
-					for _, emp := range mp.Qset {
+					for _, emp := range qsets[mp] {
 						if n == emp.SequenceNumber && emp.View >= em.View && emp.BatchDigest == em.BatchDigest {
 							quorum++
 						}
@@ -641,7 +1081,7 @@ nLoop:
 	nullLoop:
 		for _, m := range vset {
 			// "m.P has no entry"
-			for _, em := range m.Pset {
+			for _, em := range psets[m] {
 				if em.SequenceNumber == n {
 					continue nullLoop
 				}
@@ -0,0 +1,63 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pbft
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/consensus/util/events"
+)
+
+// flushVotes broadcasts the prepares and commits held back while processing
+// an event, several of them as a single vote batch
+func (instance *pbftCore) flushVotes() {
+	votes := instance.voteBuffer
+	instance.voteBuffer = nil
+	if len(votes) == 0 {
+		return
+	}
+	if len(votes) == 1 {
+		instance.broadcastMessage(votes[0])
+		return
+	}
+
+	vb := &VoteBatch{ReplicaId: instance.id}
+	for _, vote := range votes {
+		if prep := vote.GetPrepare(); prep != nil {
+			vb.Prepares = append(vb.Prepares, prep)
+		} else {
+			vb.Commits = append(vb.Commits, vote.GetCommit())
+		}
+	}
+	logger.Debugf("Replica %d broadcasting %d prepares and %d commits as a vote batch", instance.id, len(vb.Prepares), len(vb.Commits))
+	instance.broadcastMessage(&Message{Payload: &Message_VoteBatch{VoteBatch: vb}})
+}
+
+// recvVoteBatch processes each vote of a batch as if it had arrived on its
+// own, so each goes through the same checks
+func (instance *pbftCore) recvVoteBatch(vb *VoteBatch) error {
+	if len(vb.Prepares)+len(vb.Commits) > 2*int(instance.L) {
+		return fmt.Errorf("vote batch of replica %d carries %d votes, more than two per sequence number of the log", vb.ReplicaId, len(vb.Prepares)+len(vb.Commits))
+	}
+	for _, prep := range vb.Prepares {
+		events.SendEvent(instance, pbftMessageEvent{msg: &Message{Payload: &Message_Prepare{Prepare: prep}}, sender: vb.ReplicaId})
+	}
+	for _, commit := range vb.Commits {
+		events.SendEvent(instance, pbftMessageEvent{msg: &Message{Payload: &Message_Commit{Commit: commit}}, sender: vb.ReplicaId})
+	}
+	return nil
+}
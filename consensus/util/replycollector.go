@@ -0,0 +1,127 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ReplyCollector gathers the replies of replicas to a single request, and
+// yields the result once enough of them match.  Requiring f+1 matching
+// replies guarantees that at least one correct replica vouches for the
+// result; requiring 2f+1 additionally guarantees a majority of correct
+// replicas do.
+type ReplyCollector struct {
+	digest string // the request the replies must be for
+	f      int    // max. number of faulty replicas tolerated
+	quorum int    // number of matching replies required
+
+	lock    sync.Mutex
+	replies map[uint64][]byte // result reported by each replica
+	done    chan struct{}     // closed once result or err is set
+	result  []byte
+	err     error
+}
+
+// NewReplyCollector creates a ReplyCollector for the request with the given
+// digest, which waits for 2f+1 matching replies if strong is set, f+1 otherwise
+func NewReplyCollector(digest string, f int, strong bool) *ReplyCollector {
+	quorum := f + 1
+	if strong {
+		quorum = 2*f + 1
+	}
+	return &ReplyCollector{
+		digest:  digest,
+		f:       f,
+		quorum:  quorum,
+		replies: make(map[uint64][]byte),
+		done:    make(chan struct{}),
+	}
+}
+
+// Add records the result a replica replied with.  Replies for other requests,
+// and further replies from a replica which already replied, are ignored.
+func (rc *ReplyCollector) Add(replicaID uint64, digest string, result []byte) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	if digest != rc.digest {
+		logger.Warningf("Ignoring reply from replica %d for request %s, collecting replies for %s", replicaID, digest, rc.digest)
+		return
+	}
+	if _, ok := rc.replies[replicaID]; ok {
+		logger.Debugf("Ignoring duplicate reply from replica %d for request %s", replicaID, digest)
+		return
+	}
+
+	select {
+	case <-rc.done:
+		return
+	default:
+	}
+
+	rc.replies[replicaID] = result
+
+	matching := 0
+	for _, other := range rc.replies {
+		if bytes.Equal(other, result) {
+			matching++
+		}
+	}
+	if matching >= rc.quorum {
+		rc.result = result
+		close(rc.done)
+		return
+	}
+
+	// With more than f replicas disagreeing with every result, some of them must be correct
+	best := 0
+	for _, candidate := range rc.replies {
+		count := 0
+		for _, other := range rc.replies {
+			if bytes.Equal(other, candidate) {
+				count++
+			}
+		}
+		if count > best {
+			best = count
+		}
+	}
+	if len(rc.replies)-best > rc.f {
+		rc.err = fmt.Errorf("Conflicting replies for request %s: %d of %d replies disagree with the most common result, tolerating %d", rc.digest, len(rc.replies)-best, len(rc.replies), rc.f)
+		close(rc.done)
+	}
+}
+
+// Wait blocks until enough matching replies arrived, the replies conflict
+// beyond the tolerance, or the timeout expires
+func (rc *ReplyCollector) Wait(timeout time.Duration) ([]byte, error) {
+	select {
+	case <-rc.done:
+	case <-time.After(timeout):
+		rc.lock.Lock()
+		defer rc.lock.Unlock()
+		return nil, fmt.Errorf("Timed out waiting for %d matching replies for request %s, received %d replies", rc.quorum, rc.digest, len(rc.replies))
+	}
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.result, rc.err
+}
@@ -0,0 +1,69 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplyCollectorAgreement(t *testing.T) {
+	for _, strong := range []bool{false, true} {
+		rc := NewReplyCollector("req", 1, strong)
+		rc.Add(0, "req", []byte("ok"))
+		rc.Add(1, "req", []byte("bad"))
+		rc.Add(0, "req", []byte("ok"))   // duplicate, must not count twice
+		rc.Add(2, "other", []byte("ok")) // different request
+		rc.Add(3, "req", []byte("ok"))
+		if strong {
+			rc.Add(2, "req", []byte("ok"))
+		}
+
+		result, err := rc.Wait(time.Second)
+		if err != nil {
+			t.Fatalf("Expected agreement (strong=%v), got error %s", strong, err)
+		}
+		if string(result) != "ok" {
+			t.Errorf("Expected agreed result ok (strong=%v), got %s", strong, result)
+		}
+	}
+}
+
+func TestReplyCollectorConflict(t *testing.T) {
+	rc := NewReplyCollector("req", 1, true)
+	rc.Add(0, "req", []byte("a"))
+	rc.Add(1, "req", []byte("b"))
+	rc.Add(2, "req", []byte("c"))
+
+	if _, err := rc.Wait(time.Second); err == nil {
+		t.Fatalf("Expected replies disagreeing beyond f to be reported as a conflict")
+	}
+}
+
+func TestReplyCollectorTimeout(t *testing.T) {
+	rc := NewReplyCollector("req", 1, true)
+	rc.Add(0, "req", []byte("ok"))
+	rc.Add(1, "req", []byte("ok"))
+
+	start := time.Now()
+	if _, err := rc.Wait(50 * time.Millisecond); err == nil {
+		t.Fatalf("Expected timeout waiting for 3 matching replies with only 2")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Wait returned before its timeout")
+	}
+}
@@ -25,12 +25,19 @@ var configurationCached = false
 
 // Cached values of commonly used configuration constants.
 var tlsEnabled bool
+var mutualTLS *MutualTLSConfig
 
 // CacheConfiguration computes and caches commonly-used constants and
 // computed constants as package variables. Routines which were previously
 func CacheConfiguration() (err error) {
 
 	tlsEnabled = viper.GetBool("peer.tls.enabled")
+	mutualTLS = nil
+	if tlsEnabled && viper.GetBool("peer.tls.clientauth.enabled") {
+		if mutualTLS, err = LoadMutualTLSConfig(); err != nil {
+			return
+		}
+	}
 
 	configurationCached = true
 
@@ -51,3 +58,12 @@ func TLSEnabled() bool {
 	}
 	return tlsEnabled
 }
+
+// MutualTLS returns the cached TLS mutual authentication configuration, nil
+// unless "peer.tls.clientauth.enabled" is set along with "peer.tls.enabled"
+func MutualTLS() *MutualTLSConfig {
+	if !configurationCached {
+		cacheConfiguration()
+	}
+	return mutualTLS
+}
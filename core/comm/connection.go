@@ -40,6 +40,9 @@ func InitTLSForPeer() credentials.TransportAuthenticator {
 	if viper.GetString("peer.tls.serverhostoverride") != "" {
 		sn = viper.GetString("peer.tls.serverhostoverride")
 	}
+	if mtls := MutualTLS(); mtls != nil {
+		return mtls.ClientCredentials(sn)
+	}
 	var creds credentials.TransportAuthenticator
 	if viper.GetString("peer.tls.cert.file") != "" {
 		var err error
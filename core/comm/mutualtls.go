@@ -0,0 +1,123 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/spf13/viper"
+)
+
+// MutualTLSConfig configures TLS mutual authentication between replicas.  Both
+// sides of a connection present a certificate issued by one of the CAs, and a
+// replica is known by the subject common name of its certificate.
+type MutualTLSConfig struct {
+	CAs         *x509.CertPool  // authorities issuing the replica certificates
+	Certificate tls.Certificate // our own certificate and key
+	Replicas    []string        // certificate common name of each replica, indexed by replica id
+}
+
+// LoadMutualTLSConfig reads the mutual authentication settings from
+// peer.tls.clientauth, using the peer's TLS certificate and key
+func LoadMutualTLSConfig() (*MutualTLSConfig, error) {
+	pem, err := ioutil.ReadFile(viper.GetString("peer.tls.clientauth.rootcert.file"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the client authentication root certificates: %s", err)
+	}
+	cas := x509.NewCertPool()
+	if !cas.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No client authentication root certificates found")
+	}
+	cert, err := tls.LoadX509KeyPair(viper.GetString("peer.tls.cert.file"), viper.GetString("peer.tls.key.file"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not load the peer TLS certificate: %s", err)
+	}
+	return &MutualTLSConfig{
+		CAs:         cas,
+		Certificate: cert,
+		Replicas:    viper.GetStringSlice("peer.tls.clientauth.replicas"),
+	}, nil
+}
+
+// ReplicaID maps a verified certificate to the id of the replica it belongs to
+func (c *MutualTLSConfig) ReplicaID(cert *x509.Certificate) (uint64, error) {
+	for id, name := range c.Replicas {
+		if name == cert.Subject.CommonName {
+			return uint64(id), nil
+		}
+	}
+	return 0, fmt.Errorf("certificate %q belongs to no known replica", cert.Subject.CommonName)
+}
+
+// ServerCredentials refuses connections presenting no certificate, or one
+// which no CA issued
+func (c *MutualTLSConfig) ServerCredentials() credentials.TransportAuthenticator {
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{c.Certificate},
+		ClientCAs:    c.CAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+}
+
+// ClientCredentials presents our certificate and authenticates the server as a known replica
+func (c *MutualTLSConfig) ClientCredentials(serverName string) credentials.TransportAuthenticator {
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{c.Certificate},
+		RootCAs:      c.CAs,
+		ServerName:   serverName,
+		VerifyPeerCertificate: func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			if len(chains) == 0 || len(chains[0]) == 0 {
+				return fmt.Errorf("server presented no verified certificate")
+			}
+			_, err := c.ReplicaID(chains[0][0])
+			return err
+		},
+	})
+}
+
+// ReplicaFromContext returns the id of the replica which opened the stream of
+// ctx, authenticated by its certificate
+func (c *MutualTLSConfig) ReplicaFromContext(ctx context.Context) (uint64, error) {
+	authInfo, ok := credentials.FromContext(ctx)
+	if !ok {
+		return 0, fmt.Errorf("connection is not authenticated")
+	}
+	tlsInfo, ok := authInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 {
+		return 0, fmt.Errorf("connection presented no verified certificate")
+	}
+	return c.ReplicaID(tlsInfo.State.VerifiedChains[0][0])
+}
+
+// CheckPeerName verifies that the stream of ctx was opened by the replica
+// known by the peer name, the common name of the replica's certificate
+func (c *MutualTLSConfig) CheckPeerName(ctx context.Context, name string) error {
+	replica, err := c.ReplicaFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	if c.Replicas[replica] != name {
+		return fmt.Errorf("replica %d, authenticated as %q, claims to be peer %q", replica, c.Replicas[replica], name)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// newTestCA returns a self-signed authority, and a function issuing
+// certificates for a common name signed by it
+func newTestCA(t *testing.T) (*x509.Certificate, func(cn string) tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	serial := int64(1)
+	issue := func(cn string) tls.Certificate {
+		leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial++
+		leaf := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			DNSNames:     []string{"localhost"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, leaf, ca, &leafKey.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: leafKey}
+	}
+	return ca, issue
+}
+
+func TestMutualTLSRefusesUntrustedCert(t *testing.T) {
+	ca, issue := newTestCA(t)
+	_, rogueIssue := newTestCA(t)
+	replicas := []string{"vp0", "vp1"}
+
+	trusted := x509.NewCertPool()
+	trusted.AddCert(ca)
+	server := &MutualTLSConfig{CAs: trusted, Certificate: issue("vp0"), Replicas: replicas}
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer(grpc.Creds(server.ServerCredentials()))
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	dial := func(client *MutualTLSConfig) error {
+		conn, err := NewClientConnectionWithAddress(lis.Addr().String(), true, true, client.ClientCredentials("localhost"))
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	if err := dial(&MutualTLSConfig{CAs: trusted, Certificate: issue("vp1"), Replicas: replicas}); err != nil {
+		t.Fatalf("Replica with a trusted certificate could not connect: %s", err)
+	}
+
+	// A refused client certificate may only surface after the handshake, on the first read
+	handshake := func(certs []tls.Certificate) error {
+		conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{RootCAs: trusted, ServerName: "localhost", Certificates: certs})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, err = conn.Read(make([]byte, 1)); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil
+			}
+			return err
+		}
+		return nil
+	}
+	if err := handshake([]tls.Certificate{issue("vp1")}); err != nil {
+		t.Fatalf("Replica with a trusted certificate was refused: %s", err)
+	}
+	// The rogue peer presents a certificate of its own authority
+	if err := handshake([]tls.Certificate{rogueIssue("vp1")}); err == nil {
+		t.Fatalf("Peer with an untrusted certificate was allowed to connect")
+	}
+	if err := handshake(nil); err == nil {
+		t.Fatalf("Peer without a certificate was allowed to connect")
+	}
+}
+
+func TestMutualTLSCheckPeerName(t *testing.T) {
+	_, issue := newTestCA(t)
+	config := &MutualTLSConfig{Replicas: []string{"vp0", "vp1"}}
+	cert, _ := x509.ParseCertificate(issue("vp1").Certificate[0])
+	ctx := credentials.NewContext(context.Background(), credentials.TLSInfo{
+		State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+	})
+
+	if err := config.CheckPeerName(ctx, "vp1"); err != nil {
+		t.Errorf("Expected replica 1 to be known as vp1: %s", err)
+	}
+	if err := config.CheckPeerName(ctx, "vp0"); err == nil {
+		t.Errorf("Expected the certificate of replica 1 not to speak as vp0")
+	}
+	if err := config.CheckPeerName(context.Background(), "vp1"); err == nil {
+		t.Errorf("Expected an unauthenticated stream to be refused")
+	}
+}
+
+func TestMutualTLSReplicaID(t *testing.T) {
+	_, issue := newTestCA(t)
+	config := &MutualTLSConfig{Replicas: []string{"vp0", "vp1", "vp2"}}
+
+	cert, _ := x509.ParseCertificate(issue("vp2").Certificate[0])
+	if id, err := config.ReplicaID(cert); err != nil || id != 2 {
+		t.Errorf("Expected certificate of vp2 to map to replica 2, got %d (%v)", id, err)
+	}
+	cert, _ = x509.ParseCertificate(issue("vp9").Certificate[0])
+	if _, err := config.ReplicaID(cert); err == nil {
+		t.Errorf("Certificate of an unknown peer mapped to a replica")
+	}
+}
@@ -179,7 +179,7 @@ func (ledger *Ledger) CommitTxBatch(id interface{}, transactions []*protos.Trans
 	ledger.resetForNextTxGroup(true)
 	ledger.blockchain.blockPersistenceStatus(true)
 
-	sendProducerBlockEvent(block)
+	sendProducerBlockEvent(block, newBlockNumber)
 	if len(transactionResults) != 0 {
 		ledgerLogger.Debug("There were some erroneous transactions. We need to send a 'TX rejected' message here.")
 	}
@@ -390,7 +390,7 @@ func (ledger *Ledger) PutRawBlock(block *protos.Block, blockNumber uint64) error
 	if err != nil {
 		return err
 	}
-	sendProducerBlockEvent(block)
+	sendProducerBlockEvent(block, blockNumber)
 	return nil
 }
 
@@ -465,7 +465,7 @@ func (ledger *Ledger) resetForNextTxGroup(txCommited bool) {
 	ledger.state.ClearInMemoryChanges(txCommited)
 }
 
-func sendProducerBlockEvent(block *protos.Block) {
+func sendProducerBlockEvent(block *protos.Block, blockNumber uint64) {
 
 	// Remove payload from deploy transactions. This is done to make block
 	// events more lightweight as the payload for these types of transactions
@@ -489,5 +489,7 @@ func sendProducerBlockEvent(block *protos.Block) {
 		}
 	}
 
-	producer.Send(producer.CreateBlockEvent(block))
+	for _, evt := range producer.CreateCommitEvents(block, blockNumber) {
+		producer.Send(evt)
+	}
 }
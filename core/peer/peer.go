@@ -597,6 +597,14 @@ func (p *PeerImpl) chatWithPeer(address string) error {
 func (p *PeerImpl) handleChat(ctx context.Context, stream ChatStream, initiatedStream bool) error {
 	deadline, ok := ctx.Deadline()
 	peerLogger.Debugf("Current context deadline = %s, ok = %v", deadline, ok)
+	mtls := comm.MutualTLS()
+	if mtls != nil && !initiatedStream {
+		replica, err := mtls.ReplicaFromContext(ctx)
+		if err != nil {
+			return fmt.Errorf("Refusing Chat from unauthenticated peer: %s", err)
+		}
+		peerLogger.Debugf("Chat from replica %d, authenticated by its TLS certificate", replica)
+	}
 	handler, err := p.handlerFactory(p, stream, initiatedStream, nil)
 	if err != nil {
 		return fmt.Errorf("Error creating handler during handleChat initiation: %s", err)
@@ -613,6 +621,20 @@ func (p *PeerImpl) handleChat(ctx context.Context, stream ChatStream, initiatedS
 			peerLogger.Error(e.Error())
 			return e
 		}
+		if mtls != nil && !initiatedStream && in.Type == pb.Message_DISC_HELLO {
+			// the peer id the stream claims must be the one its certificate authenticates
+			hello := &pb.HelloMessage{}
+			if err := proto.Unmarshal(in.Payload, hello); err != nil {
+				return fmt.Errorf("Refusing Chat with a malformed HelloMessage: %s", err)
+			}
+			var name string
+			if id := hello.GetPeerEndpoint().GetID(); id != nil {
+				name = id.Name
+			}
+			if err := mtls.CheckPeerName(ctx, name); err != nil {
+				return fmt.Errorf("Refusing Chat: %s", err)
+			}
+		}
 		err = handler.HandleMessage(in)
 		if err != nil {
 			peerLogger.Errorf("Error handling message: %s", err)
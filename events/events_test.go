@@ -35,8 +35,9 @@ import (
 
 type Adapter struct {
 	sync.RWMutex
-	notfy chan struct{}
-	count int
+	notfy        chan struct{}
+	count        int
+	transactions []*ehpb.CommittedTransaction
 }
 
 var peerAddress string
@@ -46,6 +47,7 @@ var obcEHClient *consumer.EventsClient
 func (a *Adapter) GetInterestedEvents() ([]*ehpb.Interest, error) {
 	return []*ehpb.Interest{
 		&ehpb.Interest{EventType: ehpb.EventType_BLOCK},
+		&ehpb.Interest{EventType: ehpb.EventType_TRANSACTION},
 		&ehpb.Interest{EventType: ehpb.EventType_CHAINCODE, RegInfo: &ehpb.Interest_ChaincodeRegInfo{ChaincodeRegInfo: &ehpb.ChaincodeReg{ChaincodeID: "0xffffffff", EventName: "event1"}}},
 		&ehpb.Interest{EventType: ehpb.EventType_CHAINCODE, RegInfo: &ehpb.Interest_ChaincodeRegInfo{ChaincodeRegInfo: &ehpb.ChaincodeReg{ChaincodeID: "0xffffffff", EventName: ""}}},
 	}, nil
@@ -57,6 +59,10 @@ func (a *Adapter) Recv(msg *ehpb.Event) (bool, error) {
 	switch x := msg.Event.(type) {
 	case *ehpb.Event_Block:
 	case *ehpb.Event_ChaincodeEvent:
+	case *ehpb.Event_Transaction:
+		a.Lock()
+		a.transactions = append(a.transactions, x.Transaction)
+		a.Unlock()
 	case nil:
 		// The field is not set.
 		fmt.Printf("event not set\n")
@@ -163,6 +169,66 @@ func TestFailReceive(t *testing.T) {
 	}
 }
 
+func TestReceiveTransactionEvents(t *testing.T) {
+	if err := producer.SetCommitGranularity("transaction"); err != nil {
+		t.Fatal(err)
+	}
+	defer producer.SetCommitGranularity("block")
+
+	block := &ehpb.Block{Transactions: []*ehpb.Transaction{
+		&ehpb.Transaction{Uuid: "tx0"},
+		&ehpb.Transaction{Uuid: "tx1"},
+		&ehpb.Transaction{Uuid: "tx2"},
+	}}
+	evts := producer.CreateCommitEvents(block, 7)
+	if len(evts) != 3 {
+		t.Fatalf("Expected an event per transaction, got %d events", len(evts))
+	}
+
+	adapter.Lock()
+	adapter.count = len(evts)
+	adapter.transactions = nil
+	adapter.Unlock()
+	for _, emsg := range evts {
+		if err := producer.Send(emsg); err != nil {
+			t.Fatalf("Error sending message %s", err)
+		}
+	}
+	select {
+	case <-adapter.notfy:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out on transaction events")
+	}
+
+	adapter.Lock()
+	defer adapter.Unlock()
+	for i, ct := range adapter.transactions {
+		if ct.BlockNumber != 7 || ct.Index != uint32(i) || ct.Transaction.Uuid != block.Transactions[i].Uuid {
+			t.Errorf("Transaction event %d carried block %d, index %d and transaction %s", i, ct.BlockNumber, ct.Index, ct.Transaction.Uuid)
+		}
+	}
+	if len(adapter.transactions) != 3 {
+		t.Errorf("Expected 3 transaction events, received %d", len(adapter.transactions))
+	}
+}
+
+func TestCommitGranularity(t *testing.T) {
+	defer producer.SetCommitGranularity("block")
+	block := &ehpb.Block{Transactions: []*ehpb.Transaction{&ehpb.Transaction{}, &ehpb.Transaction{}}}
+
+	for granularity, expected := range map[string]int{"block": 1, "transaction": 2, "both": 3} {
+		if err := producer.SetCommitGranularity(granularity); err != nil {
+			t.Fatal(err)
+		}
+		if evts := producer.CreateCommitEvents(block, 1); len(evts) != expected {
+			t.Errorf("Granularity %s produced %d events, expected %d", granularity, len(evts), expected)
+		}
+	}
+	if err := producer.SetCommitGranularity("batch"); err == nil {
+		t.Errorf("Expected an unknown granularity to be refused")
+	}
+}
+
 func BenchmarkMessages(b *testing.B) {
 	numMessages := 10000
 
@@ -17,6 +17,8 @@ limitations under the License.
 package producer
 
 import (
+	"fmt"
+
 	ehpb "github.com/hyperledger/fabric/protos"
 )
 
@@ -25,6 +27,54 @@ func CreateBlockEvent(te *ehpb.Block) *ehpb.Event {
 	return &ehpb.Event{Event: &ehpb.Event_Block{Block: te}}
 }
 
+//the events a committed block produces, see SetCommitGranularity
+var blockEvents, transactionEvents = true, false
+
+//SetCommitGranularity selects the events each committed block produces:
+//"block" sends the block, "transaction" an event per transaction, carrying
+//the block number and the transaction's index in the block, and "both" sends
+//the block followed by its transaction events
+func SetCommitGranularity(granularity string) error {
+	switch granularity {
+	case "", "block":
+		blockEvents, transactionEvents = true, false
+	case "transaction":
+		blockEvents, transactionEvents = false, true
+	case "both":
+		blockEvents, transactionEvents = true, true
+	default:
+		return fmt.Errorf("unknown commit event granularity %s", granularity)
+	}
+	return nil
+}
+
+//CreateCommitEvents creates the events announcing a committed block, at the
+//configured granularity
+func CreateCommitEvents(block *ehpb.Block, blockNumber uint64) []*ehpb.Event {
+	var evts []*ehpb.Event
+	if blockEvents {
+		evts = append(evts, CreateBlockEvent(block))
+	}
+	if transactionEvents {
+		evts = append(evts, CreateTransactionEvents(block, blockNumber)...)
+	}
+	return evts
+}
+
+//CreateTransactionEvents creates an Event for each transaction of a committed
+//block, indexed by its position in the block
+func CreateTransactionEvents(block *ehpb.Block, blockNumber uint64) []*ehpb.Event {
+	var evts []*ehpb.Event
+	for i, tx := range block.GetTransactions() {
+		evts = append(evts, &ehpb.Event{Event: &ehpb.Event_Transaction{Transaction: &ehpb.CommittedTransaction{
+			BlockNumber: blockNumber,
+			Index:       uint32(i),
+			Transaction: tx,
+		}}})
+	}
+	return evts
+}
+
 //CreateChaincodeEvent creates a Event from a ChaincodeEvent
 func CreateChaincodeEvent(te *ehpb.ChaincodeEvent) *ehpb.Event {
 	return &ehpb.Event{Event: &ehpb.Event_ChaincodeEvent{ChaincodeEvent: te}}
@@ -42,6 +42,8 @@ func getMessageType(e *pb.Event) pb.EventType {
 		return pb.EventType_CHAINCODE
 	case *pb.Event_Rejection:
 		return pb.EventType_REJECTION
+	case *pb.Event_Transaction:
+		return pb.EventType_TRANSACTION
 	default:
 		return -1
 	}
@@ -52,5 +54,6 @@ func addInternalEventTypes() {
 	AddEventType(pb.EventType_BLOCK)
 	AddEventType(pb.EventType_CHAINCODE)
 	AddEventType(pb.EventType_REJECTION)
+	AddEventType(pb.EventType_TRANSACTION)
 	AddEventType(pb.EventType_REGISTER)
 }
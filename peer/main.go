@@ -369,6 +369,9 @@ func createEventHubServer() (net.Listener, *grpc.Server, error) {
 		}
 
 		grpcServer = grpc.NewServer(opts...)
+		if err := producer.SetCommitGranularity(viper.GetString("peer.validator.events.granularity")); err != nil {
+			return nil, nil, err
+		}
 		ehServer := producer.NewEventsServer(uint(viper.GetInt("peer.validator.events.buffersize")), viper.GetInt("peer.validator.events.timeout"))
 		pb.RegisterEventsServer(grpcServer, ehServer)
 	}
@@ -471,7 +474,10 @@ func serve(args []string) error {
 	}
 
 	var opts []grpc.ServerOption
-	if comm.TLSEnabled() {
+	if mtls := comm.MutualTLS(); mtls != nil {
+		logger.Infof("TLS mutual authentication of replicas enabled")
+		opts = []grpc.ServerOption{grpc.Creds(mtls.ServerCredentials())}
+	} else if comm.TLSEnabled() {
 		creds, err := credentials.NewServerTLSFromFile(viper.GetString("peer.tls.cert.file"), viper.GetString("peer.tls.key.file"))
 		if err != nil {
 			grpclog.Fatalf("Failed to generate credentials %v", err)
@@ -21,10 +21,11 @@ var _ = math.Inf
 type EventType int32
 
 const (
-	EventType_REGISTER  EventType = 0
-	EventType_BLOCK     EventType = 1
-	EventType_CHAINCODE EventType = 2
-	EventType_REJECTION EventType = 3
+	EventType_REGISTER    EventType = 0
+	EventType_BLOCK       EventType = 1
+	EventType_CHAINCODE   EventType = 2
+	EventType_REJECTION   EventType = 3
+	EventType_TRANSACTION EventType = 4
 )
 
 var EventType_name = map[int32]string{
@@ -32,12 +33,14 @@ var EventType_name = map[int32]string{
 	1: "BLOCK",
 	2: "CHAINCODE",
 	3: "REJECTION",
+	4: "TRANSACTION",
 }
 var EventType_value = map[string]int32{
-	"REGISTER":  0,
-	"BLOCK":     1,
-	"CHAINCODE": 2,
-	"REJECTION": 3,
+	"REGISTER":    0,
+	"BLOCK":       1,
+	"CHAINCODE":   2,
+	"REJECTION":   3,
+	"TRANSACTION": 4,
 }
 
 func (x EventType) String() string {
@@ -170,16 +173,37 @@ func (m *Rejection) GetTx() *Transaction {
 	return nil
 }
 
+// CommittedTransaction is sent by the producer for each transaction of a
+// committed block, when events are expanded to transaction granularity
+// string type - "transaction"
+type CommittedTransaction struct {
+	BlockNumber uint64       `protobuf:"varint,1,opt,name=blockNumber" json:"blockNumber,omitempty"`
+	Index       uint32       `protobuf:"varint,2,opt,name=index" json:"index,omitempty"`
+	Transaction *Transaction `protobuf:"bytes,3,opt,name=transaction" json:"transaction,omitempty"`
+}
+
+func (m *CommittedTransaction) Reset()         { *m = CommittedTransaction{} }
+func (m *CommittedTransaction) String() string { return proto.CompactTextString(m) }
+func (*CommittedTransaction) ProtoMessage()    {}
+
+func (m *CommittedTransaction) GetTransaction() *Transaction {
+	if m != nil {
+		return m.Transaction
+	}
+	return nil
+}
+
 // ---------- producer events ---------
 // Event is used by
-//  - consumers (adapters) to send Register
-//  - producer to advertise supported types and events
+//   - consumers (adapters) to send Register
+//   - producer to advertise supported types and events
 type Event struct {
 	// Types that are valid to be assigned to Event:
 	//	*Event_Register
 	//	*Event_Block
 	//	*Event_ChaincodeEvent
 	//	*Event_Rejection
+	//	*Event_Transaction
 	Event isEvent_Event `protobuf_oneof:"Event"`
 }
 
@@ -203,11 +227,15 @@ type Event_ChaincodeEvent struct {
 type Event_Rejection struct {
 	Rejection *Rejection `protobuf:"bytes,4,opt,name=rejection,oneof"`
 }
+type Event_Transaction struct {
+	Transaction *CommittedTransaction `protobuf:"bytes,5,opt,name=transaction,oneof"`
+}
 
 func (*Event_Register) isEvent_Event()       {}
 func (*Event_Block) isEvent_Event()          {}
 func (*Event_ChaincodeEvent) isEvent_Event() {}
 func (*Event_Rejection) isEvent_Event()      {}
+func (*Event_Transaction) isEvent_Event()    {}
 
 func (m *Event) GetEvent() isEvent_Event {
 	if m != nil {
@@ -244,6 +272,13 @@ func (m *Event) GetRejection() *Rejection {
 	return nil
 }
 
+func (m *Event) GetTransaction() *CommittedTransaction {
+	if x, ok := m.GetEvent().(*Event_Transaction); ok {
+		return x.Transaction
+	}
+	return nil
+}
+
 // XXX_OneofFuncs is for the internal use of the proto package.
 func (*Event) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer) error, func(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error), []interface{}) {
 	return _Event_OneofMarshaler, _Event_OneofUnmarshaler, []interface{}{
@@ -251,6 +286,7 @@ func (*Event) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer) error,
 		(*Event_Block)(nil),
 		(*Event_ChaincodeEvent)(nil),
 		(*Event_Rejection)(nil),
+		(*Event_Transaction)(nil),
 	}
 }
 
@@ -278,6 +314,11 @@ func _Event_OneofMarshaler(msg proto.Message, b *proto.Buffer) error {
 		if err := b.EncodeMessage(x.Rejection); err != nil {
 			return err
 		}
+	case *Event_Transaction:
+		b.EncodeVarint(5<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Transaction); err != nil {
+			return err
+		}
 	case nil:
 	default:
 		return fmt.Errorf("Event.Event has unexpected type %T", x)
@@ -320,6 +361,14 @@ func _Event_OneofUnmarshaler(msg proto.Message, tag, wire int, b *proto.Buffer)
 		err := b.DecodeMessage(msg)
 		m.Event = &Event_Rejection{msg}
 		return true, err
+	case 5: // Event.transaction
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(CommittedTransaction)
+		err := b.DecodeMessage(msg)
+		m.Event = &Event_Transaction{msg}
+		return true, err
 	default:
 		return false, nil
 	}